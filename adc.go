@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	adcFullScale = 2048.0           // Magnitude of a full-scale 12-bit ADC code
+	adcMaxCode   = adcFullScale - 1 // Largest 12-bit code; the smallest is -2048
+	adcCodes     = 2 * adcFullScale
+)
+
+// ADCConfig sets up the ADC code statistics, the clipping alarm and the
+// automatic attenuation control
+type ADCConfig struct {
+	HistogramBins   int     `json:"histogram_bins"`   // Bins over the code range (power of two, 16-4096), default 64
+	NearCodes       int     `json:"near_codes"`       // |code| at or above this is near full scale, default 1900 (-0.65 dBFS)
+	ClipPPM         float64 `json:"clip_ppm"`         // Alarm when more codes than this per million are at full scale, default 1
+	IntervalS       float64 `json:"interval_s"`       // Statistics window, default 1
+	AutoAttenuation bool    `json:"auto_attenuation"` // Step ATTENUATION_BVAL to keep the peak headroom within the limits
+	MinHeadroomDB   float64 `json:"min_headroom_db"`  // Raise attenuation while clipping or below this headroom, default 1
+	MaxHeadroomDB   float64 `json:"max_headroom_db"`  // Lower attenuation above this headroom, default 12
+	StepDB          int     `json:"step_db"`          // Attenuation change per window, default 3
+}
+
+// Validate fills in defaults and checks the ranges
+func (c *ADCConfig) Validate() error {
+	if c.HistogramBins == 0 {
+		c.HistogramBins = 64
+	}
+	if c.HistogramBins < 16 || c.HistogramBins > adcCodes || c.HistogramBins&(c.HistogramBins-1) != 0 {
+		return fmt.Errorf("histogram_bins must be a power of two from 16 to %d", int(adcCodes))
+	}
+	if c.NearCodes == 0 {
+		c.NearCodes = 1900
+	}
+	if c.NearCodes < 1 || c.NearCodes > adcMaxCode {
+		return fmt.Errorf("near_codes must be between 1 and %d", int(adcMaxCode))
+	}
+	if c.ClipPPM == 0 {
+		c.ClipPPM = 1
+	}
+	if c.ClipPPM < 0 {
+		return fmt.Errorf("clip_ppm must be positive")
+	}
+	if c.IntervalS == 0 {
+		c.IntervalS = 1
+	}
+	if c.IntervalS < 0.1 || c.IntervalS > 60 {
+		return fmt.Errorf("interval_s must be between 0.1 and 60")
+	}
+	if c.MinHeadroomDB == 0 {
+		c.MinHeadroomDB = 1
+	}
+	if c.MaxHeadroomDB == 0 {
+		c.MaxHeadroomDB = 12
+	}
+	if c.StepDB == 0 {
+		c.StepDB = 3
+	}
+	if c.StepDB < 1 || c.StepDB > 31 {
+		return fmt.Errorf("step_db must be between 1 and 31")
+	}
+	// A window narrower than a step would make the control oscillate
+	if c.MinHeadroomDB < 0 || c.MaxHeadroomDB-c.MinHeadroomDB <= float64(c.StepDB) {
+		return fmt.Errorf("max_headroom_db must exceed min_headroom_db (>= 0) by more than step_db")
+	}
+	return nil
+}
+
+// ADCChannelStats summarizes one receiver channel's ADC codes. Counts are
+// of I and Q codes, so a sample contributes two.
+type ADCChannelStats struct {
+	Channel       int      `json:"channel"`
+	Samples       int64    `json:"samples"`
+	Clipped       int64    `json:"clipped"`         // Codes at -2048 or 2047
+	ClippedPPM    float64  `json:"clipped_ppm"`     // Clipped codes per million
+	NearFullScale int64    `json:"near_full_scale"` // Codes at or above near_codes in magnitude
+	PeakCode      int      `json:"peak_code"`       // Largest |I| or |Q|
+	HeadroomDB    float64  `json:"headroom_db"`     // Peak code below full scale
+	RMSCodes      float64  `json:"rms_codes"`       // RMS of |I + jQ|
+	CrestFactorDB float64  `json:"crest_factor_db"` // Peak over RMS of |I + jQ|
+	Clipping      bool     `json:"clipping"`        // Clipped codes exceed clip_ppm
+	HistogramI    []uint64 `json:"histogram_i"`     // Equal bins from -2048 up to 2047
+	HistogramQ    []uint64 `json:"histogram_q"`
+}
+
+// ADCInfo records in capture metadata the ADC statistics of the raw data
+type ADCInfo struct {
+	NearCodes     int               `json:"near_codes"`
+	HistogramBins int               `json:"histogram_bins"`
+	Clipping      bool              `json:"clipping"` // Any channel clipping
+	Channels      []ADCChannelStats `json:"channels"`
+}
+
+// adcAccumulator collects full-resolution code histograms and moments for
+// the 8 receiver channels
+type adcAccumulator struct {
+	hist     [8]*[2][adcCodes]uint64
+	samples  [8]int64
+	near     [8]int64
+	sumSq    [8]float64
+	peak     [8]int
+	peakMag2 [8]int64
+}
+
+// adcCode maps a sample to its histogram index; codes beyond 12 bits land
+// in the end bins
+func adcCode(v int16) int {
+	if v > adcMaxCode {
+		return adcCodes - 1
+	}
+	if v < -adcMaxCode-1 {
+		return 0
+	}
+	return int(v) + adcMaxCode + 1
+}
+
+// add folds one block of a receiver channel (0-7)
+func (a *adcAccumulator) add(ch int, i, q []int16, nearCodes int) {
+	if a.hist[ch] == nil {
+		a.hist[ch] = new([2][adcCodes]uint64)
+	}
+	h := a.hist[ch]
+	var sumSq float64
+	near, peak, peakMag2 := a.near[ch], a.peak[ch], a.peakMag2[ch]
+	for s := range i {
+		vi, vq := int(i[s]), int(q[s])
+		h[0][adcCode(i[s])]++
+		h[1][adcCode(q[s])]++
+		mag2 := int64(vi*vi + vq*vq)
+		sumSq += float64(mag2)
+		if mag2 > peakMag2 {
+			peakMag2 = mag2
+		}
+		if vi < 0 {
+			vi = -vi
+		}
+		if vq < 0 {
+			vq = -vq
+		}
+		if vi >= nearCodes {
+			near++
+		}
+		if vq >= nearCodes {
+			near++
+		}
+		if vi > peak {
+			peak = vi
+		}
+		if vq > peak {
+			peak = vq
+		}
+	}
+	a.samples[ch] += int64(len(i))
+	a.sumSq[ch] += sumSq
+	a.near[ch], a.peak[ch], a.peakMag2[ch] = near, peak, peakMag2
+}
+
+// addFrames folds in interleaved frames whose slots hold the given receiver
+// channels (1-8)
+func (a *adcAccumulator) addFrames(data []byte, channels []int, nearCodes int) {
+	const block = 8192
+	frameSize := len(channels) * 4
+	if frameSize == 0 {
+		return
+	}
+	frames := len(data) / frameSize
+	i, q := make([]int16, block), make([]int16, block)
+	for start := 0; start < frames; start += block {
+		n := min(block, frames-start)
+		for slot, ch := range channels {
+			if ch < 1 || ch > 8 {
+				continue
+			}
+			for s := 0; s < n; s++ {
+				p := (start+s)*frameSize + slot*4
+				i[s] = int16(binary.LittleEndian.Uint16(data[p:]))
+				q[s] = int16(binary.LittleEndian.Uint16(data[p+2:]))
+			}
+			a.add(ch-1, i[:n], q[:n], nearCodes)
+		}
+	}
+}
+
+// report summarizes the channels seen so far
+func (a *adcAccumulator) report(cfg *ADCConfig) []ADCChannelStats {
+	out := []ADCChannelStats{}
+	shift := 0
+	for adcCodes>>shift > cfg.HistogramBins {
+		shift++
+	}
+	for ch, h := range a.hist {
+		if h == nil || a.samples[ch] == 0 {
+			continue
+		}
+		st := ADCChannelStats{
+			Channel:       ch + 1,
+			Samples:       a.samples[ch],
+			Clipped:       int64(h[0][0] + h[0][adcCodes-1] + h[1][0] + h[1][adcCodes-1]),
+			NearFullScale: a.near[ch],
+			PeakCode:      a.peak[ch],
+			RMSCodes:      math.Sqrt(a.sumSq[ch] / float64(a.samples[ch])),
+			HistogramI:    make([]uint64, cfg.HistogramBins),
+			HistogramQ:    make([]uint64, cfg.HistogramBins),
+		}
+		for code := 0; code < adcCodes; code++ {
+			st.HistogramI[code>>shift] += h[0][code]
+			st.HistogramQ[code>>shift] += h[1][code]
+		}
+		st.ClippedPPM = 1e6 * float64(st.Clipped) / float64(2*st.Samples)
+		st.Clipping = st.Clipped > 0 && st.ClippedPPM > cfg.ClipPPM
+		st.HeadroomDB = 20 * math.Log10(adcMaxCode/math.Max(float64(st.PeakCode), 1))
+		if st.RMSCodes > 0 {
+			st.CrestFactorDB = 20 * math.Log10(math.Sqrt(float64(a.peakMag2[ch]))/st.RMSCodes)
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// adcFrameStats summarizes raw interleaved frames for capture metadata
+func adcFrameStats(data []byte, channels []int, cfg ADCConfig) *ADCInfo {
+	var a adcAccumulator
+	a.addFrames(data, channels, cfg.NearCodes)
+	info := &ADCInfo{NearCodes: cfg.NearCodes, HistogramBins: cfg.HistogramBins, Channels: a.report(&cfg)}
+	for _, st := range info.Channels {
+		info.Clipping = info.Clipping || st.Clipping
+	}
+	return info
+}
+
+// currentADCConfig returns the validated configuration
+func currentADCConfig() ADCConfig {
+	serverState.mu.RLock()
+	cfg := serverState.ADC
+	serverState.mu.RUnlock()
+	cfg.Validate()
+	return cfg
+}
+
+// liveADC accumulates the stream's receiver channels over one window and
+// keeps the last window's report
+var liveADC = struct {
+	mu       sync.Mutex
+	acc      adcAccumulator
+	start    time.Time
+	last     []ADCChannelStats
+	clipping [8]bool
+	autoStep time.Time // Last automatic attenuation change
+}{}
+
+// feedADC folds the raw receiver channels of a stream frame into the
+// current window and reports the window once it is complete. The codes are
+// taken before any correction. Replayed codes aren't the hardware's, so
+// replay mode clears the statistics and the alarm instead.
+func feedADC(channelI, channelQ [][]int16) {
+	serverState.mu.RLock()
+	replay := serverState.ReplayMode
+	serverState.mu.RUnlock()
+	if replay {
+		liveADC.mu.Lock()
+		stale := liveADC.last != nil || !liveADC.start.IsZero()
+		liveADC.acc, liveADC.start, liveADC.last, liveADC.clipping = adcAccumulator{}, time.Time{}, nil, [8]bool{}
+		liveADC.mu.Unlock()
+		if stale {
+			go broadcastJSON(adcMessage())
+		}
+		return
+	}
+
+	cfg := currentADCConfig()
+	liveADC.mu.Lock()
+	now := time.Now()
+	if liveADC.start.IsZero() {
+		liveADC.start = now
+	}
+	for ch := 0; ch < 8 && ch < len(channelI); ch++ {
+		liveADC.acc.add(ch, channelI[ch], channelQ[ch], cfg.NearCodes)
+	}
+	if now.Sub(liveADC.start).Seconds() < cfg.IntervalS {
+		liveADC.mu.Unlock()
+		return
+	}
+	stats := liveADC.acc.report(&cfg)
+	liveADC.acc, liveADC.start, liveADC.last = adcAccumulator{}, now, stats
+	for _, st := range stats {
+		if st.Clipping && !liveADC.clipping[st.Channel-1] {
+			log.Printf("[ADC] Channel %d clipping (%.1f ppm, peak %d)", st.Channel, st.ClippedPPM, st.PeakCode)
+		}
+		liveADC.clipping[st.Channel-1] = st.Clipping
+	}
+	liveADC.mu.Unlock()
+
+	go broadcastJSON(adcMessage())
+	if cfg.AutoAttenuation {
+		go autoAttenuate(stats, &cfg)
+	}
+}
+
+// autoAttenuate steps ATTENUATION_BVAL by one window's statistics: up while
+// any channel clips or has too little headroom, down while every channel
+// has more than enough. It leaves the attenuation alone during recordings
+// and replay.
+func autoAttenuate(stats []ADCChannelStats, cfg *ADCConfig) {
+	if len(stats) == 0 || hwController == nil {
+		return
+	}
+	serverState.mu.RLock()
+	skip := !serverState.HardwareAvailable || serverState.Recording || serverState.ReplayMode
+	serverState.mu.RUnlock()
+	if skip {
+		return
+	}
+
+	atten, err := hwController.GetParameter(ATTENUATION_BVAL)
+	if err != nil {
+		return
+	}
+	next := nextAttenuation(stats, cfg, atten)
+	if next == atten {
+		return
+	}
+
+	// Windows started before the change still hold the old level; wait for
+	// the next complete one
+	liveADC.mu.Lock()
+	settled := time.Since(liveADC.autoStep).Seconds() >= 2*cfg.IntervalS
+	if settled {
+		liveADC.autoStep = time.Now()
+	}
+	liveADC.mu.Unlock()
+	if !settled {
+		return
+	}
+
+	if err := hwController.UpdateParameter(ATTENUATION_BVAL, next); err != nil {
+		log.Printf("[ADC] Failed to set attenuation: %v", err)
+		return
+	}
+	log.Printf("[ADC] Attenuation %d -> %d dB", atten, next)
+	broadcastJSON(map[string]interface{}{
+		"type":           "attenuation_update",
+		"attenuation_db": next,
+	})
+}
+
+// nextAttenuation is the attenuation (0-31 dB) one window's statistics call
+// for
+func nextAttenuation(stats []ADCChannelStats, cfg *ADCConfig, atten int) int {
+	minHeadroom, clipping := math.Inf(1), false
+	for _, st := range stats {
+		minHeadroom = math.Min(minHeadroom, st.HeadroomDB)
+		clipping = clipping || st.Clipping
+	}
+	if clipping || minHeadroom < cfg.MinHeadroomDB {
+		return min(atten+cfg.StepDB, 31)
+	}
+	if minHeadroom > cfg.MaxHeadroomDB {
+		return max(atten-cfg.StepDB, 0)
+	}
+	return atten
+}
+
+// handleADC gets the last window's statistics or configures the monitor
+func handleADC(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var cfg ADCConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		serverState.mu.Lock()
+		serverState.ADC = cfg
+		serverState.mu.Unlock()
+		go broadcastJSON(adcMessage())
+	}
+	json.NewEncoder(w).Encode(adcMessage())
+}
+
+// adcMessage describes the configuration and the last window's statistics
+func adcMessage() map[string]interface{} {
+	cfg := currentADCConfig()
+	liveADC.mu.Lock()
+	stats, clipping := liveADC.last, false
+	for _, c := range liveADC.clipping {
+		clipping = clipping || c
+	}
+	liveADC.mu.Unlock()
+	if stats == nil {
+		stats = []ADCChannelStats{}
+	}
+	atten := -1
+	if hwController != nil {
+		if v, err := hwController.GetParameter(ATTENUATION_BVAL); err == nil {
+			atten = v
+		}
+	}
+	return map[string]interface{}{
+		"type":           "adc",
+		"config":         cfg,
+		"channels":       stats,
+		"clipping":       clipping,
+		"attenuation_db": atten,
+	}
+}
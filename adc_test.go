@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// TestADCStats runs a clipped tone, a quiet tone and an idle channel through
+// the frame statistics and the attenuation control
+func TestADCStats(t *testing.T) {
+	const frames = 4096
+	data := make([]byte, frames*3*4)
+	for s := 0; s < frames; s++ {
+		phase := 2 * math.Pi * 37 * float64(s) / frames
+		for slot, amp := range []float64{2500, 200, 0} {
+			p := (s*3 + slot) * 4
+			i := math.Max(math.Min(math.Round(amp*math.Cos(phase)), adcMaxCode), -adcMaxCode-1)
+			q := math.Max(math.Min(math.Round(amp*math.Sin(phase)), adcMaxCode), -adcMaxCode-1)
+			binary.LittleEndian.PutUint16(data[p:], uint16(int16(i)))
+			binary.LittleEndian.PutUint16(data[p+2:], uint16(int16(q)))
+		}
+	}
+	cfg := ADCConfig{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	info := adcFrameStats(data, []int{3, 5, 8}, cfg)
+	if !info.Clipping || len(info.Channels) != 3 {
+		t.Fatalf("%d channels, clipping %v", len(info.Channels), info.Clipping)
+	}
+	loud, quiet, idle := info.Channels[0], info.Channels[1], info.Channels[2]
+	if loud.Channel != 3 || quiet.Channel != 5 || idle.Channel != 8 {
+		t.Errorf("channels %d, %d, %d", loud.Channel, quiet.Channel, idle.Channel)
+	}
+
+	for _, st := range info.Channels {
+		var sumI, sumQ uint64
+		for b := range st.HistogramI {
+			sumI += st.HistogramI[b]
+			sumQ += st.HistogramQ[b]
+		}
+		if len(st.HistogramI) != 64 || sumI != frames || sumQ != frames {
+			t.Errorf("channel %d: %d bins holding %d and %d codes", st.Channel, len(st.HistogramI), sumI, sumQ)
+		}
+	}
+
+	// acos(2047/2500) of each quarter cycle is above full scale
+	wantClipped := 2 * frames * 4 * math.Acos(float64(adcMaxCode)/2500) / (2 * math.Pi)
+	if !loud.Clipping || math.Abs(float64(loud.Clipped)/wantClipped-1) > 0.05 || loud.PeakCode != adcMaxCode+1 || loud.HeadroomDB > 0 {
+		t.Errorf("clipped tone: %+v", loud)
+	}
+	if loud.NearFullScale <= loud.Clipped {
+		t.Errorf("near full scale %d should include the %d clipped codes", loud.NearFullScale, loud.Clipped)
+	}
+	// A constant-envelope tone has a crest factor of 0 dB
+	if quiet.Clipping || quiet.Clipped != 0 || quiet.PeakCode != 200 || math.Abs(quiet.RMSCodes-200) > 1 || math.Abs(quiet.CrestFactorDB) > 0.1 {
+		t.Errorf("quiet tone: %+v", quiet)
+	}
+	if math.Abs(quiet.HeadroomDB-20*math.Log10(2047.0/200)) > 0.01 {
+		t.Errorf("quiet tone headroom %.2f dB", quiet.HeadroomDB)
+	}
+	if idle.HistogramI[32] != frames || idle.CrestFactorDB != 0 {
+		t.Errorf("idle channel: %+v", idle)
+	}
+
+	if got := nextAttenuation(info.Channels, &cfg, 30); got != 31 {
+		t.Errorf("clipping at 30 dB: attenuation %d, want 31", got)
+	}
+	if got := nextAttenuation(info.Channels[1:2], &cfg, 10); got != 7 {
+		t.Errorf("20 dB headroom at 10 dB: attenuation %d, want 7", got)
+	}
+	quiet.HeadroomDB = 6
+	if got := nextAttenuation([]ADCChannelStats{quiet}, &cfg, 10); got != 10 {
+		t.Errorf("6 dB headroom: attenuation %d, want 10", got)
+	}
+}
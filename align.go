@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// alignHalfTaps is the half-length of the windowed-sinc fractional delay
+// filter; it is flat to about 90% of the band
+const alignHalfTaps = 16
+
+// alignMinFraction is the smallest fractional delay that is interpolated;
+// anything closer to a whole sample is rounded to it
+const alignMinFraction = 1e-3
+
+// channelAligner time-aligns the slots of interleaved cs16 frames (or
+// per-channel slices). Each output sample is y[n] = x(n + base + frac),
+// interpolated for the fractional part, so every slot refers to the same
+// instant. The first margin input samples are consumed beyond the output.
+type channelAligner struct {
+	base   []int       // Integer input offset of each slot
+	taps   [][]float64 // Filter over offsets lo..hi, per slot
+	lo, hi int
+	margin int
+	lead   []float64 // Input offset of output sample 0, per slot
+}
+
+// newChannelAligner builds an aligner for per-slot delays in samples, where
+// a positive delay means the slot lags the reference
+func newChannelAligner(delays []float64) *channelAligner {
+	a := &channelAligner{}
+	minDelay := math.Inf(1)
+	fractional := false
+	for _, d := range delays {
+		minDelay = math.Min(minDelay, d)
+		if f := d - math.Floor(d); f > alignMinFraction && f < 1-alignMinFraction {
+			fractional = true
+		}
+	}
+	if fractional {
+		a.lo, a.hi = -(alignHalfTaps - 1), alignHalfTaps
+	}
+
+	maxInt := 0
+	for _, d := range delays {
+		rel := d - minDelay
+		whole := math.Floor(rel + alignMinFraction)
+		frac := math.Max(rel-whole, 0)
+		if !fractional || frac < alignMinFraction {
+			frac = 0
+		}
+		a.base = append(a.base, -a.lo+int(whole))
+		a.taps = append(a.taps, fractionalDelayTaps(frac, a.lo, a.hi))
+		a.lead = append(a.lead, float64(-a.lo)+rel)
+		if int(whole) > maxInt {
+			maxInt = int(whole)
+		}
+	}
+	a.margin = a.hi - a.lo + maxInt
+	return a
+}
+
+// fractionalDelayTaps returns a Blackman-windowed sinc that samples x(n + f)
+// from x[n+lo] ... x[n+hi], normalized to unity gain at DC
+func fractionalDelayTaps(f float64, lo, hi int) []float64 {
+	taps := make([]float64, hi-lo+1)
+	if f == 0 {
+		taps[-lo] = 1
+		return taps
+	}
+	half := float64(hi-lo+1) / 2
+	sum := 0.0
+	for k := lo; k <= hi; k++ {
+		t := float64(k) - f
+		w := 0.42 + 0.5*math.Cos(math.Pi*t/half) + 0.08*math.Cos(2*math.Pi*t/half)
+		sinc := 1.0
+		if t != 0 {
+			sinc = math.Sin(math.Pi*t) / (math.Pi * t)
+		}
+		taps[k-lo] = sinc * w
+		sum += taps[k-lo]
+	}
+	for k := range taps {
+		taps[k] /= sum
+	}
+	return taps
+}
+
+// referenceLead returns the input sample that output sample 0 was taken
+// from on the reference (least delayed) slot
+func (a *channelAligner) referenceLead() float64 {
+	lead := math.Inf(1)
+	for _, l := range a.lead {
+		lead = math.Min(lead, l)
+	}
+	return lead
+}
+
+// output returns the output length for n input samples
+func (a *channelAligner) output(n int) int {
+	if n <= a.margin {
+		return 0
+	}
+	return n - a.margin
+}
+
+// alignSlot writes one slot's n aligned samples from its input samples
+func (a *channelAligner) alignSlot(slot int, inI, inQ, outI, outQ []int16) {
+	taps := a.taps[slot]
+	start := a.base[slot] + a.lo
+	n := len(outI)
+	if len(taps) == 1 {
+		copy(outI, inI[start:start+n])
+		copy(outQ, inQ[start:start+n])
+		return
+	}
+	for s := 0; s < n; s++ {
+		xi, xq := inI[start+s:start+s+len(taps)], inQ[start+s:start+s+len(taps)]
+		var vi, vq float64
+		for k, h := range taps {
+			vi += h * float64(xi[k])
+			vq += h * float64(xq[k])
+		}
+		outI[s], outQ[s] = clampInt16(vi), clampInt16(vq)
+	}
+}
+
+// alignChannels returns aligned copies of per-slot I/Q slices, margin
+// samples shorter than the input
+func (a *channelAligner) alignChannels(channelI, channelQ [][]int16) ([][]int16, [][]int16) {
+	outI, outQ := make([][]int16, len(channelI)), make([][]int16, len(channelQ))
+	for slot := range channelI {
+		n := a.output(len(channelI[slot]))
+		outI[slot], outQ[slot] = make([]int16, n), make([]int16, n)
+		if slot >= len(a.base) {
+			copy(outI[slot], channelI[slot])
+			copy(outQ[slot], channelQ[slot])
+			continue
+		}
+		a.alignSlot(slot, channelI[slot], channelQ[slot], outI[slot], outQ[slot])
+	}
+	return outI, outQ
+}
+
+// alignFrames returns aligned interleaved frames of len(delays) slots,
+// margin frames shorter than the input
+func (a *channelAligner) alignFrames(data []byte) []byte {
+	frameSize := len(a.base) * 4
+	frames := len(data) / frameSize
+	n := a.output(frames)
+	out := make([]byte, n*frameSize)
+	inI, inQ := make([]int16, frames), make([]int16, frames)
+	outI, outQ := make([]int16, n), make([]int16, n)
+	for slot := range a.base {
+		for s := 0; s < frames; s++ {
+			p := s*frameSize + slot*4
+			inI[s] = int16(binary.LittleEndian.Uint16(data[p:]))
+			inQ[s] = int16(binary.LittleEndian.Uint16(data[p+2:]))
+		}
+		a.alignSlot(slot, inI, inQ, outI, outQ)
+		for s := 0; s < n; s++ {
+			p := s*frameSize + slot*4
+			binary.LittleEndian.PutUint16(out[p:], uint16(outI[s]))
+			binary.LittleEndian.PutUint16(out[p+2:], uint16(outQ[s]))
+		}
+	}
+	return out
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"os"
+)
+
+const speedOfLight = 299792458.0
+
+// ArrayElement is the position of one channel's antenna in meters
+type ArrayElement struct {
+	Channel int     `json:"channel"` // User-facing channel (1-8)
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Z       float64 `json:"z"`
+}
+
+// ArrayGeometry is the antenna array connected to the receiver. Azimuth is
+// measured from the +x axis towards +y and elevation up from the x-y plane.
+type ArrayGeometry struct {
+	Name     string         `json:"name"`
+	Elements []ArrayElement `json:"elements"`
+}
+
+// Validate checks that each channel appears at most once
+func (g *ArrayGeometry) Validate() error {
+	if len(g.Elements) < 2 {
+		return fmt.Errorf("array needs at least 2 elements")
+	}
+	seen := make(map[int]bool)
+	for _, e := range g.Elements {
+		if e.Channel < 1 || e.Channel > 8 {
+			return fmt.Errorf("element channel must be between 1 and 8")
+		}
+		if seen[e.Channel] {
+			return fmt.Errorf("channel %d appears twice", e.Channel)
+		}
+		seen[e.Channel] = true
+	}
+	return nil
+}
+
+// loadArrayGeometry reads an element position file
+func loadArrayGeometry(path string) (*ArrayGeometry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var g ArrayGeometry
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := g.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &g, nil
+}
+
+// currentArray returns the configured array geometry
+func currentArray() (*ArrayGeometry, error) {
+	serverState.mu.RLock()
+	defer serverState.mu.RUnlock()
+	if serverState.Array == nil {
+		return nil, fmt.Errorf("no array geometry; start with -array or POST /api/array")
+	}
+	return serverState.Array, nil
+}
+
+// subset returns the elements for the given channels, in the given order;
+// empty means all elements
+func (g *ArrayGeometry) subset(channels []int) ([]ArrayElement, error) {
+	if len(channels) == 0 {
+		return g.Elements, nil
+	}
+	var out []ArrayElement
+	for _, ch := range channels {
+		found := false
+		for _, e := range g.Elements {
+			if e.Channel == ch {
+				out = append(out, e)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("channel %d is not in the array geometry", ch)
+		}
+	}
+	if len(out) < 2 {
+		return nil, fmt.Errorf("need at least 2 array elements")
+	}
+	return out, nil
+}
+
+// isLinearX reports whether every element lies on the x axis, in which case
+// bearings either side of the axis can't be told apart
+func isLinearX(elements []ArrayElement) bool {
+	for _, e := range elements {
+		if e.Y != 0 || e.Z != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// steeringVector returns each element's phase for a plane wave at rfHz
+// arriving from azimuth/elevation. Elements nearer the source see the wave
+// first, so their phase leads.
+func steeringVector(elements []ArrayElement, azDeg, elDeg, rfHz float64) []complex128 {
+	az, el := azDeg*math.Pi/180, elDeg*math.Pi/180
+	ux, uy, uz := math.Cos(el)*math.Cos(az), math.Cos(el)*math.Sin(az), math.Sin(el)
+	k := 2 * math.Pi * rfHz / speedOfLight
+	a := make([]complex128, len(elements))
+	for i, e := range elements {
+		a[i] = cmplx.Rect(1, k*(e.X*ux+e.Y*uy+e.Z*uz))
+	}
+	return a
+}
+
+// handleArray gets or replaces the array geometry used for DOA and beamforming
+func handleArray(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var g ArrayGeometry
+		if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if err := g.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		serverState.mu.Lock()
+		serverState.Array = &g
+		serverState.mu.Unlock()
+	}
+
+	serverState.mu.RLock()
+	g := serverState.Array
+	serverState.mu.RUnlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"array": g})
+}
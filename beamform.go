@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	beamChannelBase = 9 // User-facing channel of the first beam
+	maxBeams        = 8 // Beams are channels 9-16
+	beamsFolder     = "beams"
+)
+
+// BeamWeight is the complex weight applied to one receiver channel
+type BeamWeight struct {
+	Channel int     `json:"channel"` // Receiver channel (1-8)
+	Re      float64 `json:"re"`
+	Im      float64 `json:"im"`
+}
+
+// Beam is a virtual channel formed as the weighted sum of receiver channels.
+// Weights are either given directly or computed by steering the array.
+type Beam struct {
+	Name    string       `json:"name"`
+	Weights []BeamWeight `json:"weights,omitempty"`
+
+	// Steering: unity gain towards azimuth/elevation using the array geometry
+	AzimuthDeg   *float64 `json:"azimuth_deg,omitempty"`
+	ElevationDeg float64  `json:"elevation_deg,omitempty"`
+	RFHz         float64  `json:"rf_hz,omitempty"`    // Steering frequency; 0 = DDC frequency
+	Channels     []int    `json:"channels,omitempty"` // Array elements to use; empty = all
+}
+
+// BeamSet is a named list of beams, as saved in the beams folder
+type BeamSet struct {
+	Name  string `json:"name"`
+	Beams []Beam `json:"beams"`
+}
+
+// Validate checks the beams without resolving steering weights
+func (s *BeamSet) Validate() error {
+	if len(s.Beams) > maxBeams {
+		return fmt.Errorf("at most %d beams", maxBeams)
+	}
+	for i, b := range s.Beams {
+		if (len(b.Weights) > 0) == (b.AzimuthDeg != nil) {
+			return fmt.Errorf("beam %d: give either weights or azimuth_deg", i+1)
+		}
+		for _, w := range b.Weights {
+			if w.Channel < 1 || w.Channel > 8 {
+				return fmt.Errorf("beam %d: weight channel must be between 1 and 8", i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// weights returns the beam's weight for each receiver channel index (0-7).
+// Steered beams use conj(a)/N, so a plane wave from the steering direction
+// keeps its element amplitude.
+func (b *Beam) weights(g *ArrayGeometry, ddcHz float64) ([8]complex128, error) {
+	var w [8]complex128
+	if b.AzimuthDeg == nil {
+		for _, bw := range b.Weights {
+			w[bw.Channel-1] += complex(bw.Re, bw.Im)
+		}
+		return w, nil
+	}
+	if g == nil {
+		return w, fmt.Errorf("steered beams need an array geometry")
+	}
+	elements, err := g.subset(b.Channels)
+	if err != nil {
+		return w, err
+	}
+	rf := b.RFHz
+	if rf <= 0 {
+		rf = ddcHz
+	}
+	a := steeringVector(elements, *b.AzimuthDeg, b.ElevationDeg, rf)
+	for i, e := range elements {
+		w[e.Channel-1] = cmplx.Conj(a[i]) / complex(float64(len(elements)), 0)
+	}
+	return w, nil
+}
+
+// resolveBeams computes every beam's weights; ddcHz is the frequency at DC
+func resolveBeams(beams []Beam, g *ArrayGeometry, ddcHz float64) ([][8]complex128, error) {
+	var out [][8]complex128
+	for i := range beams {
+		w, err := beams[i].weights(g, ddcHz)
+		if err != nil {
+			return nil, fmt.Errorf("beam %d: %v", i+1, err)
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+// currentBeams returns the configured beams and their weights for live
+// data. Beams that can no longer be resolved (e.g. the array was replaced)
+// output zeros.
+func currentBeams() ([]Beam, [][8]complex128) {
+	serverState.mu.RLock()
+	beams := serverState.Beams
+	g := serverState.Array
+	ddcHz := serverState.DDCFreqMHz * 1e6
+	serverState.mu.RUnlock()
+
+	weights := make([][8]complex128, len(beams))
+	for i := range beams {
+		weights[i], _ = beams[i].weights(g, ddcHz)
+	}
+	return beams, weights
+}
+
+// BeamChannel is an active beam with its channel and applied weights
+type BeamChannel struct {
+	Channel int          `json:"channel"` // User-facing channel (9-16)
+	Beam    Beam         `json:"beam"`
+	Weights []BeamWeight `json:"weights"` // Applied weights, including steered beams
+}
+
+// beamChannels pairs each beam with its channel and resolved weights, so
+// recordings keep the exact weights they were formed with
+func beamChannels(beams []Beam, weights [][8]complex128) []BeamChannel {
+	out := make([]BeamChannel, len(beams))
+	for i, b := range beams {
+		out[i] = BeamChannel{Channel: beamChannelBase + i, Beam: b, Weights: []BeamWeight{}}
+		for ch, w := range weights[i] {
+			if w != 0 {
+				out[i].Weights = append(out[i].Weights, BeamWeight{Channel: ch + 1, Re: real(w), Im: imag(w)})
+			}
+		}
+	}
+	return out
+}
+
+// formBeam writes the weighted sum of the receiver channels into outI/outQ
+func formBeam(outI, outQ []int16, channelI, channelQ [][]int16, w [8]complex128) {
+	for s := range outI {
+		var v complex128
+		for ch := 0; ch < 8 && ch < len(channelI); ch++ {
+			if w[ch] != 0 {
+				v += w[ch] * complex(float64(channelI[ch][s]), float64(channelQ[ch][s]))
+			}
+		}
+		outI[s], outQ[s] = clampInt16(real(v)), clampInt16(imag(v))
+	}
+}
+
+// appendBeamChannels returns the receiver channels followed by one channel
+// per beam. The input slices are not modified.
+func appendBeamChannels(channelI, channelQ [][]int16, weights [][8]complex128) ([][]int16, [][]int16) {
+	if len(weights) == 0 {
+		return channelI, channelQ
+	}
+	n := len(channelI[0])
+	outI := append(append([][]int16(nil), channelI...), make([][]int16, len(weights))...)
+	outQ := append(append([][]int16(nil), channelQ...), make([][]int16, len(weights))...)
+	for k, w := range weights {
+		idx := len(channelI) + k
+		outI[idx], outQ[idx] = make([]int16, n), make([]int16, n)
+		formBeam(outI[idx], outQ[idx], channelI, channelQ, w)
+	}
+	return outI, outQ
+}
+
+// clampInt16 rounds to the int16 range
+func clampInt16(v float64) int16 {
+	v = math.Round(v)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+// beamSetPath returns the file for a saved weight set
+func beamSetPath(name string) (string, error) {
+	name = strings.TrimSuffix(filepath.Base(name), ".json")
+	if name == "" || name == "." || name == "/" {
+		return "", fmt.Errorf("name required")
+	}
+	return filepath.Join(beamsFolder, name+".json"), nil
+}
+
+// handleBeams gets or replaces the active beams
+func handleBeams(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var set BeamSet
+		if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if err := applyBeamSet(&set); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	writeBeams(w)
+}
+
+// applyBeamSet validates the beams and makes them the active set
+func applyBeamSet(set *BeamSet) error {
+	if err := set.Validate(); err != nil {
+		return err
+	}
+	serverState.mu.Lock()
+	if _, err := resolveBeams(set.Beams, serverState.Array, serverState.DDCFreqMHz*1e6); err != nil {
+		serverState.mu.Unlock()
+		return err
+	}
+	serverState.Beams = set.Beams
+	serverState.BeamSetName = set.Name
+	serverState.mu.Unlock()
+
+	go broadcastJSON(beamsMessage())
+	return nil
+}
+
+// beamsMessage describes the active beams, their channels and weights
+func beamsMessage() map[string]interface{} {
+	serverState.mu.RLock()
+	name := serverState.BeamSetName
+	serverState.mu.RUnlock()
+	beams, weights := currentBeams()
+	return map[string]interface{}{"type": "beams", "name": name, "beams": beamChannels(beams, weights)}
+}
+
+// writeBeams responds with the active beams
+func writeBeams(w http.ResponseWriter) {
+	json.NewEncoder(w).Encode(beamsMessage())
+}
+
+// handleBeamSets lists the saved weight sets
+func handleBeamSets(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	entries, _ := os.ReadDir(beamsFolder)
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	sort.Strings(names)
+	json.NewEncoder(w).Encode(map[string]interface{}{"sets": names})
+}
+
+// handleBeamSave saves the active beams under a name
+func handleBeamSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	path, err := beamSetPath(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	serverState.mu.Lock()
+	set := BeamSet{Name: strings.TrimSuffix(filepath.Base(path), ".json"), Beams: serverState.Beams}
+	serverState.BeamSetName = set.Name
+	serverState.mu.Unlock()
+
+	data, _ := json.MarshalIndent(set, "", "  ")
+	if err := os.MkdirAll(beamsFolder, 0755); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "name": set.Name})
+}
+
+// handleBeamLoad makes a saved weight set the active beams
+func handleBeamLoad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	path, err := beamSetPath(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		http.Error(w, "Weight set not found", 404)
+		return
+	}
+	var set BeamSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		http.Error(w, fmt.Sprintf("%s: %v", path, err), 500)
+		return
+	}
+	set.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+	if err := applyBeamSet(&set); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	writeBeams(w)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestSteeredBeam forms beams on a simulated ULA and checks that the beam
+// towards the source keeps its amplitude while another is attenuated
+func TestSteeredBeam(t *testing.T) {
+	g := &ArrayGeometry{}
+	for i := 0; i < 8; i++ {
+		g.Elements = append(g.Elements, ArrayElement{Channel: i + 1, X: 0.6 * float64(i)})
+	}
+	sc := &SimScenario{Geometry: g, RFHz: 125e6, NoiseLSB: 1}
+	src := SimSource{AzimuthDeg: 60, OffsetHz: 10e6, Amplitude: 1000}
+	var gain [8]complex128
+	for i, a := range steeringVector(g.Elements, src.AzimuthDeg, 0, sc.RFHz+src.OffsetHz) {
+		gain[i] = a * complex(src.Amplitude, 0)
+	}
+	sc.Sources, sc.gains = []SimSource{src}, [][8]complex128{gain}
+
+	const n = 4096
+	buf := make([]byte, n*32)
+	sc.fill(buf, 0, rand.New(rand.NewSource(1)))
+	channelI, channelQ := make([][]int16, 8), make([][]int16, 8)
+	for ch := 0; ch < 8; ch++ {
+		channelI[ch], channelQ[ch] = make([]int16, n), make([]int16, n)
+		for s := 0; s < n; s++ {
+			off := s*32 + ch*4
+			channelI[ch][s] = int16(binary.LittleEndian.Uint16(buf[off:]))
+			channelQ[ch][s] = int16(binary.LittleEndian.Uint16(buf[off+2:]))
+		}
+	}
+
+	on, off := 60.0, 100.0
+	beams := []Beam{{Name: "on", AzimuthDeg: &on, RFHz: 135e6}, {Name: "off", AzimuthDeg: &off, RFHz: 135e6}}
+	weights, err := resolveBeams(beams, g, 125e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outI, outQ := appendBeamChannels(channelI, channelQ, weights)
+	if len(outI) != 10 || len(channelI) != 8 {
+		t.Fatalf("got %d channels, input now %d", len(outI), len(channelI))
+	}
+
+	rms := func(ch int) float64 {
+		var sum float64
+		for s := 0; s < n; s++ {
+			sum += float64(outI[ch][s])*float64(outI[ch][s]) + float64(outQ[ch][s])*float64(outQ[ch][s])
+		}
+		return math.Sqrt(sum / n)
+	}
+	if got := rms(8); math.Abs(got-1000) > 5 {
+		t.Errorf("beam towards source: rms %.1f, want 1000", got)
+	}
+	if got := 20 * math.Log10(rms(9)/rms(0)); got > -10 {
+		t.Errorf("beam away from source: %.1f dB relative to an element, want below -10 dB", got)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// calibrationFolder holds one folder of calibration files per unit
+const calibrationFolder = "calibration"
+
+// unitName identifies this receiver in stored calibration; set with -unit,
+// defaulting to the host name
+var unitName = "default"
+
+// initUnitName sets the unit name from the -unit flag or the host name
+func initUnitName(name string) {
+	if name == "" {
+		if host, err := os.Hostname(); err == nil {
+			name = host
+		}
+	}
+	if name = safeFileName(name); name != "" {
+		unitName = name
+	}
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// safeFileName reduces a unit or configuration name to a single path element
+func safeFileName(name string) string {
+	name = unsafeFileChars.ReplaceAllString(name, "_")
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// unitCalibrationPath returns the path of a calibration file for this unit
+func unitCalibrationPath(file string) string {
+	return filepath.Join(calibrationFolder, unitName, file)
+}
+
+// configKey names a receiver configuration for calibration lookups: the DDC
+// frequency, plus the filter and attenuation when they are known
+func configKey(ddcMHz float64, cfg *HardwareConfig) string {
+	key := fmt.Sprintf("ddc%g", ddcMHz)
+	if cfg != nil {
+		if cfg.Filter != nil && *cfg.Filter != "unknown" {
+			key += "_" + *cfg.Filter
+		}
+		if cfg.Attenuation != nil {
+			key += fmt.Sprintf("_att%d", *cfg.Attenuation)
+		}
+	}
+	return key
+}
+
+// currentConfigKey is the configuration key of the live receiver
+func currentConfigKey() string {
+	serverState.mu.RLock()
+	ddcMHz := serverState.DDCFreqMHz
+	hwAvailable := serverState.HardwareAvailable
+	serverState.mu.RUnlock()
+	var cfg *HardwareConfig
+	if hwAvailable && hwController != nil {
+		cfg = hwController.GetConfig()
+	}
+	return configKey(ddcMHz, cfg)
+}
+
+// recordingConfigKey is the configuration key a recording was made in
+func recordingConfigKey(meta *CaptureMetadata) string {
+	if meta.ConfigKey != "" {
+		return meta.ConfigKey
+	}
+	ddcMHz := 0.0
+	if meta.Config != nil && meta.Config.DDC0FreqMHz != nil {
+		ddcMHz = float64(*meta.Config.DDC0FreqMHz)
+	}
+	return configKey(ddcMHz, meta.Config)
+}
@@ -34,8 +34,9 @@ func TestCaptureWithSimulator(t *testing.T) {
 	// We want to capture a small amount of data, e.g., 1MB
 	targetSize := 1 * 1024 * 1024
 	cfg := dma.CaptureConfig{
-		DevicePath: pipePath,
-		TargetSize: targetSize,
+		DevicePath:  pipePath,
+		TargetSize:  targetSize,
+		ChannelMask: [8]bool{true, true, true, true, true, true, true, true},
 	}
 
 	// Run Capture
@@ -66,5 +67,4 @@ func TestCaptureWithSimulator(t *testing.T) {
 	fmt.Printf("Bytes Read: %d\n", result.BytesRead)
 	fmt.Printf("Duration:   %v\n", result.Duration)
 	fmt.Printf("Throughput: %.2f MB/s\n", result.Throughput)
-	fmt.Printf("Aligned:    %v\n", result.Aligned)
 }
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/dma/pkg/fft"
+)
+
+const (
+	subChannelBase = 17                                  // User-facing channel of the first sub-channel
+	maxSubChannels = 64                                  // Sub-channels are channels 17-80
+	maxChannel     = subChannelBase + maxSubChannels - 1 // Highest user-facing channel
+)
+
+// ChannelizerConfig splits one channel into uniform sub-channels with a
+// critically sampled polyphase filter bank
+type ChannelizerConfig struct {
+	Enabled       bool    `json:"enabled"`
+	Channel       int     `json:"channel"`         // Source channel (1-8, beams 9-16), default 1
+	SubChannels   int     `json:"sub_channels"`    // M, a power of two from 2 to 64, default 8
+	TapsPerBranch int     `json:"taps_per_branch"` // Prototype filter length is M * taps, default 16
+	Window        string  `json:"window"`          // Prototype filter window, default blackman-harris
+	WindowParam   float64 `json:"window_param"`    // Kaiser beta or Gaussian sigma
+	Cutoff        float64 `json:"cutoff"`          // -6 dB edge relative to the sub-channel spacing, default 0.5
+}
+
+// Validate checks the configuration and fills in defaults
+func (c *ChannelizerConfig) Validate() error {
+	if c.Channel == 0 {
+		c.Channel = 1
+	}
+	if c.Channel < 1 || c.Channel >= subChannelBase {
+		return fmt.Errorf("source channel must be between 1 and %d", subChannelBase-1)
+	}
+	if c.SubChannels == 0 {
+		c.SubChannels = 8
+	}
+	if c.SubChannels < 2 || c.SubChannels > maxSubChannels || c.SubChannels&(c.SubChannels-1) != 0 {
+		return fmt.Errorf("sub_channels must be a power of two from 2 to %d", maxSubChannels)
+	}
+	if c.TapsPerBranch == 0 {
+		c.TapsPerBranch = 16
+	}
+	if c.TapsPerBranch < 1 || c.TapsPerBranch > 64 {
+		return fmt.Errorf("taps_per_branch must be between 1 and 64")
+	}
+	if c.Window == "" {
+		c.Window = string(fft.BlackmanHarris)
+	}
+	spec, err := fft.ParseWindow(c.Window, c.WindowParam)
+	if err != nil {
+		return err
+	}
+	c.Window, c.WindowParam = string(spec.Kind), spec.Param
+	if c.Cutoff == 0 {
+		c.Cutoff = 0.5
+	}
+	if c.Cutoff <= 0 || c.Cutoff > 1 {
+		return fmt.Errorf("cutoff must be between 0 and 1")
+	}
+	return nil
+}
+
+// SubChannel is one output of the channelizer
+type SubChannel struct {
+	Channel  int     `json:"channel"`   // User-facing channel (17-80)
+	Index    int     `json:"index"`     // 0 is the lowest frequency
+	CenterHz float64 `json:"center_hz"` // Offset from the source channel's DC
+}
+
+// ChannelizerInfo describes a channelizer's outputs, for messages and
+// capture metadata
+type ChannelizerInfo struct {
+	ChannelizerConfig
+	SampleRate   float64      `json:"sample_rate"` // Of each sub-channel
+	SpacingHz    float64      `json:"spacing_hz"`
+	DelaySamples float64      `json:"delay_samples"` // Filter group delay in source samples
+	SubChannels  []SubChannel `json:"channels"`
+
+	// Weights forming the source when it is a beam channel
+	SourceWeights []BeamWeight `json:"source_weights,omitempty"`
+}
+
+// polyphaseChannelizer is a designed filter bank. Sub-channel k of output n
+// is sum_l h[l] x[nM+D-l] exp(-j2πk(nM+D-l)/M) with D = M*taps-1, computed
+// as M branch filters followed by an M-point FFT.
+type polyphaseChannelizer struct {
+	cfg      ChannelizerConfig
+	m, taps  int
+	branches [][]float64 // branches[q][t] = h[tM + M-1-q]
+}
+
+// newPolyphaseChannelizer designs the windowed-sinc prototype filter,
+// normalized to unity gain so a tone at a sub-channel center keeps its
+// amplitude
+func newPolyphaseChannelizer(cfg ChannelizerConfig) (*polyphaseChannelizer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	m, taps := cfg.SubChannels, cfg.TapsPerBranch
+	n := m * taps
+	spec, _ := fft.ParseWindow(cfg.Window, cfg.WindowParam)
+	w, err := fft.GetWindowSpec(spec, n)
+	if err != nil {
+		return nil, err
+	}
+	fc := cfg.Cutoff / float64(m)
+	h := make([]float64, n)
+	sum := 0.0
+	for l := range h {
+		t := float64(l) - float64(n-1)/2
+		sinc := 1.0
+		if t != 0 {
+			sinc = math.Sin(2*math.Pi*fc*t) / (2 * math.Pi * fc * t)
+		}
+		h[l] = sinc * w.Coeffs[l]
+		sum += h[l]
+	}
+
+	c := &polyphaseChannelizer{cfg: cfg, m: m, taps: taps, branches: make([][]float64, m)}
+	for q := range c.branches {
+		c.branches[q] = make([]float64, taps)
+		for t := range c.branches[q] {
+			c.branches[q][t] = h[t*m+m-1-q] / sum
+		}
+	}
+	return c, nil
+}
+
+// delay returns the source sample at the center of sub-channel sample 0's
+// filter; sub-channel sample k is centered m samples later per step
+func (c *polyphaseChannelizer) delay() float64 {
+	return float64(c.m*c.taps-1) / 2
+}
+
+// outputs returns the sub-channel samples produced from n source samples
+func (c *polyphaseChannelizer) outputs(n int) int {
+	if out := n/c.m - c.taps + 1; out > 0 {
+		return out
+	}
+	return 0
+}
+
+// inputs returns the source samples needed for n sub-channel samples
+func (c *polyphaseChannelizer) inputs(n int) int {
+	return (n + c.taps - 1) * c.m
+}
+
+func (c *polyphaseChannelizer) sampleRate() float64 {
+	return captureSampleRate / float64(c.m)
+}
+
+// info describes the sub-channels
+func (c *polyphaseChannelizer) info() *ChannelizerInfo {
+	info := &ChannelizerInfo{
+		ChannelizerConfig: c.cfg,
+		SampleRate:        c.sampleRate(),
+		SpacingHz:         c.sampleRate(),
+		DelaySamples:      float64(c.m*c.taps-1) / 2,
+	}
+	for k := 0; k < c.m; k++ {
+		info.SubChannels = append(info.SubChannels, SubChannel{
+			Channel:  subChannelBase + k,
+			Index:    k,
+			CenterHz: float64(k-c.m/2) * c.sampleRate(),
+		})
+	}
+	return info
+}
+
+// channelize splits the source samples into the given sub-channel indices
+// (0-M-1); nil means all of them
+func (c *polyphaseChannelizer) channelize(i, q []int16, subs []int) ([][]int16, [][]int16) {
+	if subs == nil {
+		for k := 0; k < c.m; k++ {
+			subs = append(subs, k)
+		}
+	}
+	n := c.outputs(len(i))
+	outI, outQ := make([][]int16, len(subs)), make([][]int16, len(subs))
+	for k := range subs {
+		outI[k], outQ[k] = make([]int16, n), make([]int16, n)
+	}
+	plan := fft.PlanFor(c.m)
+	u := make([]complex128, c.m)
+	for s := 0; s < n; s++ {
+		for br, taps := range c.branches {
+			var vi, vq float64
+			for t, h := range taps {
+				p := (s+c.taps-1-t)*c.m + br
+				vi += h * float64(i[p])
+				vq += h * float64(q[p])
+			}
+			u[br] = complex(vi, vq)
+		}
+		plan.InPlace(u)
+		for k, sub := range subs {
+			// Sub-channel index 0 is the lowest frequency, -fs/2
+			v := u[(sub+c.m/2)%c.m]
+			outI[k][s], outQ[k][s] = clampInt16(real(v)), clampInt16(imag(v))
+		}
+	}
+	return outI, outQ
+}
+
+// appendSubChannels returns the receiver and beam channels padded to 16,
+// followed by every sub-channel of the source. The input slices are not
+// modified; missing beams stay empty.
+func appendSubChannels(channelI, channelQ [][]int16, c *polyphaseChannelizer) ([][]int16, [][]int16) {
+	outI := make([][]int16, subChannelBase-1, subChannelBase-1+c.m)
+	outQ := make([][]int16, subChannelBase-1, subChannelBase-1+c.m)
+	copy(outI, channelI)
+	copy(outQ, channelQ)
+	src := c.cfg.Channel - 1
+	if src >= len(channelI) {
+		return outI, outQ
+	}
+	subI, subQ := c.channelize(channelI[src], channelQ[src], nil)
+	return append(outI, subI...), append(outQ, subQ...)
+}
+
+// liveChannelizer caches the design for the configured channelizer
+var liveChannelizer struct {
+	mu  sync.Mutex
+	cfg ChannelizerConfig
+	c   *polyphaseChannelizer
+}
+
+// currentChannelizer returns the enabled channelizer, or nil
+func currentChannelizer() *polyphaseChannelizer {
+	serverState.mu.RLock()
+	cfg := serverState.Channelizer
+	serverState.mu.RUnlock()
+	if !cfg.Enabled {
+		return nil
+	}
+	liveChannelizer.mu.Lock()
+	defer liveChannelizer.mu.Unlock()
+	if liveChannelizer.c == nil || liveChannelizer.cfg != cfg {
+		c, err := newPolyphaseChannelizer(cfg)
+		if err != nil {
+			return nil
+		}
+		liveChannelizer.cfg, liveChannelizer.c = cfg, c
+	}
+	return liveChannelizer.c
+}
+
+// channelizerInput returns the source samples the stream must read so each
+// sub-channel gets n samples
+func channelizerInput(n int) int {
+	if c := currentChannelizer(); c != nil {
+		return c.inputs(n)
+	}
+	return n
+}
+
+// isSubChannel reports whether a user-facing channel is a sub-channel
+func isSubChannel(ch int) bool {
+	return ch >= subChannelBase && ch <= maxChannel
+}
+
+// recordingChannelizer splits the source of a sub-channel recording
+type recordingChannelizer struct {
+	c      *polyphaseChannelizer
+	source [8]complex128 // Source as weights on the receiver channels
+	subs   []int         // Recorded sub-channel indices
+}
+
+// newRecordingChannelizer resolves the source channel and the recorded
+// sub-channels (user-facing, 17-80) of a recording job
+func newRecordingChannelizer(cfg ChannelizerConfig, channels []int, beams [][8]complex128) (*recordingChannelizer, error) {
+	c, err := newPolyphaseChannelizer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rc := &recordingChannelizer{c: c}
+	if src := cfg.Channel; src <= 8 {
+		rc.source[src-1] = 1
+	} else if k := src - beamChannelBase; k < len(beams) {
+		rc.source = beams[k]
+	} else {
+		return nil, fmt.Errorf("channelizer source channel %d is not an active beam", src)
+	}
+	for _, ch := range channels {
+		k := ch - subChannelBase
+		if k < 0 || k >= c.m {
+			return nil, fmt.Errorf("channel %d is not a sub-channel", ch)
+		}
+		rc.subs = append(rc.subs, k)
+	}
+	return rc, nil
+}
+
+// frames channelizes raw 8-channel frames into interleaved frames of the
+// recorded sub-channels.
+func (rc *recordingChannelizer) frames(data []byte) []byte {
+	const frameSize = 32
+	n := len(data) / frameSize
+	i, q := make([]int16, n), make([]int16, n)
+	for s := 0; s < n; s++ {
+		var v complex128
+		for ch, w := range rc.source {
+			if w != 0 {
+				p := s*frameSize + ch*4
+				v += w * complex(float64(int16(binary.LittleEndian.Uint16(data[p:]))), float64(int16(binary.LittleEndian.Uint16(data[p+2:]))))
+			}
+		}
+		i[s], q[s] = clampInt16(real(v)), clampInt16(imag(v))
+	}
+
+	subI, subQ := rc.c.channelize(i, q, rc.subs)
+	out := make([]byte, len(subI[0])*len(rc.subs)*4)
+	for s := range subI[0] {
+		for k := range rc.subs {
+			p := (s*len(rc.subs) + k) * 4
+			binary.LittleEndian.PutUint16(out[p:], uint16(subI[k][s]))
+			binary.LittleEndian.PutUint16(out[p+2:], uint16(subQ[k][s]))
+		}
+	}
+	return out
+}
+
+// info describes the recorded sub-channels for the capture metadata
+func (rc *recordingChannelizer) info() *ChannelizerInfo {
+	info := rc.c.info()
+	all := info.SubChannels
+	info.SubChannels = nil
+	for _, k := range rc.subs {
+		info.SubChannels = append(info.SubChannels, all[k])
+	}
+	if rc.c.cfg.Channel > 8 {
+		for ch, w := range rc.source {
+			if w != 0 {
+				info.SourceWeights = append(info.SourceWeights, BeamWeight{Channel: ch + 1, Re: real(w), Im: imag(w)})
+			}
+		}
+	}
+	return info
+}
+
+// handleChannelizer gets or replaces the channelizer configuration
+func handleChannelizer(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var cfg ChannelizerConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		serverState.mu.Lock()
+		serverState.Channelizer = cfg
+		serverState.mu.Unlock()
+		go broadcastJSON(channelizerMessage())
+	}
+	json.NewEncoder(w).Encode(channelizerMessage())
+}
+
+// channelizerMessage describes the configuration and, when enabled, the
+// sub-channels
+func channelizerMessage() map[string]interface{} {
+	serverState.mu.RLock()
+	cfg := serverState.Channelizer
+	serverState.mu.RUnlock()
+	cfg.Validate() // Show the defaults before the first configuration
+	msg := map[string]interface{}{"type": "channelizer", "config": cfg}
+	if c := currentChannelizer(); c != nil {
+		msg["channelizer"] = c.info()
+	}
+	return msg
+}
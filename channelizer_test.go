@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestChannelizerTone puts a tone at a sub-channel center and checks that
+// it keeps its amplitude there and is rejected by the other sub-channels
+func TestChannelizerTone(t *testing.T) {
+	cfg := ChannelizerConfig{SubChannels: 8}
+	c, err := newPolyphaseChannelizer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.outputs(c.inputs(100)); got != 100 {
+		t.Fatalf("outputs(inputs(100)) = %d", got)
+	}
+
+	// Sub-channel 6 is centered at +2 spacings
+	const amp = 8000.0
+	n := c.inputs(512)
+	i, q := make([]int16, n), make([]int16, n)
+	for s := range i {
+		phase := 2 * math.Pi * 2 / 8 * float64(s)
+		i[s], q[s] = clampInt16(amp*math.Cos(phase)), clampInt16(amp*math.Sin(phase))
+	}
+	subI, subQ := c.channelize(i, q, nil)
+	if len(subI) != 8 || len(subI[0]) != 512 {
+		t.Fatalf("got %d sub-channels of %d samples", len(subI), len(subI[0]))
+	}
+
+	level := func(k int) float64 {
+		sum := 0.0
+		for s := range subI[k] {
+			sum += float64(subI[k][s])*float64(subI[k][s]) + float64(subQ[k][s])*float64(subQ[k][s])
+		}
+		return 10 * math.Log10(sum/float64(len(subI[k]))/(amp*amp)+1e-20)
+	}
+	if db := level(6); math.Abs(db) > 0.1 {
+		t.Errorf("tone sub-channel level %.3f dB, want 0", db)
+	}
+	for _, k := range []int{0, 1, 2, 3, 4} {
+		if db := level(k); db > -80 {
+			t.Errorf("sub-channel %d leaks %.1f dB", k, db)
+		}
+	}
+	if center := c.info().SubChannels[6].CenterHz; center != 2*captureSampleRate/8 {
+		t.Errorf("sub-channel 6 center %.0f Hz", center)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -13,7 +14,7 @@ import (
 )
 
 // runCLI executes the one-shot capture and file save
-func runCLI(devicePath string, targetSize int, outputFilename string, configFile string, channels string, benchMode bool) {
+func runCLI(devicePath string, engines []dma.EngineConfig, targetSize int, outputFilename string, configFile string, channels string, benchMode bool, align bool) {
 	fmt.Println("--- DMA Capture Session Start ---")
 
 	// Parse channels
@@ -57,17 +58,42 @@ func runCLI(devicePath string, targetSize int, outputFilename string, configFile
 	}
 
 	fmt.Printf("Device: %s | Target: %d bytes | Channels: %v\n", devicePath, targetSize, activeChannelIndices)
+	if len(engines) > 1 {
+		for _, e := range engines {
+			fmt.Printf("  Engine %s -> channels %v\n", e.DevicePath, e.Channels)
+		}
+	}
 	if benchMode {
 		fmt.Println(">>> BENCHMARK MODE ACTIVE (Looping) <<<")
 	}
 
+	// Convert internal 0-7 indices to user-facing 1-8 for metadata
+	outputChannels := make([]int, len(activeChannelIndices))
+	for i, ch := range activeChannelIndices {
+		outputChannels[i] = ch + 1
+	}
+
+	var aligner *channelAligner
+	var delays *ChannelDelays
+	if align {
+		if delays = unitDelays(); delays == nil {
+			log.Fatalf("No stored delays for unit %s; measure them with /api/delay/estimate", unitName)
+		}
+		aligner = slotAligner(delays, outputChannels)
+		fmt.Printf("Aligning channels to reference %d (%d samples trimmed)\n", delays.Reference, aligner.margin)
+	}
+
 	for {
+		// Start-of-capture state (config, PSU reading, etc.)
+		metadata := newCaptureMetadata(outputChannels)
+
 		fmt.Println(">>> CAPTURING...")
 
 		cfg := dma.CaptureConfig{
 			DevicePath:  devicePath,
 			TargetSize:  targetSize,
 			ChannelMask: activeMask,
+			Engines:     engines,
 		}
 
 		result, err := dma.RunCapture(cfg)
@@ -75,15 +101,29 @@ func runCLI(devicePath string, targetSize int, outputFilename string, configFile
 			log.Fatalf("Capture failed: %v", err)
 		}
 
-		// Aligned flag is false for filtered captures in dma.RunCapture
-		if result.Aligned {
-			// ...
+		metadata.ADC = adcFrameStats(result.Data, outputChannels, currentADCConfig())
+		if aligner != nil {
+			result.Data = aligner.alignFrames(result.Data)
+			metadata.Alignment = alignmentInfo(delays, outputChannels, aligner.lead, aligner.margin)
 		}
 
 		fmt.Println("--- Results ---")
 		fmt.Printf("Total Read:     %d bytes\n", result.BytesRead)
 		fmt.Printf("Throughput:     %.2f MB/s\n", result.Throughput)
 		fmt.Printf("Duration:       %v\n", result.Duration)
+		if len(result.Engines) > 1 {
+			rawTotal := 0
+			for _, e := range result.Engines {
+				rawTotal += e.BytesRead
+			}
+			for _, e := range result.Engines {
+				share := 0.0
+				if rawTotal > 0 {
+					share = 100 * float64(e.BytesRead) / float64(rawTotal)
+				}
+				fmt.Printf("  %-20s %d bytes, %.2f MB/s (%.1f%%)\n", e.DevicePath, e.BytesRead, e.Throughput, share)
+			}
+		}
 
 		if outputFilename != "" {
 			fmt.Printf(">>> SAVING TO FILE: %s ... ", outputFilename)
@@ -100,34 +140,16 @@ func runCLI(devicePath string, targetSize int, outputFilename string, configFile
 				fmt.Printf("Save Throughput: %.2f MB/s\n", throughput)
 
 				// Save Metadata
-				metaFilename := strings.TrimSuffix(outputFilename, ".bin") 
-				if metaFilename == outputFilename {
-					metaFilename += ".json"
-				} else {
-					metaFilename += ".json"
-				}
-				
-				var currentConfig *HardwareConfig
-				if hwController != nil {
-					currentConfig = hwController.GetConfig()
-				}
-
-				// Convert internal 0-7 indices to user-facing 1-8 for metadata
-				outputChannels := make([]int, len(activeChannelIndices))
-				for i, ch := range activeChannelIndices {
-					outputChannels[i] = ch + 1
+				rawBytes := 0
+				for _, e := range result.Engines {
+					rawBytes += e.BytesRead
 				}
+				const bytesPerSample = 4
+				samples := int64(len(result.Data) / (len(outputChannels) * bytesPerSample))
+				metadata.finishCapture(samples, result.Duration, rawBytes)
 
-				metadata := CaptureMetadata{
-					Timestamp:  time.Now().Format(time.RFC3339),
-					SampleRate: 244400000,
-					Channels:   outputChannels,
-					Config:     currentConfig,
-				}
-
-				if metaBytes, err := json.MarshalIndent(metadata, "", "  "); err == nil {
-					os.WriteFile(metaFilename, metaBytes, 0644)
-					fmt.Printf("Metadata saved to: %s\n", metaFilename)
+				if err := writeCaptureMetadata(outputFilename, metadata); err == nil {
+					fmt.Printf("Metadata saved to: %s\n", metadataPath(outputFilename))
 				}
 			}
 		} else {
@@ -143,3 +165,60 @@ func runCLI(devicePath string, targetSize int, outputFilename string, configFile
 		fmt.Println("\n--- Restarting Capture (Benchmark) ---")
 	}
 }
+
+// runConvertCLI converts a recording (or part of one) to another sample format
+func runConvertCLI(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	input := fs.String("i", "", "Input recording (.bin)")
+	output := fs.String("o", "", "Output file (default: <input>_<format>.<ext>)")
+	format := fs.String("format", FormatCF32, "Output format: cf32, cs16, cs8 (dithered) or real (int16 I only)")
+	start := fs.Int64("start", 0, "First sample to convert")
+	count := fs.Int64("n", 0, "Number of samples to convert (0 = to end)")
+	channels := fs.String("channels", "", "Comma-separated channels (1-8) to export (default: all in recording)")
+	align := fs.Bool("align", false, "Correct the unit's stored inter-channel delays")
+	unit := fs.String("unit", "", "Unit name for stored calibration (default: host name)")
+	fs.Parse(args)
+	initUnitName(*unit)
+
+	if *input == "" {
+		log.Fatal("Error: -i input recording is required")
+	}
+
+	opts := ExportOptions{
+		Format:      strings.ToLower(*format),
+		StartSample: *start,
+		Samples:     *count,
+		Align:       *align,
+	}
+	for _, p := range strings.Split(*channels, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		ch, err := strconv.Atoi(p)
+		if err != nil || ch < 1 || ch > 8 {
+			log.Fatalf("Error: invalid channel %q", p)
+		}
+		opts.Channels = append(opts.Channels, ch)
+	}
+
+	if _, ok := formatExtensions[opts.Format]; !ok {
+		log.Fatalf("Error: unsupported format %q", opts.Format)
+	}
+	outPath := *output
+	if outPath == "" {
+		outPath = strings.TrimSuffix(*input, ".bin") + "_" + opts.Format
+	}
+	outPath = exportPath(outPath, opts.Format)
+
+	fmt.Printf(">>> CONVERTING %s -> %s (%s)\n", *input, outPath, opts.Format)
+	convertStart := time.Now()
+	meta, err := convertRecording(*input, outPath, opts)
+	if err != nil {
+		log.Fatalf("Conversion failed: %v", err)
+	}
+	fmt.Printf("Samples:        %d (from %d)\n", meta.Samples, meta.StartSample)
+	fmt.Printf("Channels:       %v\n", meta.Channels)
+	fmt.Printf("Duration:       %v\n", time.Since(convertStart))
+	fmt.Printf("Metadata saved to: %s\n", metadataPath(outPath))
+}
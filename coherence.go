@@ -0,0 +1,629 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+	"path/filepath"
+	"time"
+)
+
+// Coherence measurement modes
+const (
+	CoherenceTone = "tone" // At one tone, e.g. the CAL_EN calibration tone
+	CoherenceBand = "band" // Per bin across a band
+)
+
+// toneHalfWidth is the number of bins either side of a tone's peak that are
+// summed, so window scalloping doesn't bias the amplitude
+const toneHalfWidth = 2
+
+// CoherenceOptions configures the inter-channel amplitude and phase
+// measurement. Frequencies are offsets in Hz from the tuned (DC) frequency.
+type CoherenceOptions struct {
+	Reference   int      `json:"reference"`    // Reference channel (1-8), default 1
+	Channels    []int    `json:"channels"`     // Channels compared with the reference; empty = all available
+	Mode        string   `json:"mode"`         // tone (default) or band
+	ToneHz      *float64 `json:"tone_hz"`      // Tone mode; nil = strongest bin of the reference
+	BandLowHz   float64  `json:"band_low_hz"`  // Band mode range; both 0 = whole band
+	BandHighHz  float64  `json:"band_high_hz"` //
+	FFTSize     int      `json:"fft_size"`     // Default 1024; live data uses the stream's FFT size
+	Window      string   `json:"window"`       // See fft.ParseWindow, default blackman
+	WindowParam float64  `json:"window_param"` // Kaiser beta or Gaussian sigma
+	Averages    int      `json:"averages"`     // FFTs (live: frames) per result, default 10
+
+	// Recording source; empty Filename means live data
+	Filename        string `json:"filename,omitempty"`
+	StartSample     int64  `json:"start_sample,omitempty"`
+	IntervalSamples int64  `json:"interval_samples,omitempty"` // Between FFT starts; 0 = contiguous. Larger spreads FFTs out to show slow drift
+}
+
+// Validate checks the options, fills in defaults and returns the spectrum options
+func (o *CoherenceOptions) Validate() (SpectrumOptions, error) {
+	if o.Reference == 0 {
+		o.Reference = 1
+	}
+	if o.Reference < 1 || o.Reference > maxChannel {
+		return SpectrumOptions{}, fmt.Errorf("reference must be between 1 and %d", maxChannel)
+	}
+	for _, ch := range o.Channels {
+		if ch < 1 || ch > maxChannel {
+			return SpectrumOptions{}, fmt.Errorf("channel must be between 1 and %d", maxChannel)
+		}
+	}
+	switch o.Mode {
+	case "":
+		o.Mode = CoherenceTone
+	case CoherenceTone, CoherenceBand:
+	default:
+		return SpectrumOptions{}, fmt.Errorf("unknown mode %q (want tone or band)", o.Mode)
+	}
+	if o.ToneHz != nil && math.Abs(*o.ToneHz) > captureSampleRate/2 {
+		return SpectrumOptions{}, fmt.Errorf("tone_hz is outside the captured band")
+	}
+	if o.BandHighHz < o.BandLowHz {
+		return SpectrumOptions{}, fmt.Errorf("band_high_hz must be above band_low_hz")
+	}
+	if o.FFTSize == 0 {
+		o.FFTSize = 1024
+	}
+	if o.Averages == 0 {
+		o.Averages = 10
+	}
+	if o.Averages < 1 || o.IntervalSamples < 0 {
+		return SpectrumOptions{}, fmt.Errorf("averages and interval_samples must be positive")
+	}
+	if o.Filename != "" {
+		o.Filename = filepath.Base(o.Filename)
+	}
+	opts, err := parseSpectrumOptions(o.FFTSize, o.Window, o.WindowParam, ScalingTone)
+	if err != nil {
+		return SpectrumOptions{}, err
+	}
+	o.Window, o.WindowParam = string(opts.Window.Kind), opts.Window.Param
+	return opts, nil
+}
+
+// compared returns the channels measured against the reference, given the
+// channels available in the source
+func (o *CoherenceOptions) compared(available []int) []int {
+	channels := o.Channels
+	if len(channels) == 0 {
+		channels = available
+	}
+	var out []int
+	for _, ch := range channels {
+		if ch != o.Reference {
+			out = append(out, ch)
+		}
+	}
+	return out
+}
+
+// ChannelCoherence is one channel relative to the reference. Amplitude and
+// phase come from the averaged cross-spectrum; the spread figures come from
+// the per-FFT estimates and show how stable the relationship is over time.
+type ChannelCoherence struct {
+	Channel        int     `json:"channel"`
+	AmplitudeDB    float64 `json:"amplitude_db"` // Channel power relative to the reference
+	PhaseDeg       float64 `json:"phase_deg"`    // Channel phase minus reference phase, -180 to 180
+	Coherence      float64 `json:"coherence"`    // Magnitude-squared coherence, 0-1
+	AmplitudeStdDB float64 `json:"amplitude_std_db"`
+	AmplitudeP2PDB float64 `json:"amplitude_p2p_db"`
+	PhaseStdDeg    float64 `json:"phase_std_deg"` // Circular standard deviation
+	PhaseP2PDeg    float64 `json:"phase_p2p_deg"`
+
+	// Live subscriptions: change since the first result
+	AmplitudeDriftDB *float64 `json:"amplitude_drift_db,omitempty"`
+	PhaseDriftDeg    *float64 `json:"phase_drift_deg,omitempty"`
+
+	// Band mode: per-bin values at the result's frequencies_hz
+	BinAmplitudeDB []float64 `json:"bin_amplitude_db,omitempty"`
+	BinPhaseDeg    []float64 `json:"bin_phase_deg,omitempty"`
+	BinCoherence   []float64 `json:"bin_coherence,omitempty"`
+}
+
+// CoherenceResult is one inter-channel measurement
+type CoherenceResult struct {
+	Source          string             `json:"source"` // "live" or the recording filename
+	Time            time.Time          `json:"time"`
+	FFTSize         int                `json:"fft_size"`
+	Averages        int                `json:"averages"`
+	RBWHz           float64            `json:"rbw_hz"`
+	Reference       int                `json:"reference"`
+	ReferenceDBm    float64            `json:"reference_dbm"`              // Reference power at the tone or in the band
+	ToneHz          *float64           `json:"tone_hz,omitempty"`          // Tone measured (tone mode)
+	FrequenciesHz   []float64          `json:"frequencies_hz,omitempty"`   // Bin centers (band mode)
+	CalibrationMode *bool              `json:"calibration_mode,omitempty"` // CAL_EN when known
+	Options         CoherenceOptions   `json:"options"`
+	Channels        []ChannelCoherence `json:"channels"`
+}
+
+// coherenceAccumulator averages cross-spectra against the reference and
+// keeps per-FFT estimates over the measured bins
+type coherenceAccumulator struct {
+	o        *CoherenceOptions
+	fftSize  int
+	binHz    float64
+	channels []int
+	lo, hi   int // Measured bins, inclusive
+	count    int
+
+	refPower []float64            // Reference |X|^2 per bin
+	power    map[int][]float64    // Channel |X|^2 per bin
+	cross    map[int][]complex128 // Channel X * conj(reference X) per bin
+	perFFT   map[int][]complex128 // Summed cross term per FFT
+	ratioDB  map[int][]float64    // Power ratio per FFT
+}
+
+func newCoherenceAccumulator(o *CoherenceOptions, fftSize int, channels []int) *coherenceAccumulator {
+	a := &coherenceAccumulator{
+		o:        o,
+		fftSize:  fftSize,
+		binHz:    float64(captureSampleRate) / float64(fftSize),
+		channels: channels,
+		lo:       -1,
+		refPower: make([]float64, fftSize),
+		power:    make(map[int][]float64),
+		cross:    make(map[int][]complex128),
+		perFFT:   make(map[int][]complex128),
+		ratioDB:  make(map[int][]float64),
+	}
+	for _, ch := range channels {
+		a.power[ch] = make([]float64, fftSize)
+		a.cross[ch] = make([]complex128, fftSize)
+	}
+	return a
+}
+
+// bin returns the DC-centered bin nearest an offset frequency
+func (a *coherenceAccumulator) bin(hz float64) int {
+	b := int(math.Round(hz/a.binHz)) + a.fftSize/2
+	if b < 0 {
+		b = 0
+	}
+	if b >= a.fftSize {
+		b = a.fftSize - 1
+	}
+	return b
+}
+
+// selectBins picks the measured bins from the first reference spectrum
+func (a *coherenceAccumulator) selectBins(ref []complex128) {
+	if a.o.Mode == CoherenceBand {
+		a.lo, a.hi = 0, a.fftSize-1
+		if a.o.BandLowHz != 0 || a.o.BandHighHz != 0 {
+			a.lo, a.hi = a.bin(a.o.BandLowHz), a.bin(a.o.BandHighHz)
+		}
+		return
+	}
+
+	peak := a.fftSize / 2
+	if a.o.ToneHz != nil {
+		peak = a.bin(*a.o.ToneHz)
+	} else {
+		// Strongest bin, skipping DC where offset would otherwise win
+		best := -1.0
+		for k, v := range ref {
+			if p := real(v)*real(v) + imag(v)*imag(v); k != a.fftSize/2 && p > best {
+				best, peak = p, k
+			}
+		}
+	}
+	a.lo, a.hi = peak-toneHalfWidth, peak+toneHalfWidth
+	if a.lo < 0 {
+		a.lo = 0
+	}
+	if a.hi >= a.fftSize {
+		a.hi = a.fftSize - 1
+	}
+}
+
+// add folds in one FFT per channel, keyed by user-facing channel (1-8)
+func (a *coherenceAccumulator) add(spectra map[int][]complex128) {
+	ref := spectra[a.o.Reference]
+	if a.lo < 0 {
+		a.selectBins(ref)
+	}
+	a.count++
+	refSum := 0.0
+	for k := a.lo; k <= a.hi; k++ {
+		p := real(ref[k])*real(ref[k]) + imag(ref[k])*imag(ref[k])
+		a.refPower[k] += p
+		refSum += p
+	}
+	for _, ch := range a.channels {
+		x := spectra[ch]
+		power, cross := a.power[ch], a.cross[ch]
+		var c complex128
+		chSum := 0.0
+		for k := a.lo; k <= a.hi; k++ {
+			p := real(x[k])*real(x[k]) + imag(x[k])*imag(x[k])
+			xy := x[k] * cmplx.Conj(ref[k])
+			power[k] += p
+			cross[k] += xy
+			c += xy
+			chSum += p
+		}
+		a.perFFT[ch] = append(a.perFFT[ch], c)
+		a.ratioDB[ch] = append(a.ratioDB[ch], powerToDBm(chSum)-powerToDBm(refSum))
+	}
+}
+
+// result builds the measurement from everything added so far
+func (a *coherenceAccumulator) result(opts SpectrumOptions, source string) (*CoherenceResult, error) {
+	info, err := windowInfo(opts)
+	if err != nil {
+		return nil, err
+	}
+	res := &CoherenceResult{
+		Source:    source,
+		Time:      time.Now(),
+		FFTSize:   a.fftSize,
+		Averages:  a.count,
+		RBWHz:     info.RBWHz,
+		Reference: a.o.Reference,
+		Options:   *a.o,
+	}
+	res.Options.FFTSize = a.fftSize
+
+	refSum := 0.0
+	for k := a.lo; k <= a.hi; k++ {
+		refSum += a.refPower[k]
+	}
+	res.ReferenceDBm = powerToDBm(refSum / float64(a.count))
+
+	if a.o.Mode == CoherenceBand {
+		for k := a.lo; k <= a.hi; k++ {
+			res.FrequenciesHz = append(res.FrequenciesHz, float64(k-a.fftSize/2)*a.binHz)
+		}
+	} else {
+		// Report the power-weighted center of the measured bins
+		weighted := 0.0
+		for k := a.lo; k <= a.hi; k++ {
+			weighted += a.refPower[k] * float64(k-a.fftSize/2) * a.binHz
+		}
+		tone := 0.0
+		if refSum > 0 {
+			tone = weighted / refSum
+		}
+		res.ToneHz = &tone
+	}
+
+	for _, ch := range a.channels {
+		res.Channels = append(res.Channels, a.channelResult(ch))
+	}
+	return res, nil
+}
+
+func (a *coherenceAccumulator) channelResult(ch int) ChannelCoherence {
+	c := ChannelCoherence{Channel: ch}
+	power, cross := a.power[ch], a.cross[ch]
+
+	var sumCross complex128
+	sumPower, sumRef := 0.0, 0.0
+	weightedCoh, weights := 0.0, 0.0
+	for k := a.lo; k <= a.hi; k++ {
+		sumCross += cross[k]
+		sumPower += power[k]
+		sumRef += a.refPower[k]
+
+		coh := 0.0
+		if power[k] > 0 && a.refPower[k] > 0 {
+			coh = real(cross[k])*real(cross[k]) + imag(cross[k])*imag(cross[k])
+			coh /= power[k] * a.refPower[k]
+		}
+		if a.o.Mode == CoherenceBand {
+			c.BinAmplitudeDB = append(c.BinAmplitudeDB, powerToDBm(power[k])-powerToDBm(a.refPower[k]))
+			c.BinPhaseDeg = append(c.BinPhaseDeg, cmplx.Phase(cross[k])*180/math.Pi)
+			c.BinCoherence = append(c.BinCoherence, coh)
+		}
+		w := math.Sqrt(power[k] * a.refPower[k])
+		weightedCoh += coh * w
+		weights += w
+	}
+
+	c.AmplitudeDB = powerToDBm(sumPower) - powerToDBm(sumRef)
+	c.PhaseDeg = cmplx.Phase(sumCross) * 180 / math.Pi
+	if a.o.Mode == CoherenceBand {
+		if weights > 0 {
+			c.Coherence = weightedCoh / weights
+		}
+	} else if sumPower > 0 && sumRef > 0 {
+		c.Coherence = real(sumCross)*real(sumCross) + imag(sumCross)*imag(sumCross)
+		c.Coherence /= sumPower * sumRef
+	}
+
+	c.AmplitudeStdDB, c.AmplitudeP2PDB = spread(a.ratioDB[ch])
+	c.PhaseStdDeg, c.PhaseP2PDeg = phaseSpread(a.perFFT[ch])
+	return c
+}
+
+// spread returns the standard deviation and peak-to-peak range of values
+func spread(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+	mean, lo, hi := 0.0, values[0], values[0]
+	for _, v := range values {
+		mean += v
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	mean /= float64(len(values))
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(variance / float64(len(values))), hi - lo
+}
+
+// phaseSpread returns the circular standard deviation and peak-to-peak range
+// in degrees of the phases of values, measured around their mean direction
+func phaseSpread(values []complex128) (float64, float64) {
+	var mean complex128
+	n := 0
+	for _, v := range values {
+		if m := cmplx.Abs(v); m > 0 {
+			mean += v / complex(m, 0)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	mean /= complex(float64(n), 0)
+	r := cmplx.Abs(mean)
+	std := 180.0
+	if r > 0 {
+		std = math.Sqrt(math.Max(0, -2*math.Log(r))) * 180 / math.Pi
+	}
+
+	lo, hi := 0.0, 0.0
+	for _, v := range values {
+		if cmplx.Abs(v) > 0 {
+			d := cmplx.Phase(v*cmplx.Conj(mean)) * 180 / math.Pi
+			lo, hi = math.Min(lo, d), math.Max(hi, d)
+		}
+	}
+	return std, hi - lo
+}
+
+// coherenceRecording measures a recording. FFTs start every IntervalSamples
+// from StartSample (contiguous by default).
+func coherenceRecording(o *CoherenceOptions) (*CoherenceResult, error) {
+	opts, err := o.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the reference along with the compared channels
+	path := filepath.Join(dataFolder, o.Filename)
+	meta, _ := loadCaptureMetadata(path)
+	available := []int{1, 2, 3, 4, 5, 6, 7, 8}
+	if meta != nil && len(meta.Channels) > 0 {
+		available = meta.Channels
+	}
+	compared := o.compared(available)
+	if len(compared) == 0 {
+		return nil, fmt.Errorf("no channels to compare with reference %d", o.Reference)
+	}
+	r, err := openRecording(path, append([]int{o.Reference}, compared...))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	interval := o.IntervalSamples
+	if interval < int64(opts.FFTSize) {
+		interval = int64(opts.FFTSize)
+	}
+	acc := newCoherenceAccumulator(o, opts.FFTSize, compared)
+	spectra := make(map[int][]complex128)
+	for _, ch := range r.channels {
+		spectra[ch] = make([]complex128, opts.FFTSize)
+	}
+	for n := 0; n < o.Averages; n++ {
+		start := o.StartSample + int64(n)*interval
+		if start+int64(opts.FFTSize) > r.Frames() {
+			break
+		}
+		if err := r.SeekFrame(start); err != nil {
+			return nil, err
+		}
+		if _, err := r.Read(opts.FFTSize); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		for k, ch := range r.channels {
+			chOpts := opts
+			chOpts.Cal = r.powerCurve(ch)
+			if err := computeComplexSpectrumInto(spectra[ch], r.I[k], r.Q[k], chOpts); err != nil {
+				return nil, err
+			}
+		}
+		acc.add(spectra)
+	}
+	if acc.count == 0 {
+		return nil, fmt.Errorf("recording has fewer than %d samples after sample %d", opts.FFTSize, o.StartSample)
+	}
+
+	res, err := acc.result(opts, o.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil && meta.Config != nil {
+		res.CalibrationMode = meta.Config.Calibration
+	}
+	return res, nil
+}
+
+// coherenceLive measures the next Averages stream frames, one FFT per frame
+func coherenceLive(o *CoherenceOptions) (*CoherenceResult, error) {
+	if _, err := o.Validate(); err != nil {
+		return nil, err
+	}
+	compared := o.compared([]int{1, 2, 3, 4, 5, 6, 7, 8})
+	if len(compared) == 0 {
+		return nil, fmt.Errorf("no channels to compare with reference %d", o.Reference)
+	}
+
+	var acc *coherenceAccumulator
+	var opts SpectrumOptions
+	err := forEachLiveFrame(o.Averages, func(frame liveFrame) error {
+		if acc == nil {
+			var err error
+			if opts, err = parseSpectrumOptions(frame.fftSize, o.Window, o.WindowParam, ScalingTone); err != nil {
+				return err
+			}
+			acc = newCoherenceAccumulator(o, frame.fftSize, compared)
+		} else if frame.fftSize != acc.fftSize {
+			return fmt.Errorf("stream FFT size changed during measurement")
+		}
+		spectra, err := liveComplexSpectra(frame, append([]int{o.Reference}, compared...), opts)
+		if err != nil {
+			return err
+		}
+		acc.add(spectra)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := acc.result(opts, "live")
+	if err != nil {
+		return nil, err
+	}
+	res.CalibrationMode = liveCalibrationMode()
+	return res, nil
+}
+
+// liveComplexSpectra computes complex spectra of a stream frame for
+// user-facing channels (1-16), each with its power calibration
+func liveComplexSpectra(frame liveFrame, channels []int, opts SpectrumOptions) (map[int][]complex128, error) {
+	spectra := make(map[int][]complex128)
+	for _, ch := range channels {
+		i, q, err := frame.channel(ch)
+		if err != nil {
+			return nil, err
+		}
+		x := make([]complex128, opts.FFTSize)
+		chOpts := opts
+		chOpts.Cal = frame.powerCurve(ch)
+		if err := computeComplexSpectrumInto(x, i, q, chOpts); err != nil {
+			return nil, err
+		}
+		spectra[ch] = x
+	}
+	return spectra, nil
+}
+
+// liveCalibrationMode reports CAL_EN when the hardware is connected
+func liveCalibrationMode() *bool {
+	serverState.mu.RLock()
+	hwAvailable, replay := serverState.HardwareAvailable, serverState.ReplayMode
+	serverState.mu.RUnlock()
+	if !hwAvailable || replay || hwController == nil {
+		return nil
+	}
+	cal, err := hwController.GetParameter(CAL_EN)
+	if err != nil {
+		return nil
+	}
+	enabled := cal == 1
+	return &enabled
+}
+
+// clientCoherence is a client's live coherence subscription. A result is
+// sent every Averages frames; drift is measured from the first result.
+type clientCoherence struct {
+	opts     CoherenceOptions
+	acc      *coherenceAccumulator
+	spectrum SpectrumOptions
+	first    map[int]ChannelCoherence
+}
+
+// update folds in one frame and returns a message when a result is due.
+// Caller holds the client lock.
+func (cc *clientCoherence) update(frame liveFrame, available []int) (map[string]interface{}, error) {
+	compared := cc.opts.compared(available)
+	if len(compared) == 0 {
+		return nil, nil
+	}
+	if cc.acc == nil || cc.acc.fftSize != frame.fftSize || len(cc.acc.channels) != len(compared) {
+		opts, err := parseSpectrumOptions(frame.fftSize, cc.opts.Window, cc.opts.WindowParam, ScalingTone)
+		if err != nil {
+			return nil, err
+		}
+		if cc.acc != nil && cc.acc.fftSize != frame.fftSize {
+			cc.first = nil
+		}
+		cc.spectrum = opts
+		cc.acc = newCoherenceAccumulator(&cc.opts, frame.fftSize, compared)
+	}
+	spectra, err := liveComplexSpectra(frame, append([]int{cc.opts.Reference}, compared...), cc.spectrum)
+	if err != nil {
+		return nil, err
+	}
+	cc.acc.add(spectra)
+	if cc.acc.count < cc.opts.Averages {
+		return nil, nil
+	}
+
+	res, err := cc.acc.result(cc.spectrum, "live")
+	cc.acc = nil
+	if err != nil {
+		return nil, err
+	}
+	if cc.first == nil {
+		cc.first = make(map[int]ChannelCoherence)
+	}
+	for i := range res.Channels {
+		c := &res.Channels[i]
+		first, ok := cc.first[c.Channel]
+		if !ok {
+			cc.first[c.Channel] = *c
+			first = *c
+		}
+		ampDrift := c.AmplitudeDB - first.AmplitudeDB
+		phaseDrift := math.Remainder(c.PhaseDeg-first.PhaseDeg, 360)
+		c.AmplitudeDriftDB, c.PhaseDriftDeg = &ampDrift, &phaseDrift
+	}
+	res.CalibrationMode = liveCalibrationMode()
+	return map[string]interface{}{"type": "coherence", "coherence": res}, nil
+}
+
+// startClientCoherence replaces the client's coherence subscription. nil
+// stops it; with a filename the recording is measured once in the
+// background and the result sent to the client.
+func startClientCoherence(client *Client, o *CoherenceOptions) error {
+	if o == nil {
+		client.mu.Lock()
+		client.coherence = nil
+		client.mu.Unlock()
+		return nil
+	}
+	if _, err := o.Validate(); err != nil {
+		return err
+	}
+	if o.Filename != "" {
+		go func() {
+			var msg map[string]interface{}
+			if res, err := coherenceRecording(o); err != nil {
+				msg = map[string]interface{}{"type": "coherence_error", "error": err.Error()}
+			} else {
+				msg = map[string]interface{}{"type": "coherence", "coherence": res}
+			}
+			sendToClient(client, msg, nil)
+		}()
+		return nil
+	}
+
+	client.mu.Lock()
+	client.coherence = &clientCoherence{opts: *o}
+	client.mu.Unlock()
+	return nil
+}
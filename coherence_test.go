@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestCoherenceTone checks relative amplitude and phase of a tone seen on
+// two channels with independent noise
+func TestCoherenceTone(t *testing.T) {
+	const n = 1024
+	o := CoherenceOptions{Reference: 1, Channels: []int{2}, Window: "hann"}
+	opts, err := o.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	tone := func(amp, phase float64, start int) ([]int16, []int16) {
+		i, q := make([]int16, n), make([]int16, n)
+		for k := range i {
+			ph := 2*math.Pi*50.4*float64(k+start)/n + phase
+			i[k] = int16(math.Round(amp*math.Cos(ph) + rng.NormFloat64()*20))
+			q[k] = int16(math.Round(amp*math.Sin(ph) + rng.NormFloat64()*20))
+		}
+		return i, q
+	}
+
+	acc := newCoherenceAccumulator(&o, n, []int{2})
+	for f := 0; f < 20; f++ {
+		spectra := map[int][]complex128{1: make([]complex128, n), 2: make([]complex128, n)}
+		i1, q1 := tone(8000, 0, f*n)
+		i2, q2 := tone(4000, 30*math.Pi/180, f*n)
+		computeComplexSpectrumInto(spectra[1], i1, q1, opts)
+		computeComplexSpectrumInto(spectra[2], i2, q2, opts)
+		acc.add(spectra)
+	}
+	res, err := acc.result(opts, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := res.Channels[0]
+	if math.Abs(c.AmplitudeDB+6.02) > 0.05 {
+		t.Errorf("amplitude %.3f dB, want -6.02", c.AmplitudeDB)
+	}
+	if math.Abs(c.PhaseDeg-30) > 0.5 {
+		t.Errorf("phase %.2f deg, want 30", c.PhaseDeg)
+	}
+	if c.Coherence < 0.99 || c.PhaseStdDeg > 1 {
+		t.Errorf("coherence %.4f, phase std %.2f deg; want a stable, coherent pair", c.Coherence, c.PhaseStdDeg)
+	}
+	if want := 50.4 * captureSampleRate / n; math.Abs(*res.ToneHz-want) > captureSampleRate/n/4 {
+		t.Errorf("tone at %.0f Hz, want about %.0f", *res.ToneHz, want)
+	}
+}
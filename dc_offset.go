@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DCOffset is one receiver channel's tracked DC offset in ADC codes
+type DCOffset struct {
+	Channel   int     `json:"channel"`
+	I         float64 `json:"i"`
+	Q         float64 `json:"q"`
+	Magnitude float64 `json:"magnitude"`
+}
+
+// DCRemovalInfo records in capture metadata whether DC offsets were removed
+type DCRemovalInfo struct {
+	Applied        bool       `json:"applied"`
+	TimeConstantS  float64    `json:"time_constant_s,omitempty"`
+	InitialOffsets []DCOffset `json:"initial_offsets,omitempty"` // Live estimate the recording started from
+}
+
+// dcTracker follows each receiver channel's DC offset with a first-order
+// average. Each block moves the estimate by 1 - exp(-dt/τ), where dt is the
+// time the block stands for.
+type dcTracker struct {
+	tau     float64
+	offsets [8]complex128
+	primed  [8]bool
+}
+
+// update folds in one block of a channel covering dt seconds
+func (t *dcTracker) update(ch int, i, q []int16, dt float64) {
+	if len(i) == 0 {
+		return
+	}
+	var sumI, sumQ float64
+	for s := range i {
+		sumI += float64(i[s])
+		sumQ += float64(q[s])
+	}
+	mean := complex(sumI/float64(len(i)), sumQ/float64(len(i)))
+	if !t.primed[ch] {
+		t.offsets[ch], t.primed[ch] = mean, true
+		return
+	}
+	alpha := 1 - math.Exp(-dt/t.tau)
+	t.offsets[ch] += complex(alpha, 0) * (mean - t.offsets[ch])
+}
+
+// report lists the offsets of the channels seen so far
+func (t *dcTracker) report() []DCOffset {
+	out := []DCOffset{}
+	for ch, o := range t.offsets {
+		if t.primed[ch] {
+			out = append(out, DCOffset{Channel: ch + 1, I: real(o), Q: imag(o), Magnitude: math.Hypot(real(o), imag(o))})
+		}
+	}
+	return out
+}
+
+// liveDC tracks the offsets of streamed data
+var liveDC = struct {
+	mu      sync.Mutex
+	tracker dcTracker
+	last    time.Time
+}{tracker: dcTracker{tau: 1}}
+
+// trackLiveDC updates the live offsets from a stream frame and returns the
+// frame with them removed when removal is on. The input slices are not
+// modified.
+func trackLiveDC(channelI, channelQ [][]int16) ([][]int16, [][]int16) {
+	serverState.mu.RLock()
+	enabled := serverState.DCRemoval
+	serverState.mu.RUnlock()
+
+	liveDC.mu.Lock()
+	now := time.Now()
+	dt := now.Sub(liveDC.last).Seconds()
+	liveDC.last = now
+	for ch := 0; ch < 8 && ch < len(channelI); ch++ {
+		liveDC.tracker.update(ch, channelI[ch], channelQ[ch], dt)
+	}
+	offsets := liveDC.tracker.offsets
+	liveDC.mu.Unlock()
+
+	if !enabled {
+		return channelI, channelQ
+	}
+	return removeDC(channelI, channelQ, offsets)
+}
+
+// removeLiveDC removes the live offsets without updating them, for
+// consumers that read the same data as the stream by another path
+func removeLiveDC(channelI, channelQ [][]int16) ([][]int16, [][]int16) {
+	serverState.mu.RLock()
+	enabled := serverState.DCRemoval
+	serverState.mu.RUnlock()
+	if !enabled {
+		return channelI, channelQ
+	}
+	liveDC.mu.Lock()
+	offsets := liveDC.tracker.offsets
+	liveDC.mu.Unlock()
+	return removeDC(channelI, channelQ, offsets)
+}
+
+// removeDC subtracts the offsets from the receiver channels into new slices
+func removeDC(channelI, channelQ [][]int16, offsets [8]complex128) ([][]int16, [][]int16) {
+	outI := append([][]int16(nil), channelI...)
+	outQ := append([][]int16(nil), channelQ...)
+	for ch := 0; ch < 8 && ch < len(channelI); ch++ {
+		outI[ch], outQ[ch] = make([]int16, len(channelI[ch])), make([]int16, len(channelQ[ch]))
+		for s := range outI[ch] {
+			outI[ch][s] = clampInt16(float64(channelI[ch][s]) - real(offsets[ch]))
+			outQ[ch][s] = clampInt16(float64(channelQ[ch][s]) - imag(offsets[ch]))
+		}
+	}
+	return outI, outQ
+}
+
+// recordingDCTracker returns a copy of the live tracker to seed a
+// recording, or nil when recordings are not corrected
+func recordingDCTracker() *dcTracker {
+	serverState.mu.RLock()
+	enabled := serverState.DCRemoval && serverState.DCRemoveRecordings
+	serverState.mu.RUnlock()
+	if !enabled {
+		return nil
+	}
+	liveDC.mu.Lock()
+	t := liveDC.tracker
+	liveDC.mu.Unlock()
+	return &t
+}
+
+// removeDCFrames tracks and removes DC offsets in place on raw 8-channel
+// frames, one block at a time
+func removeDCFrames(data []byte, t *dcTracker) {
+	const frameSize, block = 32, 8192
+	i, q := make([]int16, block), make([]int16, block)
+	for start := 0; start < len(data)/frameSize; start += block {
+		frames := len(data)/frameSize - start
+		if frames > block {
+			frames = block
+		}
+		for ch := 0; ch < 8; ch++ {
+			for s := 0; s < frames; s++ {
+				p := (start+s)*frameSize + ch*4
+				i[s] = int16(binary.LittleEndian.Uint16(data[p:]))
+				q[s] = int16(binary.LittleEndian.Uint16(data[p+2:]))
+			}
+			t.update(ch, i[:frames], q[:frames], float64(frames)/captureSampleRate)
+			o := t.offsets[ch]
+			for s := 0; s < frames; s++ {
+				p := (start+s)*frameSize + ch*4
+				binary.LittleEndian.PutUint16(data[p:], uint16(clampInt16(float64(i[s])-real(o))))
+				binary.LittleEndian.PutUint16(data[p+2:], uint16(clampInt16(float64(q[s])-imag(o))))
+			}
+		}
+	}
+}
+
+// handleDC gets the tracked offsets or configures DC removal
+func handleDC(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req struct {
+			Enabled       *bool    `json:"enabled"`
+			TimeConstantS *float64 `json:"time_constant_s"`
+			Recordings    *bool    `json:"recordings"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if req.TimeConstantS != nil {
+			if *req.TimeConstantS <= 0 {
+				http.Error(w, "time_constant_s must be positive", 400)
+				return
+			}
+			liveDC.mu.Lock()
+			liveDC.tracker.tau = *req.TimeConstantS
+			liveDC.mu.Unlock()
+		}
+		serverState.mu.Lock()
+		if req.Enabled != nil {
+			serverState.DCRemoval = *req.Enabled
+		}
+		if req.Recordings != nil {
+			serverState.DCRemoveRecordings = *req.Recordings
+		}
+		serverState.mu.Unlock()
+	}
+	json.NewEncoder(w).Encode(dcMessage())
+}
+
+// dcMessage describes DC removal and the tracked offsets
+func dcMessage() map[string]interface{} {
+	serverState.mu.RLock()
+	enabled, recordings := serverState.DCRemoval, serverState.DCRemoveRecordings
+	serverState.mu.RUnlock()
+	liveDC.mu.Lock()
+	tau, offsets := liveDC.tracker.tau, liveDC.tracker.report()
+	liveDC.mu.Unlock()
+	return map[string]interface{}{
+		"type":            "dc",
+		"enabled":         enabled,
+		"time_constant_s": tau,
+		"recordings":      recordings,
+		"offsets":         offsets,
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// TestDCRemoval tracks a DC step through raw frames and checks the offset
+// follows it with the time constant and is removed from the data
+func TestDCRemoval(t *testing.T) {
+	const block, blocks = 8192, 16
+	frames := block * blocks
+	data := make([]byte, frames*32)
+	dc := func(s int) (float64, float64) {
+		if s < frames/2 {
+			return 37, -12
+		}
+		return -20, 50
+	}
+	for s := 0; s < frames; s++ {
+		ph := 2 * math.Pi * 100 * float64(s) / block // Whole cycles per block
+		di, dq := dc(s)
+		for ch := 0; ch < 8; ch++ {
+			p := s*32 + ch*4
+			binary.LittleEndian.PutUint16(data[p:], uint16(clampInt16(di+1000*math.Cos(ph))))
+			binary.LittleEndian.PutUint16(data[p+2:], uint16(clampInt16(dq+1000*math.Sin(ph))))
+		}
+	}
+
+	// The step is 4 time constants before the end
+	tr := &dcTracker{tau: float64(frames/2) / 4 / captureSampleRate}
+	removeDCFrames(data, tr)
+
+	step := complex(-20, 50) - complex(37, -12)
+	want := complex(-20, 50) - step*complex(math.Exp(-4), 0)
+	for _, o := range tr.report() {
+		if math.Abs(o.I-real(want)) > 0.5 || math.Abs(o.Q-imag(want)) > 0.5 {
+			t.Errorf("channel %d offset %.2f%+.2fj, want %.2f%+.2fj", o.Channel, o.I, o.Q, real(want), imag(want))
+		}
+	}
+
+	// The first half, tracked from its first block, has its DC removed
+	var sumI, sumQ float64
+	for s := 0; s < frames/2; s++ {
+		sumI += float64(int16(binary.LittleEndian.Uint16(data[s*32:])))
+		sumQ += float64(int16(binary.LittleEndian.Uint16(data[s*32+2:])))
+	}
+	if mi, mq := sumI/float64(frames/2), sumQ/float64(frames/2); math.Hypot(mi, mq) > 0.5 {
+		t.Errorf("residual DC %.2f%+.2fj before the step", mi, mq)
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dma/pkg/fft"
+)
+
+// delayCalibrationFile holds a unit's measured inter-channel delays
+const delayCalibrationFile = "delays.json"
+
+// ChannelDelay is one channel's delay relative to the reference channel.
+// Positive delays lag the reference.
+type ChannelDelay struct {
+	Channel      int     `json:"channel"`
+	DelaySamples float64 `json:"delay_samples"`
+	DelayNs      float64 `json:"delay_ns"`
+	Integer      int     `json:"integer"`               // Correlation peak lag
+	Fraction     float64 `json:"fraction"`              // Refinement (±0.5) from the interpolated correlation peak
+	Correlation  float64 `json:"correlation,omitempty"` // Normalized peak (0-1) once the delay is removed
+}
+
+// ChannelDelays is a set of delays as stored for a unit
+type ChannelDelays struct {
+	Unit      string         `json:"unit"`
+	Time      time.Time      `json:"time"`
+	Reference int            `json:"reference"`
+	Source    string         `json:"source"`
+	Channels  []ChannelDelay `json:"channels"`
+}
+
+// delays returns each receiver channel index's delay (0-7); channels
+// without a measurement are not shifted relative to the reference
+func (d *ChannelDelays) delays() []float64 {
+	out := make([]float64, 8)
+	for _, c := range d.Channels {
+		if c.Channel >= 1 && c.Channel <= 8 {
+			out[c.Channel-1] = c.DelaySamples
+		}
+	}
+	return out
+}
+
+// AlignmentInfo records in capture metadata the delays the channels were
+// aligned with
+type AlignmentInfo struct {
+	Applied   bool           `json:"applied"`
+	Reference int            `json:"reference,omitempty"`
+	Delays    []ChannelDelay `json:"delays,omitempty"`
+	// Input sample of each channel that output sample 0 was taken from
+	LeadSamples []float64 `json:"lead_samples,omitempty"`
+	// Samples dropped at the end, needed by the shifts and filter
+	TrimmedSamples int `json:"trimmed_samples,omitempty"`
+}
+
+// storedDelays caches this unit's delays, loaded on first use
+var storedDelays struct {
+	mu      sync.Mutex
+	loaded  bool
+	delays  *ChannelDelays
+	aligner *channelAligner // Built for all 8 receiver channels
+}
+
+// loadStoredDelays returns the unit's delays; the caller holds storedDelays.mu
+func loadStoredDelays() *ChannelDelays {
+	if !storedDelays.loaded {
+		storedDelays.loaded = true
+		if data, err := os.ReadFile(unitCalibrationPath(delayCalibrationFile)); err == nil {
+			var d ChannelDelays
+			if json.Unmarshal(data, &d) == nil {
+				storedDelays.delays = &d
+				storedDelays.aligner = newChannelAligner(d.delays())
+			}
+		}
+	}
+	return storedDelays.delays
+}
+
+// unitDelays returns the stored delays, or nil
+func unitDelays() *ChannelDelays {
+	storedDelays.mu.Lock()
+	defer storedDelays.mu.Unlock()
+	return loadStoredDelays()
+}
+
+// saveUnitDelays merges measured channels into the stored delays. Delays
+// measured against a different reference replace the set.
+func saveUnitDelays(d *ChannelDelays) error {
+	storedDelays.mu.Lock()
+	defer storedDelays.mu.Unlock()
+
+	merged := *d
+	if old := loadStoredDelays(); old != nil && old.Reference == d.Reference {
+		byChannel := make(map[int]ChannelDelay)
+		for _, c := range old.Channels {
+			byChannel[c.Channel] = c
+		}
+		for _, c := range d.Channels {
+			byChannel[c.Channel] = c
+		}
+		merged.Channels = nil
+		for _, c := range byChannel {
+			merged.Channels = append(merged.Channels, c)
+		}
+		sort.Slice(merged.Channels, func(i, j int) bool { return merged.Channels[i].Channel < merged.Channels[j].Channel })
+	}
+
+	data, _ := json.MarshalIndent(merged, "", "  ")
+	path := unitCalibrationPath(delayCalibrationFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	storedDelays.delays = &merged
+	storedDelays.aligner = newChannelAligner(merged.delays())
+	return nil
+}
+
+// currentAligner returns the aligner for live data and recordings, or nil
+// when alignment is off or no delays are stored
+func currentAligner() (*channelAligner, *ChannelDelays) {
+	serverState.mu.RLock()
+	enabled := serverState.Alignment
+	serverState.mu.RUnlock()
+	if !enabled {
+		return nil, nil
+	}
+	storedDelays.mu.Lock()
+	defer storedDelays.mu.Unlock()
+	d := loadStoredDelays()
+	if d == nil {
+		return nil, nil
+	}
+	return storedDelays.aligner, d
+}
+
+// alignmentMargin is the number of extra samples the stream reads so
+// aligned frames keep their length
+func alignmentMargin() int {
+	if a, _ := currentAligner(); a != nil {
+		return a.margin
+	}
+	return 0
+}
+
+// alignmentInfo describes an applied alignment for capture metadata.
+// leads are the aligner's lead samples of the given channels, in order.
+func alignmentInfo(d *ChannelDelays, channels []int, leads []float64, trimmed int) *AlignmentInfo {
+	info := &AlignmentInfo{Applied: true, Reference: d.Reference, LeadSamples: leads, TrimmedSamples: trimmed}
+	for _, ch := range channels {
+		for _, c := range d.Channels {
+			if c.Channel == ch {
+				info.Delays = append(info.Delays, c)
+			}
+		}
+	}
+	return info
+}
+
+// slotAligner builds an aligner for frames holding the given channels,
+// using the stored delays; beam channels are not shifted
+func slotAligner(d *ChannelDelays, channels []int) *channelAligner {
+	all := d.delays()
+	delays := make([]float64, len(channels))
+	for slot, ch := range channels {
+		if ch >= 1 && ch <= 8 {
+			delays[slot] = all[ch-1]
+		}
+	}
+	return newChannelAligner(delays)
+}
+
+// DelayOptions configures inter-channel delay estimation
+type DelayOptions struct {
+	Reference int   `json:"reference"` // Reference channel, default 1
+	Channels  []int `json:"channels"`  // Receiver channels (1-8); empty = all
+	FFTSize   int   `json:"fft_size"`  // Block size; default 8192, live data uses the stream's FFT size
+	Averages  int   `json:"averages"`  // Blocks whose cross-spectra are summed, default 16
+	MaxLag    int   `json:"max_lag"`   // Largest integer lag searched; default fft_size/4
+
+	Save bool `json:"save,omitempty"` // Store the delays for the unit
+
+	// Recording source; empty Filename means live data
+	Filename    string `json:"filename,omitempty"`
+	StartSample int64  `json:"start_sample,omitempty"`
+}
+
+// Validate checks the options and fills in defaults
+func (o *DelayOptions) Validate() (SpectrumOptions, error) {
+	if o.Reference == 0 {
+		o.Reference = 1
+	}
+	if len(o.Channels) == 0 {
+		o.Channels = []int{1, 2, 3, 4, 5, 6, 7, 8}
+	}
+	for _, ch := range append([]int{o.Reference}, o.Channels...) {
+		if ch < 1 || ch > 8 {
+			return SpectrumOptions{}, fmt.Errorf("channel must be between 1 and 8")
+		}
+	}
+	if o.FFTSize == 0 {
+		o.FFTSize = 8192
+	}
+	if o.Averages == 0 {
+		o.Averages = 16
+	}
+	if o.Averages < 1 || o.MaxLag < 0 {
+		return SpectrumOptions{}, fmt.Errorf("averages and max_lag must be positive")
+	}
+	if o.Filename != "" {
+		o.Filename = filepath.Base(o.Filename)
+	}
+	return parseSpectrumOptions(o.FFTSize, "hann", 0, ScalingTone)
+}
+
+// DelayResult is one estimation across channels
+type DelayResult struct {
+	Source    string         `json:"source"` // "live" or the recording filename
+	Time      time.Time      `json:"time"`
+	Reference int            `json:"reference"`
+	Unit      string         `json:"unit"`
+	FFTSize   int            `json:"fft_size"`
+	Averages  int            `json:"averages"`
+	Aligned   bool           `json:"aligned"` // Data was already aligned; results are residual
+	Saved     bool           `json:"saved"`
+	Channels  []ChannelDelay `json:"channels"`
+}
+
+// delayAccumulator sums each channel's cross-spectrum with the reference
+type delayAccumulator struct {
+	cross map[int][]complex128
+	power map[int]float64
+	count int
+}
+
+func newDelayAccumulator() *delayAccumulator {
+	return &delayAccumulator{cross: make(map[int][]complex128), power: make(map[int]float64)}
+}
+
+// add folds in one block of DC-centered spectra keyed by channel
+func (a *delayAccumulator) add(spectra map[int][]complex128, reference int) {
+	ref := spectra[reference]
+	for ch, x := range spectra {
+		c := a.cross[ch]
+		if c == nil {
+			c = make([]complex128, len(x))
+			a.cross[ch] = c
+		}
+		p := 0.0
+		for k := range x {
+			c[k] += x[k] * cmplx.Conj(ref[k])
+			p += real(x[k])*real(x[k]) + imag(x[k])*imag(x[k])
+		}
+		a.power[ch] += p
+	}
+	a.count++
+}
+
+// estimate finds a channel's delay: the integer lag is the peak of the
+// cross-correlation, the fraction the peak of the correlation interpolated
+// between lag-1/2 and lag+1/2
+func (a *delayAccumulator) estimate(ch, reference, maxLag int) ChannelDelay {
+	if ch == reference {
+		return ChannelDelay{Channel: ch, Correlation: 1}
+	}
+	c := a.cross[ch]
+	n := len(c)
+	half := n / 2
+
+	// Cross-spectrum in natural FFT order, then correlation
+	natural := make([]complex128, n)
+	for j, v := range c {
+		natural[(j-half+n)%n] = v
+	}
+	corr := make([]complex128, n)
+	fft.PlanFor(n).Inverse(corr, natural)
+	lag, best := 0, -1.0
+	for idx, v := range corr {
+		l := idx
+		if l >= half {
+			l -= n
+		}
+		if abs(l) <= maxLag && cmplx.Abs(v) > best {
+			lag, best = l, cmplx.Abs(v)
+		}
+	}
+
+	// Correlation at a fractional lag is the cross-spectrum summed with that
+	// delay removed; a golden-section search finds its peak
+	at := func(d float64) complex128 {
+		var sum complex128
+		for j, v := range c {
+			k := float64(j - half)
+			sum += v * cmplx.Rect(1, 2*math.Pi*k*d/float64(n))
+		}
+		return sum
+	}
+	const golden = 0.6180339887498949
+	lo, hi := float64(lag)-0.5, float64(lag)+0.5
+	x1, x2 := hi-golden*(hi-lo), lo+golden*(hi-lo)
+	f1, f2 := cmplx.Abs(at(x1)), cmplx.Abs(at(x2))
+	for hi-lo > 1e-4 {
+		if f1 > f2 {
+			hi, x2, f2 = x2, x1, f1
+			x1 = hi - golden*(hi-lo)
+			f1 = cmplx.Abs(at(x1))
+		} else {
+			lo, x1, f1 = x1, x2, f2
+			x2 = lo + golden*(hi-lo)
+			f2 = cmplx.Abs(at(x2))
+		}
+	}
+	delay := (lo + hi) / 2
+	frac := delay - float64(lag)
+	sum := at(delay)
+	norm := math.Sqrt(a.power[ch] * a.power[reference])
+
+	d := ChannelDelay{Channel: ch, Integer: lag, Fraction: frac, DelaySamples: float64(lag) + frac}
+	d.DelayNs = d.DelaySamples / captureSampleRate * 1e9
+	if norm > 0 {
+		d.Correlation = cmplx.Abs(sum) / norm
+	}
+	return d
+}
+
+// newDelayResult estimates every channel and saves the delays if requested
+func newDelayResult(o *DelayOptions, opts SpectrumOptions, source string, aligned bool, acc *delayAccumulator) (*DelayResult, error) {
+	maxLag := o.MaxLag
+	if maxLag == 0 || maxLag >= opts.FFTSize/2 {
+		maxLag = opts.FFTSize / 4
+	}
+	res := &DelayResult{Source: source, Time: time.Now(), Reference: o.Reference, Unit: unitName, FFTSize: opts.FFTSize, Averages: acc.count, Aligned: aligned}
+	for _, ch := range o.Channels {
+		if _, ok := acc.cross[ch]; ok {
+			res.Channels = append(res.Channels, acc.estimate(ch, o.Reference, maxLag))
+		}
+	}
+	if o.Save {
+		if aligned {
+			return nil, fmt.Errorf("the data is already aligned; disable alignment to measure delays to save")
+		}
+		d := &ChannelDelays{Unit: unitName, Time: res.Time, Reference: o.Reference, Source: source, Channels: res.Channels}
+		if err := saveUnitDelays(d); err != nil {
+			return nil, err
+		}
+		res.Saved = true
+	}
+	return res, nil
+}
+
+// delayChannels is the set of channels read: the reference plus the others
+func (o *DelayOptions) delayChannels() []int {
+	channels := []int{o.Reference}
+	for _, ch := range o.Channels {
+		if ch != o.Reference {
+			channels = append(channels, ch)
+		}
+	}
+	return channels
+}
+
+// estimateDelaysRecording estimates delays over Averages blocks of a
+// recording starting at StartSample
+func estimateDelaysRecording(o *DelayOptions) (*DelayResult, error) {
+	opts, err := o.Validate()
+	if err != nil {
+		return nil, err
+	}
+	r, err := openRecording(filepath.Join(dataFolder, o.Filename), o.delayChannels())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := r.SeekFrame(o.StartSample); err != nil {
+		return nil, err
+	}
+
+	acc := newDelayAccumulator()
+	for n := 0; n < o.Averages; n++ {
+		got, err := r.Read(opts.FFTSize)
+		if err == io.EOF || got < opts.FFTSize {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		spectra := make(map[int][]complex128)
+		for k, ch := range r.channels {
+			x := make([]complex128, opts.FFTSize)
+			if err := computeComplexSpectrumInto(x, r.I[k], r.Q[k], opts); err != nil {
+				return nil, err
+			}
+			spectra[ch] = x
+		}
+		acc.add(spectra, o.Reference)
+	}
+	if acc.count == 0 {
+		return nil, fmt.Errorf("recording has fewer than %d samples after sample %d", opts.FFTSize, o.StartSample)
+	}
+	aligned := r.meta.Alignment != nil && r.meta.Alignment.Applied
+	return newDelayResult(o, opts, o.Filename, aligned, acc)
+}
+
+// estimateDelaysLive estimates delays over the next Averages stream frames
+func estimateDelaysLive(o *DelayOptions) (*DelayResult, error) {
+	if _, err := o.Validate(); err != nil {
+		return nil, err
+	}
+	a, _ := currentAligner()
+
+	var opts SpectrumOptions
+	acc := newDelayAccumulator()
+	err := forEachLiveFrame(o.Averages, func(frame liveFrame) error {
+		if opts.FFTSize == 0 {
+			var err error
+			if opts, err = parseSpectrumOptions(frame.fftSize, "hann", 0, ScalingTone); err != nil {
+				return err
+			}
+		} else if frame.fftSize != opts.FFTSize {
+			return fmt.Errorf("stream FFT size changed during estimation")
+		}
+		spectra := make(map[int][]complex128)
+		for _, ch := range o.delayChannels() {
+			i, q, err := frame.channel(ch)
+			if err != nil {
+				return err
+			}
+			x := make([]complex128, opts.FFTSize)
+			if err := computeComplexSpectrumInto(x, i, q, opts); err != nil {
+				return err
+			}
+			spectra[ch] = x
+		}
+		acc.add(spectra, o.Reference)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newDelayResult(o, opts, "live", a != nil, acc)
+}
+
+// handleDelayEstimate estimates inter-channel delays. POST a DelayOptions
+// body; with a filename the recording is used, otherwise live frames.
+func handleDelayEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var o DelayOptions
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+
+	var res *DelayResult
+	var err error
+	if o.Filename != "" {
+		res, err = estimateDelaysRecording(&o)
+	} else {
+		res, err = estimateDelaysLive(&o)
+	}
+	if err != nil {
+		http.Error(w, "Estimation failed: "+err.Error(), 400)
+		return
+	}
+	if res.Saved {
+		go broadcastJSON(alignmentMessage())
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleAlignment gets or sets whether stored delays are corrected in
+// streamed and recorded data
+func handleAlignment(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		serverState.mu.Lock()
+		serverState.Alignment = req.Enabled
+		serverState.mu.Unlock()
+		go broadcastJSON(alignmentMessage())
+	}
+	json.NewEncoder(w).Encode(alignmentMessage())
+}
+
+// alignmentMessage describes the alignment state and the stored delays
+func alignmentMessage() map[string]interface{} {
+	serverState.mu.RLock()
+	enabled := serverState.Alignment
+	serverState.mu.RUnlock()
+	d := unitDelays()
+	return map[string]interface{}{
+		"type":    "alignment",
+		"enabled": enabled,
+		"applied": enabled && d != nil,
+		"unit":    unitName,
+		"delays":  d,
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+
+	"github.com/dma/pkg/fft"
+)
+
+// TestDelayAlignment estimates known fractional delays on band-limited
+// noise and checks that aligning the channels removes them
+func TestDelayAlignment(t *testing.T) {
+	const n, blocks, total = 4096, 16, 1 << 17
+	delays := []float64{0, 5.3, -2}
+
+	// Band-limited noise, delayed per channel by a phase ramp
+	rng := rand.New(rand.NewSource(1))
+	spectrum := make([]complex128, total)
+	for k := range spectrum {
+		f := float64(k)
+		if k >= total/2 {
+			f -= total
+		}
+		if math.Abs(f) < 0.4*total {
+			spectrum[k] = complex(rng.NormFloat64(), rng.NormFloat64())
+		}
+	}
+	channelI, channelQ := make([][]int16, len(delays)), make([][]int16, len(delays))
+	for ch, d := range delays {
+		shifted := make([]complex128, total)
+		for k, v := range spectrum {
+			f := float64(k)
+			if k >= total/2 {
+				f -= total
+			}
+			shifted[k] = v * cmplx.Rect(1, -2*math.Pi*f*d/total)
+		}
+		x := make([]complex128, total)
+		fft.PlanFor(total).Inverse(x, shifted)
+		channelI[ch], channelQ[ch] = make([]int16, total), make([]int16, total)
+		for s, v := range x {
+			channelI[ch][s], channelQ[ch][s] = clampInt16(real(v)*2e5), clampInt16(imag(v)*2e5)
+		}
+	}
+
+	estimate := func(channelI, channelQ [][]int16) []ChannelDelay {
+		o := DelayOptions{FFTSize: n, Averages: blocks, Channels: []int{2, 3}}
+		opts, err := o.Validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		acc := newDelayAccumulator()
+		for b := 0; b < blocks; b++ {
+			spectra := make(map[int][]complex128)
+			for k := range channelI {
+				x := make([]complex128, n)
+				if err := computeComplexSpectrumInto(x, channelI[k][b*n:], channelQ[k][b*n:], opts); err != nil {
+					t.Fatal(err)
+				}
+				spectra[k+1] = x
+			}
+			acc.add(spectra, 1)
+		}
+		res, err := newDelayResult(&o, opts, "test", false, acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Channels
+	}
+
+	for _, d := range estimate(channelI, channelQ) {
+		if want := delays[d.Channel-1]; math.Abs(d.DelaySamples-want) > 0.02 {
+			t.Errorf("channel %d delay %.3f samples, want %.3f", d.Channel, d.DelaySamples, want)
+		}
+		if d.Correlation < 0.95 {
+			t.Errorf("channel %d correlation %.3f, want above 0.95", d.Channel, d.Correlation)
+		}
+	}
+
+	alignedI, alignedQ := newChannelAligner(delays).alignChannels(channelI, channelQ)
+	for _, d := range estimate(alignedI, alignedQ) {
+		if math.Abs(d.DelaySamples) > 0.02 {
+			t.Errorf("channel %d residual delay %.3f samples after alignment", d.Channel, d.DelaySamples)
+		}
+	}
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DemodAM   = "am"
+	DemodNBFM = "nbfm"
+	DemodWBFM = "wbfm"
+	DemodUSB  = "usb"
+	DemodLSB  = "lsb"
+
+	audioSampleRate  = 48000
+	audioFrameMarker = 0xF2
+
+	demodTick      = 20 * time.Millisecond  // Source time demodulated per pass
+	demodMaxChunk  = 50 * time.Millisecond  // Source time beyond this is skipped when behind
+	demodStatusGap = 500 * time.Millisecond // Between demod_status messages
+	demodNCOScale  = 1 << 10                // NCO table amplitude; keeps the CIC inside int64
+	demodCICOrder  = 3
+	demodFIRDecim  = 4 // Second stage decimation to the IF rate
+)
+
+// DemodConfig tunes the demodulator. Changing the squelch or volume doesn't
+// restart it.
+type DemodConfig struct {
+	Enabled      bool    `json:"enabled"`
+	Channel      int     `json:"channel"`       // Receiver channel (1-8), default 1
+	OffsetHz     float64 `json:"offset_hz"`     // Tuning offset from DC
+	Mode         string  `json:"mode"`          // am, nbfm (default), wbfm, usb or lsb
+	BandwidthHz  float64 `json:"bandwidth_hz"`  // Pre-demodulation filter, default per mode
+	SquelchDBFS  float64 `json:"squelch_dbfs"`  // Mute while the filtered channel is below this; 0 = open
+	Volume       float64 `json:"volume"`        // Linear audio gain (0-4), default 1
+	DeemphasisUS float64 `json:"deemphasis_us"` // FM de-emphasis time constant, default 75 for wbfm, -1 = off
+}
+
+// demodDefaults holds the default bandwidth, the IF rate the filtered
+// channel is decimated to and the widest allowed bandwidth of each mode
+var demodDefaults = map[string]struct{ bandwidth, ifRate, maxBandwidth float64 }{
+	DemodAM:   {10e3, 96e3, 76e3},
+	DemodNBFM: {12.5e3, 96e3, 76e3},
+	DemodWBFM: {200e3, 384e3, 300e3},
+	DemodUSB:  {2.8e3, 96e3, 38e3},
+	DemodLSB:  {2.8e3, 96e3, 38e3},
+}
+
+// Validate checks the configuration and fills in defaults
+func (c *DemodConfig) Validate() error {
+	if c.Channel == 0 {
+		c.Channel = 1
+	}
+	if c.Channel < 1 || c.Channel > 8 {
+		return fmt.Errorf("channel must be a receiver channel (1-8)")
+	}
+	if c.Mode == "" {
+		c.Mode = DemodNBFM
+	}
+	def, ok := demodDefaults[c.Mode]
+	if !ok {
+		return fmt.Errorf("unknown mode %q (want am, nbfm, wbfm, usb or lsb)", c.Mode)
+	}
+	if c.BandwidthHz == 0 {
+		c.BandwidthHz = def.bandwidth
+	}
+	if c.BandwidthHz < 100 || c.BandwidthHz > def.maxBandwidth {
+		return fmt.Errorf("bandwidth_hz must be between 100 and %.0f for %s", def.maxBandwidth, c.Mode)
+	}
+	if math.Abs(c.OffsetHz)+c.BandwidthHz/2 > captureSampleRate/2 {
+		return fmt.Errorf("offset_hz puts the channel outside the %.0f Hz band", float64(captureSampleRate))
+	}
+	if c.SquelchDBFS > 0 {
+		return fmt.Errorf("squelch_dbfs must be negative (0 = open)")
+	}
+	if c.Volume == 0 {
+		c.Volume = 1
+	}
+	if c.Volume < 0 || c.Volume > 4 {
+		return fmt.Errorf("volume must be between 0 and 4")
+	}
+	if c.DeemphasisUS == 0 && c.Mode == DemodWBFM {
+		c.DeemphasisUS = 75
+	}
+	if c.DeemphasisUS < 0 {
+		c.DeemphasisUS = -1
+	}
+	return nil
+}
+
+// design returns the settings that need a new demodulator when changed
+func (c DemodConfig) design() DemodConfig {
+	c.Enabled, c.SquelchDBFS, c.Volume = false, 0, 0
+	return c
+}
+
+// lowpassTaps designs a Blackman windowed-sinc low-pass with unity DC gain;
+// cutoff is relative to the sample rate
+func lowpassTaps(n int, cutoff float64) []float64 {
+	taps := make([]float64, n)
+	sum := 0.0
+	for k := range taps {
+		t := float64(k) - float64(n-1)/2
+		sinc := 2 * cutoff
+		if t != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*t) / (math.Pi * t)
+		}
+		x := 2 * math.Pi * float64(k) / float64(n-1)
+		taps[k] = sinc * (0.42 - 0.5*math.Cos(x) + 0.08*math.Cos(2*x))
+		sum += taps[k]
+	}
+	for k := range taps {
+		taps[k] /= sum
+	}
+	return taps
+}
+
+// demodulator turns contiguous samples of one channel into 48 kHz audio:
+// NCO tuning, a CIC and an FIR decimator down to the IF rate, the
+// demodulator, an audio low-pass and a linear resampler. State carries
+// across calls.
+type demodulator struct {
+	cfg    DemodConfig
+	r1     int     // CIC decimation
+	ifRate float64 // After the FIR decimator
+
+	nco, ncoStep uint32
+	cosTab       [1024]int64
+	sinTab       [1024]int64
+	integ, comb  [demodCICOrder][2]int64
+	cicCount     int
+	cicGain      float64
+
+	chanTaps []float64
+	chanHist []complex128 // Doubled so the filter reads one contiguous window
+	chanPos  int
+	firCount int
+
+	ssb     complex128 // Shifts the centered sideband back to audio
+	ssbStep complex128
+	prev    complex128 // FM discriminator
+	deemph  float64
+	deAlpha float64
+	carrier float64 // AM carrier level
+	dcAlpha float64 // AM carrier and SSB AGC decay
+	agc     float64 // SSB envelope
+
+	audioTaps []float64
+	audioHist []float64
+	audioPos  int
+	resT      float64
+	resStep   float64
+	resPrev   float64
+
+	power float64 // Filtered channel power, for the level and squelch
+	count int
+}
+
+func newDemodulator(cfg DemodConfig) *demodulator {
+	def := demodDefaults[cfg.Mode]
+	d := &demodulator{cfg: cfg}
+	total := int(math.Round(captureSampleRate / def.ifRate))
+	d.r1 = total / demodFIRDecim
+	rate1 := captureSampleRate / float64(d.r1)
+	d.ifRate = rate1 / demodFIRDecim
+	d.cicGain = 1 / (math.Pow(float64(d.r1), demodCICOrder) * demodNCOScale)
+
+	// SSB centers the wanted sideband in the channel filter
+	tune := cfg.OffsetHz
+	switch cfg.Mode {
+	case DemodUSB:
+		tune += cfg.BandwidthHz / 2
+	case DemodLSB:
+		tune -= cfg.BandwidthHz / 2
+	}
+	d.ncoStep = uint32(int64(math.Round(tune / captureSampleRate * (1 << 32))))
+	for k := range d.cosTab {
+		s, c := math.Sincos(2 * math.Pi * float64(k) / float64(len(d.cosTab)))
+		d.cosTab[k], d.sinTab[k] = int64(math.Round(c*demodNCOScale)), int64(math.Round(s*demodNCOScale))
+	}
+
+	d.chanTaps = lowpassTaps(16*demodFIRDecim+1, cfg.BandwidthHz/2/rate1)
+	d.chanHist = make([]complex128, 2*len(d.chanTaps))
+	d.ssb = 1
+	d.ssbStep = cmplx.Rect(1, 2*math.Pi*(tune-cfg.OffsetHz)/d.ifRate)
+	if cfg.DeemphasisUS > 0 {
+		d.deAlpha = 1 - math.Exp(-1/(d.ifRate*cfg.DeemphasisUS*1e-6))
+	}
+	d.dcAlpha = 1 - math.Exp(-2*math.Pi*50/d.ifRate)
+
+	cutoff := cfg.BandwidthHz / 2
+	switch cfg.Mode {
+	case DemodUSB, DemodLSB:
+		cutoff = cfg.BandwidthHz
+	case DemodWBFM:
+		cutoff = 15e3
+	}
+	cutoff = math.Min(cutoff, 16e3)
+	n := int(math.Ceil(5.5*d.ifRate/(audioSampleRate/2-cutoff))) | 1
+	d.audioTaps = lowpassTaps(n, cutoff/d.ifRate)
+	d.audioHist = make([]float64, 2*n)
+	d.resStep = d.ifRate / audioSampleRate
+	return d
+}
+
+// process demodulates contiguous samples and returns the audio and the
+// filtered channel level in dBFS
+func (d *demodulator) process(i, q []int16) ([]int16, float64) {
+	audio := make([]int16, 0, int(float64(len(i))/float64(d.r1*demodFIRDecim)/d.resStep)+2)
+	d.power, d.count = 0, 0
+
+	// The order-3 CIC is unrolled into locals; this loop runs at the full
+	// capture rate
+	nco, step, count := d.nco, d.ncoStep, d.cicCount
+	i1, q1, i2, q2, i3, q3 := d.integ[0][0], d.integ[0][1], d.integ[1][0], d.integ[1][1], d.integ[2][0], d.integ[2][1]
+	for s := range i {
+		idx := nco >> 22
+		nco += step
+		c, sn := d.cosTab[idx&1023], d.sinTab[idx&1023]
+		x, y := int64(i[s]), int64(q[s])
+		i1 += x*c + y*sn // Multiplied by exp(-jθ)
+		q1 += y*c - x*sn
+		i2 += i1
+		q2 += q1
+		i3 += i2
+		q3 += q2
+		if count++; count < d.r1 {
+			continue
+		}
+		count = 0
+		vi, vq := i3, q3
+		for k := 0; k < demodCICOrder; k++ {
+			vi, d.comb[k][0] = vi-d.comb[k][0], vi
+			vq, d.comb[k][1] = vq-d.comb[k][1], vq
+		}
+		audio = d.channelSample(complex(float64(vi)*d.cicGain, float64(vq)*d.cicGain), audio)
+	}
+	d.nco, d.cicCount = nco, count
+	d.integ = [demodCICOrder][2]int64{{i1, q1}, {i2, q2}, {i3, q3}}
+	level := -150.0
+	if d.count > 0 && d.power > 0 {
+		level = 10 * math.Log10(d.power/float64(d.count)/(fullScaleAmplitude*fullScaleAmplitude))
+	}
+	return audio, level
+}
+
+// channelSample runs the channel filter on one CIC output, and the rest of
+// the chain on every demodFIRDecim-th
+func (d *demodulator) channelSample(x complex128, audio []int16) []int16 {
+	n := len(d.chanTaps)
+	d.chanHist[d.chanPos], d.chanHist[d.chanPos+n] = x, x
+	d.chanPos = (d.chanPos + 1) % n
+	if d.firCount++; d.firCount < demodFIRDecim {
+		return audio
+	}
+	d.firCount = 0
+	var v complex128
+	for k, h := range d.chanTaps {
+		v += complex(h, 0) * d.chanHist[d.chanPos+k]
+	}
+	d.power += real(v)*real(v) + imag(v)*imag(v)
+	d.count++
+
+	var a float64
+	switch d.cfg.Mode {
+	case DemodAM:
+		env := cmplx.Abs(v)
+		if d.carrier == 0 {
+			d.carrier = env
+		}
+		d.carrier += d.dcAlpha * (env - d.carrier)
+		if d.carrier > 0 {
+			a = (env - d.carrier) / d.carrier
+		}
+	case DemodNBFM, DemodWBFM:
+		deviation := 75e3
+		if d.cfg.Mode == DemodNBFM {
+			deviation = d.cfg.BandwidthHz / 4
+		}
+		a = cmplx.Phase(v*cmplx.Conj(d.prev)) * d.ifRate / (2 * math.Pi * deviation)
+		d.prev = v
+		if d.deAlpha > 0 {
+			d.deemph += d.deAlpha * (a - d.deemph)
+			a = d.deemph
+		}
+	default:
+		d.ssb *= d.ssbStep
+		d.ssb /= complex(cmplx.Abs(d.ssb), 0)
+		s := v * d.ssb
+		env := cmplx.Abs(s)
+		if env > d.agc {
+			d.agc = env
+		} else {
+			d.agc -= d.dcAlpha * (d.agc - env)
+		}
+		if d.agc > 0 {
+			a = real(s) / d.agc
+		}
+	}
+
+	m := len(d.audioTaps)
+	d.audioHist[d.audioPos], d.audioHist[d.audioPos+m] = a, a
+	d.audioPos = (d.audioPos + 1) % m
+	var y float64
+	for k, h := range d.audioTaps {
+		y += h * d.audioHist[d.audioPos+k]
+	}
+
+	// Linear interpolation between the previous and this IF sample
+	for ; d.resT < 1; d.resT += d.resStep {
+		out := d.resPrev + (y-d.resPrev)*d.resT
+		audio = append(audio, clampInt16(out*0.5*32767*d.cfg.Volume))
+	}
+	d.resT--
+	d.resPrev = y
+	return audio
+}
+
+// demodReader supplies contiguous samples of one receiver channel
+type demodReader interface {
+	// read returns up to n new samples; fewer when the source has no more yet
+	read(ch, n int) ([]int16, []int16)
+	close()
+}
+
+// replayReader plays the replay buffer at the real-time rate, looping at
+// the end
+type replayReader struct {
+	data      []byte
+	blockSize int
+	offsets   map[int]int // Channel index -> offset within a frame
+	pos       int
+}
+
+func newReplayReader(data []byte, channels []int, offset int) *replayReader {
+	r := &replayReader{data: data, blockSize: 32, offsets: make(map[int]int)}
+	if len(channels) > 0 {
+		r.blockSize = len(channels) * 4
+		for k, ch := range channels {
+			r.offsets[ch] = k * 4
+		}
+	} else {
+		for ch := 0; ch < 8; ch++ {
+			r.offsets[ch] = ch * 4
+		}
+	}
+	r.pos = offset / r.blockSize
+	return r
+}
+
+func (r *replayReader) read(ch, n int) ([]int16, []int16) {
+	i, q := make([]int16, n), make([]int16, n)
+	off, ok := r.offsets[ch]
+	frames := len(r.data) / r.blockSize
+	if !ok || frames == 0 {
+		return i, q
+	}
+	for s := 0; s < n; s++ {
+		if r.pos >= frames {
+			r.pos = 0
+		}
+		p := r.pos*r.blockSize + off
+		i[s] = int16(binary.LittleEndian.Uint16(r.data[p:]))
+		q[s] = int16(binary.LittleEndian.Uint16(r.data[p+2:]))
+		r.pos++
+	}
+	return i, q
+}
+
+func (r *replayReader) close() {}
+
+// liveDemod tracks the demodulator goroutine and the latest status
+var liveDemod struct {
+	mu      sync.Mutex
+	running bool
+	status  map[string]interface{}
+}
+
+// startDemodulator runs the demodulator goroutine unless it is running
+func startDemodulator() {
+	liveDemod.mu.Lock()
+	defer liveDemod.mu.Unlock()
+	if !liveDemod.running {
+		liveDemod.running = true
+		go runDemodulator()
+	}
+}
+
+// runDemodulator reads contiguous samples from the replay buffer or the SHM
+// ring and sends audio frames to listening clients until the demodulator is
+// disabled. When processing is slower than real time, the source time it
+// can't keep up with is skipped.
+func runDemodulator() {
+	var d *demodulator
+	var src demodReader
+	var srcKey string
+	defer func() {
+		if src != nil {
+			src.close()
+		}
+		liveDemod.mu.Lock()
+		liveDemod.running = false
+		liveDemod.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(demodTick)
+	defer ticker.Stop()
+	last := time.Now()
+	lastStatus := time.Time{}
+	var busy, elapsed time.Duration
+	for range ticker.C {
+		serverState.mu.RLock()
+		cfg := serverState.Demod
+		replayMode, replayData := serverState.ReplayMode, serverState.ReplayData
+		replayChannels, replayOffset := serverState.ReplayChannels, serverState.ReplayOffset
+		useSHM, shmName, hwAvailable := serverState.UseSHM, serverState.SHMName, serverState.HardwareAvailable
+		serverState.mu.RUnlock()
+		if !cfg.Enabled {
+			return
+		}
+		if d == nil || d.cfg.design() != cfg.design() {
+			d = newDemodulator(cfg)
+		}
+		d.cfg = cfg
+
+		// Contiguous source: replay data, else the live SHM ring
+		key, status := "", ""
+		switch {
+		case replayMode && len(replayData) > 0:
+			key = fmt.Sprintf("replay %p %v", &replayData[0], replayChannels)
+		case hwAvailable && useSHM:
+			key = "shm " + shmName
+		default:
+			status = "no contiguous source; live audio needs -use-shm, or use replay"
+		}
+		if key != srcKey {
+			if src != nil {
+				src.close()
+				src = nil
+			}
+			srcKey = key
+			var err error
+			switch {
+			case key == "":
+			case replayMode:
+				src = newReplayReader(replayData, replayChannels, replayOffset)
+			default:
+				if src, err = openRingReader(shmName); err != nil {
+					log.Printf("[DEMOD] %v", err)
+					status = err.Error()
+					srcKey = ""
+				}
+			}
+		}
+
+		now := time.Now()
+		span := now.Sub(last)
+		last = now
+		if span > demodMaxChunk {
+			span = demodMaxChunk
+		}
+		level := -150.0
+		open := false
+		if src != nil {
+			i, q := src.read(cfg.Channel-1, int(span.Seconds()*captureSampleRate))
+			start := time.Now()
+			var audio []int16
+			audio, level = d.process(i, q)
+			busy += time.Since(start)
+			elapsed += span
+			open = cfg.SquelchDBFS == 0 || level >= cfg.SquelchDBFS
+			if open && len(audio) > 0 {
+				broadcastAudio(audio)
+			}
+		}
+
+		if now.Sub(lastStatus) >= demodStatusGap {
+			msg := map[string]interface{}{
+				"type":         "demod_status",
+				"level_dbfs":   level,
+				"squelch_open": open,
+				"if_rate":      d.ifRate,
+			}
+			if elapsed > 0 {
+				msg["load"] = busy.Seconds() / elapsed.Seconds() // Above 1 means source time is being skipped
+			}
+			if status != "" {
+				msg["error"] = status
+			}
+			liveDemod.mu.Lock()
+			liveDemod.status = msg
+			liveDemod.mu.Unlock()
+			broadcastJSON(msg)
+			busy, elapsed, lastStatus = 0, 0, now
+		}
+	}
+}
+
+// broadcastAudio sends an audio frame to the clients that are listening.
+// Layout: marker 0xF2, uint32 sample rate, then int16 mono samples.
+func broadcastAudio(audio []int16) {
+	frame := make([]byte, 5, 5+2*len(audio))
+	frame[0] = audioFrameMarker
+	binary.LittleEndian.PutUint32(frame[1:], audioSampleRate)
+	for _, v := range audio {
+		frame = binary.LittleEndian.AppendUint16(frame, uint16(v))
+	}
+	wsClientsMu.RLock()
+	defer wsClientsMu.RUnlock()
+	for client := range wsClients {
+		client.mu.Lock()
+		listening := client.audio
+		client.mu.Unlock()
+		if listening {
+			select {
+			case client.send <- frame:
+			default:
+			}
+		}
+	}
+}
+
+// handleDemod gets or replaces the demodulator configuration
+func handleDemod(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var cfg DemodConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		serverState.mu.Lock()
+		serverState.Demod = cfg
+		serverState.mu.Unlock()
+		if cfg.Enabled {
+			startDemodulator()
+		}
+		go broadcastJSON(demodMessage())
+	}
+	json.NewEncoder(w).Encode(demodMessage())
+}
+
+// demodMessage describes the configuration and the latest status
+func demodMessage() map[string]interface{} {
+	serverState.mu.RLock()
+	cfg := serverState.Demod
+	serverState.mu.RUnlock()
+	cfg.Validate() // Show the defaults before the first configuration
+	liveDemod.mu.Lock()
+	status := liveDemod.status
+	liveDemod.mu.Unlock()
+	return map[string]interface{}{"type": "demod", "config": cfg, "status": status}
+}
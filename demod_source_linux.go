@@ -0,0 +1,108 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dma/pkg/shm_ring"
+)
+
+// ringReader follows the SHM ring from the producer's head. If it falls more
+// than n samples behind, it skips ahead to the newest data.
+type ringReader struct {
+	ring *shm_ring.ShmRing
+	pos  uint64
+}
+
+func openRingReader(name string) (demodReader, error) {
+	r, err := newRingReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// openRingStatsReader follows the SHM ring for the channel statistics
+func openRingStatsReader(name string) (statsReader, error) {
+	r, err := newRingReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func newRingReader(name string) (*ringReader, error) {
+	ring, err := shm_ring.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SHM ring: %v", err)
+	}
+	const inputBlockSize = 32
+	return &ringReader{ring: ring, pos: ring.GetHead() / inputBlockSize * inputBlockSize}, nil
+}
+
+// available returns how many frames, up to n, can be read, after skipping
+// ahead to the newest n when the reader has fallen behind
+func (r *ringReader) available(n int) int {
+	const inputBlockSize = 32
+	total := r.ring.Total()
+	head := r.ring.GetHead()
+	var available uint64
+	if head >= r.pos {
+		available = head - r.pos
+	} else {
+		available = total - r.pos + head
+	}
+	frames := int(available / inputBlockSize)
+	if frames > n {
+		r.pos = (r.pos + uint64(frames-n)*inputBlockSize) % total
+		frames = n
+	}
+	return frames
+}
+
+func (r *ringReader) read(ch, n int) ([]int16, []int16) {
+	const inputBlockSize = 32
+	total := r.ring.Total()
+	frames := r.available(n)
+
+	data := r.ring.Data()
+	i, q := make([]int16, frames), make([]int16, frames)
+	for s := 0; s < frames; s++ {
+		p := (r.pos + uint64(ch*4)) % total
+		i[s] = int16(binary.LittleEndian.Uint16(data[p:]))
+		q[s] = int16(binary.LittleEndian.Uint16(data[p+2:]))
+		r.pos = (r.pos + inputBlockSize) % total
+	}
+	return i, q
+}
+
+// frames reads up to n contiguous frames of all 8 receiver channels and
+// returns how many frames it skipped to catch up
+func (r *ringReader) frames(n int) ([][]int16, [][]int16, int) {
+	const inputBlockSize = 32
+	total := r.ring.Total()
+	start := r.pos
+	frames := r.available(n)
+	skipped := int((r.pos + total - start) % total / inputBlockSize)
+
+	data := r.ring.Data()
+	channelI, channelQ := make([][]int16, 8), make([][]int16, 8)
+	for ch := range channelI {
+		channelI[ch], channelQ[ch] = make([]int16, frames), make([]int16, frames)
+	}
+	for s := 0; s < frames; s++ {
+		for ch := 0; ch < 8; ch++ {
+			p := (r.pos + uint64(ch*4)) % total
+			channelI[ch][s] = int16(binary.LittleEndian.Uint16(data[p:]))
+			channelQ[ch][s] = int16(binary.LittleEndian.Uint16(data[p+2:]))
+		}
+		r.pos = (r.pos + inputBlockSize) % total
+	}
+	return channelI, channelQ, skipped
+}
+
+func (r *ringReader) close() {
+	r.ring.Close()
+}
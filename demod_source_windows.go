@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import "fmt"
+
+func openRingReader(name string) (demodReader, error) {
+	return nil, fmt.Errorf("the SHM ring is not supported on Windows")
+}
+
+func openRingStatsReader(name string) (statsReader, error) {
+	return nil, fmt.Errorf("the SHM ring is not supported on Windows")
+}
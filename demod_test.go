@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestDemodulator modulates a 1 kHz tone onto a carrier at an offset and
+// checks the recovered audio's rate, frequency and level. The 10 ms signal
+// repeats seamlessly, so it is fed three times to let the chain settle.
+func TestDemodulator(t *testing.T) {
+	const offset, tone, amp = 1.5e6, 1000.0, 4000.0
+	n := int(0.01 * captureSampleRate)
+
+	cases := []struct {
+		mode   string
+		signal func(t float64) (float64, float64) // Amplitude and phase
+		want   float64                            // Audio amplitude
+	}{
+		{DemodAM, func(t float64) (float64, float64) {
+			return amp * (1 + 0.5*math.Cos(2*math.Pi*tone*t)), 2 * math.Pi * offset * t
+		}, 0.25 * 32767},
+		{DemodNBFM, func(t float64) (float64, float64) {
+			// Peak deviation bandwidth/4 is full deviation
+			beta := 12.5e3 / 4 / tone
+			return amp, 2*math.Pi*offset*t + beta*math.Sin(2*math.Pi*tone*t)
+		}, 0.5 * 32767},
+		{DemodUSB, func(t float64) (float64, float64) {
+			return amp, 2 * math.Pi * (offset + tone) * t
+		}, 0.5 * 32767},
+		{DemodLSB, func(t float64) (float64, float64) {
+			return amp, 2 * math.Pi * (offset - tone) * t
+		}, 0.5 * 32767},
+	}
+	for _, c := range cases {
+		i, q := make([]int16, n), make([]int16, n)
+		for s := range i {
+			a, phase := c.signal(float64(s) / captureSampleRate)
+			i[s], q[s] = clampInt16(a*math.Cos(phase)), clampInt16(a*math.Sin(phase))
+		}
+		cfg := DemodConfig{Mode: c.mode, OffsetHz: offset}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		d := newDemodulator(cfg)
+		d.process(i, q)
+		d.process(i, q)
+		audio, level := d.process(i, q)
+
+		if want := 0.01 * audioSampleRate; math.Abs(float64(len(audio))-want) > 2 {
+			t.Errorf("%s: %d audio samples, want %.0f", c.mode, len(audio), want)
+		}
+		if c.mode != DemodAM && math.Abs(level-20*math.Log10(amp/fullScaleAmplitude)) > 0.5 {
+			t.Errorf("%s: level %.2f dBFS", c.mode, level)
+		}
+
+		// Tone amplitude
+		var re, im, power float64
+		for k, v := range audio {
+			s, co := math.Sincos(2 * math.Pi * tone * float64(k) / audioSampleRate)
+			re += float64(v) * co
+			im += float64(v) * s
+			power += float64(v) * float64(v)
+		}
+		got := 2 * math.Hypot(re, im) / float64(len(audio))
+		if math.Abs(got/c.want-1) > 0.05 {
+			t.Errorf("%s: 1 kHz amplitude %.0f, want %.0f", c.mode, got, c.want)
+		}
+		// Nearly all the audio power is the tone
+		if purity := got * got / 2 / (power / float64(len(audio))); purity < 0.95 {
+			t.Errorf("%s: tone holds %.2f of the audio power", c.mode, purity)
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dma/pkg/fft"
+)
+
+const (
+	CFARCellAveraging   = "ca" // Noise is the mean of the reference cells
+	CFAROrderStatistic  = "os" // Noise is a ranked reference cell, robust to nearby signals
+	detectorExpiryCheck = 250 * time.Millisecond
+)
+
+// DetectorConfig configures the live CFAR detector
+type DetectorConfig struct {
+	Enabled        bool    `json:"enabled"`
+	Method         string  `json:"method"`          // "ca" (default) or "os"
+	Channels       []int   `json:"channels"`        // User-facing channels (1-80), default 1
+	Averages       int     `json:"averages"`        // Stream frames power-averaged per pass, default 4
+	Window         string  `json:"window"`          // See fft.ParseWindow, default blackman
+	WindowParam    float64 `json:"window_param"`    // Kaiser beta or Gaussian sigma
+	GuardCells     int     `json:"guard_cells"`     // Each side of the cell under test, default 4
+	ReferenceCells int     `json:"reference_cells"` // Each side, outside the guard cells, default 16
+	Rank           float64 `json:"rank"`            // OS-CFAR order statistic as a fraction of the reference cells, default 0.75
+	ThresholdDB    float64 `json:"threshold_db"`    // Detection threshold above the noise estimate, default 12
+	MergeBins      int     `json:"merge_bins"`      // Gaps of up to this many bins join detections, default 2, -1 = none
+	HoldS          float64 `json:"hold_s"`          // An emitter disappears when not detected for this long, default 2
+	LogSize        int     `json:"log_size"`        // Emitters kept in the log, default 1000
+}
+
+// Validate checks the configuration and fills in defaults
+func (c *DetectorConfig) Validate() (fft.WindowSpec, error) {
+	if c.Method == "" {
+		c.Method = CFARCellAveraging
+	}
+	if c.Method != CFARCellAveraging && c.Method != CFAROrderStatistic {
+		return fft.WindowSpec{}, fmt.Errorf("unknown method %q (want ca or os)", c.Method)
+	}
+	if len(c.Channels) == 0 {
+		c.Channels = []int{1}
+	}
+	for _, ch := range c.Channels {
+		if ch < 1 || ch > maxChannel {
+			return fft.WindowSpec{}, fmt.Errorf("channel %d out of range (1-%d)", ch, maxChannel)
+		}
+	}
+	if c.Averages == 0 {
+		c.Averages = 4
+	}
+	if c.Averages < 1 || c.Averages > 1000 {
+		return fft.WindowSpec{}, fmt.Errorf("averages must be between 1 and 1000")
+	}
+	if c.Window == "" {
+		c.Window = string(fft.Blackman)
+	}
+	spec, err := fft.ParseWindow(c.Window, c.WindowParam)
+	if err != nil {
+		return fft.WindowSpec{}, err
+	}
+	c.Window, c.WindowParam = string(spec.Kind), spec.Param
+	if c.GuardCells == 0 {
+		c.GuardCells = 4
+	}
+	if c.ReferenceCells == 0 {
+		c.ReferenceCells = 16
+	}
+	if c.GuardCells < 0 || c.ReferenceCells < 1 || c.GuardCells+c.ReferenceCells > 1024 {
+		return fft.WindowSpec{}, fmt.Errorf("guard_cells and reference_cells must be positive and total at most 1024")
+	}
+	if c.Rank == 0 {
+		c.Rank = 0.75
+	}
+	if c.Rank <= 0 || c.Rank > 1 {
+		return fft.WindowSpec{}, fmt.Errorf("rank must be between 0 and 1")
+	}
+	if c.ThresholdDB == 0 {
+		c.ThresholdDB = 12
+	}
+	if c.ThresholdDB < 0 {
+		return fft.WindowSpec{}, fmt.Errorf("threshold_db must be positive")
+	}
+	if c.MergeBins == 0 {
+		c.MergeBins = 2
+	}
+	if c.MergeBins < 0 {
+		c.MergeBins = 0
+	}
+	if c.HoldS == 0 {
+		c.HoldS = 2
+	}
+	if c.HoldS < 0 {
+		return fft.WindowSpec{}, fmt.Errorf("hold_s must be positive")
+	}
+	if c.LogSize == 0 {
+		c.LogSize = 1000
+	}
+	if c.LogSize < 1 {
+		return fft.WindowSpec{}, fmt.Errorf("log_size must be positive")
+	}
+	return spec, nil
+}
+
+// cfarNoise estimates the noise power under each bin from the reference
+// cells on both sides, skipping the guard cells. Near the band edges only
+// the cells that exist are used.
+func cfarNoise(p []float64, cfg *DetectorConfig) []float64 {
+	n := len(p)
+	noise := make([]float64, n)
+	g, r := cfg.GuardCells, cfg.ReferenceCells
+	if cfg.Method == CFAROrderStatistic {
+		cells := make([]float64, 0, 2*r)
+		for i := range p {
+			cells = cells[:0]
+			for k := i - g - r; k <= i+g+r; k++ {
+				if k >= 0 && k < n && (k < i-g || k > i+g) {
+					cells = append(cells, p[k])
+				}
+			}
+			if len(cells) == 0 {
+				continue
+			}
+			sort.Float64s(cells)
+			rank := int(math.Ceil(cfg.Rank*float64(len(cells)))) - 1
+			if rank < 0 {
+				rank = 0
+			}
+			noise[i] = cells[rank]
+		}
+		return noise
+	}
+
+	// Cell averaging from prefix sums
+	sum := make([]float64, n+1)
+	for i, v := range p {
+		sum[i+1] = sum[i] + v
+	}
+	window := func(lo, hi int) (float64, int) {
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > n-1 {
+			hi = n - 1
+		}
+		if hi < lo {
+			return 0, 0
+		}
+		return sum[hi+1] - sum[lo], hi - lo + 1
+	}
+	for i := range p {
+		left, nl := window(i-g-r, i-g-1)
+		right, nr := window(i+g+1, i+g+r)
+		if nl+nr > 0 {
+			noise[i] = (left + right) / float64(nl+nr)
+		}
+	}
+	return noise
+}
+
+// detection is one group of adjacent bins above the CFAR threshold
+type detection struct {
+	CenterHz    float64 // Power-weighted centroid, offset from the channel's DC
+	BandwidthHz float64 // Extent of the detected bins
+	PowerMW     float64 // Integrated over the detected bins
+	SNRDB       float64 // Peak bin above its noise estimate
+}
+
+// cfarDetect finds the detections in a DC-centered density spectrum (mW/Hz)
+func cfarDetect(density []float64, binHz float64, cfg *DetectorConfig) []detection {
+	noise := cfarNoise(density, cfg)
+	alpha := math.Pow(10, cfg.ThresholdDB/10)
+	n := len(density)
+	var out []detection
+	for i := 0; i < n; {
+		if density[i] <= noise[i]*alpha {
+			i++
+			continue
+		}
+		// Extend through gaps of up to MergeBins
+		end, gap := i, 0
+		for k := i + 1; k < n && gap <= cfg.MergeBins; k++ {
+			if density[k] > noise[k]*alpha {
+				end, gap = k, 0
+			} else {
+				gap++
+			}
+		}
+		var d detection
+		var moment float64
+		for k := i; k <= end; k++ {
+			f := float64(k-n/2) * binHz
+			d.PowerMW += density[k] * binHz
+			moment += f * density[k]
+			if noise[k] > 0 {
+				d.SNRDB = math.Max(d.SNRDB, 10*math.Log10(density[k]/noise[k]))
+			}
+		}
+		d.CenterHz = moment * binHz / d.PowerMW
+		d.BandwidthHz = float64(end-i+1) * binHz
+		out = append(out, d)
+		i = end + 1
+	}
+	return out
+}
+
+// Emitter is a signal tracked across detections on one channel
+type Emitter struct {
+	ID           int       `json:"id"`
+	Channel      int       `json:"channel"`
+	CenterHz     float64   `json:"center_hz"` // Offset from the tuned (DC) frequency
+	RFMHz        float64   `json:"rf_mhz"`    // Absolute, from the DDC frequency
+	BandwidthHz  float64   `json:"bandwidth_hz"`
+	PowerDBm     float64   `json:"power_dbm"` // Latest integrated power
+	PeakPowerDBm float64   `json:"peak_power_dbm"`
+	SNRDB        float64   `json:"snr_db"` // Latest peak bin above the noise estimate
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+	Detections   int       `json:"detections"`
+	Active       bool      `json:"active"`
+}
+
+// emitterLog groups detections into emitters. A detection belongs to an
+// active emitter on the same channel when their bands overlap; the closest
+// center wins.
+type emitterLog struct {
+	nextID   int
+	emitters []*Emitter // Oldest first
+}
+
+// update folds in one pass of detections and returns the emitters that
+// appeared
+func (l *emitterLog) update(ch int, dets []detection, offsetHz, ddcMHz float64, now time.Time, size int) []Emitter {
+	var added []*Emitter
+	claimed := make(map[*Emitter]bool)
+	for _, d := range dets {
+		center := d.CenterHz + offsetHz
+		var best *Emitter
+		bestDist := math.Inf(1)
+		for _, e := range l.emitters {
+			if !e.Active || e.Channel != ch || claimed[e] {
+				continue
+			}
+			dist := math.Abs(e.CenterHz - center)
+			if dist <= (e.BandwidthHz+d.BandwidthHz)/2 && dist < bestDist {
+				best, bestDist = e, dist
+			}
+		}
+		power := powerToDBm(d.PowerMW)
+		if best == nil {
+			l.nextID++
+			best = &Emitter{ID: l.nextID, Channel: ch, FirstSeen: now, Active: true, PeakPowerDBm: power}
+			l.emitters = append(l.emitters, best)
+			added = append(added, best)
+		}
+		claimed[best] = true
+		best.CenterHz, best.BandwidthHz = center, d.BandwidthHz
+		best.RFMHz = ddcMHz + center/1e6
+		best.PowerDBm, best.SNRDB = power, d.SNRDB
+		best.PeakPowerDBm = math.Max(best.PeakPowerDBm, power)
+		best.LastSeen = now
+		best.Detections++
+	}
+	if len(l.emitters) > size {
+		l.emitters = append([]*Emitter(nil), l.emitters[len(l.emitters)-size:]...)
+	}
+	appeared := make([]Emitter, len(added))
+	for k, e := range added {
+		appeared[k] = *e
+	}
+	return appeared
+}
+
+// expire marks emitters not detected within hold as gone and returns them
+func (l *emitterLog) expire(now time.Time, hold time.Duration) []Emitter {
+	var lost []Emitter
+	for _, e := range l.emitters {
+		if e.Active && now.Sub(e.LastSeen) > hold {
+			e.Active = false
+			lost = append(lost, *e)
+		}
+	}
+	return lost
+}
+
+// liveDetector runs the detector on stream frames in its own goroutine, so
+// a slow pass drops frames rather than delaying the stream
+var liveDetector = struct {
+	once   sync.Once
+	frames chan liveFrame
+
+	mu      sync.Mutex
+	log     emitterLog
+	avg     map[int]*powerAverager
+	fftSize int
+	passes  int
+}{frames: make(chan liveFrame, 1)}
+
+// feedDetector hands a complete stream frame to the detector
+func feedDetector(frame liveFrame) {
+	serverState.mu.RLock()
+	enabled := serverState.Detector.Enabled
+	serverState.mu.RUnlock()
+	if !enabled {
+		return
+	}
+	liveDetector.once.Do(func() { go runDetector() })
+	select {
+	case liveDetector.frames <- frame:
+	default:
+	}
+}
+
+// runDetector processes frames and expires emitters that stopped being
+// detected
+func runDetector() {
+	ticker := time.NewTicker(detectorExpiryCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case frame := <-liveDetector.frames:
+			detectFrame(frame)
+		case <-ticker.C:
+		}
+		serverState.mu.RLock()
+		hold := time.Duration(serverState.Detector.HoldS * float64(time.Second))
+		serverState.mu.RUnlock()
+		liveDetector.mu.Lock()
+		lost := liveDetector.log.expire(time.Now(), hold)
+		liveDetector.mu.Unlock()
+		for _, e := range lost {
+			broadcastJSON(map[string]interface{}{"type": "emitter_lost", "emitter": e})
+		}
+	}
+}
+
+// detectFrame averages one frame's spectra and runs a detection pass once
+// enough frames are in
+func detectFrame(frame liveFrame) {
+	serverState.mu.RLock()
+	cfg := serverState.Detector
+	cfg.Channels = append([]int(nil), cfg.Channels...)
+	ddcMHz := serverState.DDCFreqMHz
+	serverState.mu.RUnlock()
+	spec, err := cfg.Validate()
+	if !cfg.Enabled || err != nil {
+		return
+	}
+	chz := currentChannelizer()
+
+	liveDetector.mu.Lock()
+	defer liveDetector.mu.Unlock()
+	if liveDetector.avg == nil || liveDetector.fftSize != frame.fftSize {
+		liveDetector.avg, liveDetector.fftSize = make(map[int]*powerAverager), frame.fftSize
+	}
+	now := time.Now()
+	var appeared []Emitter
+	for _, ch := range cfg.Channels {
+		i, q, err := frame.channel(ch)
+		if err != nil {
+			continue
+		}
+		opts := SpectrumOptions{FFTSize: frame.fftSize, Window: spec, Scaling: ScalingDensity, SampleRate: frame.sampleRate(ch), Cal: frame.powerCurve(ch)}
+		p := make([]float64, frame.fftSize)
+		if computePowerSpectrumInto(p, i, q, opts) != nil {
+			continue
+		}
+		a := liveDetector.avg[ch]
+		if a == nil {
+			a = &powerAverager{}
+			liveDetector.avg[ch] = a
+		}
+		a.add(p)
+		if a.count < cfg.Averages {
+			continue
+		}
+		delete(liveDetector.avg, ch)
+
+		// Sub-channel frequencies are reported relative to the source's DC
+		offsetHz := 0.0
+		if isSubChannel(ch) && chz != nil {
+			if k := ch - subChannelBase; k < chz.m {
+				offsetHz = chz.info().SubChannels[k].CenterHz
+			}
+		}
+		binHz := opts.sampleRate() / float64(frame.fftSize)
+		dets := cfarDetect(a.mean(), binHz, &cfg)
+		appeared = append(appeared, liveDetector.log.update(ch, dets, offsetHz, ddcMHz, now, cfg.LogSize)...)
+		liveDetector.passes++
+	}
+	for _, e := range appeared {
+		go broadcastJSON(map[string]interface{}{"type": "emitter_appeared", "emitter": e})
+	}
+}
+
+// handleDetector gets or replaces the detector configuration
+func handleDetector(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var cfg DetectorConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if _, err := cfg.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		serverState.mu.Lock()
+		serverState.Detector = cfg
+		serverState.mu.Unlock()
+		liveDetector.mu.Lock()
+		liveDetector.avg = nil
+		liveDetector.mu.Unlock()
+		go broadcastJSON(detectorMessage())
+	}
+	json.NewEncoder(w).Encode(detectorMessage())
+}
+
+// detectorMessage describes the configuration and the active emitters
+func detectorMessage() map[string]interface{} {
+	serverState.mu.RLock()
+	cfg := serverState.Detector
+	serverState.mu.RUnlock()
+	cfg.Validate() // Show the defaults before the first configuration
+	liveDetector.mu.Lock()
+	passes, total, active := liveDetector.passes, len(liveDetector.log.emitters), 0
+	for _, e := range liveDetector.log.emitters {
+		if e.Active {
+			active++
+		}
+	}
+	liveDetector.mu.Unlock()
+	return map[string]interface{}{
+		"type":   "detector",
+		"config": cfg,
+		"passes": passes,
+		"logged": total,
+		"active": active,
+	}
+}
+
+// handleEmitters queries the emitter log. Filters: channel, active=1,
+// since (RFC 3339, last seen at or after), min_power_dbm, min_hz and max_hz
+// (center offset). DELETE clears the log.
+func handleEmitters(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		liveDetector.mu.Lock()
+		liveDetector.log.emitters = nil
+		liveDetector.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+		return
+	}
+
+	q := r.URL.Query()
+	channel := 0
+	if v := q.Get("channel"); v != "" {
+		var err error
+		if channel, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid channel", 400)
+			return
+		}
+	}
+	activeOnly := q.Get("active") == "1" || q.Get("active") == "true"
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid since (want RFC 3339)", 400)
+			return
+		}
+	}
+	number := func(name string, def float64) (float64, error) {
+		v := q.Get(name)
+		if v == "" {
+			return def, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s", name)
+		}
+		return f, nil
+	}
+	minPower, err1 := number("min_power_dbm", math.Inf(-1))
+	minHz, err2 := number("min_hz", math.Inf(-1))
+	maxHz, err3 := number("max_hz", math.Inf(1))
+	for _, err := range []error{err1, err2, err3} {
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	out := []Emitter{}
+	liveDetector.mu.Lock()
+	for _, e := range liveDetector.log.emitters {
+		if channel != 0 && e.Channel != channel || activeOnly && !e.Active || e.LastSeen.Before(since) ||
+			e.PeakPowerDBm < minPower || e.CenterHz < minHz || e.CenterHz > maxHz {
+			continue
+		}
+		out = append(out, *e)
+	}
+	liveDetector.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"emitters": out})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/dma/pkg/fft"
+)
+
+// TestCFARDetector detects two tones in noise with both CFAR methods and
+// follows them through the emitter log
+func TestCFARDetector(t *testing.T) {
+	const n, averages = 1024, 8
+	binHz := float64(captureSampleRate) / n
+	tones := []float64{100.5, -200} // Offsets in bins
+
+	rng := rand.New(rand.NewSource(1))
+	opts := SpectrumOptions{FFTSize: n, Window: fft.WindowSpec{Kind: fft.Blackman}, Scaling: ScalingDensity}
+	var avg powerAverager
+	i, q := make([]int16, n), make([]int16, n)
+	for a := 0; a < averages; a++ {
+		for s := range i {
+			v := complex(rng.NormFloat64()*50, rng.NormFloat64()*50)
+			for _, b := range tones {
+				phase := 2*math.Pi*b*float64(s)/n + float64(a)
+				v += complex(1000*math.Cos(phase), 1000*math.Sin(phase))
+			}
+			i[s], q[s] = clampInt16(real(v)), clampInt16(imag(v))
+		}
+		p := make([]float64, n)
+		if err := computePowerSpectrumInto(p, i, q, opts); err != nil {
+			t.Fatal(err)
+		}
+		avg.add(p)
+	}
+	density := avg.mean()
+
+	for _, method := range []string{CFARCellAveraging, CFAROrderStatistic} {
+		cfg := DetectorConfig{Method: method}
+		if _, err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		dets := cfarDetect(density, binHz, &cfg)
+		if len(dets) != len(tones) {
+			t.Fatalf("%s: %d detections, want %d: %+v", method, len(dets), len(tones), dets)
+		}
+		// Detections come out in ascending frequency
+		for k, b := range []float64{tones[1], tones[0]} {
+			if math.Abs(dets[k].CenterHz/binHz-b) > 0.1 {
+				t.Errorf("%s: detection at %.2f bins, want %.2f", method, dets[k].CenterHz/binHz, b)
+			}
+			if dets[k].SNRDB < 30 {
+				t.Errorf("%s: SNR %.1f dB", method, dets[k].SNRDB)
+			}
+		}
+	}
+
+	// Repeated detections update one emitter; it disappears after the hold time
+	cfg := DetectorConfig{}
+	cfg.Validate()
+	dets := cfarDetect(density, binHz, &cfg)
+	var log emitterLog
+	start := time.Now()
+	if got := log.update(1, dets, 0, 125, start, 10); len(got) != 2 {
+		t.Fatalf("%d emitters appeared, want 2", len(got))
+	}
+	if got := log.update(1, dets, 0, 125, start.Add(time.Second), 10); len(got) != 0 {
+		t.Errorf("%d emitters appeared on the second pass", len(got))
+	}
+	if got := log.update(2, dets[:1], 0, 125, start.Add(time.Second), 10); len(got) != 1 {
+		t.Errorf("another channel should add an emitter")
+	}
+	if e := log.emitters[0]; e.Detections != 2 || !e.FirstSeen.Equal(start) {
+		t.Errorf("emitter %+v", *e)
+	}
+	if lost := log.expire(start.Add(2500*time.Millisecond), 2*time.Second); len(lost) != 0 {
+		t.Errorf("%d emitters lost within the hold time", len(lost))
+	}
+	if lost := log.expire(start.Add(3500*time.Millisecond), 2*time.Second); len(lost) != 3 {
+		t.Errorf("%d emitters lost, want 3", len(lost))
+	}
+}
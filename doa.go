@@ -0,0 +1,604 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DOA methods
+const (
+	DOABartlett = "bartlett"
+	DOAMUSIC    = "music"
+	DOABoth     = "both"
+)
+
+// DOAOptions configures direction-of-arrival estimation at one frequency bin
+type DOAOptions struct {
+	Channels     []int    `json:"channels"`      // Array elements to use; empty = all in the geometry
+	BinHz        *float64 `json:"bin_hz"`        // Offset from DC; nil = strongest bin summed over channels
+	RFHz         float64  `json:"rf_hz"`         // Carrier at DC; 0 = DDC frequency
+	Method       string   `json:"method"`        // bartlett, music or both (default)
+	Sources      int      `json:"sources"`       // Signals for MUSIC; 0 = estimate from eigenvalues (MDL)
+	AzMinDeg     float64  `json:"az_min_deg"`    // Scan range; both 0 = 0-180 for arrays on the x axis, else -180-180
+	AzMaxDeg     float64  `json:"az_max_deg"`    //
+	AzStepDeg    float64  `json:"az_step_deg"`   // Default 1
+	ElevationDeg float64  `json:"elevation_deg"` // Elevation of the scan
+	FFTSize      int      `json:"fft_size"`      // Default 1024; live data uses the stream's FFT size
+	Window       string   `json:"window"`        // See fft.ParseWindow, default blackman
+	WindowParam  float64  `json:"window_param"`  // Kaiser beta or Gaussian sigma
+	Snapshots    int      `json:"snapshots"`     // FFTs (live: frames) in the covariance, default 32
+
+	// Recording source; empty Filename means live data
+	Filename    string `json:"filename,omitempty"`
+	StartSample int64  `json:"start_sample,omitempty"`
+}
+
+// Validate checks the options, fills in defaults and returns the spectrum options
+func (o *DOAOptions) Validate() (SpectrumOptions, error) {
+	switch o.Method {
+	case "":
+		o.Method = DOABoth
+	case DOABartlett, DOAMUSIC, DOABoth:
+	default:
+		return SpectrumOptions{}, fmt.Errorf("unknown method %q (want bartlett, music or both)", o.Method)
+	}
+	if o.Sources < 0 || o.Sources > 7 {
+		return SpectrumOptions{}, fmt.Errorf("sources must be between 0 and 7")
+	}
+	if o.AzMaxDeg < o.AzMinDeg {
+		return SpectrumOptions{}, fmt.Errorf("az_max_deg must be above az_min_deg")
+	}
+	if o.AzStepDeg == 0 {
+		o.AzStepDeg = 1
+	}
+	if o.AzStepDeg < 0.01 {
+		return SpectrumOptions{}, fmt.Errorf("az_step_deg must be at least 0.01")
+	}
+	if o.RFHz < 0 {
+		return SpectrumOptions{}, fmt.Errorf("rf_hz must be positive")
+	}
+	if o.FFTSize == 0 {
+		o.FFTSize = 1024
+	}
+	if o.Snapshots == 0 {
+		o.Snapshots = 32
+	}
+	if o.Snapshots < 1 {
+		return SpectrumOptions{}, fmt.Errorf("snapshots must be positive")
+	}
+	if o.Filename != "" {
+		o.Filename = filepath.Base(o.Filename)
+	}
+	opts, err := parseSpectrumOptions(o.FFTSize, o.Window, o.WindowParam, ScalingTone)
+	if err != nil {
+		return SpectrumOptions{}, err
+	}
+	o.Window, o.WindowParam = string(opts.Window.Kind), opts.Window.Param
+	return opts, nil
+}
+
+// DOABearing is one detected signal
+type DOABearing struct {
+	Method     string  `json:"method"`
+	AzimuthDeg float64 `json:"azimuth_deg"`
+	LevelDB    float64 `json:"level_db"` // Pseudo-spectrum peak relative to its maximum
+}
+
+// DOAResult holds the pseudo-spectra over the azimuth scan and the bearings
+// of their strongest peaks
+type DOAResult struct {
+	Source       string       `json:"source"` // "live" or the recording filename
+	Time         time.Time    `json:"time"`
+	FFTSize      int          `json:"fft_size"`
+	Snapshots    int          `json:"snapshots"`
+	BinHz        float64      `json:"bin_hz"` // Offset of the bin used
+	RFHz         float64      `json:"rf_hz"`  // Frequency used for the steering vectors
+	Channels     []int        `json:"channels"`
+	SignalDBm    float64      `json:"signal_dbm"`    // Mean power per element in the bin
+	Sources      int          `json:"sources"`       // Used for MUSIC (estimated if not given)
+	EigenvalueDB []float64    `json:"eigenvalue_db"` // Covariance eigenvalues, descending
+	AzimuthsDeg  []float64    `json:"azimuths_deg"`
+	Bartlett     []float64    `json:"bartlett_db,omitempty"` // Normalized to 0 dB peak
+	MUSIC        []float64    `json:"music_db,omitempty"`    // Normalized to 0 dB peak
+	Bearings     []DOABearing `json:"bearings"`
+	Options      DOAOptions   `json:"options"`
+}
+
+// doaAccumulator builds the spatial covariance at one bin
+type doaAccumulator struct {
+	o        *DOAOptions
+	elements []ArrayElement
+	fftSize  int
+	bin      int // -1 until chosen
+	cov      [][]complex128
+	count    int
+}
+
+func newDOAAccumulator(o *DOAOptions, elements []ArrayElement, fftSize int) *doaAccumulator {
+	m := len(elements)
+	a := &doaAccumulator{o: o, elements: elements, fftSize: fftSize, bin: -1, cov: make([][]complex128, m)}
+	for i := range a.cov {
+		a.cov[i] = make([]complex128, m)
+	}
+	return a
+}
+
+// add folds in one snapshot; spectra are keyed by user-facing channel (1-8)
+func (a *doaAccumulator) add(spectra map[int][]complex128) {
+	binHz := float64(captureSampleRate) / float64(a.fftSize)
+	if a.bin < 0 {
+		if a.o.BinHz != nil {
+			a.bin = int(math.Round(*a.o.BinHz/binHz)) + a.fftSize/2
+			if a.bin < 0 || a.bin >= a.fftSize {
+				a.bin = a.fftSize / 2
+			}
+		} else {
+			// Strongest bin across the array, skipping DC
+			best := -1.0
+			for k := 0; k < a.fftSize; k++ {
+				p := 0.0
+				for _, e := range a.elements {
+					v := spectra[e.Channel][k]
+					p += real(v)*real(v) + imag(v)*imag(v)
+				}
+				if k != a.fftSize/2 && p > best {
+					best, a.bin = p, k
+				}
+			}
+		}
+	}
+
+	x := make([]complex128, len(a.elements))
+	for i, e := range a.elements {
+		x[i] = spectra[e.Channel][a.bin]
+	}
+	for i := range x {
+		for j := range x {
+			a.cov[i][j] += x[i] * cmplx.Conj(x[j])
+		}
+	}
+	a.count++
+}
+
+// result computes the pseudo-spectra and bearings
+func (a *doaAccumulator) result(source string, rfCenterHz float64) *DOAResult {
+	m := len(a.elements)
+	n := float64(a.count)
+	r := make([][]complex128, m)
+	power := 0.0
+	for i := range r {
+		r[i] = make([]complex128, m)
+		for j := range r[i] {
+			r[i][j] = a.cov[i][j] / complex(n, 0)
+		}
+		power += real(r[i][i])
+	}
+
+	binHz := float64(captureSampleRate) / float64(a.fftSize)
+	res := &DOAResult{
+		Source:    source,
+		Time:      time.Now(),
+		FFTSize:   a.fftSize,
+		Snapshots: a.count,
+		BinHz:     float64(a.bin-a.fftSize/2) * binHz,
+		SignalDBm: powerToDBm(power / float64(m)),
+		Options:   *a.o,
+	}
+	res.Options.FFTSize = a.fftSize
+	res.RFHz = rfCenterHz + res.BinHz
+	for _, e := range a.elements {
+		res.Channels = append(res.Channels, e.Channel)
+	}
+
+	values, vectors := hermitianEigen(r)
+	for _, v := range values {
+		res.EigenvalueDB = append(res.EigenvalueDB, powerToDBm(v))
+	}
+	res.Sources = a.o.Sources
+	if res.Sources == 0 {
+		res.Sources = estimateSources(values, a.count)
+	}
+
+	azMin, azMax := a.o.AzMinDeg, a.o.AzMaxDeg
+	if azMin == 0 && azMax == 0 {
+		azMin, azMax = -180, 180
+		if isLinearX(a.elements) {
+			azMin, azMax = 0, 180
+		}
+	}
+	peaks := res.Sources
+	if peaks == 0 {
+		peaks = 1
+	}
+
+	var bartlett, music []float64
+	for az := azMin; az <= azMax+1e-9; az += a.o.AzStepDeg {
+		res.AzimuthsDeg = append(res.AzimuthsDeg, az)
+		sv := steeringVector(a.elements, az, a.o.ElevationDeg, res.RFHz)
+		if a.o.Method != DOAMUSIC {
+			// a^H R a / a^H a
+			var p complex128
+			for i := range sv {
+				for j := range sv {
+					p += cmplx.Conj(sv[i]) * r[i][j] * sv[j]
+				}
+			}
+			bartlett = append(bartlett, real(p)/float64(m))
+		}
+		if a.o.Method != DOABartlett {
+			// 1 / |En^H a|^2, the noise subspace being the smallest eigenvectors
+			noise := 0.0
+			for k := 2 * res.Sources; k < 2*m; k++ {
+				d := 0.0
+				for i := range sv {
+					d += vectors[k][i]*real(sv[i]) + vectors[k][i+m]*imag(sv[i])
+				}
+				noise += d * d
+			}
+			music = append(music, 1/math.Max(noise, 1e-12))
+		}
+	}
+
+	if bartlett != nil {
+		res.Bartlett = normalizeDB(bartlett)
+		res.Bearings = append(res.Bearings, findBearings(DOABartlett, res.AzimuthsDeg, res.Bartlett, peaks)...)
+	}
+	if music != nil {
+		res.MUSIC = normalizeDB(music)
+		res.Bearings = append(res.Bearings, findBearings(DOAMUSIC, res.AzimuthsDeg, res.MUSIC, peaks)...)
+	}
+	return res
+}
+
+// normalizeDB converts a pseudo-spectrum to dB relative to its maximum
+func normalizeDB(p []float64) []float64 {
+	peak := 0.0
+	for _, v := range p {
+		peak = math.Max(peak, v)
+	}
+	out := make([]float64, len(p))
+	for i, v := range p {
+		out[i] = -150
+		if v > 0 && peak > 0 {
+			out[i] = math.Max(10*math.Log10(v/peak), -150)
+		}
+	}
+	return out
+}
+
+// findBearings returns the strongest local maxima, refined by fitting a
+// parabola through each peak and its neighbours
+func findBearings(method string, az, dB []float64, count int) []DOABearing {
+	var found []DOABearing
+	for i := range dB {
+		left, right := i-1, i+1
+		if left < 0 || right >= len(dB) {
+			continue
+		}
+		if dB[i] <= dB[left] || dB[i] < dB[right] {
+			continue
+		}
+		b := DOABearing{Method: method, AzimuthDeg: az[i], LevelDB: dB[i]}
+		if denom := dB[left] - 2*dB[i] + dB[right]; denom < 0 {
+			delta := 0.5 * (dB[left] - dB[right]) / denom
+			b.AzimuthDeg += delta * (az[right] - az[i])
+			b.LevelDB -= 0.25 * (dB[left] - dB[right]) * delta
+		}
+		found = append(found, b)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].LevelDB > found[j].LevelDB })
+	if len(found) > count {
+		found = found[:count]
+	}
+	return found
+}
+
+// estimateSources picks the number of signals with the minimum description
+// length criterion on the descending eigenvalues
+func estimateSources(values []float64, snapshots int) int {
+	m := len(values)
+	n := float64(snapshots)
+	best, bestK := math.Inf(1), 0
+	for k := 0; k < m; k++ {
+		logSum, sum := 0.0, 0.0
+		for _, v := range values[k:] {
+			v = math.Max(v, 1e-30)
+			logSum += math.Log(v)
+			sum += v
+		}
+		p := float64(m - k)
+		geo, arith := logSum/p, math.Log(sum/p)
+		mdl := -n*p*(geo-arith) + 0.5*float64(k*(2*m-k))*math.Log(n)
+		if mdl < best {
+			best, bestK = mdl, k
+		}
+	}
+	if bestK > m-1 {
+		bestK = m - 1
+	}
+	return bestK
+}
+
+// hermitianEigen returns the eigenvalues of a Hermitian matrix in descending
+// order. The n x n complex matrix is embedded in the real symmetric 2n x 2n
+// matrix [Re -Im; Im Re], where each eigenvalue appears twice, and
+// diagonalised with cyclic Jacobi rotations. The 2n real eigenvectors are
+// returned in the same order, two per complex eigenvalue; the projection of
+// [Re x; Im x] onto a set of them has the same norm as the projection of x
+// onto the matching complex eigenvectors.
+func hermitianEigen(h [][]complex128) ([]float64, [][]float64) {
+	n := len(h)
+	size := 2 * n
+	a := make([][]float64, size)
+	v := make([][]float64, size)
+	for i := range a {
+		a[i] = make([]float64, size)
+		v[i] = make([]float64, size)
+		v[i][i] = 1
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			re, im := real(h[i][j]), imag(h[i][j])
+			a[i][j], a[i+n][j+n] = re, re
+			a[i][j+n], a[i+n][j] = -im, im
+		}
+	}
+
+	for sweep := 0; sweep < 100; sweep++ {
+		off := 0.0
+		for p := 0; p < size; p++ {
+			for q := p + 1; q < size; q++ {
+				off += a[p][q] * a[p][q]
+			}
+		}
+		if off < 1e-22 {
+			break
+		}
+		for p := 0; p < size; p++ {
+			for q := p + 1; q < size; q++ {
+				if math.Abs(a[p][q]) < 1e-300 {
+					continue
+				}
+				theta := (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t := math.Copysign(1, theta) / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+				for k := 0; k < size; k++ {
+					akp, akq := a[k][p], a[k][q]
+					a[k][p], a[k][q] = c*akp-s*akq, s*akp+c*akq
+				}
+				for k := 0; k < size; k++ {
+					apk, aqk := a[p][k], a[q][k]
+					a[p][k], a[q][k] = c*apk-s*aqk, s*apk+c*aqk
+				}
+				for k := 0; k < size; k++ {
+					vkp, vkq := v[k][p], v[k][q]
+					v[k][p], v[k][q] = c*vkp-s*vkq, s*vkp+c*vkq
+				}
+			}
+		}
+	}
+
+	order := make([]int, size)
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return a[order[i]][order[i]] > a[order[j]][order[j]] })
+
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = a[order[2*i]][order[2*i]]
+	}
+	vectors := make([][]float64, size)
+	for i, col := range order {
+		vectors[i] = make([]float64, size)
+		for k := range vectors[i] {
+			vectors[i][k] = v[k][col]
+		}
+	}
+	return values, vectors
+}
+
+// rfCenterHz returns the carrier at DC: the override if set, otherwise the
+// DDC frequency from metadata (recordings) or the server state (live)
+func rfCenterHz(o *DOAOptions, meta *CaptureMetadata) float64 {
+	if o.RFHz > 0 {
+		return o.RFHz
+	}
+	if meta != nil {
+		if meta.Config != nil && meta.Config.DDC0FreqMHz != nil {
+			return float64(*meta.Config.DDC0FreqMHz) * 1e6
+		}
+		return 0
+	}
+	serverState.mu.RLock()
+	defer serverState.mu.RUnlock()
+	return serverState.DDCFreqMHz * 1e6
+}
+
+// doaRecording estimates bearings from consecutive FFTs of a recording
+func doaRecording(o *DOAOptions) (*DOAResult, error) {
+	opts, err := o.Validate()
+	if err != nil {
+		return nil, err
+	}
+	g, err := currentArray()
+	if err != nil {
+		return nil, err
+	}
+	elements, err := g.subset(o.Channels)
+	if err != nil {
+		return nil, err
+	}
+	var channels []int
+	for _, e := range elements {
+		channels = append(channels, e.Channel)
+	}
+
+	path := filepath.Join(dataFolder, o.Filename)
+	r, err := openRecording(path, channels)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := r.SeekFrame(o.StartSample); err != nil {
+		return nil, err
+	}
+	rf := rfCenterHz(o, r.meta)
+	if rf <= 0 {
+		return nil, fmt.Errorf("recording has no DDC frequency; set rf_hz")
+	}
+
+	acc := newDOAAccumulator(o, elements, opts.FFTSize)
+	spectra := make(map[int][]complex128)
+	for _, ch := range channels {
+		spectra[ch] = make([]complex128, opts.FFTSize)
+	}
+	for n := 0; n < o.Snapshots; n++ {
+		if _, err := r.Read(opts.FFTSize); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if len(r.I[0]) < opts.FFTSize {
+			break
+		}
+		for k, ch := range channels {
+			chOpts := opts
+			chOpts.Cal = r.powerCurve(ch)
+			if err := computeComplexSpectrumInto(spectra[ch], r.I[k], r.Q[k], chOpts); err != nil {
+				return nil, err
+			}
+		}
+		acc.add(spectra)
+	}
+	if acc.count == 0 {
+		return nil, fmt.Errorf("recording has fewer than %d samples after sample %d", opts.FFTSize, o.StartSample)
+	}
+	return acc.result(o.Filename, rf), nil
+}
+
+// doaLive estimates bearings from the next Snapshots stream frames
+func doaLive(o *DOAOptions) (*DOAResult, error) {
+	if _, err := o.Validate(); err != nil {
+		return nil, err
+	}
+	g, err := currentArray()
+	if err != nil {
+		return nil, err
+	}
+	elements, err := g.subset(o.Channels)
+	if err != nil {
+		return nil, err
+	}
+	var channels []int
+	for _, e := range elements {
+		channels = append(channels, e.Channel)
+	}
+
+	var acc *doaAccumulator
+	var opts SpectrumOptions
+	err = forEachLiveFrame(o.Snapshots, func(frame liveFrame) error {
+		if acc == nil {
+			var err error
+			if opts, err = parseSpectrumOptions(frame.fftSize, o.Window, o.WindowParam, ScalingTone); err != nil {
+				return err
+			}
+			acc = newDOAAccumulator(o, elements, frame.fftSize)
+		} else if frame.fftSize != acc.fftSize {
+			return fmt.Errorf("stream FFT size changed during measurement")
+		}
+		spectra, err := liveComplexSpectra(frame, channels, opts)
+		if err != nil {
+			return err
+		}
+		acc.add(spectra)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return acc.result("live", rfCenterHz(o, nil)), nil
+}
+
+// clientDOA is a client's live DOA subscription; a result is sent every
+// Snapshots frames
+type clientDOA struct {
+	opts     DOAOptions
+	elements []ArrayElement
+	acc      *doaAccumulator
+	spectrum SpectrumOptions
+}
+
+// update folds in one frame and returns a message when a result is due.
+// Caller holds the client lock.
+func (cd *clientDOA) update(frame liveFrame) (map[string]interface{}, error) {
+	if cd.acc == nil || cd.acc.fftSize != frame.fftSize {
+		opts, err := parseSpectrumOptions(frame.fftSize, cd.opts.Window, cd.opts.WindowParam, ScalingTone)
+		if err != nil {
+			return nil, err
+		}
+		cd.spectrum = opts
+		cd.acc = newDOAAccumulator(&cd.opts, cd.elements, frame.fftSize)
+	}
+	var channels []int
+	for _, e := range cd.elements {
+		channels = append(channels, e.Channel)
+	}
+	spectra, err := liveComplexSpectra(frame, channels, cd.spectrum)
+	if err != nil {
+		return nil, err
+	}
+	cd.acc.add(spectra)
+	if cd.acc.count < cd.opts.Snapshots {
+		return nil, nil
+	}
+	res := cd.acc.result("live", rfCenterHz(&cd.opts, nil))
+	cd.acc = nil
+	return map[string]interface{}{"type": "doa", "doa": res}, nil
+}
+
+// startClientDOA replaces the client's DOA subscription. nil stops it; with
+// a filename the recording is processed once in the background.
+func startClientDOA(client *Client, o *DOAOptions) error {
+	if o == nil {
+		client.mu.Lock()
+		client.doa = nil
+		client.mu.Unlock()
+		return nil
+	}
+	if _, err := o.Validate(); err != nil {
+		return err
+	}
+	if o.Filename != "" {
+		go func() {
+			var msg map[string]interface{}
+			if res, err := doaRecording(o); err != nil {
+				msg = map[string]interface{}{"type": "doa_error", "error": err.Error()}
+			} else {
+				msg = map[string]interface{}{"type": "doa", "doa": res}
+			}
+			sendToClient(client, msg, nil)
+		}()
+		return nil
+	}
+
+	g, err := currentArray()
+	if err != nil {
+		return err
+	}
+	elements, err := g.subset(o.Channels)
+	if err != nil {
+		return err
+	}
+	client.mu.Lock()
+	client.doa = &clientDOA{opts: *o, elements: elements}
+	client.mu.Unlock()
+	return nil
+}
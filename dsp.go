@@ -1,100 +1,258 @@
 package main
 
 import (
+	"fmt"
 	"math"
-	"math/cmplx"
+	"sync"
+
+	"github.com/dma/pkg/fft"
+)
+
+// Spectrum scaling modes
+const (
+	ScalingTone    = "tone"    // dBm, amplitude-correct for a tone centered in a bin
+	ScalingDensity = "density" // dBm/Hz, correct for noise-like signals
+)
+
+// For I/Q (complex) FFT, full scale sine appears in ONE bin (no pos/neg split)
+// Reference: full-scale amplitude = 2048, after windowed FFT = 2048 * windowSum
+const (
+	fullScaleAmplitude = 32768.0
+	fullScaleDBm       = 3.9
 )
 
+// SpectrumOptions selects the FFT size, window and output scaling
+type SpectrumOptions struct {
+	FFTSize    int
+	Window     fft.WindowSpec
+	Scaling    string
+	SampleRate float64 // Hz; 0 = captureSampleRate, sub-channels run slower
+	Cal        *powerCurve // Power calibration of the channel; nil = nominal fullScaleDBm
+}
+
+// sampleRate returns the sample rate the spectrum is scaled for
+func (o SpectrumOptions) sampleRate() float64 {
+	if o.SampleRate > 0 {
+		return o.SampleRate
+	}
+	return captureSampleRate
+}
+
+// defaultSpectrumOptions is the original Blackman, tone-scaled spectrum
+func defaultSpectrumOptions(fftSize int) SpectrumOptions {
+	return SpectrumOptions{FFTSize: fftSize, Window: fft.WindowSpec{Kind: fft.Blackman}, Scaling: ScalingTone}
+}
+
+// parseSpectrumOptions builds options from user-facing window/scaling names
+func parseSpectrumOptions(fftSize int, window string, windowParam float64, scaling string) (SpectrumOptions, error) {
+	spec, err := fft.ParseWindow(window, windowParam)
+	if err != nil {
+		return SpectrumOptions{}, err
+	}
+	switch scaling {
+	case "":
+		scaling = ScalingTone
+	case ScalingTone, ScalingDensity:
+	default:
+		return SpectrumOptions{}, fmt.Errorf("unknown scaling %q (want tone or density)", scaling)
+	}
+	if err := checkFFTSize(fftSize); err != nil {
+		return SpectrumOptions{}, err
+	}
+	return SpectrumOptions{FFTSize: fftSize, Window: spec, Scaling: scaling}, nil
+}
+
+// maxFFTSize bounds client-requested FFT sizes; plans and windows stay
+// cached per size for the life of the process
+const maxFFTSize = 1 << 20
+
+// checkFFTSize accepts sizes from 2 to maxFFTSize whose prime factors are
+// 2, 3 and 5 only, so no request falls back to the slow odd-prime radix
+func checkFFTSize(n int) error {
+	if n < 2 || n > maxFFTSize {
+		return fmt.Errorf("fft size must be between 2 and %d", maxFFTSize)
+	}
+	m := n
+	for _, p := range []int{2, 3, 5} {
+		for m%p == 0 {
+			m /= p
+		}
+	}
+	if m != 1 {
+		return fmt.Errorf("fft size %d has a prime factor above 5", n)
+	}
+	return nil
+}
+
+// WindowInfo describes a window at a given FFT size
+type WindowInfo struct {
+	Window       fft.WindowKind `json:"window"`
+	Param        float64        `json:"param,omitempty"`
+	FFTSize      int            `json:"fft_size"`
+	CoherentGain float64        `json:"coherent_gain"`
+	CoherentDB   float64        `json:"coherent_gain_db"`
+	ENBWBins     float64        `json:"enbw_bins"`
+	BinWidthHz   float64        `json:"bin_width_hz"`
+	RBWHz        float64        `json:"rbw_hz"` // ENBW in Hz
+}
+
+// windowInfo reports the gain and noise bandwidth of the options' window
+func windowInfo(opts SpectrumOptions) (*WindowInfo, error) {
+	w, err := fft.GetWindowSpec(opts.Window, opts.FFTSize)
+	if err != nil {
+		return nil, err
+	}
+	binWidth := opts.sampleRate() / float64(opts.FFTSize)
+	return &WindowInfo{
+		Window:       opts.Window.Kind,
+		Param:        opts.Window.Param,
+		FFTSize:      opts.FFTSize,
+		CoherentGain: w.CoherentGain,
+		CoherentDB:   20 * math.Log10(w.CoherentGain),
+		ENBWBins:     w.ENBW,
+		BinWidthHz:   binWidth,
+		RBWHz:        w.ENBW * binWidth,
+	}, nil
+}
+
+// fftBuffers reuses complex work buffers between computeFFT calls
+var fftBuffers sync.Pool
+
 // computeFFT computes power spectrum in dBm from I/Q samples
 func computeFFT(iSamples, qSamples []int16, fftSize int) []float64 {
-	// Generate Blackman window and compute its sum for normalization
-	window := make([]float64, fftSize)
-	windowSum := 0.0
-	for i := 0; i < fftSize; i++ {
-		// Blackman window
-		window[i] = 0.42 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(fftSize-1)) +
-			0.08*math.Cos(4*math.Pi*float64(i)/float64(fftSize-1))
-		windowSum += window[i]
+	result := make([]float64, fftSize)
+	computeSpectrumInto(result, iSamples, qSamples, defaultSpectrumOptions(fftSize))
+	return result
+}
+
+// computeSpectrum computes a DC-centered power spectrum with the given window
+// and scaling. Tone scaling divides by the window's coherent gain so a tone's
+// peak reads its power in dBm; density scaling divides by the window's noise
+// bandwidth so noise reads in dBm/Hz independent of FFT size and window.
+func computeSpectrum(iSamples, qSamples []int16, opts SpectrumOptions) ([]float64, error) {
+	result := make([]float64, opts.FFTSize)
+	if err := computeSpectrumInto(result, iSamples, qSamples, opts); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// computeSpectrumInto is computeSpectrum writing into a caller-provided result slice
+func computeSpectrumInto(result []float64, iSamples, qSamples []int16, opts SpectrumOptions) error {
+	if err := computePowerSpectrumInto(result, iSamples, qSamples, opts); err != nil {
+		return err
+	}
+	for i, p := range result[:opts.FFTSize] {
+		result[i] = powerToDBm(p)
 	}
+	return nil
+}
+
+// powerToDBm converts linear power in mW (or mW/Hz) to dBm, floored at -150
+func powerToDBm(p float64) float64 {
+	if p > 0 {
+		return 10 * math.Log10(p)
+	}
+	return -150.0
+}
+
+// computePowerSpectrumInto computes the DC-centered spectrum as linear power
+// in mW per bin (tone scaling) or mW/Hz (density scaling). Averaging and
+// band integration should be done on these values rather than on dBm.
+func computePowerSpectrumInto(result []float64, iSamples, qSamples []int16, opts SpectrumOptions) error {
+	fftSize := opts.FFTSize
+	if len(iSamples) < fftSize || len(qSamples) < fftSize || len(result) < fftSize {
+		return fmt.Errorf("need %d samples, have %d", fftSize, len(iSamples))
+	}
+
+	// Window and plan are cached per size
+	window, err := fft.GetWindowSpec(opts.Window, fftSize)
+	if err != nil {
+		return err
+	}
+	plan := fft.PlanFor(fftSize)
+
+	bufp, _ := fftBuffers.Get().(*[]complex128)
+	if bufp == nil || cap(*bufp) < fftSize {
+		buf := make([]complex128, fftSize)
+		bufp = &buf
+	}
+	input := (*bufp)[:fftSize]
 
 	// Build complex input with window applied
-	input := make([]complex128, fftSize)
-	for i := 0; i < fftSize; i++ {
-		input[i] = complex(float64(iSamples[i])*window[i], float64(qSamples[i])*window[i])
+	for i, w := range window.Coeffs {
+		input[i] = complex(float64(iSamples[i])*w, float64(qSamples[i])*w)
 	}
 
-	output := fft(input)
+	plan.InPlace(input)
 
-	// Compute power in dBm and shift so DC is in center
-	result := make([]float64, fftSize)
+	// Shift so DC is in center
 	halfSize := fftSize / 2
-
-	// For I/Q (complex) FFT, full scale sine appears in ONE bin (no pos/neg split)
-	// Reference: full-scale amplitude = 2048, after windowed FFT = 2048 * windowSum
-	const fullScaleAmplitude = 32768.0
-	const fullScaleDBm = 3.9
-	reference := fullScaleAmplitude * windowSum
+	scale := spectrumScale(window, opts)
 
 	for i := 0; i < fftSize; i++ {
 		// FFT shift: move DC to center
-		srcIdx := (i + halfSize) % fftSize
-		mag := cmplx.Abs(output[srcIdx])
-
-		// Convert to dBm
-		var powerDBm float64
-		if mag > 0 {
-			powerDBm = 20*math.Log10(mag/reference) + fullScaleDBm
-		} else {
-			powerDBm = -150.0
+		v := input[(i+halfSize)%fftSize]
+		result[i] = (real(v)*real(v) + imag(v)*imag(v)) * scale
+	}
+	if gains := opts.Cal.binGains(fftSize, opts.sampleRate()); gains != nil {
+		for i, g := range gains {
+			result[i] *= g
 		}
-
-		result[i] = powerDBm
 	}
 
-	return result
+	fftBuffers.Put(bufp)
+	return nil
 }
 
-// Simple radix-2 FFT implementation
-func fft(x []complex128) []complex128 {
-	n := len(x)
-	if n <= 1 {
-		return x
-	}
-
-	// Bit-reversal permutation
-	result := make([]complex128, n)
-	bits := 0
-	for temp := n; temp > 1; temp >>= 1 {
-		bits++
-	}
-	for i := 0; i < n; i++ {
-		j := 0
-		for k := 0; k < bits; k++ {
-			if i&(1<<k) != 0 {
-				j |= 1 << (bits - 1 - k)
-			}
-		}
-		result[j] = x[i]
-	}
-
-	// Cooley-Tukey iterative FFT
-	for size := 2; size <= n; size *= 2 {
-		halfSize := size / 2
-		tableStep := n / size
-		for i := 0; i < n; i += size {
-			k := 0
-			for j := i; j < i+halfSize; j++ {
-				// Twiddle factor
-				angle := -2 * math.Pi * float64(k) / float64(n)
-				w := cmplx.Exp(complex(0, angle))
-
-				t := result[j+halfSize] * w
-				result[j+halfSize] = result[j] - t
-				result[j] = result[j] + t
-				k += tableStep
-			}
-		}
+// spectrumScale converts |X|^2 of a windowed FFT to mW (tone) or mW/Hz (density)
+func spectrumScale(window *fft.Window, opts SpectrumOptions) float64 {
+	var refPower, offsetDB float64
+	switch opts.Scaling {
+	case ScalingDensity:
+		// For white noise |X|^2 / sum(w^2) estimates the total in-band power;
+		// dividing by the sample rate gives power per Hz
+		refPower = fullScaleAmplitude * fullScaleAmplitude * window.SumSq
+		offsetDB = fullScaleDBm - 10*math.Log10(opts.sampleRate())
+	default:
+		reference := fullScaleAmplitude * window.Sum
+		refPower = reference * reference
+		offsetDB = fullScaleDBm
 	}
+	return math.Pow(10, offsetDB/10) / refPower
+}
 
-	return result
+// computeComplexSpectrumInto computes the DC-centered complex spectrum, scaled
+// so that |X|^2 is the power computePowerSpectrumInto would report. Phase is
+// relative to the first sample.
+func computeComplexSpectrumInto(result []complex128, iSamples, qSamples []int16, opts SpectrumOptions) error {
+	fftSize := opts.FFTSize
+	if len(iSamples) < fftSize || len(qSamples) < fftSize || len(result) < fftSize {
+		return fmt.Errorf("need %d samples, have %d", fftSize, len(iSamples))
+	}
+	window, err := fft.GetWindowSpec(opts.Window, fftSize)
+	if err != nil {
+		return err
+	}
+	input := result[:fftSize]
+	for i, w := range window.Coeffs {
+		input[i] = complex(float64(iSamples[i])*w, float64(qSamples[i])*w)
+	}
+	fft.PlanFor(fftSize).InPlace(input)
+
+	// Rotate in place so DC is in the center, then scale
+	halfSize := fftSize / 2
+	rotated := append([]complex128(nil), input[halfSize:]...)
+	copy(input[fftSize-halfSize:], input[:halfSize])
+	copy(input, rotated)
+	scale := complex(math.Sqrt(spectrumScale(window, opts)), 0)
+	for i := range input {
+		input[i] *= scale
+	}
+	if gains := opts.Cal.binGains(fftSize, opts.sampleRate()); gains != nil {
+		for i, g := range gains {
+			input[i] *= complex(math.Sqrt(g), 0)
+		}
+	}
+	return nil
 }
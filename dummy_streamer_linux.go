@@ -21,6 +21,9 @@ func RunSimulator(devicePath string) {
 	}
 
 	log.Printf("[SIM] Streaming 12-bit LSB aligned data to: %s", devicePath)
+	if simScenario != nil {
+		log.Printf("[SIM] Plane-wave scenario: %d sources at %.3f MHz", len(simScenario.Sources), simScenario.RFHz/1e6)
+	}
 
 	fd, err := unix.Open(devicePath, unix.O_WRONLY, 0)
 	if err != nil {
@@ -66,47 +69,53 @@ func RunSimulator(devicePath string) {
 	// Create a fast local random source for dithering (global rand is slow due to locks)
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 
+	var written int64
 	for {
-		for s := 0; s < samplesPerWrite; s++ {
-			for c := 0; c < numChannels; c++ {
+		if simScenario != nil {
+			simScenario.fill(writeBuf, written, rng)
+			written += samplesPerWrite
+		} else {
+			for s := 0; s < samplesPerWrite; s++ {
+				for c := 0; c < numChannels; c++ {
 				
-				// 1. Calculate Phase
-				// Add the channel offset to the current time accumulator
-				currentPhaseInt := phaseAcc + chanOffsets[c]
+					// 1. Calculate Phase
+					// Add the channel offset to the current time accumulator
+					currentPhaseInt := phaseAcc + chanOffsets[c]
 				
-				// Convert back to Radians for math.Cos/Sin
-				// angle = (int_phase / 2^32) * 2*Pi
-				rads := float64(currentPhaseInt) * (2.0 * math.Pi / 4294967296.0)
-
-				// 2. Generate Signal
-				valI := amplitude * math.Cos(rads)
-				valQ := amplitude * math.Sin(rads)
-
-				// 3. APPLY DITHER (The Fix)
-				// We add triangular dither (+/- 1 LSB) to randomize quantization error.
-				// This turns harmonic spurs into a flat noise floor.
-				ditherI := rng.Float64() - rng.Float64()
-				ditherQ := rng.Float64() - rng.Float64()
-
-				valI += ditherI
-				valQ += ditherQ
-
-				// 4. Clamp and Cast
-				if valI > 2047 { valI = 2047 }
-				if valI < -2048 { valI = -2048 }
-				if valQ > 2047 { valQ = 2047 }
-				if valQ < -2048 { valQ = -2048 }
-
-				iVal := int16(valI)
-				qVal := int16(valQ)
-
-				idx := (s*numChannels + c) * 4
-				binary.LittleEndian.PutUint16(writeBuf[idx:], uint16(iVal))
-				binary.LittleEndian.PutUint16(writeBuf[idx+2:], uint16(qVal))
-			}
+					// Convert back to Radians for math.Cos/Sin
+					// angle = (int_phase / 2^32) * 2*Pi
+					rads := float64(currentPhaseInt) * (2.0 * math.Pi / 4294967296.0)
+
+					// 2. Generate Signal
+					valI := amplitude * math.Cos(rads)
+					valQ := amplitude * math.Sin(rads)
+
+					// 3. APPLY DITHER (The Fix)
+					// We add triangular dither (+/- 1 LSB) to randomize quantization error.
+					// This turns harmonic spurs into a flat noise floor.
+					ditherI := rng.Float64() - rng.Float64()
+					ditherQ := rng.Float64() - rng.Float64()
+
+					valI += ditherI
+					valQ += ditherQ
+
+					// 4. Clamp and Cast
+					if valI > adcMaxCode { valI = adcMaxCode }
+					if valI < -adcMaxCode-1 { valI = -adcMaxCode - 1 }
+					if valQ > adcMaxCode { valQ = adcMaxCode }
+					if valQ < -adcMaxCode-1 { valQ = -adcMaxCode - 1 }
+
+					iVal := int16(valI)
+					qVal := int16(valQ)
+
+					idx := (s*numChannels + c) * 4
+					binary.LittleEndian.PutUint16(writeBuf[idx:], uint16(iVal))
+					binary.LittleEndian.PutUint16(writeBuf[idx+2:], uint16(qVal))
+				}
 			
-			// Increment time phase
-			phaseAcc += tuningWord
+				// Increment time phase
+				phaseAcc += tuningWord
+			}
 		}
 
 		if _, err := unix.Write(fd, writeBuf); err != nil {
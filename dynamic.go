@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"time"
+)
+
+// DynamicOptions configures the ADC dynamic performance analysis (SNR, SFDR,
+// THD, SINAD, ENOB) of a single clean tone
+type DynamicOptions struct {
+	Channels      []int    `json:"channels"`       // User-facing channels; empty = all
+	FundamentalHz *float64 `json:"fundamental_hz"` // Offset from DC; nil = strongest bin outside the DC exclusion
+	Harmonics     int      `json:"harmonics"`      // Harmonics in THD, from the 2nd; default 5 (2nd-6th)
+	ToneBins      int      `json:"tone_bins"`      // Half-width excluded around the fundamental and each harmonic; 0 = from the window
+	DCBins        int      `json:"dc_bins"`        // Half-width excluded around DC; 0 = same as tone_bins, -1 = none
+	FFTSize       int      `json:"fft_size"`       // Default 8192; live data uses the stream's FFT size
+	Window        string   `json:"window"`         // Default blackman-harris
+	WindowParam   float64  `json:"window_param"`
+	Averages      int      `json:"averages"`         // Power-averaged FFTs, default 4
+	FullScale     float64  `json:"full_scale_codes"` // Peak code of a full-scale tone, default 32768 (2048 for 12-bit data)
+
+	Limits *DynamicLimits `json:"limits,omitempty"`
+
+	// Recording source; empty Filename means live data
+	Filename    string `json:"filename,omitempty"`
+	StartSample int64  `json:"start_sample,omitempty"`
+}
+
+// DynamicLimits are optional pass/fail limits; unset limits are not checked
+type DynamicLimits struct {
+	MinSNRDB   *float64 `json:"min_snr_db,omitempty"`
+	MinSFDRDB  *float64 `json:"min_sfdr_dbc,omitempty"`
+	MaxTHDDB   *float64 `json:"max_thd_dbc,omitempty"`
+	MinSINADDB *float64 `json:"min_sinad_db,omitempty"`
+	MinENOB    *float64 `json:"min_enob,omitempty"`
+}
+
+// Validate checks the options, fills in defaults and returns the spectrum options
+func (o *DynamicOptions) Validate() (SpectrumOptions, error) {
+	for _, ch := range o.Channels {
+		if ch < 1 || ch > maxChannel {
+			return SpectrumOptions{}, fmt.Errorf("channel must be between 1 and %d", maxChannel)
+		}
+	}
+	if o.Harmonics == 0 {
+		o.Harmonics = 5
+	}
+	if o.Harmonics < 0 || o.ToneBins < 0 || o.DCBins < -1 {
+		return SpectrumOptions{}, fmt.Errorf("harmonics, tone_bins and dc_bins must be positive")
+	}
+	if o.FFTSize == 0 {
+		o.FFTSize = 8192
+	}
+	if o.Window == "" {
+		o.Window = "blackman-harris"
+	}
+	if o.Averages == 0 {
+		o.Averages = 4
+	}
+	if o.Averages < 1 {
+		return SpectrumOptions{}, fmt.Errorf("averages must be positive")
+	}
+	if o.FullScale == 0 {
+		o.FullScale = fullScaleAmplitude
+	}
+	if o.FullScale < 0 {
+		return SpectrumOptions{}, fmt.Errorf("full_scale_codes must be positive")
+	}
+	if o.Filename != "" {
+		o.Filename = filepath.Base(o.Filename)
+	}
+	if o.FundamentalHz != nil && math.Abs(*o.FundamentalHz) >= captureSampleRate/2 {
+		return SpectrumOptions{}, fmt.Errorf("fundamental_hz is outside the captured band")
+	}
+	opts, err := parseSpectrumOptions(o.FFTSize, o.Window, o.WindowParam, ScalingDensity)
+	if err != nil {
+		return SpectrumOptions{}, err
+	}
+	o.Window, o.WindowParam = string(opts.Window.Kind), opts.Window.Param
+	return opts, nil
+}
+
+// HarmonicResult is the power of one harmonic
+type HarmonicResult struct {
+	Order    int     `json:"order"`
+	FreqHz   float64 `json:"freq_hz"` // Folded into the captured band
+	PowerDBc float64 `json:"power_dbc"`
+	Excluded bool    `json:"excluded,omitempty"` // Falls on DC, the fundamental or a lower harmonic; not in THD
+}
+
+// ChannelDynamics holds one channel's dynamic performance
+type ChannelDynamics struct {
+	Channel         int              `json:"channel"`
+	FundamentalHz   float64          `json:"fundamental_hz"`
+	FundamentalDBm  float64          `json:"fundamental_dbm"`
+	FundamentalDBFS float64          `json:"fundamental_dbfs"`
+	NoiseDBm        float64          `json:"noise_dbm"` // Total noise over the band, excluded bins filled with the mean
+	SNRDB           float64          `json:"snr_db"`
+	SFDRDBc         float64          `json:"sfdr_dbc"`
+	SpurHz          float64          `json:"spur_hz"` // Largest spur, harmonic or not
+	THDDBc          float64          `json:"thd_dbc"`
+	SINADDB         float64          `json:"sinad_db"`
+	ENOB            float64          `json:"enob"`    // From SINAD
+	ENOBFullScale   float64          `json:"enob_fs"` // Corrected to a full-scale tone
+	Harmonics       []HarmonicResult `json:"harmonics"`
+	Pass            *bool            `json:"pass,omitempty"`
+	Failures        []string         `json:"failures,omitempty"`
+}
+
+// DynamicResult is one analysis across channels
+type DynamicResult struct {
+	Source   string            `json:"source"` // "live" or the recording filename
+	Time     time.Time         `json:"time"`
+	FFTSize  int               `json:"fft_size"`
+	Averages int               `json:"averages"`
+	BinHz    float64           `json:"bin_hz"`
+	ToneBins int               `json:"tone_bins"`
+	DCBins   int               `json:"dc_bins"`
+	Pass     *bool             `json:"pass,omitempty"` // All channels within limits
+	Options  DynamicOptions    `json:"options"`
+	Channels []ChannelDynamics `json:"channels"`
+}
+
+// foldHz folds a frequency into the captured band [-fs/2, fs/2)
+func foldHz(f float64) float64 {
+	const fs = captureSampleRate
+	f = math.Mod(f+fs/2, fs)
+	if f < 0 {
+		f += fs
+	}
+	return f - fs/2
+}
+
+// analyzeDynamics computes the metrics of an averaged density spectrum
+// (mW/Hz, DC-centered). Bins around DC, the fundamental and the harmonics are
+// left out of the noise.
+func analyzeDynamics(ch int, density []float64, binHz float64, toneBins, dcBins int, o *DynamicOptions, cal *powerCurve) ChannelDynamics {
+	n := len(density)
+	d := ChannelDynamics{Channel: ch, Harmonics: []HarmonicResult{}}
+	excluded := make([]bool, n)
+	binOf := func(f float64) int { return int(math.Round(f/binHz)) + n/2 }
+	region := func(center, half int) (int, int) {
+		lo, hi := center-half, center+half
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > n-1 {
+			hi = n - 1
+		}
+		return lo, hi
+	}
+	sum := func(lo, hi int) float64 {
+		total := 0.0
+		for k := lo; k <= hi; k++ {
+			total += density[k]
+		}
+		return total * binHz
+	}
+	overlaps := func(lo, hi int) bool {
+		for k := lo; k <= hi; k++ {
+			if excluded[k] {
+				return true
+			}
+		}
+		return false
+	}
+	mark := func(lo, hi int) {
+		for k := lo; k <= hi; k++ {
+			excluded[k] = true
+		}
+	}
+
+	if dcBins >= 0 {
+		mark(region(n/2, dcBins))
+	}
+
+	// Fundamental: the given frequency, or the strongest bin outside DC
+	peak := -1
+	if o.FundamentalHz != nil {
+		lo, hi := region(binOf(*o.FundamentalHz), toneBins)
+		for k := lo; k <= hi; k++ {
+			if peak < 0 || density[k] > density[peak] {
+				peak = k
+			}
+		}
+	} else {
+		for k := range density {
+			if !excluded[k] && (peak < 0 || density[k] > density[peak]) {
+				peak = k
+			}
+		}
+	}
+	fLo, fHi := region(peak, toneBins)
+	fundamental := sum(fLo, fHi)
+	// Power-weighted centroid locates the tone between bins for the harmonics
+	weighted := 0.0
+	for k := fLo; k <= fHi; k++ {
+		weighted += float64(k-n/2) * density[k] * binHz
+	}
+	d.FundamentalHz = weighted / fundamental * binHz
+	d.FundamentalDBm = powerToDBm(fundamental)
+	d.FundamentalDBFS = d.FundamentalDBm - cal.fullScaleDBm(d.FundamentalHz) + 20*math.Log10(fullScaleAmplitude/o.FullScale)
+	mark(fLo, fHi)
+
+	// Harmonics n*f0, aliased back into the captured band
+	harmonics := 0.0
+	for order := 2; order <= o.Harmonics+1; order++ {
+		h := HarmonicResult{Order: order, FreqHz: foldHz(float64(order) * d.FundamentalHz)}
+		lo, hi := region(binOf(h.FreqHz), toneBins)
+		p := sum(lo, hi)
+		h.PowerDBc = powerToDBm(p) - d.FundamentalDBm
+		if overlaps(lo, hi) {
+			h.Excluded = true
+		} else {
+			harmonics += p
+		}
+		mark(lo, hi)
+		d.Harmonics = append(d.Harmonics, h)
+	}
+
+	// Noise: the mean of the remaining bins, extended over the whole band
+	noiseSum, noiseBins := 0.0, 0
+	for k, p := range density {
+		if !excluded[k] {
+			noiseSum += p
+			noiseBins++
+		}
+	}
+	noise := 0.0
+	if noiseBins > 0 {
+		noise = noiseSum / float64(noiseBins) * float64(n) * binHz
+	}
+
+	// Largest spur outside DC and the fundamental, harmonics included
+	spurPeak := -1
+	for k := range density {
+		inFundamental := k >= fLo && k <= fHi
+		inDC := dcBins >= 0 && k >= n/2-dcBins && k <= n/2+dcBins
+		if !inFundamental && !inDC && (spurPeak < 0 || density[k] > density[spurPeak]) {
+			spurPeak = k
+		}
+	}
+	spur := 0.0
+	if spurPeak >= 0 {
+		lo, hi := region(spurPeak, toneBins)
+		for k := lo; k <= hi; k++ {
+			if !(k >= fLo && k <= fHi) && !(dcBins >= 0 && k >= n/2-dcBins && k <= n/2+dcBins) {
+				spur += density[k] * binHz
+			}
+		}
+		d.SpurHz = float64(spurPeak-n/2) * binHz
+	}
+
+	// Capped at 300 dB so an empty term still encodes as JSON
+	ratioDB := func(num, den float64) float64 {
+		return 10 * math.Log10(num/math.Max(den, num*1e-30))
+	}
+	d.NoiseDBm = powerToDBm(noise)
+	d.SNRDB = ratioDB(fundamental, noise)
+	d.SFDRDBc = ratioDB(fundamental, spur)
+	d.THDDBc = -ratioDB(fundamental, harmonics)
+	d.SINADDB = ratioDB(fundamental, noise+harmonics)
+	d.ENOB = (d.SINADDB - 1.76) / 6.02
+	d.ENOBFullScale = (d.SINADDB - 1.76 - d.FundamentalDBFS) / 6.02
+	d.checkLimits(o.Limits)
+	return d
+}
+
+// checkLimits sets Pass and lists the metrics outside the limits
+func (d *ChannelDynamics) checkLimits(l *DynamicLimits) {
+	if l == nil {
+		return
+	}
+	check := func(name string, value float64, limit *float64, min bool) {
+		if limit == nil {
+			return
+		}
+		if (min && value < *limit) || (!min && value > *limit) {
+			d.Failures = append(d.Failures, fmt.Sprintf("%s %.2f outside limit %.2f", name, value, *limit))
+		}
+	}
+	check("snr_db", d.SNRDB, l.MinSNRDB, true)
+	check("sfdr_dbc", d.SFDRDBc, l.MinSFDRDB, true)
+	check("thd_dbc", d.THDDBc, l.MaxTHDDB, false)
+	check("sinad_db", d.SINADDB, l.MinSINADDB, true)
+	check("enob", d.ENOB, l.MinENOB, true)
+	pass := len(d.Failures) == 0
+	d.Pass = &pass
+}
+
+// defaultToneBins is the half-width holding a tone's main lobe: about twice
+// the window's noise bandwidth, plus a bin for a tone between bins
+func defaultToneBins(opts SpectrumOptions) (int, error) {
+	info, err := windowInfo(opts)
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Ceil(2*info.ENBWBins)) + 1, nil
+}
+
+// newDynamicResult analyzes each channel's averaged density spectrum, which
+// was computed with the channel's power calibration in curves
+func newDynamicResult(o *DynamicOptions, opts SpectrumOptions, source string, averages int, spectra map[int][]float64, curves map[int]*powerCurve) (*DynamicResult, error) {
+	toneBins := o.ToneBins
+	if toneBins == 0 {
+		var err error
+		if toneBins, err = defaultToneBins(opts); err != nil {
+			return nil, err
+		}
+	}
+	dcBins := o.DCBins
+	if dcBins == 0 {
+		dcBins = toneBins
+	}
+	if 2*toneBins+2*dcBins+2 >= opts.FFTSize {
+		return nil, fmt.Errorf("fft_size %d is too small for the exclusion bins", opts.FFTSize)
+	}
+
+	res := &DynamicResult{
+		Source:   source,
+		Time:     time.Now(),
+		FFTSize:  opts.FFTSize,
+		Averages: averages,
+		BinHz:    float64(captureSampleRate) / float64(opts.FFTSize),
+		ToneBins: toneBins,
+		DCBins:   dcBins,
+		Options:  *o,
+	}
+	res.Options.FFTSize = opts.FFTSize
+	for ch := 1; ch <= maxChannel; ch++ {
+		if density, ok := spectra[ch]; ok {
+			d := analyzeDynamics(ch, density, res.BinHz, toneBins, dcBins, o, curves[ch])
+			if d.Pass != nil {
+				pass := *d.Pass && (res.Pass == nil || *res.Pass)
+				res.Pass = &pass
+			}
+			res.Channels = append(res.Channels, d)
+		}
+	}
+	return res, nil
+}
+
+// dynamicsRecording analyzes Averages consecutive FFTs of a recording
+// starting at StartSample
+func dynamicsRecording(o *DynamicOptions) (*DynamicResult, error) {
+	opts, err := o.Validate()
+	if err != nil {
+		return nil, err
+	}
+	r, err := openRecording(filepath.Join(dataFolder, o.Filename), o.Channels)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := r.SeekFrame(o.StartSample); err != nil {
+		return nil, err
+	}
+
+	avg := make([]powerAverager, len(r.channels))
+	curves := make(map[int]*powerCurve)
+	chOpts := make([]SpectrumOptions, len(r.channels))
+	for k, ch := range r.channels {
+		curves[ch] = r.powerCurve(ch)
+		chOpts[k] = opts
+		chOpts[k].Cal = curves[ch]
+	}
+	power := make([]float64, opts.FFTSize)
+	for n := 0; n < o.Averages; n++ {
+		got, err := r.Read(opts.FFTSize)
+		if err == io.EOF || got < opts.FFTSize {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for k := range r.channels {
+			if err := computePowerSpectrumInto(power, r.I[k], r.Q[k], chOpts[k]); err != nil {
+				return nil, err
+			}
+			avg[k].add(power)
+		}
+	}
+	if avg[0].count == 0 {
+		return nil, fmt.Errorf("recording has fewer than %d samples after sample %d", opts.FFTSize, o.StartSample)
+	}
+
+	spectra := make(map[int][]float64)
+	for k, ch := range r.channels {
+		spectra[ch] = avg[k].mean()
+	}
+	return newDynamicResult(o, opts, o.Filename, avg[0].count, spectra, curves)
+}
+
+// dynamicsLive analyzes the next Averages stream frames at the stream's FFT size
+func dynamicsLive(o *DynamicOptions) (*DynamicResult, error) {
+	if _, err := o.Validate(); err != nil {
+		return nil, err
+	}
+	channels := o.Channels
+	if len(channels) == 0 {
+		channels = []int{1, 2, 3, 4, 5, 6, 7, 8}
+	}
+
+	var opts SpectrumOptions
+	avg := make(map[int]*powerAverager)
+	curves := make(map[int]*powerCurve)
+	err := forEachLiveFrame(o.Averages, func(frame liveFrame) error {
+		if opts.FFTSize == 0 {
+			opts, _ = parseSpectrumOptions(frame.fftSize, o.Window, o.WindowParam, ScalingDensity)
+		} else if frame.fftSize != opts.FFTSize {
+			return fmt.Errorf("stream FFT size changed during measurement")
+		}
+		for _, ch := range channels {
+			i, q, err := frame.channel(ch)
+			if err != nil {
+				return err
+			}
+			p := make([]float64, opts.FFTSize)
+			chOpts := opts
+			chOpts.Cal = frame.powerCurve(ch)
+			curves[ch] = chOpts.Cal
+			if err := computePowerSpectrumInto(p, i, q, chOpts); err != nil {
+				return err
+			}
+			if avg[ch] == nil {
+				avg[ch] = &powerAverager{}
+			}
+			avg[ch].add(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	spectra := make(map[int][]float64)
+	for ch, a := range avg {
+		spectra[ch] = a.mean()
+	}
+	return newDynamicResult(o, opts, "live", o.Averages, spectra, curves)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestDynamicsTone checks SNR, THD, SFDR and SINAD of a tone with known
+// harmonics and noise, including a 3rd harmonic aliased past fs/2
+func TestDynamicsTone(t *testing.T) {
+	const n = 8192
+	binHz := float64(captureSampleRate) / n
+	o := DynamicOptions{Harmonics: 2}
+	opts, err := o.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.FFTSize = n
+	opts.FFTSize = n
+
+	// -6 dBFS at 1500.3 bins, 2nd at -60 dBc, 3rd at -70 dBc, SNR 60 dB
+	amp := fullScaleAmplitude / 2
+	sigma := amp / math.Sqrt(2e6)
+	tones := []struct{ bins, amp float64 }{{1500.3, amp}, {3000.6, amp * 1e-3}, {4500.9, amp * math.Pow(10, -3.5)}}
+	rng := rand.New(rand.NewSource(1))
+	avg := &powerAverager{}
+	for frame := 0; frame < 8; frame++ {
+		i, q := make([]int16, n), make([]int16, n)
+		for k := range i {
+			re, im := rng.NormFloat64()*sigma, rng.NormFloat64()*sigma
+			for _, tone := range tones {
+				ph := 2 * math.Pi * tone.bins * float64(frame*n+k) / n
+				re += tone.amp * math.Cos(ph)
+				im += tone.amp * math.Sin(ph)
+			}
+			i[k], q[k] = int16(math.Round(re)), int16(math.Round(im))
+		}
+		p := make([]float64, n)
+		if err := computePowerSpectrumInto(p, i, q, opts); err != nil {
+			t.Fatal(err)
+		}
+		avg.add(p)
+	}
+
+	res, err := newDynamicResult(&o, opts, "test", avg.count, map[int][]float64{1: avg.mean()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := res.Channels[0]
+	if math.Abs(d.FundamentalHz/binHz-1500.3) > 0.05 {
+		t.Errorf("fundamental at %.2f bins, want 1500.3", d.FundamentalHz/binHz)
+	}
+	if got := d.Harmonics[1].FreqHz / binHz; math.Abs(got-(4500.9-n)) > 0.5 {
+		t.Errorf("3rd harmonic at %.1f bins, want %.1f", got, 4500.9-n)
+	}
+	checks := []struct {
+		name      string
+		got, want float64
+	}{
+		{"fundamental dBFS", d.FundamentalDBFS, -6.02},
+		{"snr", d.SNRDB, 60},
+		{"2nd harmonic", d.Harmonics[0].PowerDBc, -60},
+		{"3rd harmonic", d.Harmonics[1].PowerDBc, -70},
+		{"thd", d.THDDBc, 10 * math.Log10(1e-6+1e-7)},
+		{"sfdr", d.SFDRDBc, 60},
+		{"sinad", d.SINADDB, -10 * math.Log10(1e-6+1e-6+1e-7)},
+	}
+	for _, c := range checks {
+		if math.Abs(c.got-c.want) > 0.5 {
+			t.Errorf("%s %.2f, want %.2f", c.name, c.got, c.want)
+		}
+	}
+
+	limit := 70.0
+	o.Limits = &DynamicLimits{MinSNRDB: &limit}
+	res, _ = newDynamicResult(&o, opts, "test", avg.count, map[int][]float64{1: avg.mean()}, nil)
+	if res.Pass == nil || *res.Pass || len(res.Channels[0].Failures) != 1 {
+		t.Errorf("SNR limit of 70 dB should fail, got %v", res.Channels[0].Failures)
+	}
+}
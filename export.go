@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sample formats a recording can be exported to
+const (
+	FormatCS16 = "cs16" // Complex int16 interleaved I/Q (native recording format)
+	FormatCF32 = "cf32" // Complex float32, scaled so ADC full scale = 1.0
+	FormatCS8  = "cs8"  // Complex int8 with TPDF dither
+	FormatReal = "real" // Real-only int16 (I component)
+)
+
+// formatExtensions maps each export format to its output file extension
+var formatExtensions = map[string]string{
+	FormatCS16: ".cs16",
+	FormatCF32: ".cf32",
+	FormatCS8:  ".cs8",
+	FormatReal: ".r16",
+}
+
+// errExportConflict reports an export that would replace an existing file
+var errExportConflict = errors.New("export target conflict")
+
+// exportPath gives name the extension of format, replacing any it has
+func exportPath(name, format string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + formatExtensions[format]
+}
+
+// ExportOptions selects the format and the part of a recording to convert
+type ExportOptions struct {
+	Format      string `json:"format"`
+	StartSample int64  `json:"start_sample"` // First sample (frame) to convert
+	Samples     int64  `json:"samples"`      // Number of samples, 0 = to end of file
+	Channels    []int  `json:"channels"`     // User-facing channels (1-8, beams 9-16), empty = all in file
+	Align       bool   `json:"align"`        // Correct the unit's stored inter-channel delays
+}
+
+// convertRecording streams inPath into outPath in the requested sample format
+// and writes the output's metadata next to it
+func convertRecording(inPath, outPath string, opts ExportOptions) (*CaptureMetadata, error) {
+	if _, ok := formatExtensions[opts.Format]; !ok {
+		return nil, fmt.Errorf("unsupported format %q (want cs16, cf32, cs8 or real)", opts.Format)
+	}
+
+	// Neither the output nor its sidecar may replace an existing file,
+	// including the source's own metadata
+	if filepath.Clean(metadataPath(outPath)) == filepath.Clean(metadataPath(inPath)) {
+		return nil, fmt.Errorf("%w: %s would replace the source's metadata", errExportConflict, metadataPath(outPath))
+	}
+	for _, p := range []string{outPath, metadataPath(outPath)} {
+		if _, err := os.Lstat(p); err == nil {
+			return nil, fmt.Errorf("%w: %s already exists", errExportConflict, p)
+		}
+	}
+
+	// Without metadata, assume a legacy full 8-channel capture
+	srcMeta, err := loadCaptureMetadata(inPath)
+	if err != nil {
+		srcMeta = &CaptureMetadata{SampleRate: captureSampleRate, Channels: []int{1, 2, 3, 4, 5, 6, 7, 8}}
+	}
+	if srcMeta.Format != "" && srcMeta.Format != FormatCS16 {
+		return nil, fmt.Errorf("source is %s; only raw cs16 recordings can be converted", srcMeta.Format)
+	}
+	srcChannels := srcMeta.Channels
+	if len(srcChannels) == 0 {
+		srcChannels = []int{1, 2, 3, 4, 5, 6, 7, 8}
+	}
+
+	// Map requested channels to their slot within each source frame
+	outChannels := opts.Channels
+	if len(outChannels) == 0 {
+		outChannels = srcChannels
+	}
+	slots := make([]int, len(outChannels))
+	for i, ch := range outChannels {
+		slots[i] = -1
+		for slot, srcCh := range srcChannels {
+			if srcCh == ch {
+				slots[i] = slot
+			}
+		}
+		if slots[i] < 0 {
+			return nil, fmt.Errorf("channel %d is not in the recording", ch)
+		}
+	}
+
+	// Alignment shifts each channel within the chunks, carrying the samples
+	// it still needs into the next chunk; beam channels are not shifted
+	var aligner *channelAligner
+	var alignment *AlignmentInfo
+	var carryI, carryQ [][]int16
+	if opts.Align {
+		if srcMeta.Alignment != nil && srcMeta.Alignment.Applied {
+			return nil, fmt.Errorf("recording is already aligned")
+		}
+		delays := unitDelays()
+		if delays == nil {
+			return nil, fmt.Errorf("no stored delays for unit %s", unitName)
+		}
+		aligner = slotAligner(delays, outChannels)
+		var channels []int
+		var leads []float64
+		for slot, ch := range outChannels {
+			if ch >= 1 && ch <= 8 {
+				channels = append(channels, ch)
+				leads = append(leads, aligner.lead[slot])
+			}
+		}
+		alignment = alignmentInfo(delays, channels, leads, aligner.margin)
+		carryI, carryQ = make([][]int16, len(slots)), make([][]int16, len(slots))
+	}
+
+	in, err := os.Open(inPath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const bytesPerSample = 4
+	frameSize := int64(len(srcChannels) * bytesPerSample)
+	totalFrames := info.Size() / frameSize
+	if opts.StartSample < 0 || opts.StartSample >= totalFrames {
+		return nil, fmt.Errorf("start sample %d outside recording (0-%d)", opts.StartSample, totalFrames-1)
+	}
+	frames := totalFrames - opts.StartSample
+	if opts.Samples > 0 && opts.Samples < frames {
+		frames = opts.Samples
+	}
+
+	if _, err := in.Seek(opts.StartSample*frameSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	out, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// A failed export removes what it created, so the name can be retried
+	done, metaWritten := false, false
+	defer func() {
+		if done {
+			return
+		}
+		out.Close()
+		os.Remove(outPath)
+		if metaWritten {
+			os.Remove(metadataPath(outPath))
+		}
+	}()
+	w := bufio.NewWriterSize(out, 4*1024*1024)
+
+	// Process in chunks so long recordings are never loaded whole
+	const chunkFrames = 64 * 1024
+	inBuf := make([]byte, chunkFrames*frameSize)
+	var outBuf []byte
+	var written int64
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for remaining := frames; remaining > 0; {
+		n := int64(chunkFrames)
+		if n > remaining {
+			n = remaining
+		}
+		chunk := inBuf[:n*frameSize]
+		if _, err := io.ReadFull(in, chunk); err != nil {
+			return nil, fmt.Errorf("read failed: %w", err)
+		}
+
+		outBuf = outBuf[:0]
+		if aligner == nil {
+			for f := int64(0); f < n; f++ {
+				base := f * frameSize
+				for _, slot := range slots {
+					off := base + int64(slot*bytesPerSample)
+					iVal := int16(binary.LittleEndian.Uint16(chunk[off:]))
+					qVal := int16(binary.LittleEndian.Uint16(chunk[off+2:]))
+					outBuf = appendSample(outBuf, opts.Format, iVal, qVal, rng)
+				}
+			}
+			written += n
+		} else {
+			for k, slot := range slots {
+				for f := int64(0); f < n; f++ {
+					off := f*frameSize + int64(slot*bytesPerSample)
+					carryI[k] = append(carryI[k], int16(binary.LittleEndian.Uint16(chunk[off:])))
+					carryQ[k] = append(carryQ[k], int16(binary.LittleEndian.Uint16(chunk[off+2:])))
+				}
+			}
+			alignedI, alignedQ := aligner.alignChannels(carryI, carryQ)
+			for s := range alignedI[0] {
+				for k := range slots {
+					outBuf = appendSample(outBuf, opts.Format, alignedI[k][s], alignedQ[k][s], rng)
+				}
+			}
+			for k := range slots {
+				used := len(alignedI[k])
+				carryI[k] = append(carryI[k][:0], carryI[k][used:]...)
+				carryQ[k] = append(carryQ[k][:0], carryQ[k][used:]...)
+			}
+			written += int64(len(alignedI[0]))
+		}
+		if _, err := w.Write(outBuf); err != nil {
+			return nil, fmt.Errorf("write failed: %w", err)
+		}
+		remaining -= n
+	}
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("write failed: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return nil, fmt.Errorf("write failed: %w", err)
+	}
+
+	meta := *srcMeta
+	meta.Channels = outChannels
+	meta.Format = opts.Format
+	meta.SourceFile = inPath
+	meta.StartSample = opts.StartSample
+	meta.Samples = written
+	if alignment != nil {
+		meta.Alignment = alignment
+	}
+	metaWritten = true
+	if err := writeCaptureMetadata(outPath, &meta); err != nil {
+		return nil, fmt.Errorf("failed to save metadata: %w", err)
+	}
+	done = true
+	return &meta, nil
+}
+
+// appendSample encodes one I/Q pair in the given format
+func appendSample(buf []byte, format string, iVal, qVal int16, rng *rand.Rand) []byte {
+	switch format {
+	case FormatCF32:
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(float64(iVal)/adcFullScale)))
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(float64(qVal)/adcFullScale)))
+	case FormatCS8:
+		buf = append(buf, byte(ditherToInt8(iVal, rng)), byte(ditherToInt8(qVal, rng)))
+	case FormatReal:
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(iVal))
+	default:
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(iVal))
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(qVal))
+	}
+	return buf
+}
+
+// ditherToInt8 requantizes a 12-bit code to 8 bits with triangular (TPDF)
+// dither of +/- 1 output LSB, so truncation error becomes a flat noise floor
+func ditherToInt8(v int16, rng *rand.Rand) int8 {
+	const scale = adcFullScale / 128.0
+	x := float64(v)/scale + rng.Float64() - rng.Float64()
+	x = math.Round(x)
+	if x > 127 {
+		x = 127
+	}
+	if x < -128 {
+		x = -128
+	}
+	return int8(x)
+}
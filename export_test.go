@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestExportConflicts refuses outputs that would replace the source, its
+// metadata or an earlier export
+func TestExportConflicts(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "cap.bin")
+	if err := os.WriteFile(in, make([]byte, 64*4), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCaptureMetadata(in, &CaptureMetadata{SampleRate: captureSampleRate, Channels: []int{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		output   string
+		conflict bool
+	}{
+		{"cap", true},           // Sidecar is the source's cap.json
+		{"cap.bin", true},       // The source itself
+		{"other.dat", true},     // Sidecar of an unrelated file
+		{"cap_cf32", false},     // New pair
+		{"cap_cf32.bin", true},  // Same pair again
+		{"cap_cf32.cs16", true}, // Extension replaced, so the same pair
+	}
+	for _, c := range cases {
+		out := filepath.Join(dir, exportPath(c.output, FormatCF32))
+		_, err := convertRecording(in, out, ExportOptions{Format: FormatCF32})
+		if c.conflict && !errors.Is(err, errExportConflict) {
+			t.Errorf("%s: %v, want a conflict", c.output, err)
+		} else if !c.conflict && err != nil {
+			t.Errorf("%s: %v", c.output, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cap_cf32.cf32")); err != nil {
+		t.Error(err)
+	}
+	if meta, err := loadCaptureMetadata(in); err != nil || meta.Format != "" {
+		t.Errorf("source metadata changed: %+v, %v", meta, err)
+	}
+}
+
+// TestExportFormats checks cf32 scaling, the cs8 dither range and that real
+// output keeps only I
+func TestExportFormats(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "cap.bin")
+	codes := []int16{0, 1, -1, 100, -100, 1000, -1000, 2047, -2048}
+	const repeats = 2000
+	var data []byte
+	for r := 0; r < repeats; r++ {
+		for _, v := range codes {
+			data = binary.LittleEndian.AppendUint16(data, uint16(v))
+			data = binary.LittleEndian.AppendUint16(data, uint16(-v/2))
+		}
+	}
+	if err := os.WriteFile(in, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCaptureMetadata(in, &CaptureMetadata{SampleRate: captureSampleRate, Channels: []int{1}}); err != nil {
+		t.Fatal(err)
+	}
+	export := func(format string) []byte {
+		out := filepath.Join(dir, exportPath("cap_"+format, format))
+		if _, err := convertRecording(in, out, ExportOptions{Format: format}); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	n := len(codes) * repeats
+
+	cf32 := export(FormatCF32)
+	if len(cf32) != n*8 {
+		t.Fatalf("cf32 is %d bytes, want %d", len(cf32), n*8)
+	}
+	for k, v := range codes {
+		i := math.Float32frombits(binary.LittleEndian.Uint32(cf32[8*k:]))
+		q := math.Float32frombits(binary.LittleEndian.Uint32(cf32[8*k+4:]))
+		if i != float32(float64(v)/adcFullScale) || q != float32(float64(-v/2)/adcFullScale) {
+			t.Errorf("cf32 code %d: %g, %g", v, i, q)
+		}
+	}
+
+	// TPDF dither keeps each value within 1.5 LSB of the scaled code, in
+	// range, and unbiased on average
+	cs8 := export(FormatCS8)
+	if len(cs8) != n*2 {
+		t.Fatalf("cs8 is %d bytes, want %d", len(cs8), n*2)
+	}
+	sums := make([]float64, len(codes))
+	for s := 0; s < n; s++ {
+		k := s % len(codes)
+		want := float64(codes[k]) / (adcFullScale / 128)
+		got := float64(int8(cs8[2*s]))
+		if math.Abs(got-want) > 1.5 || got > 127 || got < -128 {
+			t.Fatalf("cs8 code %d dithered to %g", codes[k], got)
+		}
+		sums[k] += got
+	}
+	// Clipping biases the codes at full scale, so only the others are checked
+	for k, v := range codes[:len(codes)-2] {
+		want := float64(v) / (adcFullScale / 128)
+		if mean := sums[k] / repeats; math.Abs(mean-want) > 0.05 {
+			t.Errorf("cs8 code %d averages %.3f, want %.3f", v, mean, want)
+		}
+	}
+
+	real := export(FormatReal)
+	if len(real) != n*2 {
+		t.Fatalf("real is %d bytes, want %d", len(real), n*2)
+	}
+	for s := 0; s < n; s++ {
+		if got := int16(binary.LittleEndian.Uint16(real[2*s:])); got != codes[s%len(codes)] {
+			t.Fatalf("real sample %d is %d, want %d", s, got, codes[s%len(codes)])
+		}
+	}
+}
+
+// TestExportFailureCleanup checks that a failed export leaves nothing
+// behind, so it can be retried under the same name
+func TestExportFailureCleanup(t *testing.T) {
+	dir := t.TempDir()
+	// Reading a directory fails after the output is created
+	in := filepath.Join(dir, "src")
+	if err := os.Mkdir(in, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(in); err != nil || info.Size() < 32 {
+		t.Skip("directory size too small to pass the range check")
+	}
+	out := filepath.Join(dir, exportPath("out", FormatCS16))
+	for try := 0; try < 2; try++ {
+		_, err := convertRecording(in, out, ExportOptions{Format: FormatCS16})
+		if err == nil || errors.Is(err, errExportConflict) {
+			t.Fatalf("try %d: %v, want a read error", try, err)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Fatalf("try %d left %s behind", try, out)
+		}
+	}
+}
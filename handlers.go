@@ -381,18 +381,14 @@ func handleReplaySelect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Try to load metadata to get channels
-	metaFilename := strings.TrimSuffix(safeFilename, ".bin") + ".json"
-	metaPath := filepath.Join(dataFolder, metaFilename)
 	var replayChannels []int
-
-	if metaBytes, err := os.ReadFile(metaPath); err == nil {
-		var meta CaptureMetadata
-		if err := json.Unmarshal(metaBytes, &meta); err == nil {
-			// Convert from 1-8 (metadata) to 0-7 (internal)
-			replayChannels = make([]int, len(meta.Channels))
-			for i, ch := range meta.Channels {
-				replayChannels[i] = ch - 1
-			}
+	var replayConfig *HardwareConfig
+	if meta, err := loadCaptureMetadata(filePath); err == nil {
+		replayConfig = meta.Config
+		// Convert from 1-8 (metadata) to 0-7 (internal)
+		replayChannels = make([]int, len(meta.Channels))
+		for i, ch := range meta.Channels {
+			replayChannels[i] = ch - 1
 		}
 	}
 
@@ -401,6 +397,7 @@ func handleReplaySelect(w http.ResponseWriter, r *http.Request) {
 	serverState.ReplayName = req.Filename
 	serverState.ReplayOffset = 0
 	serverState.ReplayChannels = replayChannels
+	serverState.ReplayConfig = replayConfig
 	serverState.mu.Unlock()
 
 	log.Printf("[REPLAY] Selected %s (%d bytes). Channels: %v", req.Filename, len(data), replayChannels)
@@ -441,6 +438,7 @@ func handleReplayDelete(w http.ResponseWriter, r *http.Request) {
 		serverState.ReplayData = nil
 		serverState.ReplayName = ""
 		serverState.ReplayOffset = 0
+		serverState.ReplayConfig = nil
 	}
 	serverState.mu.Unlock()
 
@@ -532,6 +530,7 @@ func handleReplayClear(w http.ResponseWriter, r *http.Request) {
 	serverState.ReplayData = nil
 	serverState.ReplayName = ""
 	serverState.ReplayOffset = 0
+	serverState.ReplayConfig = nil
 	serverState.mu.Unlock()
 
 	log.Println("[REPLAY] Selection cleared")
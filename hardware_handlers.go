@@ -456,6 +456,7 @@ func handleHardwareState(w http.ResponseWriter, r *http.Request) {
 			"cal_enabled":    false,
 			"system_enabled": false,
 			"active_filter":  "unknown",
+			"dma_engines":    shmEngineStates(),
 		})
 		serverState.mu.RUnlock()
 		return
@@ -506,5 +507,6 @@ func handleHardwareState(w http.ResponseWriter, r *http.Request) {
 		"cal_enabled":    cal == 1,
 		"system_enabled": sysEn == 1,
 		"active_filter":  activeFilter,
+		"dma_engines":    shmEngineStates(),
 	})
 }
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// iqCalibrationFile holds the IQ imbalance sets of a unit, by configuration
+const iqCalibrationFile = "iq_imbalance.json"
+
+// IQImbalance is one channel's gain and phase mismatch between I and Q,
+// modeled as I' = I, Q' = g(Q cos φ - I sin φ)
+type IQImbalance struct {
+	Channel  int     `json:"channel"`
+	GainDB   float64 `json:"gain_db"`           // 20log10(g): Q relative to I
+	PhaseDeg float64 `json:"phase_deg"`         // φ: Q's deviation from quadrature
+	IRRDB    float64 `json:"irr_db"`            // Image rejection ratio
+	ToneHz   float64 `json:"tone_hz,omitempty"` // Tone used by the tone method
+}
+
+// newIQImbalance describes a gain ratio g and phase error phi (radians)
+func newIQImbalance(ch int, g, phi float64) IQImbalance {
+	// y = αx + βx* with α = (1 + g e^-jφ)/2 and β = (1 - g e^jφ)/2
+	c := 2 * g * math.Cos(phi)
+	image := 1 - c + g*g
+	irr := 300.0
+	if image > 0 {
+		irr = math.Min(irr, 10*math.Log10((1+c+g*g)/image))
+	}
+	return IQImbalance{Channel: ch, GainDB: 20 * math.Log10(g), PhaseDeg: phi * 180 / math.Pi, IRRDB: irr}
+}
+
+// iqCorrector restores quadrature: Q = cross*I' + scale*Q'
+type iqCorrector struct {
+	cross, scale float64
+}
+
+func (b IQImbalance) corrector() iqCorrector {
+	g := math.Pow(10, b.GainDB/20)
+	phi := b.PhaseDeg * math.Pi / 180
+	return iqCorrector{cross: math.Tan(phi), scale: 1 / (g * math.Cos(phi))}
+}
+
+func (c iqCorrector) q(i, q int16) int16 {
+	return clampInt16(c.cross*float64(i) + c.scale*float64(q))
+}
+
+// IQCalibration is the stored IQ imbalance of the channels of one unit in
+// one receiver configuration
+type IQCalibration struct {
+	Unit     string        `json:"unit"`
+	Config   string        `json:"config"`
+	Time     time.Time     `json:"time"`
+	Method   string        `json:"method"`
+	Source   string        `json:"source"`
+	Channels []IQImbalance `json:"channels"`
+}
+
+// correctors returns the corrector of each receiver channel index (0-7)
+func (c *IQCalibration) correctors() [8]*iqCorrector {
+	var out [8]*iqCorrector
+	for _, b := range c.Channels {
+		if b.Channel >= 1 && b.Channel <= 8 {
+			corr := b.corrector()
+			out[b.Channel-1] = &corr
+		}
+	}
+	return out
+}
+
+// iqCalibrations caches this unit's stored sets, loaded on first use
+var iqCalibrations struct {
+	mu     sync.Mutex
+	loaded bool
+	sets   map[string]*IQCalibration
+}
+
+// loadIQCalibrations returns the unit's sets; the caller holds iqCalibrations.mu
+func loadIQCalibrations() map[string]*IQCalibration {
+	if !iqCalibrations.loaded {
+		iqCalibrations.loaded = true
+		iqCalibrations.sets = make(map[string]*IQCalibration)
+		if data, err := os.ReadFile(unitCalibrationPath(iqCalibrationFile)); err == nil {
+			json.Unmarshal(data, &iqCalibrations.sets)
+		}
+	}
+	return iqCalibrations.sets
+}
+
+// iqCalibrationFor returns the stored set for a configuration, or nil
+func iqCalibrationFor(config string) *IQCalibration {
+	iqCalibrations.mu.Lock()
+	defer iqCalibrations.mu.Unlock()
+	return loadIQCalibrations()[config]
+}
+
+// saveIQCalibration merges a set's channels into the stored set for its
+// configuration and writes the unit's file
+func saveIQCalibration(cal *IQCalibration) (*IQCalibration, error) {
+	iqCalibrations.mu.Lock()
+	defer iqCalibrations.mu.Unlock()
+	sets := loadIQCalibrations()
+
+	merged := *cal
+	if old := sets[cal.Config]; old != nil {
+		byChannel := make(map[int]IQImbalance)
+		for _, b := range old.Channels {
+			byChannel[b.Channel] = b
+		}
+		for _, b := range cal.Channels {
+			byChannel[b.Channel] = b
+		}
+		merged.Channels = nil
+		for _, b := range byChannel {
+			merged.Channels = append(merged.Channels, b)
+		}
+		sort.Slice(merged.Channels, func(i, j int) bool { return merged.Channels[i].Channel < merged.Channels[j].Channel })
+	}
+
+	updated := make(map[string]*IQCalibration, len(sets)+1)
+	for k, v := range sets {
+		updated[k] = v
+	}
+	updated[cal.Config] = &merged
+	data, _ := json.MarshalIndent(updated, "", "  ")
+	path := unitCalibrationPath(iqCalibrationFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return nil, err
+	}
+	iqCalibrations.sets = updated
+	return &merged, nil
+}
+
+// currentIQCorrection returns the set to apply to live data, or nil when
+// correction is off or the current configuration has no stored set
+func currentIQCorrection() *IQCalibration {
+	serverState.mu.RLock()
+	enabled := serverState.IQCorrection
+	serverState.mu.RUnlock()
+	if !enabled {
+		return nil
+	}
+	return iqCalibrationFor(currentConfigKey())
+}
+
+// applyIQCorrection returns the channels with the correction applied to the
+// receiver channels it covers. The input slices are not modified.
+func applyIQCorrection(channelI, channelQ [][]int16, cal *IQCalibration) [][]int16 {
+	if cal == nil {
+		return channelQ
+	}
+	outQ := append([][]int16(nil), channelQ...)
+	for idx, c := range cal.correctors() {
+		if c == nil || idx >= len(channelI) {
+			continue
+		}
+		q := make([]int16, len(channelQ[idx]))
+		for s := range q {
+			q[s] = c.q(channelI[idx][s], channelQ[idx][s])
+		}
+		outQ[idx] = q
+	}
+	return outQ
+}
+
+// correctIQFrames applies the correction in place to raw 8-channel frames
+func correctIQFrames(data []byte, cal *IQCalibration) {
+	const frameSize = 32
+	correctors := cal.correctors()
+	for off := 0; off+frameSize <= len(data); off += frameSize {
+		for ch, c := range correctors {
+			if c == nil {
+				continue
+			}
+			p := off + ch*4
+			i := int16(binary.LittleEndian.Uint16(data[p:]))
+			q := int16(binary.LittleEndian.Uint16(data[p+2:]))
+			binary.LittleEndian.PutUint16(data[p+2:], uint16(c.q(i, q)))
+		}
+	}
+}
+
+// IQEstimateOptions configures IQ imbalance estimation
+type IQEstimateOptions struct {
+	Channels []int    `json:"channels"` // Receiver channels (1-8); empty = all
+	Method   string   `json:"method"`   // "blind" (default) or "tone"
+	ToneHz   *float64 `json:"tone_hz"`  // Tone offset from DC; nil = strongest bin outside DC
+	FFTSize  int      `json:"fft_size"` // Block size; default 8192, live data uses the stream's FFT size
+	Window   string   `json:"window"`   // Tone method window, default blackman-harris
+	Averages int      `json:"averages"` // Blocks to accumulate, default 16
+
+	// Save stores the result for the unit, in Config or the data's configuration
+	Save   bool   `json:"save,omitempty"`
+	Config string `json:"config,omitempty"`
+
+	// Recording source; empty Filename means live data
+	Filename    string `json:"filename,omitempty"`
+	StartSample int64  `json:"start_sample,omitempty"`
+}
+
+// Validate checks the options, fills in defaults and returns the spectrum options
+func (o *IQEstimateOptions) Validate() (SpectrumOptions, error) {
+	if len(o.Channels) == 0 {
+		o.Channels = []int{1, 2, 3, 4, 5, 6, 7, 8}
+	}
+	for _, ch := range o.Channels {
+		if ch < 1 || ch > 8 {
+			return SpectrumOptions{}, fmt.Errorf("channel must be between 1 and 8")
+		}
+	}
+	if o.Method == "" {
+		o.Method = "blind"
+	}
+	if o.Method != "blind" && o.Method != "tone" {
+		return SpectrumOptions{}, fmt.Errorf("method must be blind or tone")
+	}
+	if o.FFTSize == 0 {
+		o.FFTSize = 8192
+	}
+	if o.Window == "" {
+		o.Window = "blackman-harris"
+	}
+	if o.Averages == 0 {
+		o.Averages = 16
+	}
+	if o.Averages < 1 {
+		return SpectrumOptions{}, fmt.Errorf("averages must be positive")
+	}
+	if o.Filename != "" {
+		o.Filename = filepath.Base(o.Filename)
+	}
+	o.Config = safeFileName(o.Config)
+	return parseSpectrumOptions(o.FFTSize, o.Window, 0, ScalingTone)
+}
+
+// IQEstimateResult is one estimation across channels
+type IQEstimateResult struct {
+	Source    string        `json:"source"` // "live" or the recording filename
+	Time      time.Time     `json:"time"`
+	Method    string        `json:"method"`
+	Unit      string        `json:"unit"`
+	Config    string        `json:"config"`
+	Corrected bool          `json:"corrected"` // Data already had IQ correction applied; results are residual
+	Saved     bool          `json:"saved"`
+	Channels  []IQImbalance `json:"channels"`
+}
+
+// iqAccumulator collects one channel's statistics over blocks
+type iqAccumulator struct {
+	// Blind: second-order moments of I and Q
+	sumI, sumQ, sumII, sumQQ, sumIQ, n float64
+
+	// Tone: Σ X[-m]X[m] and Σ|X[m]|² over the tone's main lobe
+	toneBin   int
+	cross     complex128
+	tonePower float64
+}
+
+func (a *iqAccumulator) addBlind(i, q []int16) {
+	for s := range i {
+		fi, fq := float64(i[s]), float64(q[s])
+		a.sumI += fi
+		a.sumQ += fq
+		a.sumII += fi * fi
+		a.sumQQ += fq * fq
+		a.sumIQ += fi * fq
+	}
+	a.n += float64(len(i))
+}
+
+// blind estimates g and φ assuming the signal is proper (I and Q
+// uncorrelated with equal power), as noise and most signals are
+func (a *iqAccumulator) blind() (g, phi float64, err error) {
+	mi, mq := a.sumI/a.n, a.sumQ/a.n
+	vi, vq := a.sumII/a.n-mi*mi, a.sumQQ/a.n-mq*mq
+	if vi <= 0 || vq <= 0 {
+		return 0, 0, fmt.Errorf("no signal")
+	}
+	cov := a.sumIQ/a.n - mi*mq
+	return math.Sqrt(vq / vi), math.Asin(-cov / math.Sqrt(vi*vq)), nil
+}
+
+// addTone folds in a DC-centered complex spectrum. The tone is found in the
+// first block; lobe bins either side are summed.
+func (a *iqAccumulator) addTone(x []complex128, toneBin *int, lobe int) error {
+	n := len(x)
+	if a.toneBin == 0 {
+		if toneBin != nil {
+			a.toneBin = *toneBin
+		} else {
+			best := 0.0
+			for m := lobe + 1; m < n/2-lobe; m++ {
+				for _, k := range []int{m, -m} {
+					if p := real(x[n/2+k])*real(x[n/2+k]) + imag(x[n/2+k])*imag(x[n/2+k]); p > best {
+						best, a.toneBin = p, k
+					}
+				}
+			}
+		}
+		if a.toneBin == 0 || abs(a.toneBin) <= lobe || abs(a.toneBin) >= n/2-lobe {
+			return fmt.Errorf("tone must be more than %d bins from DC and the band edge", lobe)
+		}
+	}
+	for m := a.toneBin - lobe; m <= a.toneBin+lobe; m++ {
+		a.cross += x[n/2-m] * x[n/2+m]
+		a.tonePower += real(x[n/2+m])*real(x[n/2+m]) + imag(x[n/2+m])*imag(x[n/2+m])
+	}
+	return nil
+}
+
+// tone estimates g and φ from the tone's image: X[-m]X[m]/|X[m]|² = β/α*,
+// and z = g e^jφ = (1 - k)/(1 + k)
+func (a *iqAccumulator) tone() (g, phi float64, err error) {
+	if a.tonePower <= 0 {
+		return 0, 0, fmt.Errorf("no tone")
+	}
+	k := a.cross / complex(a.tonePower, 0)
+	z := (1 - k) / (1 + k)
+	return cmplx.Abs(z), cmplx.Phase(z), nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// iqBlockFunc feeds one block of a channel to its accumulator
+type iqBlockFunc func(a *iqAccumulator, i, q []int16) error
+
+// iqBlockHandler returns the per-block step for the method
+func (o *IQEstimateOptions) iqBlockHandler(opts SpectrumOptions) (iqBlockFunc, error) {
+	if o.Method == "blind" {
+		return func(a *iqAccumulator, i, q []int16) error {
+			a.addBlind(i[:opts.FFTSize], q[:opts.FFTSize])
+			return nil
+		}, nil
+	}
+	lobe, err := defaultToneBins(opts)
+	if err != nil {
+		return nil, err
+	}
+	var toneBin *int
+	if o.ToneHz != nil {
+		b := int(math.Round(*o.ToneHz / (captureSampleRate / float64(opts.FFTSize))))
+		toneBin = &b
+	}
+	x := make([]complex128, opts.FFTSize)
+	return func(a *iqAccumulator, i, q []int16) error {
+		if err := computeComplexSpectrumInto(x, i, q, opts); err != nil {
+			return err
+		}
+		return a.addTone(x, toneBin, lobe)
+	}, nil
+}
+
+// newIQEstimateResult turns the accumulators into results and saves them
+// if requested
+func newIQEstimateResult(o *IQEstimateOptions, opts SpectrumOptions, source, config string, corrected bool, acc map[int]*iqAccumulator) (*IQEstimateResult, error) {
+	if o.Config != "" {
+		config = o.Config
+	}
+	res := &IQEstimateResult{Source: source, Time: time.Now(), Method: o.Method, Unit: unitName, Config: config, Corrected: corrected}
+	binHz := captureSampleRate / float64(opts.FFTSize)
+	for _, ch := range o.Channels {
+		a := acc[ch]
+		if a == nil {
+			continue
+		}
+		var g, phi float64
+		var err error
+		if o.Method == "tone" {
+			g, phi, err = a.tone()
+		} else {
+			g, phi, err = a.blind()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("channel %d: %v", ch, err)
+		}
+		b := newIQImbalance(ch, g, phi)
+		if o.Method == "tone" {
+			b.ToneHz = float64(a.toneBin) * binHz
+		}
+		res.Channels = append(res.Channels, b)
+	}
+
+	if o.Save {
+		if corrected {
+			return nil, fmt.Errorf("the data already has IQ correction applied; disable it to estimate coefficients to save")
+		}
+		cal := &IQCalibration{Unit: unitName, Config: config, Time: res.Time, Method: o.Method, Source: source, Channels: res.Channels}
+		if _, err := saveIQCalibration(cal); err != nil {
+			return nil, err
+		}
+		res.Saved = true
+	}
+	return res, nil
+}
+
+// estimateIQRecording estimates IQ imbalance over Averages blocks of a
+// recording starting at StartSample
+func estimateIQRecording(o *IQEstimateOptions) (*IQEstimateResult, error) {
+	opts, err := o.Validate()
+	if err != nil {
+		return nil, err
+	}
+	step, err := o.iqBlockHandler(opts)
+	if err != nil {
+		return nil, err
+	}
+	r, err := openRecording(filepath.Join(dataFolder, o.Filename), o.Channels)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := r.SeekFrame(o.StartSample); err != nil {
+		return nil, err
+	}
+
+	acc := make(map[int]*iqAccumulator)
+	for _, ch := range o.Channels {
+		acc[ch] = &iqAccumulator{}
+	}
+	blocks := 0
+	for ; blocks < o.Averages; blocks++ {
+		got, err := r.Read(opts.FFTSize)
+		if err == io.EOF || got < opts.FFTSize {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for k, ch := range r.channels {
+			if err := step(acc[ch], r.I[k], r.Q[k]); err != nil {
+				return nil, fmt.Errorf("channel %d: %v", ch, err)
+			}
+		}
+	}
+	if blocks == 0 {
+		return nil, fmt.Errorf("recording has fewer than %d samples after sample %d", opts.FFTSize, o.StartSample)
+	}
+	return newIQEstimateResult(o, opts, o.Filename, recordingConfigKey(r.meta), r.meta.IQCorrection != nil, acc)
+}
+
+// estimateIQLive estimates IQ imbalance over the next Averages stream frames
+func estimateIQLive(o *IQEstimateOptions) (*IQEstimateResult, error) {
+	if _, err := o.Validate(); err != nil {
+		return nil, err
+	}
+	config, corrected := currentConfigKey(), currentIQCorrection() != nil
+
+	var opts SpectrumOptions
+	var step iqBlockFunc
+	acc := make(map[int]*iqAccumulator)
+	err := forEachLiveFrame(o.Averages, func(frame liveFrame) error {
+		if step == nil {
+			var err error
+			if opts, err = parseSpectrumOptions(frame.fftSize, o.Window, 0, ScalingTone); err != nil {
+				return err
+			}
+			if step, err = o.iqBlockHandler(opts); err != nil {
+				return err
+			}
+		} else if frame.fftSize != opts.FFTSize {
+			return fmt.Errorf("stream FFT size changed during estimation")
+		}
+		for _, ch := range o.Channels {
+			i, q, err := frame.channel(ch)
+			if err != nil {
+				return err
+			}
+			if acc[ch] == nil {
+				acc[ch] = &iqAccumulator{}
+			}
+			if err := step(acc[ch], i, q); err != nil {
+				return fmt.Errorf("channel %d: %v", ch, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newIQEstimateResult(o, opts, "live", config, corrected, acc)
+}
+
+// handleIQEstimate estimates IQ imbalance. POST an IQEstimateOptions body;
+// with a filename the recording is used, otherwise live frames.
+func handleIQEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var o IQEstimateOptions
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+
+	var res *IQEstimateResult
+	var err error
+	if o.Filename != "" {
+		res, err = estimateIQRecording(&o)
+	} else {
+		res, err = estimateIQLive(&o)
+	}
+	if err != nil {
+		http.Error(w, "Estimation failed: "+err.Error(), 400)
+		return
+	}
+	if res.Saved {
+		go broadcastJSON(iqCorrectionMessage())
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleIQCorrection gets or sets whether IQ correction is applied to
+// streamed and recorded data
+func handleIQCorrection(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		serverState.mu.Lock()
+		serverState.IQCorrection = req.Enabled
+		serverState.mu.Unlock()
+		go broadcastJSON(iqCorrectionMessage())
+	}
+	json.NewEncoder(w).Encode(iqCorrectionMessage())
+}
+
+// iqCorrectionMessage describes the correction state and the stored set
+// for the current configuration
+func iqCorrectionMessage() map[string]interface{} {
+	serverState.mu.RLock()
+	enabled := serverState.IQCorrection
+	serverState.mu.RUnlock()
+	config := currentConfigKey()
+
+	iqCalibrations.mu.Lock()
+	sets := loadIQCalibrations()
+	configs := []string{}
+	for k := range sets {
+		configs = append(configs, k)
+	}
+	cal := sets[config]
+	iqCalibrations.mu.Unlock()
+	sort.Strings(configs)
+
+	return map[string]interface{}{
+		"type":        "iq_correction",
+		"enabled":     enabled,
+		"applied":     enabled && cal != nil,
+		"unit":        unitName,
+		"config":      config,
+		"calibration": cal,
+		"configs":     configs,
+	}
+}
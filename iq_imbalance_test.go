@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestIQImbalance estimates a known gain and phase error with both methods
+// and checks that correcting it removes the image
+func TestIQImbalance(t *testing.T) {
+	const n, blocks = 8192, 8
+	const g, phi = 1.05, 3 * math.Pi / 180
+	rng := rand.New(rand.NewSource(1))
+	i, q := make([]int16, n*blocks), make([]int16, n*blocks)
+	for k := range i {
+		ph := 2 * math.Pi * 1000.3 * float64(k) / n
+		re, im := 8000*math.Cos(ph)+rng.NormFloat64()*5, 8000*math.Sin(ph)+rng.NormFloat64()*5
+		i[k], q[k] = clampInt16(re), clampInt16(g*(im*math.Cos(phi)-re*math.Sin(phi)))
+	}
+
+	estimate := func(method string, i, q []int16) IQImbalance {
+		o := IQEstimateOptions{Method: method, FFTSize: n, Averages: blocks}
+		opts, err := o.Validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, err := o.iqBlockHandler(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := &iqAccumulator{}
+		for b := 0; b < blocks; b++ {
+			if err := step(a, i[b*n:], q[b*n:]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		o.Channels = []int{1}
+		res, err := newIQEstimateResult(&o, opts, "test", "test", false, map[int]*iqAccumulator{1: a})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Channels[0]
+	}
+
+	want := newIQImbalance(1, g, phi)
+	for _, method := range []string{"blind", "tone"} {
+		got := estimate(method, i, q)
+		if math.Abs(got.GainDB-want.GainDB) > 0.01 || math.Abs(got.PhaseDeg-want.PhaseDeg) > 0.05 {
+			t.Errorf("%s: gain %.3f dB phase %.3f°, want %.3f dB %.3f°", method, got.GainDB, got.PhaseDeg, want.GainDB, want.PhaseDeg)
+		}
+		if math.Abs(got.IRRDB-want.IRRDB) > 0.5 {
+			t.Errorf("%s: IRR %.1f dB, want %.1f dB", method, got.IRRDB, want.IRRDB)
+		}
+	}
+
+	cal := &IQCalibration{Channels: []IQImbalance{want}}
+	corrected := applyIQCorrection([][]int16{i}, [][]int16{q}, cal)[0]
+	if after := estimate("tone", i, corrected); after.IRRDB < 60 {
+		t.Errorf("IRR after correction %.1f dB, want above 60 dB (was %.1f dB)", after.IRRDB, want.IRRDB)
+	}
+}
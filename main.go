@@ -10,6 +10,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/dma/pkg/dma"
+	"github.com/dma/pkg/psu"
 )
 
 //go:embed templates/* static/*
@@ -49,8 +52,15 @@ func (s *sizeFlag) Set(value string) error {
 }
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		runConvertCLI(os.Args[2:])
+		return
+	}
+
 	// Common flags
 	device := flag.String("d", "/dev/xdma0_c2h_0", "DMA device path")
+	engineMap := flag.String("engines", "", "Read several C2H engines in parallel, e.g. /dev/xdma0_c2h_0:1-4,/dev/xdma0_c2h_1:5-8 (overrides -d)")
 	
 	// Use custom size flag
 	var size sizeFlag = 100 * 1024 * 1024 // Default 100MB
@@ -75,6 +85,17 @@ func main() {
 	// Simulation flags
 	isSim := flag.Bool("sim", false, "Simulate XDMA hardware via named pipe")
 	simPath := flag.String("sim-path", "/tmp/xdma_sim", "Path for simulation pipe")
+	simScenarioFile := flag.String("sim-scenario", "", "Plane-wave scenario JSON for the simulator (see README)")
+
+	// Antenna array
+	arrayFile := flag.String("array", "", "Element position JSON for direction finding, e.g. configs/array_ula8.json")
+
+	// Calibration
+	unit := flag.String("unit", "", "Unit name for stored calibration (default: host name)")
+	align := flag.Bool("align", false, "Correct the unit's stored inter-channel delays (CLI mode only)")
+
+	// Bench equipment
+	psuAddr := flag.String("psu", "", "Keysight E3631A VISA address, e.g. TCPIP::192.168.1.200::inst0::INSTR (readings are stored in capture metadata)")
 
 	// PCIe reset flag
 	resetPCIe := flag.Bool("r", false, "Reset PCIe device before starting")
@@ -85,18 +106,27 @@ func main() {
 		fmt.Fprintln(os.Stderr, "  CLI Mode:    go run . [options]")
 		fmt.Fprintln(os.Stderr, "  Server Mode: go run . --server [options]")
 		fmt.Fprintln(os.Stderr, "  Sim Mode:    go run . --sim [options]")
+		fmt.Fprintln(os.Stderr, "  Convert:     go run . convert -i capture.bin -format cf32 [options]")
 		fmt.Fprintln(os.Stderr, "\nOptions:")
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
 
-	// Update global state with flags
-	serverState.mu.Lock()
-	serverState.DevicePath = *device
-	serverState.UseSHM = *useSHM
-	serverState.SHMName = *shmName
-	serverState.mu.Unlock()
+	var engines []dma.EngineConfig
+	if *engineMap != "" {
+		var err error
+		engines, err = dma.ParseEngineMap(*engineMap)
+		if err != nil {
+			log.Fatalf("Invalid -engines mapping: %v", err)
+		}
+		*device = engines[0].DevicePath
+		if !dma.IsDefaultLayout(engines) && *isServer && !*useSHM {
+			// Live streaming and recording merge engines through the SHM producer
+			log.Println("Multiple C2H engines require the SHM ring; enabling -use-shm")
+			*useSHM = true
+		}
+	}
 
 	// Reset PCIe device if requested
 	if *resetPCIe {
@@ -111,14 +141,48 @@ func main() {
 		time.Sleep(1 * time.Second)
 	}
 
+	if *psuAddr != "" {
+		log.Printf("Initializing PSU at %s...", *psuAddr)
+		if err := psu.InitGlobalPSU(*psuAddr); err != nil {
+			log.Printf("Warning: Failed to initialize PSU: %v", err)
+		}
+	}
+
+	initUnitName(*unit)
+
+	if *arrayFile != "" {
+		g, err := loadArrayGeometry(*arrayFile)
+		if err != nil {
+			log.Fatalf("Invalid -array: %v", err)
+		}
+		serverState.mu.Lock()
+		serverState.Array = g
+		serverState.mu.Unlock()
+	}
+
 	// If simulation mode is on, override device path and start the background generator
 	if *isSim {
+		if *simScenarioFile != "" {
+			sc, err := loadSimScenario(*simScenarioFile)
+			if err != nil {
+				log.Fatalf("Invalid -sim-scenario: %v", err)
+			}
+			simScenario = sc
+		}
 		*device = *simPath
 		go RunSimulator(*device)
 		// Give the simulator a moment to initialize the pipe
 		time.Sleep(200 * time.Millisecond)
 	}
 
+	// Update global state with flags
+	serverState.mu.Lock()
+	serverState.DevicePath = *device
+	serverState.DMAEngines = engines
+	serverState.UseSHM = *useSHM
+	serverState.SHMName = *shmName
+	serverState.mu.Unlock()
+
 	targetSize := int(size)
 
 	// Calculate target size based on precedence
@@ -137,6 +201,6 @@ func main() {
 	if *isServer {
 		runServer(*port, *device, targetSize)
 	} else {
-		runCLI(*device, targetSize, *outputFile, *configFile, *channels, *benchMode)
+		runCLI(*device, engines, targetSize, *outputFile, *configFile, *channels, *benchMode, *align)
 	}
 }
\ No newline at end of file
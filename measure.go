@@ -0,0 +1,461 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"time"
+)
+
+// MeasureOptions configures channel power, occupied bandwidth and ACPR.
+// Frequencies are offsets in Hz from the tuned (DC) frequency.
+type MeasureOptions struct {
+	Channels            []int   `json:"channels"`              // User-facing channels (1-80); empty = receivers 1-8
+	OffsetHz            float64 `json:"offset_hz"`             // Center of the main channel
+	BandwidthHz         float64 `json:"bandwidth_hz"`          // Integration bandwidth of the main channel
+	SpacingHz           float64 `json:"spacing_hz"`            // Adjacent channel spacing, default bandwidth_hz
+	AdjacentBandwidthHz float64 `json:"adjacent_bandwidth_hz"` // Default bandwidth_hz
+	OBWPercent          float64 `json:"obw_percent"`           // Default 99
+	SpanHz              float64 `json:"span_hz"`               // Span searched for OBW, default main plus both adjacent channels
+	FFTSize             int     `json:"fft_size"`              // Default 1024; live data uses the stream's FFT size
+	Window              string  `json:"window"`                // See fft.ParseWindow, default blackman
+	WindowParam         float64 `json:"window_param"`          // Kaiser beta or Gaussian sigma
+	Averages            int     `json:"averages"`              // Spectra power-averaged per result, default 10
+
+	// Recording source; empty Filename means live data
+	Filename    string `json:"filename,omitempty"`
+	StartSample int64  `json:"start_sample,omitempty"`
+}
+
+// Validate checks the options, fills in defaults and returns the spectrum
+// options. Measurements integrate a density-scaled spectrum, so results do
+// not depend on the window or FFT size.
+func (o *MeasureOptions) Validate() (SpectrumOptions, error) {
+	for _, ch := range o.Channels {
+		if ch < 1 || ch > maxChannel {
+			return SpectrumOptions{}, fmt.Errorf("channel must be between 1 and %d", maxChannel)
+		}
+	}
+	if o.BandwidthHz <= 0 {
+		return SpectrumOptions{}, fmt.Errorf("bandwidth_hz must be positive")
+	}
+	if o.SpacingHz == 0 {
+		o.SpacingHz = o.BandwidthHz
+	}
+	if o.AdjacentBandwidthHz == 0 {
+		o.AdjacentBandwidthHz = o.BandwidthHz
+	}
+	if o.SpacingHz < 0 || o.AdjacentBandwidthHz < 0 {
+		return SpectrumOptions{}, fmt.Errorf("spacing_hz and adjacent_bandwidth_hz must be positive")
+	}
+	if o.OBWPercent == 0 {
+		o.OBWPercent = 99
+	}
+	if o.OBWPercent <= 0 || o.OBWPercent >= 100 {
+		return SpectrumOptions{}, fmt.Errorf("obw_percent must be between 0 and 100")
+	}
+	if o.SpanHz == 0 {
+		o.SpanHz = 2*o.SpacingHz + o.AdjacentBandwidthHz
+	}
+	if o.SpanHz < 0 {
+		return SpectrumOptions{}, fmt.Errorf("span_hz must be positive")
+	}
+	if o.FFTSize == 0 {
+		o.FFTSize = 1024
+	}
+	if o.Averages == 0 {
+		o.Averages = 10
+	}
+	if o.Averages < 1 {
+		return SpectrumOptions{}, fmt.Errorf("averages must be positive")
+	}
+	if o.Filename != "" {
+		o.Filename = filepath.Base(o.Filename)
+	}
+	if math.Abs(o.OffsetHz)+o.BandwidthHz/2 > captureSampleRate/2 {
+		return SpectrumOptions{}, fmt.Errorf("main channel extends outside the captured band")
+	}
+	opts, err := parseSpectrumOptions(o.FFTSize, o.Window, o.WindowParam, ScalingDensity)
+	if err != nil {
+		return SpectrumOptions{}, err
+	}
+	o.Window, o.WindowParam = string(opts.Window.Kind), opts.Window.Param
+	return opts, nil
+}
+
+// ChannelMeasurement holds the results for one channel. Adjacent channel
+// fields are omitted when that channel falls outside the captured band.
+type ChannelMeasurement struct {
+	Channel         int     `json:"channel"`
+	ChannelPowerDBm float64 `json:"channel_power_dbm"`
+	DensityDBmHz    float64 `json:"density_dbm_hz"` // Mean density within the main channel
+	OBWHz           float64 `json:"obw_hz"`
+	OBWLowHz        float64 `json:"obw_low_hz"`
+	OBWHighHz       float64 `json:"obw_high_hz"`
+
+	LowerAdjacentDBm *float64 `json:"lower_adjacent_dbm,omitempty"`
+	UpperAdjacentDBm *float64 `json:"upper_adjacent_dbm,omitempty"`
+	ACPRLowerDB      *float64 `json:"acpr_lower_db,omitempty"` // Adjacent relative to main channel (dBc)
+	ACPRUpperDB      *float64 `json:"acpr_upper_db,omitempty"`
+}
+
+// MeasurementResult is one measurement across channels
+type MeasurementResult struct {
+	Source   string               `json:"source"` // "live" or the recording filename
+	Time     time.Time            `json:"time"`
+	FFTSize  int                  `json:"fft_size"`
+	Averages int                  `json:"averages"` // Spectra actually averaged
+	RBWHz    float64              `json:"rbw_hz"`
+	Options  MeasureOptions       `json:"options"`
+	Channels []ChannelMeasurement `json:"channels"`
+}
+
+// binEdges returns the frequency offsets of the edges of bin i in a
+// DC-centered spectrum of n bins
+func binEdges(i, n int, binHz float64) (float64, float64) {
+	center := float64(i-n/2) * binHz
+	return center - binHz/2, center + binHz/2
+}
+
+// bandPower integrates a density spectrum (mW/Hz) over [lo, hi] Hz, weighting
+// partially covered bins by their overlap. Returns false if the band is not
+// entirely inside the spectrum.
+func bandPower(density []float64, binHz, lo, hi float64) (float64, bool) {
+	n := len(density)
+	first, _ := binEdges(0, n, binHz)
+	_, last := binEdges(n-1, n, binHz)
+	if lo < first || hi > last || hi <= lo {
+		return 0, false
+	}
+	total := 0.0
+	for i, p := range density {
+		a, b := binEdges(i, n, binHz)
+		overlap := math.Min(b, hi) - math.Max(a, lo)
+		if overlap > 0 {
+			total += p * overlap
+		}
+	}
+	return total, true
+}
+
+// occupiedBandwidth finds the band within [lo, hi] holding percent of its
+// power, leaving equal power outside on either side
+func occupiedBandwidth(density []float64, binHz, lo, hi, percent float64) (float64, float64) {
+	n := len(density)
+	first, _ := binEdges(0, n, binHz)
+	_, last := binEdges(n-1, n, binHz)
+	lo, hi = math.Max(lo, first), math.Min(hi, last)
+
+	total, _ := bandPower(density, binHz, lo, hi)
+	if total <= 0 {
+		return lo, hi
+	}
+	lowTarget := total * (1 - percent/100) / 2
+	highTarget := total - lowTarget
+
+	// Walk bins, interpolating linearly inside the bin that crosses each target
+	obwLow, obwHigh := lo, hi
+	foundLow := false
+	cum := 0.0
+	for i, p := range density {
+		a, b := binEdges(i, n, binHz)
+		a, b = math.Max(a, lo), math.Min(b, hi)
+		if b <= a {
+			continue
+		}
+		power := p * (b - a)
+		if !foundLow && cum+power >= lowTarget {
+			obwLow = a + (b-a)*(lowTarget-cum)/power
+			foundLow = true
+		}
+		if cum+power >= highTarget {
+			obwHigh = a + (b-a)*(highTarget-cum)/power
+			break
+		}
+		cum += power
+	}
+	return obwLow, obwHigh
+}
+
+// measureChannel computes all results for one averaged density spectrum
+func measureChannel(ch int, density []float64, binHz float64, o *MeasureOptions) ChannelMeasurement {
+	m := ChannelMeasurement{Channel: ch}
+
+	lo, hi := o.OffsetHz-o.BandwidthHz/2, o.OffsetHz+o.BandwidthHz/2
+	main, _ := bandPower(density, binHz, lo, hi)
+	m.ChannelPowerDBm = powerToDBm(main)
+	m.DensityDBmHz = powerToDBm(main / o.BandwidthHz)
+
+	m.OBWLowHz, m.OBWHighHz = occupiedBandwidth(density, binHz, o.OffsetHz-o.SpanHz/2, o.OffsetHz+o.SpanHz/2, o.OBWPercent)
+	m.OBWHz = m.OBWHighHz - m.OBWLowHz
+
+	adjacent := func(center float64) (*float64, *float64) {
+		p, ok := bandPower(density, binHz, center-o.AdjacentBandwidthHz/2, center+o.AdjacentBandwidthHz/2)
+		if !ok {
+			return nil, nil
+		}
+		dBm := powerToDBm(p)
+		dBc := dBm - m.ChannelPowerDBm
+		return &dBm, &dBc
+	}
+	m.LowerAdjacentDBm, m.ACPRLowerDB = adjacent(o.OffsetHz - o.SpacingHz)
+	m.UpperAdjacentDBm, m.ACPRUpperDB = adjacent(o.OffsetHz + o.SpacingHz)
+	return m
+}
+
+// newMeasurementResult measures each channel's averaged density spectrum
+func newMeasurementResult(o *MeasureOptions, opts SpectrumOptions, source string, averages int, spectra map[int][]float64) (*MeasurementResult, error) {
+	info, err := windowInfo(opts)
+	if err != nil {
+		return nil, err
+	}
+	if math.Abs(o.OffsetHz)+o.BandwidthHz/2 > opts.sampleRate()/2 {
+		return nil, fmt.Errorf("main channel extends outside the %.0f Hz band", opts.sampleRate())
+	}
+	res := &MeasurementResult{
+		Source:   source,
+		Time:     time.Now(),
+		FFTSize:  opts.FFTSize,
+		Averages: averages,
+		RBWHz:    info.RBWHz,
+		Options:  *o,
+	}
+	res.Options.FFTSize = opts.FFTSize
+	for ch := 1; ch <= maxChannel; ch++ {
+		if density, ok := spectra[ch]; ok {
+			res.Channels = append(res.Channels, measureChannel(ch, density, info.BinWidthHz, o))
+		}
+	}
+	return res, nil
+}
+
+// powerAverager accumulates the mean of linear power spectra
+type powerAverager struct {
+	sum   []float64
+	count int
+}
+
+func (a *powerAverager) add(p []float64) {
+	if a.sum == nil {
+		a.sum = make([]float64, len(p))
+	}
+	for i, v := range p {
+		a.sum[i] += v
+	}
+	a.count++
+}
+
+func (a *powerAverager) mean() []float64 {
+	out := make([]float64, len(a.sum))
+	for i, v := range a.sum {
+		out[i] = v / float64(a.count)
+	}
+	return out
+}
+
+// measureRecording averages consecutive, non-overlapping FFTs from a
+// recording starting at StartSample
+func measureRecording(o *MeasureOptions) (*MeasurementResult, error) {
+	opts, err := o.Validate()
+	if err != nil {
+		return nil, err
+	}
+	r, err := openRecording(filepath.Join(dataFolder, o.Filename), o.Channels)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := r.SeekFrame(o.StartSample); err != nil {
+		return nil, err
+	}
+	opts.SampleRate = float64(r.meta.SampleRate) // Sub-channel recordings run slower
+
+	avg := make([]powerAverager, len(r.channels))
+	chOpts := make([]SpectrumOptions, len(r.channels))
+	for k, ch := range r.channels {
+		chOpts[k] = opts
+		chOpts[k].Cal = r.powerCurve(ch)
+	}
+	power := make([]float64, opts.FFTSize)
+	for n := 0; n < o.Averages; n++ {
+		got, err := r.Read(opts.FFTSize)
+		if err == io.EOF || got < opts.FFTSize {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for k := range r.channels {
+			if err := computePowerSpectrumInto(power, r.I[k], r.Q[k], chOpts[k]); err != nil {
+				return nil, err
+			}
+			avg[k].add(power)
+		}
+	}
+	if avg[0].count == 0 {
+		return nil, fmt.Errorf("recording has fewer than %d samples after sample %d", opts.FFTSize, o.StartSample)
+	}
+
+	spectra := make(map[int][]float64)
+	for k, ch := range r.channels {
+		spectra[ch] = avg[k].mean()
+	}
+	return newMeasurementResult(o, opts, o.Filename, avg[0].count, spectra)
+}
+
+// measureLive averages the next Averages stream frames. The stream loop
+// only runs while a WebSocket client is connected with streaming enabled.
+func measureLive(o *MeasureOptions) (*MeasurementResult, error) {
+	if _, err := o.Validate(); err != nil {
+		return nil, err
+	}
+	channels := o.Channels
+	if len(channels) == 0 {
+		channels = []int{1, 2, 3, 4, 5, 6, 7, 8}
+	}
+
+	var opts SpectrumOptions
+	avg := make(map[int]*powerAverager)
+	err := forEachLiveFrame(o.Averages, func(frame liveFrame) error {
+		if opts.FFTSize == 0 {
+			opts, _ = parseSpectrumOptions(frame.fftSize, o.Window, o.WindowParam, ScalingDensity)
+		} else if frame.fftSize != opts.FFTSize {
+			return fmt.Errorf("stream FFT size changed during measurement")
+		}
+		rate, err := frame.channelsRate(channels)
+		if err != nil {
+			return err
+		}
+		if opts.SampleRate != 0 && rate != opts.SampleRate {
+			return fmt.Errorf("sub-channel sample rate changed during measurement")
+		}
+		opts.SampleRate = rate
+		for _, ch := range channels {
+			i, q, err := frame.channel(ch)
+			if err != nil {
+				return err
+			}
+			p := make([]float64, opts.FFTSize)
+			chOpts := opts
+			chOpts.Cal = frame.powerCurve(ch)
+			if err := computePowerSpectrumInto(p, i, q, chOpts); err != nil {
+				return err
+			}
+			if avg[ch] == nil {
+				avg[ch] = &powerAverager{}
+			}
+			avg[ch].add(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	spectra := make(map[int][]float64)
+	for ch, a := range avg {
+		spectra[ch] = a.mean()
+	}
+	return newMeasurementResult(o, opts, "live", o.Averages, spectra)
+}
+
+// clientMeasure is a client's live measurement subscription. Each channel's
+// density spectrum is power-averaged over the last Averages frames (a
+// running average once full) and measured after every frame.
+type clientMeasure struct {
+	opts    MeasureOptions
+	fftSize int
+	frames  map[int]int
+	avg     map[int][]float64
+}
+
+func newClientMeasure(o MeasureOptions) (*clientMeasure, error) {
+	if _, err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return &clientMeasure{opts: o, frames: make(map[int]int), avg: make(map[int][]float64)}, nil
+}
+
+// update folds in one frame's density spectra (keyed by channel index 0-7)
+// and returns the measurement message. Caller holds the client lock.
+func (cm *clientMeasure) update(spectra map[int][]float64, opts SpectrumOptions) map[string]interface{} {
+	if opts.FFTSize != cm.fftSize {
+		cm.fftSize = opts.FFTSize
+		cm.frames = make(map[int]int)
+		cm.avg = make(map[int][]float64)
+	}
+	for ch, p := range spectra {
+		cm.frames[ch]++
+		k := cm.frames[ch]
+		if k > cm.opts.Averages {
+			k = cm.opts.Averages
+		}
+		avg := cm.avg[ch]
+		if avg == nil {
+			avg = make([]float64, len(p))
+			cm.avg[ch] = avg
+		}
+		for i, v := range p {
+			avg[i] += (v - avg[i]) / float64(k)
+		}
+	}
+
+	averaged := make(map[int][]float64)
+	frames := 0
+	for ch := range spectra {
+		averaged[ch+1] = cm.avg[ch]
+		if f := cm.frames[ch]; frames == 0 || f < frames {
+			frames = f
+		}
+	}
+	if frames > cm.opts.Averages {
+		frames = cm.opts.Averages
+	}
+	res, err := newMeasurementResult(&cm.opts, opts, "live", frames, averaged)
+	if err != nil {
+		return map[string]interface{}{"type": "measure_error", "error": err.Error()}
+	}
+	return map[string]interface{}{"type": "measurement", "measurement": res}
+}
+
+// spectrumOptions returns the density spectrum options at the stream's FFT size
+func (cm *clientMeasure) spectrumOptions(fftSize int) (SpectrumOptions, error) {
+	return parseSpectrumOptions(fftSize, cm.opts.Window, cm.opts.WindowParam, ScalingDensity)
+}
+
+// startClientMeasure replaces the client's live measurement subscription.
+// nil stops it; with a filename the recording is measured once in the
+// background and the result sent to the client.
+func startClientMeasure(client *Client, o *MeasureOptions) error {
+	if o == nil {
+		client.mu.Lock()
+		client.measure = nil
+		client.mu.Unlock()
+		return nil
+	}
+	if o.Filename != "" {
+		if _, err := o.Validate(); err != nil {
+			return err
+		}
+		go func() {
+			var msg map[string]interface{}
+			if res, err := measureRecording(o); err != nil {
+				msg = map[string]interface{}{"type": "measure_error", "error": err.Error()}
+			} else {
+				msg = map[string]interface{}{"type": "measurement", "measurement": res}
+			}
+			sendToClient(client, msg, nil)
+		}()
+		return nil
+	}
+
+	cm, err := newClientMeasure(*o)
+	if err != nil {
+		return err
+	}
+	client.mu.Lock()
+	client.measure = cm
+	client.mu.Unlock()
+	return nil
+}
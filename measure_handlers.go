@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleMeasure measures channel power, occupied bandwidth and ACPR.
+// POST a MeasureOptions body; with a filename the recording is measured,
+// otherwise the next averages frames of the live stream.
+func handleMeasure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var o MeasureOptions
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+
+	var res *MeasurementResult
+	var err error
+	if o.Filename != "" {
+		res, err = measureRecording(&o)
+	} else {
+		res, err = measureLive(&o)
+	}
+	if err != nil {
+		http.Error(w, "Measurement failed: "+err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleDynamics computes SNR, SFDR, THD, SINAD and ENOB of a clean tone.
+// POST a DynamicOptions body; with a filename the recording is analyzed,
+// otherwise the next averages live frames.
+func handleDynamics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var o DynamicOptions
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+
+	var res *DynamicResult
+	var err error
+	if o.Filename != "" {
+		res, err = dynamicsRecording(&o)
+	} else {
+		res, err = dynamicsLive(&o)
+	}
+	if err != nil {
+		http.Error(w, "Analysis failed: "+err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleCoherence measures amplitude and phase of channels against a
+// reference channel. POST a CoherenceOptions body; with a filename the
+// recording is measured, otherwise the next averages live frames.
+func handleCoherence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var o CoherenceOptions
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+
+	var res *CoherenceResult
+	var err error
+	if o.Filename != "" {
+		res, err = coherenceRecording(&o)
+	} else {
+		res, err = coherenceLive(&o)
+	}
+	if err != nil {
+		http.Error(w, "Measurement failed: "+err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleDOA estimates directions of arrival with the configured array.
+// POST a DOAOptions body; with a filename the recording is used, otherwise
+// the next snapshots live frames.
+func handleDOA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var o DOAOptions
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+
+	var res *DOAResult
+	var err error
+	if o.Filename != "" {
+		res, err = doaRecording(&o)
+	} else {
+		res, err = doaLive(&o)
+	}
+	if err != nil {
+		http.Error(w, "DOA failed: "+err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
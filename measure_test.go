@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/dma/pkg/fft"
+)
+
+// TestMeasureToneAndNoise checks channel power against a tone of known
+// power and OBW/ACPR against band-limited noise
+func TestMeasureToneAndNoise(t *testing.T) {
+	const n = 4096
+	binHz := float64(captureSampleRate) / n
+	opts, err := parseSpectrumOptions(n, "blackman-harris", 0, ScalingDensity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tone at -20 dBFS, 100.3 bins above DC
+	amp := fullScaleAmplitude * 0.1
+	iq := func(f func(k int) complex128) ([]int16, []int16) {
+		i, q := make([]int16, n), make([]int16, n)
+		for k := range i {
+			v := f(k)
+			i[k], q[k] = int16(math.Round(real(v))), int16(math.Round(imag(v)))
+		}
+		return i, q
+	}
+	i, q := iq(func(k int) complex128 {
+		ph := 2 * math.Pi * 100.3 * float64(k) / n
+		return complex(amp*math.Cos(ph), amp*math.Sin(ph))
+	})
+	density := make([]float64, n)
+	if err := computePowerSpectrumInto(density, i, q, opts); err != nil {
+		t.Fatal(err)
+	}
+	o := MeasureOptions{OffsetHz: 100.3 * binHz, BandwidthHz: 20 * binHz}
+	if _, err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m := measureChannel(1, density, binHz, &o)
+	if want := fullScaleDBm - 20; math.Abs(m.ChannelPowerDBm-want) > 0.1 {
+		t.Errorf("tone channel power %.2f dBm, want %.2f", m.ChannelPowerDBm, want)
+	}
+
+	// Noise filled evenly between -200 and +200 bins, averaged over many FFTs
+	rng := rand.New(rand.NewSource(1))
+	avg := &powerAverager{}
+	for frame := 0; frame < 50; frame++ {
+		spec := make([]complex128, n)
+		for b := -200; b <= 200; b++ {
+			spec[(b+n)%n] = complex(rng.NormFloat64(), rng.NormFloat64()) * 2000
+		}
+		td := make([]complex128, n)
+		fft.PlanFor(n).Inverse(td, spec)
+		i, q := iq(func(k int) complex128 { return td[k] * n / 20 })
+		p := make([]float64, n)
+		computePowerSpectrumInto(p, i, q, opts)
+		avg.add(p)
+	}
+	o = MeasureOptions{BandwidthHz: 401 * binHz, SpacingHz: 800 * binHz}
+	o.Validate()
+	m = measureChannel(1, avg.mean(), binHz, &o)
+	if got, want := m.OBWHz/binHz, 0.99*401; math.Abs(got-want) > 8 {
+		t.Errorf("noise OBW %.1f bins, want about %.1f", got, want)
+	}
+	if m.ACPRLowerDB == nil || *m.ACPRLowerDB > -60 || *m.ACPRUpperDB > -60 {
+		t.Errorf("adjacent channels should be empty, got %v %v", m.ACPRLowerDB, m.ACPRUpperDB)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/dma/pkg/dma"
+	"github.com/dma/pkg/psu"
+)
+
+// captureSampleRate is the per-channel complex sample rate in Hz
+const captureSampleRate = 244400000
+
+// version can be set at build time with -ldflags "-X main.version=1.2.3"
+var version = ""
+
+// CaptureMetadata represents the metadata saved alongside a capture
+type CaptureMetadata struct {
+	Timestamp  string          `json:"timestamp"`
+	SampleRate int             `json:"sample_rate"` // 244400000, or the sub-channel rate
+	Channels   []int           `json:"channels"`    // Channels in this capture (1-8, beams 9-16, sub-channels 17-80), in frame order
+	Config     *HardwareConfig `json:"config"`
+
+	// Data layout
+	Format    string `json:"format,omitempty"`     // cs16 for raw recordings, see export.go
+	ByteOrder string `json:"byte_order,omitempty"` // Always "little"
+
+	// Provenance
+	Software   *SoftwareInfo      `json:"software,omitempty"`
+	Host       string             `json:"host,omitempty"`
+	Unit       string             `json:"unit,omitempty"`       // Unit name for stored calibration
+	ConfigKey  string             `json:"config_key,omitempty"` // Receiver configuration for calibration lookups
+	DevicePath string             `json:"device_path,omitempty"`
+	Engines    []dma.EngineConfig `json:"engines,omitempty"`
+
+	// Bench equipment state
+	PSUStart *psu.PSUState   `json:"psu_start,omitempty"`
+	PSUEnd   *psu.PSUState   `json:"psu_end,omitempty"`
+	SigGen   *SigGenSnapshot `json:"siggen,omitempty"`
+	Sweep    *SweepSnapshot  `json:"sweep,omitempty"`
+
+	// Capture results
+	DurationSec    float64 `json:"duration_s,omitempty"`
+	ThroughputMBps float64 `json:"throughput_mbps,omitempty"`
+
+	// Sample range; on converted exports, the part of SourceFile they came from
+	SourceFile  string `json:"source_file,omitempty"`
+	StartSample int64  `json:"start_sample,omitempty"`
+	Samples     int64  `json:"samples,omitempty"`
+
+	// Tuning schedule for hop-list recordings
+	HopPlan     *HopPlan     `json:"hop_plan,omitempty"`
+	HopTimeline []HopSegment `json:"hop_timeline,omitempty"`
+
+	// Weights of the beam channels in this capture
+	Beams []BeamChannel `json:"beams,omitempty"`
+
+	// IQ imbalance correction applied to the receiver channels; nil = none
+	IQCorrection *IQCalibration `json:"iq_correction,omitempty"`
+
+	// Whether DC offsets were removed; nil on captures made without tracking
+	DCRemoval *DCRemovalInfo `json:"dc_removal,omitempty"`
+
+	// Inter-channel delays the channels were aligned with; nil = not aligned
+	Alignment *AlignmentInfo `json:"alignment,omitempty"`
+
+	// Filter bank the sub-channels in this capture came from
+	Channelizer *ChannelizerInfo `json:"channelizer,omitempty"`
+
+	// ADC code statistics of the raw receiver channels
+	ADC *ADCInfo `json:"adc,omitempty"`
+
+	// Power calibration tables for the capture's configuration; nil = the
+	// unit has none and levels use the nominal full scale
+	PowerCalibration *PowerCalRef `json:"power_calibration,omitempty"`
+}
+
+// SoftwareInfo identifies the build that produced a capture
+type SoftwareInfo struct {
+	Version      string `json:"version"`
+	GoVersion    string `json:"go_version,omitempty"`
+	Revision     string `json:"vcs_revision,omitempty"`
+	RevisionTime string `json:"vcs_time,omitempty"`
+	Modified     bool   `json:"vcs_modified,omitempty"`
+}
+
+// SigGenSnapshot is the signal generator state at capture start
+type SigGenSnapshot struct {
+	FreqMHz  float64 `json:"freq_mhz"`
+	PowerDBm float64 `json:"power_dbm"`
+	RFOutput bool    `json:"rf_output"`
+}
+
+// SweepSnapshot is the sweep state at capture start
+type SweepSnapshot struct {
+	Running bool         `json:"running"`
+	Params  *SweepParams `json:"params,omitempty"`
+}
+
+// softwareInfo reads version and VCS details from the Go build info
+func softwareInfo() *SoftwareInfo {
+	info := &SoftwareInfo{Version: version}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		if info.Version == "" {
+			info.Version = "unknown"
+		}
+		return info
+	}
+
+	info.GoVersion = bi.GoVersion
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.RevisionTime = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// psuSnapshot polls the PSU for a fresh reading, or returns nil if none is connected
+func psuSnapshot() *psu.PSUState {
+	p := psu.GetGlobalPSU()
+	if p == nil || !p.IsConnected() {
+		return nil
+	}
+	if err := p.Poll(); err != nil {
+		log.Printf("PSU poll for metadata failed: %v", err)
+	}
+	state := p.GetState()
+	return &state
+}
+
+// newCaptureMetadata collects everything known at the start of a capture.
+// channels are user-facing (1-8). Used by both the CLI and the server.
+func newCaptureMetadata(channels []int) *CaptureMetadata {
+	meta := &CaptureMetadata{
+		Timestamp:  time.Now().Format(time.RFC3339),
+		SampleRate: captureSampleRate,
+		Channels:   channels,
+		Format:     FormatCS16,
+		ByteOrder:  "little",
+		Software:   softwareInfo(),
+		PSUStart:   psuSnapshot(),
+	}
+
+	if hwController != nil {
+		meta.Config = hwController.GetConfig()
+	}
+	if host, err := os.Hostname(); err == nil {
+		meta.Host = host
+	}
+	meta.Unit = unitName
+	meta.ConfigKey = currentConfigKey()
+	meta.PowerCalibration = powerCalRef(configPowerCalContext(meta.Config), channels)
+
+	serverState.mu.RLock()
+	meta.DevicePath = serverState.DevicePath
+	meta.Engines = serverState.DMAEngines
+	meta.SigGen = &SigGenSnapshot{
+		FreqMHz:  serverState.SigGenFreqMHz,
+		PowerDBm: serverState.SigGenPowerDBm,
+		RFOutput: serverState.SigGenRFOutput,
+	}
+	meta.Sweep = &SweepSnapshot{Running: serverState.SweepRunning}
+	if serverState.SweepParams != nil {
+		params := *serverState.SweepParams
+		meta.Sweep.Params = &params
+	}
+	serverState.mu.RUnlock()
+
+	return meta
+}
+
+// finishCapture records the capture outcome and the end-of-capture PSU reading.
+// bytesRead is the raw amount read from the device during duration.
+func (m *CaptureMetadata) finishCapture(samples int64, duration time.Duration, bytesRead int) {
+	m.Samples = samples
+	m.DurationSec = duration.Seconds()
+	if duration > 0 {
+		m.ThroughputMBps = float64(bytesRead) / (1024 * 1024) / duration.Seconds()
+	}
+	m.PSUEnd = psuSnapshot()
+}
+
+// metadataPath returns the .json sidecar path for a data file
+func metadataPath(dataPath string) string {
+	ext := ""
+	if i := strings.LastIndex(dataPath, "."); i > strings.LastIndex(dataPath, "/") {
+		ext = dataPath[i:]
+	}
+	return strings.TrimSuffix(dataPath, ext) + ".json"
+}
+
+// writeCaptureMetadata saves the sidecar metadata for a data file
+func writeCaptureMetadata(dataPath string, meta *CaptureMetadata) error {
+	metaBytes, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metadataPath(dataPath), metaBytes, 0644)
+}
+
+// loadCaptureMetadata reads the sidecar metadata for a recording, if any
+func loadCaptureMetadata(dataPath string) (*CaptureMetadata, error) {
+	metaBytes, err := os.ReadFile(metadataPath(dataPath))
+	if err != nil {
+		return nil, err
+	}
+	var meta CaptureMetadata
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// updateCaptureMetadata rewrites the sidecar metadata for a recording in place
+func updateCaptureMetadata(dataPath string, update func(*CaptureMetadata)) error {
+	meta, err := loadCaptureMetadata(dataPath)
+	if err != nil {
+		return err
+	}
+	update(meta)
+	return writeCaptureMetadata(dataPath, meta)
+}
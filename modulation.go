@@ -0,0 +1,703 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dma/pkg/fft"
+)
+
+const (
+	ModBPSK  = "bpsk"
+	ModQPSK  = "qpsk"
+	ModQAM16 = "16qam"
+	ModQAM64 = "64qam"
+
+	modMinSymbols = 64      // Fewer can't be measured
+	modMaxSymbols = 65536   // Per recording measurement
+	modSpan       = 6       // Matched filter length on each side, in symbols
+	modTargetSPS  = 8       // Samples per symbol after decimation, at least
+	modCoarseLen  = 1 << 18 // Samples used for the coarse carrier estimate
+)
+
+// ModQualityConfig describes the single-carrier signal whose modulation
+// quality is measured
+type ModQualityConfig struct {
+	Enabled      bool    `json:"enabled"`        // Live measurement and constellation
+	Channel      int     `json:"channel"`        // User-facing channel (1-80), default 1
+	OffsetHz     float64 `json:"offset_hz"`      // Nominal carrier, offset from the channel's DC
+	SymbolRateHz float64 `json:"symbol_rate_hz"` // Nominal symbol rate
+	Modulation   string  `json:"modulation"`     // bpsk, qpsk (default), 16qam or 64qam
+	RollOff      float64 `json:"roll_off"`       // Root-raised-cosine roll-off of the matched filter, default 0.35
+	Averages     int     `json:"averages"`       // Live frames combined per result, default 4
+	Points       int     `json:"points"`         // Constellation points streamed per frame, default 512
+}
+
+// Validate checks the configuration and fills in defaults
+func (c *ModQualityConfig) Validate() error {
+	if c.Channel == 0 {
+		c.Channel = 1
+	}
+	if c.Modulation == "" {
+		c.Modulation = ModQPSK
+	}
+	if c.RollOff == 0 {
+		c.RollOff = 0.35
+	}
+	if c.Averages == 0 {
+		c.Averages = 4
+	}
+	if c.Points == 0 {
+		c.Points = 512
+	}
+	if c.Channel < 1 || c.Channel > maxChannel {
+		return fmt.Errorf("channel %d out of range (1-%d)", c.Channel, maxChannel)
+	}
+	if _, ok := modConstellations[c.Modulation]; !ok {
+		return fmt.Errorf("unknown modulation %q (want bpsk, qpsk, 16qam or 64qam)", c.Modulation)
+	}
+	if c.RollOff < 0.01 || c.RollOff > 1 {
+		return fmt.Errorf("roll_off must be between 0.01 and 1")
+	}
+	if c.Averages < 1 || c.Averages > 1000 {
+		return fmt.Errorf("averages must be between 1 and 1000")
+	}
+	if c.Points < 1 || c.Points > 4096 {
+		return fmt.Errorf("points must be between 1 and 4096")
+	}
+	if c.SymbolRateHz <= 0 {
+		return fmt.Errorf("symbol_rate_hz is required")
+	}
+	return nil
+}
+
+// check tests the signal against a channel's sample rate
+func (c *ModQualityConfig) check(rate float64) error {
+	if c.SymbolRateHz > rate/4 {
+		return fmt.Errorf("symbol rate above %.0f Hz, a quarter of the channel's sample rate", rate/4)
+	}
+	if math.Abs(c.OffsetHz)+(1+c.RollOff)*c.SymbolRateHz/2 > rate/2 {
+		return fmt.Errorf("offset_hz puts the signal outside the channel's %.0f Hz band", rate)
+	}
+	return nil
+}
+
+// modConstellation is a square constellation scaled to unit mean power.
+// The carrier phase comes from the symbols raised to power, which removes
+// the modulation up to a sign.
+type modConstellation struct {
+	levels int     // Per axis; BPSK uses I only
+	scale  float64 // Distance of the innermost level from the axis
+	power  int
+	sign   float64 // Of the mean symbol raised to power
+}
+
+var modConstellations = map[string]modConstellation{
+	ModBPSK:  {2, 1, 2, 1},
+	ModQPSK:  {2, 1 / math.Sqrt2, 4, -1},
+	ModQAM16: {4, 1 / math.Sqrt(10), 4, -1},
+	ModQAM64: {8, 1 / math.Sqrt(42), 4, -1},
+}
+
+// slice returns the constellation point nearest to s
+func (m modConstellation) slice(s complex128) complex128 {
+	axis := func(v float64) float64 {
+		k := math.Round((v/m.scale + float64(m.levels-1)) / 2)
+		k = math.Max(0, math.Min(float64(m.levels-1), k))
+		return (2*k - float64(m.levels-1)) * m.scale
+	}
+	if m.power == 2 {
+		return complex(axis(real(s)), 0)
+	}
+	return complex(axis(real(s)), axis(imag(s)))
+}
+
+// modTuner shifts a channel's samples by the nominal carrier offset, then
+// low-pass filters and decimates them to at least modTargetSPS samples per
+// symbol. Blocks passed to process are contiguous.
+type modTuner struct {
+	decim int
+	rate  float64 // After decimation
+	taps  []float64
+	buf   []complex128 // Mixed samples not yet consumed
+	nco   complex128
+	step  complex128
+	count int
+}
+
+func newModTuner(cfg *ModQualityConfig, rate float64) *modTuner {
+	t := &modTuner{decim: max(1, int(rate/(modTargetSPS*cfg.SymbolRateHz))), nco: 1}
+	t.rate = rate / float64(t.decim)
+	t.step = cmplx.Exp(complex(0, -2*math.Pi*cfg.OffsetHz/rate))
+	t.taps = []float64{1}
+	if t.decim > 1 {
+		// Flat to 3 symbol rates, stopped from 5; the aliases land outside
+		// the signal and the matched filter removes them
+		n := int(2.75*rate/cfg.SymbolRateHz) | 1
+		t.taps = lowpassTaps(n, 0.5/float64(t.decim))
+	}
+	return t
+}
+
+// process appends the decimated samples of a block to out
+func (t *modTuner) process(i, q []int16, out []complex128) []complex128 {
+	for k := range i {
+		t.buf = append(t.buf, complex(float64(i[k]), float64(q[k]))*t.nco)
+		t.nco *= t.step
+		if t.count++; t.count%1024 == 0 {
+			t.nco /= complex(cmplx.Abs(t.nco), 0)
+		}
+	}
+	n := len(t.taps)
+	pos := 0
+	for ; pos+n <= len(t.buf); pos += t.decim {
+		var re, im float64
+		for k, h := range t.taps {
+			v := t.buf[pos+k]
+			re += h * real(v)
+			im += h * imag(v)
+		}
+		out = append(out, complex(re, im))
+	}
+	t.buf = append(t.buf[:0], t.buf[pos:]...)
+	return out
+}
+
+// rrc is the root-raised-cosine pulse at t symbols from its center
+func rrc(t, beta float64) float64 {
+	switch {
+	case t == 0:
+		return 1 - beta + 4*beta/math.Pi
+	case math.Abs(math.Abs(t)-1/(4*beta)) < 1e-9:
+		return beta / math.Sqrt2 * ((1+2/math.Pi)*math.Sin(math.Pi/(4*beta)) + (1-2/math.Pi)*math.Cos(math.Pi/(4*beta)))
+	}
+	return (math.Sin(math.Pi*t*(1-beta)) + 4*beta*t*math.Cos(math.Pi*t*(1+beta))) /
+		(math.Pi * t * (1 - 16*beta*beta*t*t))
+}
+
+// modStats sums one or more analyses. Error sums are relative to the
+// constellation's unit mean power.
+type modStats struct {
+	symbols  int
+	errPower float64
+	refPower float64
+	peakErr  float64 // Largest |error|²
+	magErr   float64 // Sum of squared magnitude errors
+	phaseErr float64 // Sum of squared phase errors, rad²
+	freqHz   float64 // Carrier from the nominal offset
+	rateHz   float64 // Symbol rate
+	measured int     // Analyses combined
+}
+
+func (s *modStats) add(o modStats) {
+	n := float64(s.symbols + o.symbols)
+	s.freqHz = (s.freqHz*float64(s.symbols) + o.freqHz*float64(o.symbols)) / n
+	s.rateHz = (s.rateHz*float64(s.symbols) + o.rateHz*float64(o.symbols)) / n
+	s.symbols += o.symbols
+	s.errPower += o.errPower
+	s.refPower += o.refPower
+	s.peakErr = math.Max(s.peakErr, o.peakErr)
+	s.magErr += o.magErr
+	s.phaseErr += o.phaseErr
+	s.measured += o.measured
+}
+
+// analyzeModulation recovers the symbols of the tuned samples x at rate
+// and compares them with the nearest constellation points. It returns the
+// corrected symbols, scaled to unit mean power.
+//
+// The carrier is found coarsely from the spectral line of x raised to the
+// constellation's power. After the matched filter, the symbol rate and
+// timing come from the line at the symbol rate in |y|²: its phase drift
+// across blocks gives the rate and its phase the timing. The symbols are
+// filtered at the recovered instants, then the residual frequency, phase
+// and gain are fitted against the decisions.
+func analyzeModulation(x []complex128, rate float64, cfg *ModQualityConfig) (modStats, []complex128, error) {
+	m := modConstellations[cfg.Modulation]
+	sps := rate / cfg.SymbolRateHz
+	span := modSpan * sps
+	if avail := int((float64(len(x)) - 2*span) / sps); avail < modMinSymbols {
+		return modStats{}, nil, fmt.Errorf("%d symbols available, at least %d are needed; use more samples or a higher symbol rate", max(avail, 0), modMinSymbols)
+	}
+
+	// Coarse carrier, within ±rate/(2·power)
+	nc := min(len(x), modCoarseLen)
+	nfft := 1
+	for nfft < 2*nc {
+		nfft <<= 1
+	}
+	z := make([]complex128, nfft)
+	for k := range nc {
+		v := x[k]
+		z[k] = v * v
+		if m.power == 4 {
+			z[k] *= z[k]
+		}
+	}
+	fft.PlanFor(nfft).InPlace(z)
+	peak := 0
+	for k := range z {
+		if cmplx.Abs(z[k]) > cmplx.Abs(z[peak]) {
+			peak = k
+		}
+	}
+	a, b, c := cmplx.Abs(z[(peak-1+nfft)%nfft]), cmplx.Abs(z[peak]), cmplx.Abs(z[(peak+1)%nfft])
+	bin := float64(peak)
+	if d := a - 2*b + c; d != 0 {
+		bin += 0.5 * (a - c) / d
+	}
+	if bin >= float64(nfft)/2 {
+		bin -= float64(nfft)
+	}
+	f0 := bin / float64(nfft) / float64(m.power) // Cycles per sample
+	y := make([]complex128, len(x))
+	for k, v := range x {
+		y[k] = v * cmplx.Exp(complex(0, -2*math.Pi*f0*float64(k)))
+	}
+
+	// Matched filter output at sample positions
+	h := int(span)
+	taps := make([]float64, 2*h+1)
+	for j := range taps {
+		taps[j] = rrc(float64(j-h)/sps, cfg.RollOff)
+	}
+	p := make([]float64, len(y))
+	for k := h; k < len(y)-h; k++ {
+		var v complex128
+		for j, t := range taps {
+			v += y[k-h+j] * complex(t, 0)
+		}
+		p[k] = real(v)*real(v) + imag(v)*imag(v)
+	}
+
+	// Symbol rate from the drift of the timing phase across blocks of up
+	// to 64 symbols, which must stay under half a symbol per block
+	lo, hi := h+1, len(y)-h-1
+	block := int(float64(max(16, min(64, int(float64(hi-lo)/sps)/16))) * sps)
+	var drift lineFit
+	prev := 0.0
+	for start := lo; start+block <= hi; start += block {
+		var s complex128
+		for k := start; k < start+block; k++ {
+			s += complex(p[k], 0) * cmplx.Exp(complex(0, -2*math.Pi*float64(k)/sps))
+		}
+		ph := cmplx.Phase(s)
+		if start > lo {
+			ph = prev + math.Remainder(ph-prev, 2*math.Pi)
+		}
+		prev = ph
+		drift.add(float64(start)+float64(block)/2, ph, 1)
+	}
+	slope, _ := drift.line()
+	cycles := 1/sps + slope/(2*math.Pi) // Symbol rate in cycles per sample
+	sps = 1 / cycles
+	var s complex128
+	for k := lo; k < hi; k++ {
+		s += complex(p[k], 0) * cmplx.Exp(complex(0, -2*math.Pi*float64(k)/sps))
+	}
+	t0 := math.Mod(-cmplx.Phase(s)/(2*math.Pi)*sps, sps)
+	for t0 < float64(lo) {
+		t0 += sps
+	}
+
+	// Symbols at the recovered instants
+	var syms []complex128
+	for t := t0; t < float64(hi); t += sps {
+		var v complex128
+		for k := int(math.Ceil(t - span)); k <= int(math.Floor(t+span)); k++ {
+			v += y[k] * complex(rrc((t-float64(k))/sps, cfg.RollOff), 0)
+		}
+		syms = append(syms, v)
+	}
+	var pow float64
+	for _, v := range syms {
+		pow += real(v)*real(v) + imag(v)*imag(v)
+	}
+	if pow == 0 {
+		return modStats{}, nil, fmt.Errorf("no signal")
+	}
+	norm := complex(1/math.Sqrt(pow/float64(len(syms))), 0)
+	for k := range syms {
+		syms[k] *= norm
+	}
+
+	// Residual frequency and phase from the symbols raised to power, summed
+	// over blocks of 32 to average out the spread of QAM symbols
+	var carrier lineFit
+	for b := 0; b+32 <= len(syms); b += 32 {
+		var acc complex128
+		for _, v := range syms[b : b+32] {
+			v *= v
+			if m.power == 4 {
+				v *= v
+			}
+			acc += v
+		}
+		ph := cmplx.Phase(acc * complex(m.sign, 0))
+		if b > 0 {
+			ph = prev + math.Remainder(ph-prev, 2*math.Pi)
+		}
+		prev = ph
+		carrier.add(float64(b)+15.5, ph, 1)
+	}
+	slope, theta := carrier.line()
+	w := slope / float64(m.power) // Radians per symbol
+	theta /= float64(m.power)
+	for k := range syms {
+		syms[k] *= cmplx.Exp(complex(0, -theta-w*float64(k)))
+	}
+
+	// Then frequency, phase and gain fitted against the decisions
+	for range 3 {
+		var fit lineFit
+		for k, v := range syms {
+			r := v * cmplx.Conj(m.slice(v))
+			fit.add(float64(k), cmplx.Phase(r), cmplx.Abs(r))
+		}
+		dw, _ := fit.line()
+		var num complex128
+		var den float64
+		for k, v := range syms {
+			v *= cmplx.Exp(complex(0, -dw*float64(k)))
+			d := m.slice(v)
+			num += v * cmplx.Conj(d)
+			den += real(d)*real(d) + imag(d)*imag(d)
+		}
+		g := num / complex(den, 0)
+		for k := range syms {
+			syms[k] *= cmplx.Exp(complex(0, -dw*float64(k))) / g
+		}
+		w += dw
+	}
+
+	res := modStats{symbols: len(syms), measured: 1}
+	for _, v := range syms {
+		d := m.slice(v)
+		e := v - d
+		e2 := real(e)*real(e) + imag(e)*imag(e)
+		res.errPower += e2
+		res.refPower += real(d)*real(d) + imag(d)*imag(d)
+		res.peakErr = math.Max(res.peakErr, e2)
+		dm := cmplx.Abs(v) - cmplx.Abs(d)
+		res.magErr += dm * dm
+		dp := cmplx.Phase(v * cmplx.Conj(d))
+		res.phaseErr += dp * dp
+	}
+	res.rateHz = cycles * rate
+	res.freqHz = f0*rate + w/(2*math.Pi)*res.rateHz
+	return res, syms, nil
+}
+
+// lineFit is a weighted least-squares straight line
+type lineFit struct {
+	w, x, y, xx, xy float64
+}
+
+func (f *lineFit) add(x, y, w float64) {
+	f.w += w
+	f.x += w * x
+	f.y += w * y
+	f.xx += w * x * x
+	f.xy += w * x * y
+}
+
+// line returns the slope and intercept; the slope is 0 without two
+// distinct x
+func (f *lineFit) line() (slope, intercept float64) {
+	if d := f.w*f.xx - f.x*f.x; d > 1e-9*f.w*f.xx {
+		slope = (f.w*f.xy - f.x*f.y) / d
+	}
+	if f.w > 0 {
+		intercept = (f.y - slope*f.x) / f.w
+	}
+	return slope, intercept
+}
+
+// ModQualityResult is a modulation quality measurement. EVM and the
+// magnitude error are relative to the RMS of the constellation; MER is
+// the same power ratio in dB.
+type ModQualityResult struct {
+	Source             string    `json:"source"` // "live" or the recording filename
+	Time               time.Time `json:"time"`
+	Channel            int       `json:"channel"`
+	Modulation         string    `json:"modulation"`
+	Symbols            int       `json:"symbols"`
+	Frames             int       `json:"frames,omitempty"` // Live frames combined
+	EVMPct             float64   `json:"evm_pct"`
+	EVMPeakPct         float64   `json:"evm_peak_pct"`
+	MERDB              float64   `json:"mer_db"`
+	MagnitudeErrorPct  float64   `json:"magnitude_error_pct"`
+	PhaseErrorDeg      float64   `json:"phase_error_deg"`
+	FreqErrorHz        float64   `json:"freq_error_hz"` // Carrier from offset_hz
+	CarrierHz          float64   `json:"carrier_hz"`    // From the tuned (DC) frequency, including a sub-channel's center
+	RFMHz              float64   `json:"rf_mhz"`
+	SymbolRateHz       float64   `json:"symbol_rate_hz"`
+	SymbolRateErrorHz  float64   `json:"symbol_rate_error_hz"`
+	SymbolRateErrorPPM float64   `json:"symbol_rate_error_ppm"`
+}
+
+func newModQualityResult(s modStats, cfg *ModQualityConfig, source string, centerHz, ddcMHz float64) *ModQualityResult {
+	evm := math.Sqrt(s.errPower / s.refPower)
+	carrier := centerHz + cfg.OffsetHz + s.freqHz
+	return &ModQualityResult{
+		Source:             source,
+		Time:               time.Now(),
+		Channel:            cfg.Channel,
+		Modulation:         cfg.Modulation,
+		Symbols:            s.symbols,
+		EVMPct:             100 * evm,
+		EVMPeakPct:         100 * math.Sqrt(s.peakErr/(s.refPower/float64(s.symbols))),
+		MERDB:              -20 * math.Log10(evm),
+		MagnitudeErrorPct:  100 * math.Sqrt(s.magErr/s.refPower),
+		PhaseErrorDeg:      math.Sqrt(s.phaseErr/float64(s.symbols)) * 180 / math.Pi,
+		FreqErrorHz:        s.freqHz,
+		CarrierHz:          carrier,
+		RFMHz:              ddcMHz + carrier/1e6,
+		SymbolRateHz:       s.rateHz,
+		SymbolRateErrorHz:  s.rateHz - cfg.SymbolRateHz,
+		SymbolRateErrorPPM: (s.rateHz/cfg.SymbolRateHz - 1) * 1e6,
+	}
+}
+
+// analyzeFrame measures the configured channel of one stream frame
+func analyzeFrame(frame liveFrame, cfg *ModQualityConfig) (modStats, []complex128, error) {
+	i, q, err := frame.channel(cfg.Channel)
+	if err != nil {
+		return modStats{}, nil, err
+	}
+	rate := frame.sampleRate(cfg.Channel)
+	if err := cfg.check(rate); err != nil {
+		return modStats{}, nil, err
+	}
+	t := newModTuner(cfg, rate)
+	return analyzeModulation(t.process(i, q, nil), t.rate, cfg)
+}
+
+// liveModulation measures stream frames in its own goroutine, like the
+// detector, and streams the constellation
+var liveModulation = struct {
+	once   sync.Once
+	frames chan liveFrame
+
+	mu     sync.Mutex
+	cfg    ModQualityConfig // Of recent
+	recent []modStats
+	result *ModQualityResult
+	err    string
+}{frames: make(chan liveFrame, 1)}
+
+// feedModulation hands a complete stream frame to the live measurement
+func feedModulation(frame liveFrame) {
+	serverState.mu.RLock()
+	enabled := serverState.Modulation.Enabled
+	serverState.mu.RUnlock()
+	if !enabled {
+		return
+	}
+	liveModulation.once.Do(func() {
+		go func() {
+			for frame := range liveModulation.frames {
+				measureFrame(frame)
+			}
+		}()
+	})
+	select {
+	case liveModulation.frames <- frame:
+	default:
+	}
+}
+
+// measureFrame combines a frame's analysis with the previous Averages-1
+// and broadcasts the result with the frame's constellation
+func measureFrame(frame liveFrame) {
+	serverState.mu.RLock()
+	cfg := serverState.Modulation
+	serverState.mu.RUnlock()
+	if !cfg.Enabled || cfg.Validate() != nil {
+		return
+	}
+	st, syms, err := analyzeFrame(frame, &cfg)
+
+	msg := map[string]interface{}{"type": "constellation", "modulation": cfg.Modulation}
+	liveModulation.mu.Lock()
+	if liveModulation.cfg != cfg {
+		liveModulation.cfg, liveModulation.recent, liveModulation.result = cfg, nil, nil
+	}
+	if err != nil {
+		liveModulation.err = err.Error()
+		msg["error"] = liveModulation.err
+	} else {
+		liveModulation.err = ""
+		liveModulation.recent = append(liveModulation.recent, st)
+		if len(liveModulation.recent) > cfg.Averages {
+			liveModulation.recent = liveModulation.recent[1:]
+		}
+		var sum modStats
+		for _, s := range liveModulation.recent {
+			sum.add(s)
+		}
+		res := newModQualityResult(sum, &cfg, "live", subChannelCenterHz(cfg.Channel, frame.chz), frame.cal.ddcMHz)
+		res.Frames = sum.measured
+		liveModulation.result = res
+		msg["result"] = res
+
+		n := min(len(syms), cfg.Points)
+		pi, pq := make([]float64, n), make([]float64, n)
+		for k := range n {
+			pi[k] = math.Round(real(syms[k])*1000) / 1000
+			pq[k] = math.Round(imag(syms[k])*1000) / 1000
+		}
+		msg["i"], msg["q"] = pi, pq
+	}
+	liveModulation.mu.Unlock()
+	broadcastJSON(msg)
+}
+
+// ModQualityOptions configures a one-off measurement of the next live
+// frames or of a recording
+type ModQualityOptions struct {
+	ModQualityConfig
+	Filename    string `json:"filename,omitempty"`
+	StartSample int64  `json:"start_sample,omitempty"`
+	Symbols     int    `json:"symbols,omitempty"` // Recording symbols analyzed, default 4096
+}
+
+// measureModulationLive combines the next Averages stream frames
+func measureModulationLive(o *ModQualityOptions) (*ModQualityResult, error) {
+	var sum modStats
+	var centerHz, ddcMHz float64
+	err := forEachLiveFrame(o.Averages, func(frame liveFrame) error {
+		st, _, err := analyzeFrame(frame, &o.ModQualityConfig)
+		if err != nil {
+			return err
+		}
+		sum.add(st)
+		centerHz, ddcMHz = subChannelCenterHz(o.Channel, frame.chz), frame.cal.ddcMHz
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := newModQualityResult(sum, &o.ModQualityConfig, "live", centerHz, ddcMHz)
+	res.Frames = sum.measured
+	return res, nil
+}
+
+// measureModulationRecording analyzes Symbols symbols of a recording from
+// StartSample
+func measureModulationRecording(o *ModQualityOptions) (*ModQualityResult, error) {
+	if o.Symbols == 0 {
+		o.Symbols = 4096
+	}
+	if o.Symbols < modMinSymbols || o.Symbols > modMaxSymbols {
+		return nil, fmt.Errorf("symbols must be between %d and %d", modMinSymbols, modMaxSymbols)
+	}
+	o.Filename = filepath.Base(o.Filename)
+	r, err := openRecording(filepath.Join(dataFolder, o.Filename), []int{o.Channel})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := r.SeekFrame(o.StartSample); err != nil {
+		return nil, err
+	}
+	rate := float64(r.meta.SampleRate)
+	if err := o.check(rate); err != nil {
+		return nil, err
+	}
+
+	t := newModTuner(&o.ModQualityConfig, rate)
+	need := int(float64(o.Symbols+2*modSpan+1) * t.rate / o.SymbolRateHz)
+	var x []complex128
+	for len(x) < need {
+		n, err := r.Read(65536)
+		if n == 0 || err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		x = t.process(r.I[0][:n], r.Q[0][:n], x)
+	}
+	st, _, err := analyzeModulation(x[:min(len(x), need)], t.rate, &o.ModQualityConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newModQualityResult(st, &o.ModQualityConfig, o.Filename,
+		subChannelCenterHz(o.Channel, r.meta.Channelizer), recordingPowerCalContext(r.meta).ddcMHz), nil
+}
+
+// handleModulation gets or replaces the live measurement configuration
+func handleModulation(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var cfg ModQualityConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		serverState.mu.Lock()
+		serverState.Modulation = cfg
+		serverState.mu.Unlock()
+		go broadcastJSON(modulationMessage())
+	}
+	json.NewEncoder(w).Encode(modulationMessage())
+}
+
+// modulationMessage describes the configuration and the latest live result
+func modulationMessage() map[string]interface{} {
+	serverState.mu.RLock()
+	cfg := serverState.Modulation
+	serverState.mu.RUnlock()
+	cfg.Validate() // Show the defaults before the first configuration
+	msg := map[string]interface{}{"type": "modulation", "config": cfg}
+	liveModulation.mu.Lock()
+	if liveModulation.result != nil && liveModulation.cfg == cfg {
+		msg["result"] = liveModulation.result
+	}
+	if liveModulation.err != "" {
+		msg["error"] = liveModulation.err
+	}
+	liveModulation.mu.Unlock()
+	return msg
+}
+
+// handleModulationMeasure measures a ModQualityOptions body: with a
+// filename the recording, otherwise the next averages live frames
+func handleModulationMeasure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var o ModQualityOptions
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	if err := o.Validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var res *ModQualityResult
+	var err error
+	if o.Filename != "" {
+		res, err = measureModulationRecording(&o)
+	} else {
+		res, err = measureModulationLive(&o)
+	}
+	if err != nil {
+		http.Error(w, "Measurement failed: "+err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestModulationQuality measures synthetic root-raised-cosine signals with
+// a carrier offset, a symbol rate error and noise of known power
+func TestModulationQuality(t *testing.T) {
+	cases := []struct {
+		modulation  string
+		rate, symHz float64
+		offsetHz    float64
+		freqErrHz   float64
+		ppm         float64
+		esN0dB      float64 // 0 = noise-free
+	}{
+		{modulation: ModQPSK, rate: captureSampleRate, symHz: 5e6, offsetHz: 20e6, freqErrHz: 3e3, ppm: 100},
+		{modulation: ModBPSK, rate: captureSampleRate / 8, symHz: 1e6, offsetHz: -2e6, freqErrHz: -500, ppm: -40},
+		{modulation: ModQAM16, rate: captureSampleRate / 8, symHz: 3.2e6, offsetHz: 1e6, freqErrHz: 20e3, ppm: 20, esN0dB: 25},
+		{modulation: ModQAM64, rate: captureSampleRate / 8, symHz: 2.5e6, freqErrHz: 1e3, esN0dB: 32},
+	}
+	for _, c := range cases {
+		t.Run(c.modulation, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			m := modConstellations[c.modulation]
+			const symbols = 2048
+			d := make([]complex128, symbols)
+			for n := range d {
+				d[n] = m.slice(complex(rng.NormFloat64(), rng.NormFloat64()))
+			}
+
+			// Shaped symbols at the offset rate and carrier, 8000 codes RMS
+			const beta = 0.35
+			period := c.rate / (c.symHz * (1 + c.ppm*1e-6))
+			n := int(float64(symbols) * period)
+			x := make([]complex128, n)
+			var pow float64
+			for k := range x {
+				var v complex128
+				center := float64(k) / period
+				for s := max(0, int(center)-8); s <= min(symbols-1, int(center)+8); s++ {
+					v += d[s] * complex(rrc(center-float64(s), beta), 0)
+				}
+				ph := 2 * math.Pi * (c.offsetHz + c.freqErrHz) * float64(k) / c.rate
+				x[k] = v * complex(math.Cos(ph), math.Sin(ph))
+				pow += real(v)*real(v) + imag(v)*imag(v)
+			}
+			scale := 8000 / math.Sqrt(pow/float64(n))
+			sigma := 0.0
+			if c.esN0dB != 0 {
+				// Es/N0 = P·T/N0 with N0 = σ²/rate
+				sigma = 8000 * math.Sqrt(period/math.Pow(10, c.esN0dB/10)/2)
+			}
+			i, q := make([]int16, n), make([]int16, n)
+			for k, v := range x {
+				i[k] = int16(math.Round(real(v)*scale + sigma*rng.NormFloat64()))
+				q[k] = int16(math.Round(imag(v)*scale + sigma*rng.NormFloat64()))
+			}
+
+			cfg := ModQualityConfig{OffsetHz: c.offsetHz, SymbolRateHz: c.symHz, Modulation: c.modulation}
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if err := cfg.check(c.rate); err != nil {
+				t.Fatal(err)
+			}
+			// Two blocks exercise the tuner's state
+			tu := newModTuner(&cfg, c.rate)
+			y := tu.process(i[:n/3], q[:n/3], nil)
+			y = tu.process(i[n/3:], q[n/3:], y)
+			st, syms, err := analyzeModulation(y, tu.rate, &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := newModQualityResult(st, &cfg, "test", 0, 0)
+			if res.Symbols < symbols-2*modSpan-4 || len(syms) != res.Symbols {
+				t.Errorf("%d symbols recovered of %d", res.Symbols, symbols)
+			}
+			if math.Abs(res.FreqErrorHz-c.freqErrHz) > 1e-4*c.symHz {
+				t.Errorf("frequency error %.1f Hz, want %.1f", res.FreqErrorHz, c.freqErrHz)
+			}
+			if math.Abs(res.SymbolRateErrorPPM-c.ppm) > 10 {
+				t.Errorf("symbol rate error %.1f ppm, want %.1f", res.SymbolRateErrorPPM, c.ppm)
+			}
+			if c.esN0dB == 0 {
+				if res.MERDB < 35 {
+					t.Errorf("MER %.1f dB without noise, EVM %.2f%%", res.MERDB, res.EVMPct)
+				}
+			} else if math.Abs(res.MERDB-c.esN0dB) > 1 {
+				t.Errorf("MER %.2f dB, want %.0f", res.MERDB, c.esN0dB)
+			}
+			if math.Abs(res.MERDB+20*math.Log10(res.EVMPct/100)) > 1e-9 {
+				t.Errorf("EVM %.3f%% doesn't match MER %.2f dB", res.EVMPct, res.MERDB)
+			}
+		})
+	}
+}
@@ -0,0 +1,813 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	PDWModNone    = "none"    // Constant carrier
+	PDWModLFM     = "lfm"     // Linear frequency sweep
+	PDWModFM      = "fm"      // Non-linear frequency modulation
+	PDWModPhase   = "phase"   // Phase jumps, e.g. Barker codes
+	PDWModUnknown = "unknown" // Too short to tell
+
+	pdwBlockSamples = 65536 // Recording samples read per channel at a time
+)
+
+// PDWConfig configures pulse extraction
+type PDWConfig struct {
+	Enabled      bool    `json:"enabled"`       // Live extraction
+	Channels     []int   `json:"channels"`      // User-facing channels (1-80), default 1
+	ThresholdDB  float64 `json:"threshold_db"`  // A pulse starts this far above the noise floor, default 12
+	HysteresisDB float64 `json:"hysteresis_db"` // and ends this much lower, default 3
+	MinSamples   int     `json:"min_samples"`   // Shorter pulses are noise, default 4
+	EdgeSamples  int     `json:"edge_samples"`  // Kept on each side of the threshold crossings for the edges, default 8
+	MaxWidthUS   float64 `json:"max_width_us"`  // Longer pulses are cut and marked truncated, default 1000
+	LogSize      int     `json:"log_size"`      // Live PDWs kept, default 10000
+}
+
+// Validate checks the configuration and fills in defaults
+func (c *PDWConfig) Validate() error {
+	if len(c.Channels) == 0 {
+		c.Channels = []int{1}
+	}
+	for _, ch := range c.Channels {
+		if ch < 1 || ch > maxChannel {
+			return fmt.Errorf("channel %d out of range (1-%d)", ch, maxChannel)
+		}
+	}
+	if c.ThresholdDB == 0 {
+		c.ThresholdDB = 12
+	}
+	if c.HysteresisDB == 0 {
+		c.HysteresisDB = 3
+	}
+	if c.ThresholdDB <= 0 || c.HysteresisDB < 0 || c.HysteresisDB >= c.ThresholdDB {
+		return fmt.Errorf("threshold_db must be positive and hysteresis_db between 0 and threshold_db")
+	}
+	if c.MinSamples == 0 {
+		c.MinSamples = 4
+	}
+	if c.EdgeSamples == 0 {
+		c.EdgeSamples = 8
+	}
+	if c.MinSamples < 1 || c.EdgeSamples < 1 || c.EdgeSamples > 4096 {
+		return fmt.Errorf("min_samples must be positive and edge_samples between 1 and 4096")
+	}
+	if c.MaxWidthUS == 0 {
+		c.MaxWidthUS = 1000
+	}
+	if c.MaxWidthUS <= 0 || c.MaxWidthUS > 100000 {
+		return fmt.Errorf("max_width_us must be between 0 and 100000")
+	}
+	if c.LogSize == 0 {
+		c.LogSize = 10000
+	}
+	if c.LogSize < 1 {
+		return fmt.Errorf("log_size must be positive")
+	}
+	return nil
+}
+
+// PDW is the pulse descriptor word of one pulse. Edges are the 50%
+// amplitude (-6 dB) points of the pulse top.
+type PDW struct {
+	ID           int       `json:"id"`
+	Channel      int       `json:"channel"`
+	Time         time.Time `json:"time"`          // Time of arrival (leading edge)
+	TOAS         float64   `json:"toa_s"`         // Recordings: from the start of the file; live: from the start of the log
+	TOASample    float64   `json:"toa_sample"`    // Recordings: sample index in the file; live: within the stream frame
+	PWS          float64   `json:"pw_s"`          // Pulse width between the edges
+	AmplitudeDBm float64   `json:"amplitude_dbm"` // Mean power of the pulse top
+	PeakDBm      float64   `json:"peak_dbm"`
+	SNRDB        float64   `json:"snr_db"`      // Pulse top above the noise floor
+	FreqHz       float64   `json:"freq_hz"`     // Carrier, offset from the tuned (DC) frequency
+	RFMHz        float64   `json:"rf_mhz"`      // Absolute, from the DDC frequency
+	ChirpHz      float64   `json:"chirp_hz"`    // Frequency change across the pulse from a linear fit
+	FreqDevHz    float64   `json:"freq_dev_hz"` // RMS frequency deviation from the fit
+	PhaseJumps   int       `json:"phase_jumps"` // Sample-to-sample phase steps over 90° beyond the carrier
+	Modulation   string    `json:"modulation"`  // none, lfm, fm, phase or unknown
+	Truncated    bool      `json:"truncated"`   // Cut at max_width_us
+}
+
+// pulse is a pulse measured in one channel's samples before it is placed
+// in time and frequency
+type pulse struct {
+	toa, width       float64 // Samples
+	topPower, peak2  float64 // Codes²
+	snrDB            float64
+	freq, chirp, dev float64 // Fractions of the sample rate
+	jumps            int
+	modulation       string
+	truncated        bool
+}
+
+// pdwExtractor finds pulses in one channel's samples. Blocks passed to
+// process are contiguous; a pulse can span them.
+type pdwExtractor struct {
+	cfg      *PDWConfig
+	maxWidth int
+
+	noise    float64      // Mean noise power of the current block, codes²
+	hist     []complex128 // Samples before the current one, up to EdgeSamples
+	cur      []complex128 // Pulse in progress, from EdgeSamples before its rise
+	curStart int64        // Sample index of cur[0]
+	curNoise float64      // Noise floor, rise and fall thresholds of the pulse in progress
+	curRise  float64
+	curFall  float64
+	above    int   // Samples of the pulse at or above the falling threshold
+	trail    int   // Samples since the pulse fell, -1 while it is up
+	pos      int64 // Sample index of the next sample
+}
+
+func newPDWExtractor(cfg *PDWConfig, rate float64) *pdwExtractor {
+	return &pdwExtractor{cfg: cfg, maxWidth: int(cfg.MaxWidthUS * 1e-6 * rate)}
+}
+
+// noiseFloor estimates the mean noise power of a block from the median of
+// the sample powers, which pulses with a duty cycle under 50% don't move.
+// The median of exponentially distributed power is ln 2 times its mean.
+func noiseFloor(i, q []int16) float64 {
+	step := max(1, len(i)/4096)
+	p := make([]float64, 0, len(i)/step+1)
+	for k := 0; k < len(i); k += step {
+		vi, vq := float64(i[k]), float64(q[k])
+		p = append(p, vi*vi+vq*vq)
+	}
+	sort.Float64s(p)
+	return math.Max(p[len(p)/2]/math.Ln2, 1)
+}
+
+// process runs one block through the threshold detector and returns the
+// pulses that ended in it; toa is relative to the first block
+func (e *pdwExtractor) process(i, q []int16) []pulse {
+	if len(i) == 0 {
+		return nil
+	}
+	e.noise = noiseFloor(i, q)
+	rise := e.noise * math.Pow(10, e.cfg.ThresholdDB/10)
+	edge := e.cfg.EdgeSamples
+	var out []pulse
+	for k := range i {
+		x := complex(float64(i[k]), float64(q[k]))
+		p := real(x)*real(x) + imag(x)*imag(x)
+		if e.cur == nil {
+			if p >= rise {
+				e.cur = append(append(make([]complex128, 0, 4*edge), e.hist...), x)
+				e.curStart, e.curNoise = e.pos-int64(len(e.hist)), e.noise
+				e.curRise, e.curFall = rise, e.noise*math.Pow(10, (e.cfg.ThresholdDB-e.cfg.HysteresisDB)/10)
+				e.above, e.trail = 1, -1
+			} else {
+				if len(e.hist) == edge {
+					copy(e.hist, e.hist[1:])
+					e.hist = e.hist[:edge-1]
+				}
+				e.hist = append(e.hist, x)
+			}
+			e.pos++
+			continue
+		}
+
+		e.cur = append(e.cur, x)
+		fall := e.curFall
+		if p >= fall {
+			e.above++
+		}
+		switch {
+		case e.trail < 0 && p < fall:
+			e.trail = 1
+		case e.trail >= 0 && p >= e.curRise:
+			e.trail = -1 // Rose again within the edge samples: same pulse
+		case e.trail >= 0:
+			e.trail++
+		}
+		e.pos++
+		truncated := e.trail < 0 && len(e.cur)-edge > e.maxWidth
+		if e.trail > edge || truncated {
+			if e.above >= e.cfg.MinSamples {
+				if pl, ok := measurePulse(e.cur, e.curNoise, truncated); ok {
+					pl.toa += float64(e.curStart)
+					out = append(out, pl)
+				}
+			}
+			e.hist = append(e.hist[:0], e.cur[max(0, len(e.cur)-edge):]...)
+			if truncated {
+				// The rest of the pulse has no leading edge and is dropped
+				e.hist = e.hist[:0]
+			}
+			e.cur = nil
+		}
+	}
+	return out
+}
+
+// measurePulse describes the samples of one pulse, which start and end
+// below the threshold. ok is false when the leading edge isn't in them.
+func measurePulse(x []complex128, noise float64, truncated bool) (pulse, bool) {
+	n := len(x)
+	mag := make([]float64, n)
+	peak := 0.0
+	for k, v := range x {
+		mag[k] = cmplx.Abs(v)
+		peak = math.Max(peak, mag[k])
+	}
+	// The pulse top is the median magnitude above half the peak, so
+	// overshoot and noise spikes don't set the edges
+	var top []float64
+	for _, m := range mag {
+		if m >= peak/2 {
+			top = append(top, m)
+		}
+	}
+	sort.Float64s(top)
+	half := top[len(top)/2] / 2
+
+	first, last := -1, -1
+	for k, m := range mag {
+		if m >= half {
+			if first < 0 {
+				first = k
+			}
+			last = k
+		}
+	}
+	if first == 0 {
+		return pulse{}, false
+	}
+	lead := float64(first-1) + (half-mag[first-1])/(mag[first]-mag[first-1])
+	trail := float64(last)
+	if last < n-1 {
+		trail += (mag[last] - half) / (mag[last] - mag[last+1])
+	}
+	pl := pulse{toa: lead, width: math.Max(trail-lead, 0), peak2: peak * peak, truncated: truncated}
+
+	// Measure on the middle 80% so the edges don't bias the top
+	c0, c1 := int(math.Ceil(lead+0.1*pl.width)), int(math.Floor(trail-0.1*pl.width))
+	if c1-c0 < 2 {
+		c0, c1 = first, last
+	}
+	for k := c0; k <= c1; k++ {
+		pl.topPower += real(x[k])*real(x[k]) + imag(x[k])*imag(x[k])
+	}
+	pl.topPower /= float64(c1 - c0 + 1)
+	pl.snrDB = 10 * math.Log10(pl.topPower/noise)
+
+	// Carrier from the mean phase step; chirp and deviation from a linear
+	// fit to the frequencies of up to 16 segments
+	d := make([]complex128, 0, c1-c0)
+	var sum complex128
+	for k := c0 + 1; k <= c1; k++ {
+		v := x[k] * cmplx.Conj(x[k-1])
+		d = append(d, v)
+		sum += v
+	}
+	pl.freq = cmplx.Phase(sum) / (2 * math.Pi)
+	segments := min(16, len(d)/8)
+	slope, intercept := 0.0, pl.freq
+	if segments >= 3 {
+		size := len(d) / segments
+		var st, sf, stt, stf float64
+		freqs, times := make([]float64, segments), make([]float64, segments)
+		for s := range segments {
+			var seg complex128
+			for _, v := range d[s*size : (s+1)*size] {
+				seg += v
+			}
+			freqs[s] = cmplx.Phase(seg) / (2 * math.Pi)
+			times[s] = float64(s*size) + float64(size-1)/2
+			st, sf, stt, stf = st+times[s], sf+freqs[s], stt+times[s]*times[s], stf+times[s]*freqs[s]
+		}
+		ns := float64(segments)
+		slope = (ns*stf - st*sf) / (ns*stt - st*st)
+		intercept = (sf - slope*st) / ns
+		for s := range segments {
+			r := freqs[s] - intercept - slope*times[s]
+			pl.dev += r * r
+		}
+		pl.dev = math.Sqrt(pl.dev / ns)
+		pl.chirp = slope * pl.width
+	}
+	for k, v := range d {
+		ref := cmplx.Exp(complex(0, -2*math.Pi*(intercept+slope*float64(k))))
+		if math.Abs(cmplx.Phase(v*ref)) > math.Pi/2 {
+			pl.jumps++
+		}
+	}
+
+	// Frequency noise of a segment is about 1/(2π sqrt(size·SNR)) of the
+	// sample rate; hints need changes well above it and above the pulse's
+	// own bandwidth, 1/width
+	bw := 1 / math.Max(pl.width, 1)
+	floor := 0.0
+	if segments >= 3 {
+		floor = 1 / (2 * math.Pi * math.Sqrt(float64(len(d)/segments)*math.Pow(10, pl.snrDB/10)))
+	}
+	switch {
+	case c1-c0 < 8:
+		pl.modulation = PDWModUnknown
+	case pl.jumps > 0:
+		pl.modulation = PDWModPhase
+	case math.Abs(pl.chirp) > math.Max(2*bw, 6*floor) && pl.dev < math.Abs(pl.chirp)/4:
+		pl.modulation = PDWModLFM
+	case pl.dev > math.Max(bw, 3*floor):
+		pl.modulation = PDWModFM
+	default:
+		pl.modulation = PDWModNone
+	}
+	return pl, true
+}
+
+// subChannelCenterHz returns a sub-channel's center offset from its source
+// channel's DC, or 0 for other channels
+func subChannelCenterHz(ch int, chz *ChannelizerInfo) float64 {
+	if chz != nil && isSubChannel(ch) {
+		for _, sub := range chz.SubChannels {
+			if sub.Channel == ch {
+				return sub.CenterHz
+			}
+		}
+	}
+	return 0
+}
+
+// pdwPlacer turns a channel's pulses into PDWs
+type pdwPlacer struct {
+	channel  int
+	rate     float64
+	centerHz float64 // Channel's DC from the tuned frequency
+	ddcMHz   float64
+	cal      *powerCurve
+	start    time.Time // Time of sample 0
+}
+
+func (pp *pdwPlacer) pdw(pl pulse) PDW {
+	toaS := pl.toa / pp.rate
+	freqHz := pl.freq * pp.rate
+	fs := pp.cal.fullScaleDBm(freqHz)
+	dbfs := func(p float64) float64 { return 10 * math.Log10(p/(fullScaleAmplitude*fullScaleAmplitude)) }
+	return PDW{
+		Channel:      pp.channel,
+		Time:         pp.start.Add(time.Duration(toaS * float64(time.Second))),
+		TOAS:         toaS,
+		TOASample:    pl.toa,
+		PWS:          pl.width / pp.rate,
+		AmplitudeDBm: dbfs(pl.topPower) + fs,
+		PeakDBm:      dbfs(pl.peak2) + fs,
+		SNRDB:        pl.snrDB,
+		FreqHz:       pp.centerHz + freqHz,
+		RFMHz:        pp.ddcMHz + (pp.centerHz+freqHz)/1e6,
+		ChirpHz:      pl.chirp * pp.rate,
+		FreqDevHz:    pl.dev * pp.rate,
+		PhaseJumps:   pl.jumps,
+		Modulation:   pl.modulation,
+		Truncated:    pl.truncated,
+	}
+}
+
+// livePDW runs the extractor on stream frames in its own goroutine, like
+// the detector, and keeps the latest PDWs
+var livePDW = struct {
+	once   sync.Once
+	frames chan liveFrame
+
+	mu     sync.Mutex
+	pdws   []PDW // Oldest first
+	nextID int
+	start  time.Time // Of the log, for toa_s
+	passes int
+}{frames: make(chan liveFrame, 1)}
+
+// feedPDW hands a complete stream frame to the pulse extractor
+func feedPDW(frame liveFrame) {
+	serverState.mu.RLock()
+	enabled := serverState.PDW.Enabled
+	serverState.mu.RUnlock()
+	if !enabled {
+		return
+	}
+	livePDW.once.Do(func() {
+		go func() {
+			for frame := range livePDW.frames {
+				extractFrame(frame)
+			}
+		}()
+	})
+	select {
+	case livePDW.frames <- frame:
+	default:
+	}
+}
+
+// extractFrame logs and broadcasts the pulses of one stream frame. Frames
+// are snapshots, so pulses cut by the frame's ends are dropped. Times come
+// from the frame's capture time, not from when the frame is processed.
+func extractFrame(frame liveFrame) {
+	serverState.mu.RLock()
+	cfg := serverState.PDW
+	cfg.Channels = append([]int(nil), cfg.Channels...)
+	serverState.mu.RUnlock()
+	if !cfg.Enabled || cfg.Validate() != nil {
+		return
+	}
+
+	var found []PDW
+	for _, ch := range cfg.Channels {
+		i, q, err := frame.channel(ch)
+		if err != nil {
+			continue
+		}
+		rate := frame.sampleRate(ch)
+		pulses := newPDWExtractor(&cfg, rate).process(i, q)
+		if len(pulses) == 0 {
+			continue
+		}
+		// The frame ends at its capture time; its first sample came len(i)
+		// samples earlier
+		start := frame.end.Add(-time.Duration(float64(len(i)) / rate * float64(time.Second)))
+		pp := &pdwPlacer{channel: ch, rate: rate, centerHz: subChannelCenterHz(ch, frame.chz), ddcMHz: frame.cal.ddcMHz, cal: frame.powerCurve(ch), start: start}
+		for _, pl := range pulses {
+			found = append(found, pp.pdw(pl))
+		}
+	}
+
+	livePDW.mu.Lock()
+	livePDW.passes++
+	if livePDW.start.IsZero() {
+		livePDW.start = frame.end
+	}
+	for k := range found {
+		livePDW.nextID++
+		found[k].ID = livePDW.nextID
+		found[k].TOAS = found[k].Time.Sub(livePDW.start).Seconds()
+	}
+	livePDW.pdws = append(livePDW.pdws, found...)
+	if len(livePDW.pdws) > cfg.LogSize {
+		livePDW.pdws = append([]PDW(nil), livePDW.pdws[len(livePDW.pdws)-cfg.LogSize:]...)
+	}
+	livePDW.mu.Unlock()
+
+	if len(found) > 0 {
+		broadcastJSON(map[string]interface{}{"type": "pdw", "pdws": found})
+	}
+}
+
+// extractRecording runs the extractor through a recording and hands the
+// PDWs of each block to emit, in time order within the block
+func extractRecording(o *PDWOptions, emit func([]PDW) error) (*CaptureMetadata, error) {
+	r, err := openRecording(filepath.Join(dataFolder, o.Filename), o.Channels)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	start, end := o.StartSample, r.Frames()
+	if start < 0 || start >= end {
+		return nil, fmt.Errorf("start sample %d outside recording (0-%d)", start, end-1)
+	}
+	if o.Samples > 0 && start+o.Samples < end {
+		end = start + o.Samples
+	}
+	if err := r.SeekFrame(start); err != nil {
+		return nil, err
+	}
+
+	rate := float64(r.meta.SampleRate)
+	t0, _ := time.Parse(time.RFC3339, r.meta.Timestamp)
+	x := recordingPowerCalContext(r.meta)
+	extractors := make([]*pdwExtractor, len(r.channels))
+	placers := make([]*pdwPlacer, len(r.channels))
+	for k, ch := range r.channels {
+		extractors[k] = newPDWExtractor(&o.PDWConfig, rate)
+		extractors[k].pos = start
+		placers[k] = &pdwPlacer{channel: ch, rate: rate, centerHz: subChannelCenterHz(ch, r.meta.Channelizer), ddcMHz: x.ddcMHz, cal: r.powerCurve(ch), start: t0}
+	}
+	id := 0
+	for pos := start; pos < end; {
+		n, err := r.Read(int(min(pdwBlockSamples, end-pos)))
+		if n == 0 || err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pos += int64(n)
+		var block []PDW
+		for k := range r.channels {
+			for _, pl := range extractors[k].process(r.I[k][:n], r.Q[k][:n]) {
+				block = append(block, placers[k].pdw(pl))
+			}
+		}
+		sort.Slice(block, func(a, b int) bool { return block[a].TOASample < block[b].TOASample })
+		for k := range block {
+			id++
+			block[k].ID = id
+		}
+		if len(block) > 0 {
+			if err := emit(block); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r.meta, nil
+}
+
+// PDWOptions selects a recording and the extraction settings for it
+type PDWOptions struct {
+	PDWConfig
+	Filename    string `json:"filename"`
+	StartSample int64  `json:"start_sample"`
+	Samples     int64  `json:"samples"` // 0 = to the end
+	Format      string `json:"format"`  // json (default), csv or parquet
+}
+
+// pdwRecord is an exported PDW; the tags name the export columns, in order.
+// time is RFC 3339 and truncated is 0 or 1.
+type pdwRecord struct {
+	ID           int64   `parquet:"id"`
+	Channel      int64   `parquet:"channel"`
+	Time         string  `parquet:"time"`
+	TOAS         float64 `parquet:"toa_s"`
+	TOASample    float64 `parquet:"toa_sample"`
+	PWS          float64 `parquet:"pw_s"`
+	AmplitudeDBm float64 `parquet:"amplitude_dbm"`
+	PeakDBm      float64 `parquet:"peak_dbm"`
+	SNRDB        float64 `parquet:"snr_db"`
+	FreqHz       float64 `parquet:"freq_hz"`
+	RFMHz        float64 `parquet:"rf_mhz"`
+	ChirpHz      float64 `parquet:"chirp_hz"`
+	FreqDevHz    float64 `parquet:"freq_dev_hz"`
+	PhaseJumps   int64   `parquet:"phase_jumps"`
+	Modulation   string  `parquet:"modulation"`
+	Truncated    int64   `parquet:"truncated"`
+}
+
+func (p *PDW) record() pdwRecord {
+	var truncated int64
+	if p.Truncated {
+		truncated = 1
+	}
+	return pdwRecord{
+		int64(p.ID), int64(p.Channel), p.Time.UTC().Format(time.RFC3339Nano), p.TOAS, p.TOASample, p.PWS,
+		p.AmplitudeDBm, p.PeakDBm, p.SNRDB, p.FreqHz, p.RFMHz, p.ChirpHz, p.FreqDevHz,
+		int64(p.PhaseJumps), p.Modulation, truncated,
+	}
+}
+
+// pdwWriter writes PDWs as CSV or Parquet
+type pdwWriter struct {
+	csv     *csv.Writer
+	parquet *parquet.GenericWriter[pdwRecord]
+}
+
+// newPDWWriter starts an export; metadata goes in a Parquet file's footer
+func newPDWWriter(w io.Writer, format string, metadata map[string]string) (*pdwWriter, error) {
+	if format == "csv" {
+		pw := &pdwWriter{csv: csv.NewWriter(w)}
+		t := reflect.TypeOf(pdwRecord{})
+		header := make([]string, t.NumField())
+		for k := range header {
+			header[k] = t.Field(k).Tag.Get("parquet")
+		}
+		pw.csv.Write(header)
+		return pw, nil
+	}
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	opts := make([]parquet.WriterOption, len(keys))
+	for n, k := range keys {
+		opts[n] = parquet.KeyValueMetadata(k, metadata[k])
+	}
+	return &pdwWriter{parquet: parquet.NewGenericWriter[pdwRecord](w, opts...)}, nil
+}
+
+func (pw *pdwWriter) write(pdws []PDW) error {
+	records := make([]pdwRecord, len(pdws))
+	for k := range pdws {
+		records[k] = pdws[k].record()
+	}
+	if pw.parquet != nil {
+		_, err := pw.parquet.Write(records)
+		return err
+	}
+	for k := range records {
+		row := reflect.ValueOf(records[k])
+		rec := make([]string, row.NumField())
+		for c := range rec {
+			switch v := row.Field(c).Interface().(type) {
+			case int64:
+				rec[c] = strconv.FormatInt(v, 10)
+			case float64:
+				rec[c] = strconv.FormatFloat(v, 'g', -1, 64)
+			case string:
+				rec[c] = v
+			}
+		}
+		if err := pw.csv.Write(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pw *pdwWriter) close() error {
+	if pw.parquet != nil {
+		return pw.parquet.Close()
+	}
+	pw.csv.Flush()
+	return pw.csv.Error()
+}
+
+// startPDWExport sets the download headers for an export format
+func startPDWExport(w http.ResponseWriter, format, name string) error {
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+	case "parquet":
+		w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	default:
+		return fmt.Errorf("format must be json, csv or parquet")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	return nil
+}
+
+// handlePDW gets or replaces the live extraction configuration
+func handlePDW(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var cfg PDWConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		serverState.mu.Lock()
+		serverState.PDW = cfg
+		serverState.mu.Unlock()
+		go broadcastJSON(pdwMessage())
+	}
+	json.NewEncoder(w).Encode(pdwMessage())
+}
+
+// pdwMessage describes the configuration and the log
+func pdwMessage() map[string]interface{} {
+	serverState.mu.RLock()
+	cfg := serverState.PDW
+	serverState.mu.RUnlock()
+	cfg.Validate() // Show the defaults before the first configuration
+	livePDW.mu.Lock()
+	passes, logged, lastID := livePDW.passes, len(livePDW.pdws), livePDW.nextID
+	livePDW.mu.Unlock()
+	return map[string]interface{}{
+		"type":    "pdw_config",
+		"config":  cfg,
+		"passes":  passes,
+		"logged":  logged,
+		"last_id": lastID,
+	}
+}
+
+// handlePDWLog queries the live PDW log as JSON, or exports it with
+// format=csv or parquet. Filters: channel, since_id (IDs after it) and
+// limit (the latest). DELETE clears the log and restarts toa_s.
+func handlePDWLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		livePDW.mu.Lock()
+		livePDW.pdws, livePDW.start = nil, time.Time{}
+		livePDW.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+		return
+	}
+
+	q := r.URL.Query()
+	var channel, sinceID, limit int
+	for name, dst := range map[string]*int{"channel": &channel, "since_id": &sinceID, "limit": &limit} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid "+name, 400)
+				return
+			}
+			*dst = n
+		}
+	}
+	out := []PDW{}
+	livePDW.mu.Lock()
+	for _, p := range livePDW.pdws {
+		if (channel == 0 || p.Channel == channel) && p.ID > sinceID {
+			out = append(out, p)
+		}
+	}
+	livePDW.mu.Unlock()
+	if limit > 0 && len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+
+	format := q.Get("format")
+	if format == "" || format == "json" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"pdws": out})
+		return
+	}
+	if err := startPDWExport(w, format, "pdw_live_"+time.Now().Format("20060102_150405")); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	pw, err := newPDWWriter(w, format, map[string]string{"source": "live", "unit": unitName})
+	if err == nil {
+		if err = pw.write(out); err == nil {
+			err = pw.close()
+		}
+	}
+	if err != nil {
+		log.Printf("[PDW] Export failed: %v", err)
+	}
+}
+
+// handlePDWRecording extracts the PDWs of a recording, returned as JSON or
+// exported as CSV or Parquet
+func handlePDWRecording(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var o PDWOptions
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	if o.Filename == "" {
+		http.Error(w, "filename is required", 400)
+		return
+	}
+	if len(o.Channels) == 0 {
+		o.Channels = []int{1}
+	}
+	if err := o.Validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	o.Filename = filepath.Base(o.Filename)
+	if _, err := os.Stat(filepath.Join(dataFolder, o.Filename)); err != nil {
+		http.Error(w, "Recording not found: "+o.Filename, 404)
+		return
+	}
+
+	if o.Format == "" || o.Format == "json" {
+		pdws := []PDW{}
+		meta, err := extractRecording(&o, func(block []PDW) error {
+			pdws = append(pdws, block...)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"source":      o.Filename,
+			"sample_rate": meta.SampleRate,
+			"options":     o,
+			"pdws":        pdws,
+		})
+		return
+	}
+
+	// Exports stream as the recording is read, so errors after the first
+	// block can only end the download early
+	if err := startPDWExport(w, o.Format, "pdw_"+strings.TrimSuffix(o.Filename, filepath.Ext(o.Filename))); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	cfg, _ := json.Marshal(o)
+	pw, err := newPDWWriter(w, o.Format, map[string]string{"source": o.Filename, "unit": unitName, "options": string(cfg)})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if _, err := extractRecording(&o, pw.write); err != nil {
+		log.Printf("[PDW] Extraction of %s failed: %v", o.Filename, err)
+	}
+	if err := pw.close(); err != nil {
+		log.Printf("[PDW] Export of %s failed: %v", o.Filename, err)
+	}
+}
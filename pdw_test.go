@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// TestPDWExtraction checks the descriptors of a constant-carrier, a chirped
+// and a Barker-coded pulse in noise, processed in blocks
+func TestPDWExtraction(t *testing.T) {
+	const rate = captureSampleRate
+	const n = 40000
+	rng := rand.New(rand.NewSource(1))
+	x := make([]complex128, n)
+	for k := range x {
+		x[k] = complex(rng.NormFloat64()*20, rng.NormFloat64()*20)
+	}
+	const amp = 4000.0
+	add := func(start, width int, phase func(k int) float64) {
+		for k := 0; k < width; k++ {
+			ph := phase(k)
+			x[start+k] += complex(amp*math.Cos(ph), amp*math.Sin(ph))
+		}
+	}
+	// 2 µs at +10 MHz, across the block boundary at 8192
+	add(8000, 489, func(k int) float64 { return 2 * math.Pi * 10e6 * float64(k) / rate })
+	// 4 µs sweeping -20 to +20 MHz
+	add(15000, 978, func(k int) float64 {
+		tk := float64(k) / rate
+		return 2 * math.Pi * (-20e6*tk + 0.5*(40e6/(978.0/rate))*tk*tk)
+	})
+	// Barker 13 with 40-sample chips at -5 MHz
+	barker := []float64{1, 1, 1, 1, 1, -1, -1, 1, 1, -1, 1, -1, 1}
+	add(25000, 13*40, func(k int) float64 {
+		ph := -2 * math.Pi * 5e6 * float64(k) / rate
+		if barker[k/40] < 0 {
+			ph += math.Pi
+		}
+		return ph
+	})
+
+	i, q := make([]int16, n), make([]int16, n)
+	for k, v := range x {
+		i[k], q[k] = int16(math.Round(real(v))), int16(math.Round(imag(v)))
+	}
+	cfg := PDWConfig{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	e := newPDWExtractor(&cfg, rate)
+	var pulses []pulse
+	for start := 0; start < n; start += 8192 {
+		end := min(start+8192, n)
+		pulses = append(pulses, e.process(i[start:end], q[start:end])...)
+	}
+	if len(pulses) != 3 {
+		t.Fatalf("%d pulses, want 3: %+v", len(pulses), pulses)
+	}
+	pp := &pdwPlacer{channel: 1, rate: rate}
+	want := []struct {
+		toa, width, freq float64
+		modulation       string
+	}{
+		{8000, 489, 10e6, PDWModNone},
+		{15000, 978, 0, PDWModLFM},
+		{25000, 520, -5e6, PDWModPhase},
+	}
+	for k, w := range want {
+		p := pp.pdw(pulses[k])
+		if math.Abs(p.TOASample-w.toa) > 1 || math.Abs(p.PWS*rate-w.width) > 2 {
+			t.Errorf("pulse %d: toa %.1f width %.1f samples, want %g and %g", k, p.TOASample, p.PWS*rate, w.toa, w.width)
+		}
+		if math.Abs(p.FreqHz-w.freq) > 0.5e6 {
+			t.Errorf("pulse %d: carrier %.3f MHz, want %.3f", k, p.FreqHz/1e6, w.freq/1e6)
+		}
+		if want := 20*math.Log10(amp/fullScaleAmplitude) + fullScaleDBm; math.Abs(p.AmplitudeDBm-want) > 0.2 {
+			t.Errorf("pulse %d: amplitude %.2f dBm, want %.2f", k, p.AmplitudeDBm, want)
+		}
+		if p.Modulation != w.modulation {
+			t.Errorf("pulse %d: modulation %s, want %s (chirp %.2f MHz, deviation %.2f MHz, %d jumps)",
+				k, p.Modulation, w.modulation, p.ChirpHz/1e6, p.FreqDevHz/1e6, p.PhaseJumps)
+		}
+	}
+	if p := pp.pdw(pulses[1]); math.Abs(p.ChirpHz-40e6) > 2e6 {
+		t.Errorf("chirp %.2f MHz, want 40", p.ChirpHz/1e6)
+	}
+	if p := pp.pdw(pulses[2]); p.PhaseJumps < 5 || p.PhaseJumps > 6 {
+		t.Errorf("%d phase jumps, want the 5-6 code transitions inside the measured part", p.PhaseJumps)
+	}
+}
+
+// TestPDWExportFormats writes PDWs as CSV and Parquet and reads them back
+func TestPDWExportFormats(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 6000, time.UTC)
+	pdws := []PDW{
+		{ID: 1, Channel: 2, Time: at, TOAS: 0.5, PWS: 1e-6, AmplitudeDBm: -40.25, Modulation: PDWModLFM},
+		{ID: 2, Channel: 3, Time: at.Add(time.Millisecond), FreqHz: -1.5e6, PhaseJumps: 12, Modulation: PDWModPhase, Truncated: true},
+	}
+
+	var buf bytes.Buffer
+	pw, err := newPDWWriter(&buf, "csv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.write(pdws); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.close(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "id" || rows[0][15] != "truncated" {
+		t.Fatalf("csv header %v in %d rows", rows[0], len(rows))
+	}
+	if r := rows[2]; r[2] != "2026-01-02T03:04:05.001006Z" || r[9] != "-1.5e+06" || r[14] != PDWModPhase || r[15] != "1" {
+		t.Errorf("csv row %v", r)
+	}
+
+	buf.Reset()
+	pw, err = newPDWWriter(&buf, "parquet", map[string]string{"source": "test.bin", "unit": "unit1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.write(pdws); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := f.Lookup("source"); !ok || v != "test.bin" {
+		t.Errorf("metadata source %q, %v", v, ok)
+	}
+	r := parquet.NewGenericReader[pdwRecord](bytes.NewReader(buf.Bytes()))
+	defer r.Close()
+	got := make([]pdwRecord, len(pdws)+1)
+	n, err := r.Read(got)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if n != len(pdws) {
+		t.Fatalf("read %d rows, want %d", n, len(pdws))
+	}
+	for k := range pdws {
+		if want := pdws[k].record(); got[k] != want {
+			t.Errorf("row %d read back as %+v, want %+v", k, got[k], want)
+		}
+	}
+}
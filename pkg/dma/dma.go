@@ -2,6 +2,7 @@ package dma
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -12,6 +13,13 @@ type CaptureConfig struct {
 	DevicePath  string
 	TargetSize  int
 	ChannelMask [8]bool // Active channels (true = record)
+
+	// Engines lists the C2H engines to read concurrently and the channels each
+	// one carries. If empty, DevicePath is read as a single 8-channel engine.
+	Engines []EngineConfig
+	// SeparateStreams keeps each engine's data apart in CaptureResult.Streams
+	// instead of merging everything into one 8-channel stream in Data
+	SeparateStreams bool
 }
 
 // CaptureResult holds the data and stats from a capture
@@ -20,42 +28,134 @@ type CaptureResult struct {
 	Duration   time.Duration
 	Throughput float64 // MB/s
 	BytesRead  int
-	Aligned    bool
+
+	Streams [][]byte      // Per-engine filtered data (SeparateStreams only)
+	Engines []EngineStats // Per-engine contribution to the capture
 }
 
-// RunCapture performs the read from the device and filters active channels
+// RunCapture performs the read from the device(s) and filters active channels
 // Uses two-phase approach: fast capture into RAM, then filter afterwards
 func RunCapture(cfg CaptureConfig) (*CaptureResult, error) {
-	fd, err := unix.Open(cfg.DevicePath, unix.O_RDONLY, 0)
-	if err != nil {
-		return nil, fmt.Errorf("could not open device %s: %v", cfg.DevicePath, err)
+	engines := cfg.Engines
+	if len(engines) == 0 {
+		engines = DefaultEngines(cfg.DevicePath)
+	}
+	if err := ValidateEngines(engines); err != nil {
+		return nil, err
 	}
-	defer unix.Close(fd)
-
-	// Increase pipe buffer size
-	const maxPipeSize = 1024 * 1024
-	_, _ = unix.FcntlInt(uintptr(fd), unix.F_SETPIPE_SZ, maxPipeSize)
 
-	// Count active channels
-	activeCount := 0
-	for _, active := range cfg.ChannelMask {
-		if active {
-			activeCount++
+	// Only channels that some engine actually carries can be captured
+	mask := cfg.ChannelMask
+	carried := 0
+	for _, e := range engines {
+		for _, ch := range e.Channels {
+			if mask[ch] {
+				carried++
+			}
 		}
 	}
-	if activeCount == 0 {
+	if carried == 0 {
 		return nil, fmt.Errorf("no active channels selected")
 	}
 
-	const bytesPerFrame = 32 // 8 channels * 4 bytes each
-
 	// Calculate how many input bytes we need to read
 	// TargetSize is the desired output size
-	totalSamples := cfg.TargetSize / (activeCount * 4)
-	inputReadSize := totalSamples * bytesPerFrame
+	totalSamples := cfg.TargetSize / (carried * BytesPerSample)
+
+	// PHASE 1: Fast capture into RAM on every engine in parallel
+	type engineRead struct {
+		data    []byte
+		elapsed time.Duration
+		err     error
+	}
+	reads := make([]engineRead, len(engines))
+	var wg sync.WaitGroup
+	for i, e := range engines {
+		wg.Add(1)
+		go func(i int, e EngineConfig) {
+			defer wg.Done()
+			data, elapsed, err := captureEngine(e.DevicePath, totalSamples*e.FrameSize())
+			// Truncate to actual read size (aligned to frame boundary)
+			data = data[:(len(data)/e.FrameSize())*e.FrameSize()]
+			reads[i] = engineRead{data: data, elapsed: elapsed, err: err}
+		}(i, e)
+	}
+	wg.Wait()
+
+	var captureElapsed time.Duration
+	totalRead := 0
+	stats := make([]EngineStats, len(engines))
+	for i, e := range engines {
+		if reads[i].err != nil {
+			return nil, fmt.Errorf("engine %s: %v", e.DevicePath, reads[i].err)
+		}
+		if reads[i].elapsed > captureElapsed {
+			captureElapsed = reads[i].elapsed
+		}
+		totalRead += len(reads[i].data)
+		stats[i] = EngineStats{
+			DevicePath: e.DevicePath,
+			Channels:   e.Channels,
+			BytesRead:  len(reads[i].data),
+			Duration:   reads[i].elapsed,
+			Throughput: throughputMBps(len(reads[i].data), reads[i].elapsed),
+		}
+	}
+
+	// PHASE 2: Filter channels (post-processing)
+	result := &CaptureResult{
+		Duration: captureElapsed,
+		// Calculate throughput based on capture speed (not including filtering)
+		Throughput: throughputMBps(totalRead, captureElapsed),
+		Engines:    stats,
+	}
+
+	if cfg.SeparateStreams {
+		result.Streams = make([][]byte, len(engines))
+		for i, e := range engines {
+			result.Streams[i] = filterFrames(reads[i].data, e.Channels, mask)
+			result.BytesRead += len(result.Streams[i])
+		}
+		return result, nil
+	}
 
-	// PHASE 1: Fast capture into RAM (all channels, no processing)
-	data := make([]byte, inputReadSize)
+	var data []byte
+	if IsDefaultLayout(engines) {
+		data = reads[0].data
+	} else {
+		// Merge engines into standard 8-channel frames
+		frames := totalSamples
+		for i, e := range engines {
+			if n := len(reads[i].data) / e.FrameSize(); n < frames {
+				frames = n
+			}
+		}
+		srcs := make([][]byte, len(engines))
+		for i := range reads {
+			srcs[i] = reads[i].data
+		}
+		data = make([]byte, frames*BytesPerFrame)
+		Interleave(data, srcs, engines)
+	}
+
+	result.Data = filterFrames(data, AllChannels(), mask)
+	result.BytesRead = len(result.Data)
+	return result, nil
+}
+
+// captureEngine reads size bytes from a single C2H device into RAM
+func captureEngine(devicePath string, size int) ([]byte, time.Duration, error) {
+	fd, err := unix.Open(devicePath, unix.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not open device %s: %v", devicePath, err)
+	}
+	defer unix.Close(fd)
+
+	// Increase pipe buffer size
+	const maxPipeSize = 1024 * 1024
+	_, _ = unix.FcntlInt(uintptr(fd), unix.F_SETPIPE_SZ, maxPipeSize)
+
+	data := make([]byte, size)
 
 	// Pre-fault pages to avoid page faults during timed read
 	for i := 0; i < len(data); i += 4096 {
@@ -66,8 +166,8 @@ func RunCapture(cfg CaptureConfig) (*CaptureResult, error) {
 
 	totalRead := 0
 	const chunkSize = 4 * 1024 * 1024 // 4MB chunks
-	for totalRead < inputReadSize {
-		remaining := inputReadSize - totalRead
+	for totalRead < size {
+		remaining := size - totalRead
 		readSize := remaining
 		if readSize > chunkSize {
 			readSize = chunkSize
@@ -80,100 +180,58 @@ func RunCapture(cfg CaptureConfig) (*CaptureResult, error) {
 			if err == unix.EINTR {
 				continue
 			}
-			return nil, fmt.Errorf("read failed after %d bytes: %v", totalRead, err)
+			return nil, 0, fmt.Errorf("read failed after %d bytes: %v", totalRead, err)
 		}
 		if n == 0 {
 			break // EOF
 		}
 	}
 
-	captureElapsed := time.Since(startTime)
-
-	// Truncate to actual read size (aligned to frame boundary)
-	totalRead = (totalRead / bytesPerFrame) * bytesPerFrame
-	data = data[:totalRead]
+	return data[:totalRead], time.Since(startTime), nil
+}
 
-	// PHASE 2: Filter channels (post-processing)
-	var outputData []byte
+// filterFrames keeps only the masked channels from frames laid out as chans
+func filterFrames(data []byte, chans []int, mask [8]bool) []byte {
+	frameSize := len(chans) * BytesPerSample
 
-	if activeCount == 8 {
-		// All channels selected - no filtering needed, use data directly
-		outputData = data
-	} else {
-		// Filter to selected channels only
-		totalFrames := totalRead / bytesPerFrame
-		outputSize := totalFrames * activeCount * 4
-		outputData = make([]byte, outputSize)
-
-		// Pre-calculate copy offsets
-		type copyOp struct {
-			srcOffset int
-		}
-		ops := make([]copyOp, 0, activeCount)
-		for i := 0; i < 8; i++ {
-			if cfg.ChannelMask[i] {
-				ops = append(ops, copyOp{srcOffset: i * 4})
-			}
-		}
-
-		// Fast filtering loop
-		wIdx := 0
-		for f := 0; f < totalFrames; f++ {
-			baseSrc := f * bytesPerFrame
-			for _, op := range ops {
-				src := baseSrc + op.srcOffset
-				outputData[wIdx] = data[src]
-				outputData[wIdx+1] = data[src+1]
-				outputData[wIdx+2] = data[src+2]
-				outputData[wIdx+3] = data[src+3]
-				wIdx += 4
-			}
+	// Pre-calculate copy offsets
+	type copyOp struct {
+		srcOffset int
+	}
+	ops := make([]copyOp, 0, len(chans))
+	for slot, ch := range chans {
+		if mask[ch] {
+			ops = append(ops, copyOp{srcOffset: slot * BytesPerSample})
 		}
 	}
 
-	// Calculate throughput based on capture speed (not including filtering)
-	mbRead := float64(totalRead) / (1024 * 1024)
-	mbps := 0.0
-	if captureElapsed.Seconds() > 0 {
-		mbps = mbRead / captureElapsed.Seconds()
+	if len(ops) == len(chans) {
+		// All channels selected - no filtering needed, use data directly
+		return data
 	}
 
-	return &CaptureResult{
-		Data:       outputData,
-		Duration:   captureElapsed,
-		Throughput: mbps,
-		BytesRead:  len(outputData),
-		Aligned:    false,
-	}, nil
-}
-
-// alignData performs the specific channel shifting logic
-func alignData(data []byte) ([]byte, bool) {
-	n := len(data)
-	const shiftSamples = 97992
-	const bytesPerFrame = 32
-	const bytesHalfFrame = 16 // 8 channels * 2 bytes
-
-	totalSamples := n / bytesPerFrame
-	if totalSamples <= shiftSamples {
-		return data, false
+	totalFrames := len(data) / frameSize
+	outputData := make([]byte, totalFrames*len(ops)*BytesPerSample)
+
+	// Fast filtering loop
+	wIdx := 0
+	for f := 0; f < totalFrames; f++ {
+		baseSrc := f * frameSize
+		for _, op := range ops {
+			src := baseSrc + op.srcOffset
+			outputData[wIdx] = data[src]
+			outputData[wIdx+1] = data[src+1]
+			outputData[wIdx+2] = data[src+2]
+			outputData[wIdx+3] = data[src+3]
+			wIdx += 4
+		}
 	}
+	return outputData
+}
 
-	newSamples := totalSamples - shiftSamples
-	newData := make([]byte, newSamples*bytesPerFrame)
-
-	for i := 0; i < newSamples; i++ {
-		dstBase := i * bytesPerFrame
-		
-		// Ch 0-7 (First 16 bytes) come from later in the buffer (shifted "up" -> earlier in output)
-		srcBaseCh0_7 := (i + shiftSamples) * bytesPerFrame
-		
-		// Ch 8-15 (Next 16 bytes) come from current position
-		srcBaseCh8_15 := i * bytesPerFrame
-
-		copy(newData[dstBase:dstBase+bytesHalfFrame], data[srcBaseCh0_7:srcBaseCh0_7+bytesHalfFrame])
-		copy(newData[dstBase+bytesHalfFrame:dstBase+bytesPerFrame], data[srcBaseCh8_15+bytesHalfFrame:srcBaseCh8_15+bytesPerFrame])
+func throughputMBps(bytes int, elapsed time.Duration) float64 {
+	if elapsed.Seconds() <= 0 {
+		return 0
 	}
-
-	return newData, true
-}
\ No newline at end of file
+	return float64(bytes) / (1024 * 1024) / elapsed.Seconds()
+}
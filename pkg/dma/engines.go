@@ -0,0 +1,157 @@
+package dma
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	NumChannels    = 8
+	BytesPerSample = 4 // 2 byte I + 2 byte Q
+	BytesPerFrame  = NumChannels * BytesPerSample
+)
+
+// EngineConfig describes one card-to-host DMA engine and the channels it carries
+type EngineConfig struct {
+	DevicePath string `json:"device_path"`
+	Channels   []int  `json:"channels"` // Channel indices (0-7) in on-wire order
+}
+
+// FrameSize returns the number of bytes per sample frame on this engine
+func (e EngineConfig) FrameSize() int {
+	return len(e.Channels) * BytesPerSample
+}
+
+// EngineStats holds the per-engine contribution to a capture
+type EngineStats struct {
+	DevicePath string        `json:"device_path"`
+	Channels   []int         `json:"channels"`
+	BytesRead  int           `json:"bytes_read"`
+	Duration   time.Duration `json:"duration"`
+	Throughput float64       `json:"throughput_mbps"` // MB/s
+}
+
+// AllChannels returns channel indices 0-7 in standard frame order
+func AllChannels() []int {
+	chs := make([]int, NumChannels)
+	for i := range chs {
+		chs[i] = i
+	}
+	return chs
+}
+
+// DefaultEngines returns the single-engine layout: all 8 channels on devicePath
+func DefaultEngines(devicePath string) []EngineConfig {
+	return []EngineConfig{{DevicePath: devicePath, Channels: AllChannels()}}
+}
+
+// IsDefaultLayout reports whether engines is one device carrying channels 0-7 in order
+func IsDefaultLayout(engines []EngineConfig) bool {
+	if len(engines) != 1 || len(engines[0].Channels) != NumChannels {
+		return false
+	}
+	for i, ch := range engines[0].Channels {
+		if ch != i {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseEngineMap parses a channel-to-engine mapping such as
+// "/dev/xdma0_c2h_0:1-4,/dev/xdma0_c2h_1:5-8". Channels are user-facing (1-8)
+// and may be given as ranges or '+'-separated lists ("1+3+5").
+// An entry without a channel list carries all 8 channels.
+func ParseEngineMap(spec string) ([]EngineConfig, error) {
+	var engines []EngineConfig
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		path, chList, hasList := strings.Cut(entry, ":")
+		if path == "" {
+			return nil, fmt.Errorf("engine entry %q has no device path", entry)
+		}
+		if !hasList {
+			engines = append(engines, DefaultEngines(path)...)
+			continue
+		}
+
+		var chans []int
+		for _, part := range strings.Split(chList, "+") {
+			lo, hi, isRange := strings.Cut(part, "-")
+			first, err := strconv.Atoi(strings.TrimSpace(lo))
+			if err != nil {
+				return nil, fmt.Errorf("invalid channel %q in %q", part, entry)
+			}
+			last := first
+			if isRange {
+				if last, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+					return nil, fmt.Errorf("invalid channel range %q in %q", part, entry)
+				}
+			}
+			for ch := first; ch <= last; ch++ {
+				chans = append(chans, ch-1)
+			}
+		}
+		engines = append(engines, EngineConfig{DevicePath: path, Channels: chans})
+	}
+
+	if err := ValidateEngines(engines); err != nil {
+		return nil, err
+	}
+	return engines, nil
+}
+
+// ValidateEngines checks that every channel is valid and carried by at most one engine
+func ValidateEngines(engines []EngineConfig) error {
+	if len(engines) == 0 {
+		return fmt.Errorf("no DMA engines configured")
+	}
+	seen := [NumChannels]string{}
+	for _, e := range engines {
+		if len(e.Channels) == 0 {
+			return fmt.Errorf("engine %s carries no channels", e.DevicePath)
+		}
+		for _, ch := range e.Channels {
+			if ch < 0 || ch >= NumChannels {
+				return fmt.Errorf("engine %s: channel %d out of range 1-%d", e.DevicePath, ch+1, NumChannels)
+			}
+			if seen[ch] != "" {
+				return fmt.Errorf("channel %d mapped to both %s and %s", ch+1, seen[ch], e.DevicePath)
+			}
+			seen[ch] = e.DevicePath
+		}
+	}
+	return nil
+}
+
+// Interleave merges per-engine frame data into standard 8-channel frames.
+// srcs[i] holds raw data read from engines[i]. Channels not carried by any
+// engine are zero-filled. Returns the number of frames written to dst.
+func Interleave(dst []byte, srcs [][]byte, engines []EngineConfig) int {
+	frames := len(dst) / BytesPerFrame
+	for i, e := range engines {
+		if n := len(srcs[i]) / e.FrameSize(); n < frames {
+			frames = n
+		}
+	}
+
+	for f := 0; f < frames; f++ {
+		out := dst[f*BytesPerFrame : (f+1)*BytesPerFrame]
+		for i := range out {
+			out[i] = 0
+		}
+		for i, e := range engines {
+			in := srcs[i][f*e.FrameSize():]
+			for slot, ch := range e.Channels {
+				copy(out[ch*BytesPerSample:(ch+1)*BytesPerSample], in[slot*BytesPerSample:(slot+1)*BytesPerSample])
+			}
+		}
+	}
+	return frames
+}
@@ -0,0 +1,101 @@
+package dma
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEngineMap(t *testing.T) {
+	cases := []struct {
+		spec string
+		want []EngineConfig // nil = error
+	}{
+		{"/dev/c2h_0", DefaultEngines("/dev/c2h_0")},
+		{"/dev/c2h_0:1-4, /dev/c2h_1:5-8", []EngineConfig{
+			{DevicePath: "/dev/c2h_0", Channels: []int{0, 1, 2, 3}},
+			{DevicePath: "/dev/c2h_1", Channels: []int{4, 5, 6, 7}},
+		}},
+		{"/dev/c2h_0:1+3+5-6,/dev/c2h_1:8+2,", []EngineConfig{
+			{DevicePath: "/dev/c2h_0", Channels: []int{0, 2, 4, 5}},
+			{DevicePath: "/dev/c2h_1", Channels: []int{7, 1}},
+		}},
+		{"", nil},
+		{":1-4", nil},
+		{"/dev/c2h_0:", nil},
+		{"/dev/c2h_0:a-4", nil},
+		{"/dev/c2h_0:1-x", nil},
+		{"/dev/c2h_0:4-1", nil},
+		{"/dev/c2h_0:0-3", nil},
+		{"/dev/c2h_0:5-9", nil},
+		{"/dev/c2h_0:1-4,/dev/c2h_1:4-8", nil},
+		{"/dev/c2h_0:1+1", nil},
+		{"/dev/c2h_0,/dev/c2h_1:1", nil},
+	}
+	for _, c := range cases {
+		got, err := ParseEngineMap(c.spec)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("%q: parsed as %+v, want an error", c.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.spec, err)
+		} else if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: %+v, want %+v", c.spec, got, c.want)
+		}
+	}
+}
+
+// TestInterleave reassembles engines carrying channels out of order, with
+// one channel on no engine, and stops at the shortest engine
+func TestInterleave(t *testing.T) {
+	engines := []EngineConfig{
+		{DevicePath: "a", Channels: []int{6, 0, 3}},
+		{DevicePath: "b", Channels: []int{1, 2, 7, 4}},
+	}
+	// Each sample holds its frame and channel so misplacement is visible
+	sample := func(frame, ch int) []byte {
+		return []byte{byte(frame), byte(ch), byte(frame), byte(ch) | 0x80}
+	}
+	source := func(e EngineConfig, frames int) []byte {
+		var b []byte
+		for f := range frames {
+			for _, ch := range e.Channels {
+				b = append(b, sample(f, ch)...)
+			}
+		}
+		return b
+	}
+	srcs := [][]byte{source(engines[0], 5), source(engines[1], 4)}
+	dst := make([]byte, 6*BytesPerFrame)
+	for i := range dst {
+		dst[i] = 0xff
+	}
+
+	if n := Interleave(dst, srcs, engines); n != 4 {
+		t.Fatalf("%d frames, want 4", n)
+	}
+	for f := range 6 {
+		for ch := range NumChannels {
+			got := dst[(f*NumChannels+ch)*BytesPerSample:][:BytesPerSample]
+			want := sample(f, ch)
+			switch {
+			case f >= 4:
+				want = []byte{0xff, 0xff, 0xff, 0xff}
+			case ch == 5:
+				want = make([]byte, BytesPerSample)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("frame %d channel %d: %x, want %x", f, ch, got, want)
+			}
+		}
+	}
+}
+
+func TestRunCaptureNeedsChannels(t *testing.T) {
+	cfg := CaptureConfig{DevicePath: "/nonexistent/xdma0_c2h_0", TargetSize: 1024}
+	if _, err := RunCapture(cfg); err == nil || err.Error() != "no active channels selected" {
+		t.Errorf("empty mask: %v, want no active channels selected", err)
+	}
+}
@@ -0,0 +1,261 @@
+// Package fft provides cached FFT plans for repeated transforms of the same size.
+//
+// A Plan holds the twiddle factors, bit-reversal table and radix factorization
+// for one length. Plans are immutable after creation and safe for concurrent
+// use; PlanFor returns a shared plan from a process-wide cache. Power-of-two
+// sizes use an in-place iterative radix-2 transform. Other sizes use a
+// recursive mixed-radix decimation-in-time transform (radix 4, 2, 3, 5 and
+// generic odd primes), with per-call scratch taken from a pool so steady-state
+// transforms do not allocate.
+package fft
+
+import (
+	"math"
+	"sync"
+)
+
+// Plan is a precomputed FFT of a fixed length
+type Plan struct {
+	n       int
+	pow2    bool
+	twiddle []complex128 // exp(-2*pi*i*k/n), k = 0..n-1
+	bitrev  []int        // Bit-reversal permutation (power-of-two only)
+	factors []int        // Radix for each decimation stage (mixed radix only)
+	maxRad  int
+	scratch sync.Pool // *[]complex128 of length n + maxRad
+}
+
+var (
+	plansMu sync.Mutex
+	plans   = make(map[int]*Plan)
+)
+
+// PlanFor returns the cached plan for length n, creating it on first use
+func PlanFor(n int) *Plan {
+	plansMu.Lock()
+	defer plansMu.Unlock()
+
+	p, ok := plans[n]
+	if !ok {
+		p = NewPlan(n)
+		plans[n] = p
+	}
+	return p
+}
+
+// NewPlan builds an uncached plan for length n (n >= 1)
+func NewPlan(n int) *Plan {
+	if n < 1 {
+		panic("fft: plan length must be positive")
+	}
+
+	p := &Plan{n: n, pow2: n&(n-1) == 0}
+
+	p.twiddle = make([]complex128, n)
+	for k := 0; k < n; k++ {
+		s, c := math.Sincos(-2 * math.Pi * float64(k) / float64(n))
+		p.twiddle[k] = complex(c, s)
+	}
+
+	if p.pow2 {
+		bits := 0
+		for temp := n; temp > 1; temp >>= 1 {
+			bits++
+		}
+		p.bitrev = make([]int, n)
+		for i := 0; i < n; i++ {
+			j := 0
+			for k := 0; k < bits; k++ {
+				if i&(1<<k) != 0 {
+					j |= 1 << (bits - 1 - k)
+				}
+			}
+			p.bitrev[i] = j
+		}
+		return p
+	}
+
+	p.factors = factorize(n)
+	for _, r := range p.factors {
+		if r > p.maxRad {
+			p.maxRad = r
+		}
+	}
+	size := n + p.maxRad
+	p.scratch.New = func() interface{} {
+		buf := make([]complex128, size)
+		return &buf
+	}
+	return p
+}
+
+// factorize splits n into radices, preferring 4, then 2, 3, 5 and odd primes
+func factorize(n int) []int {
+	var factors []int
+	for n%4 == 0 {
+		factors = append(factors, 4)
+		n /= 4
+	}
+	for _, r := range []int{2, 3, 5} {
+		for n%r == 0 {
+			factors = append(factors, r)
+			n /= r
+		}
+	}
+	for r := 7; r*r <= n; r += 2 {
+		for n%r == 0 {
+			factors = append(factors, r)
+			n /= r
+		}
+	}
+	if n > 1 {
+		factors = append(factors, n)
+	}
+	return factors
+}
+
+// Len returns the transform length
+func (p *Plan) Len() int {
+	return p.n
+}
+
+// Transform computes the forward FFT of src into dst. Both must have length
+// Len(). dst and src may be the same slice.
+func (p *Plan) Transform(dst, src []complex128) {
+	p.checkLen(dst, src)
+	if &dst[0] == &src[0] {
+		p.InPlace(dst)
+		return
+	}
+
+	if p.pow2 {
+		for i, j := range p.bitrev {
+			dst[j] = src[i]
+		}
+		p.butterflies(dst)
+		return
+	}
+
+	bufp := p.scratch.Get().(*[]complex128)
+	p.mixed(dst, src, 1, p.n, 0, (*bufp)[p.n:])
+	p.scratch.Put(bufp)
+}
+
+// InPlace computes the forward FFT of x, overwriting it
+func (p *Plan) InPlace(x []complex128) {
+	p.checkLen(x, x)
+
+	if p.pow2 {
+		for i, j := range p.bitrev {
+			if i < j {
+				x[i], x[j] = x[j], x[i]
+			}
+		}
+		p.butterflies(x)
+		return
+	}
+
+	bufp := p.scratch.Get().(*[]complex128)
+	buf := *bufp
+	copy(buf[:p.n], x)
+	p.mixed(x, buf[:p.n], 1, p.n, 0, buf[p.n:])
+	p.scratch.Put(bufp)
+}
+
+// Inverse computes the inverse FFT of src into dst, scaled by 1/n.
+// dst and src may be the same slice.
+func (p *Plan) Inverse(dst, src []complex128) {
+	p.checkLen(dst, src)
+
+	// IFFT(x) = conj(FFT(conj(x))) / n
+	for i, v := range src {
+		dst[i] = complex(real(v), -imag(v))
+	}
+	p.InPlace(dst)
+	scale := 1 / float64(p.n)
+	for i, v := range dst {
+		dst[i] = complex(real(v)*scale, -imag(v)*scale)
+	}
+}
+
+func (p *Plan) checkLen(dst, src []complex128) {
+	if len(dst) != p.n || len(src) != p.n {
+		panic("fft: slice length does not match plan")
+	}
+}
+
+// butterflies runs the iterative radix-2 stages on bit-reversed data
+func (p *Plan) butterflies(x []complex128) {
+	n := p.n
+	for size := 2; size <= n; size <<= 1 {
+		half := size >> 1
+		tableStep := n / size
+		for i := 0; i < n; i += size {
+			k := 0
+			for j := i; j < i+half; j++ {
+				t := x[j+half] * p.twiddle[k]
+				x[j+half] = x[j] - t
+				x[j] += t
+				k += tableStep
+			}
+		}
+	}
+}
+
+// mixed computes the length-n DFT of src[0], src[stride], ... into dst
+// using the radices from factors[fi:]. tmp holds at least maxRad values.
+func (p *Plan) mixed(dst, src []complex128, stride, n, fi int, tmp []complex128) {
+	if n == 1 {
+		dst[0] = src[0]
+		return
+	}
+
+	r := p.factors[fi]
+	m := n / r
+
+	// Sub-transforms of the r decimated sequences
+	for q := 0; q < r; q++ {
+		p.mixed(dst[q*m:(q+1)*m], src[q*stride:], stride*r, m, fi+1, tmp)
+	}
+
+	// Combine: twiddle step for length n within the length-N table
+	tw := p.n / n
+	switch r {
+	case 2:
+		for k := 0; k < m; k++ {
+			a := dst[k]
+			b := dst[m+k] * p.twiddle[k*tw]
+			dst[k] = a + b
+			dst[m+k] = a - b
+		}
+	case 4:
+		for k := 0; k < m; k++ {
+			a := dst[k]
+			b := dst[m+k] * p.twiddle[k*tw]
+			c := dst[2*m+k] * p.twiddle[2*k*tw]
+			d := dst[3*m+k] * p.twiddle[3*k*tw]
+			t0, t1 := a+c, a-c
+			t2, t3 := b+d, b-d
+			// Multiply t3 by -i
+			t3 = complex(imag(t3), -real(t3))
+			dst[k] = t0 + t2
+			dst[m+k] = t1 + t3
+			dst[2*m+k] = t0 - t2
+			dst[3*m+k] = t1 - t3
+		}
+	default:
+		rstep := p.n / r
+		for k := 0; k < m; k++ {
+			for q := 0; q < r; q++ {
+				tmp[q] = dst[q*m+k] * p.twiddle[(q*k*tw)%p.n]
+			}
+			for s := 0; s < r; s++ {
+				var sum complex128
+				for q := 0; q < r; q++ {
+					sum += tmp[q] * p.twiddle[((q*s)%r)*rstep]
+				}
+				dst[s*m+k] = sum
+			}
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package fft
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// naiveDFT is the O(n^2) reference transform
+func naiveDFT(x []complex128) []complex128 {
+	n := len(x)
+	out := make([]complex128, n)
+	for k := 0; k < n; k++ {
+		var sum complex128
+		for t := 0; t < n; t++ {
+			angle := -2 * math.Pi * float64(k*t%n) / float64(n)
+			sum += x[t] * cmplx.Exp(complex(0, angle))
+		}
+		out[k] = sum
+	}
+	return out
+}
+
+// legacyFFT is the radix-2 transform previously in dsp.go, which computed
+// every twiddle with cmplx.Exp and allocated its output on each call
+func legacyFFT(x []complex128) []complex128 {
+	n := len(x)
+	if n <= 1 {
+		return x
+	}
+
+	result := make([]complex128, n)
+	bits := 0
+	for temp := n; temp > 1; temp >>= 1 {
+		bits++
+	}
+	for i := 0; i < n; i++ {
+		j := 0
+		for k := 0; k < bits; k++ {
+			if i&(1<<k) != 0 {
+				j |= 1 << (bits - 1 - k)
+			}
+		}
+		result[j] = x[i]
+	}
+
+	for size := 2; size <= n; size *= 2 {
+		halfSize := size / 2
+		tableStep := n / size
+		for i := 0; i < n; i += size {
+			k := 0
+			for j := i; j < i+halfSize; j++ {
+				angle := -2 * math.Pi * float64(k) / float64(n)
+				w := cmplx.Exp(complex(0, angle))
+				t := result[j+halfSize] * w
+				result[j+halfSize] = result[j] - t
+				result[j] = result[j] + t
+				k += tableStep
+			}
+		}
+	}
+	return result
+}
+
+// legacySpectrum mirrors the old computeFFT: window rebuilt per call, then legacyFFT
+func legacySpectrum(iSamples, qSamples []int16, fftSize int) []float64 {
+	window := make([]float64, fftSize)
+	windowSum := 0.0
+	for i := 0; i < fftSize; i++ {
+		window[i] = 0.42 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(fftSize-1)) +
+			0.08*math.Cos(4*math.Pi*float64(i)/float64(fftSize-1))
+		windowSum += window[i]
+	}
+	input := make([]complex128, fftSize)
+	for i := 0; i < fftSize; i++ {
+		input[i] = complex(float64(iSamples[i])*window[i], float64(qSamples[i])*window[i])
+	}
+	output := legacyFFT(input)
+	result := make([]float64, fftSize)
+	reference := 32768.0 * windowSum
+	for i := 0; i < fftSize; i++ {
+		mag := cmplx.Abs(output[(i+fftSize/2)%fftSize])
+		if mag > 0 {
+			result[i] = 20*math.Log10(mag/reference) + 3.9
+		} else {
+			result[i] = -150.0
+		}
+	}
+	return result
+}
+
+// planSpectrum is the same pipeline on a cached plan and window
+func planSpectrum(result []float64, buf []complex128, iSamples, qSamples []int16) {
+	n := len(buf)
+	window, _ := GetWindow(Blackman, n)
+	for i, w := range window.Coeffs {
+		buf[i] = complex(float64(iSamples[i])*w, float64(qSamples[i])*w)
+	}
+	PlanFor(n).InPlace(buf)
+	refPower := math.Pow(32768.0*window.Sum, 2)
+	for i := range result {
+		v := buf[(i+n/2)%n]
+		p := real(v)*real(v) + imag(v)*imag(v)
+		if p > 0 {
+			result[i] = 10*math.Log10(p/refPower) + 3.9
+		} else {
+			result[i] = -150.0
+		}
+	}
+}
+
+func randomInput(n int, seed int64) []complex128 {
+	rng := rand.New(rand.NewSource(seed))
+	x := make([]complex128, n)
+	for i := range x {
+		x[i] = complex(rng.NormFloat64(), rng.NormFloat64())
+	}
+	return x
+}
+
+func maxError(a, b []complex128) float64 {
+	worst := 0.0
+	for i := range a {
+		if d := cmplx.Abs(a[i] - b[i]); d > worst {
+			worst = d
+		}
+	}
+	return worst
+}
+
+func TestPlanMatchesDFT(t *testing.T) {
+	sizes := []int{1, 2, 4, 8, 64, 1024, 3, 6, 12, 15, 60, 100, 360, 1000, 7, 49, 77, 97, 1536}
+	for _, n := range sizes {
+		x := randomInput(n, int64(n))
+		want := naiveDFT(x)
+		tol := 1e-9 * float64(n)
+
+		got := make([]complex128, n)
+		PlanFor(n).Transform(got, x)
+		if e := maxError(got, want); e > tol {
+			t.Errorf("n=%d: Transform error %g", n, e)
+		}
+
+		inPlace := append([]complex128(nil), x...)
+		PlanFor(n).InPlace(inPlace)
+		if e := maxError(inPlace, want); e > tol {
+			t.Errorf("n=%d: InPlace error %g", n, e)
+		}
+
+		back := make([]complex128, n)
+		PlanFor(n).Inverse(back, got)
+		if e := maxError(back, x); e > tol {
+			t.Errorf("n=%d: Inverse round trip error %g", n, e)
+		}
+	}
+}
+
+func TestPlanDoesNotAllocate(t *testing.T) {
+	for _, n := range []int{4096, 3000} {
+		p := PlanFor(n)
+		x := randomInput(n, 1)
+		dst := make([]complex128, n)
+		p.InPlace(x) // Warm the scratch pool
+		allocs := testing.AllocsPerRun(100, func() {
+			p.InPlace(x)
+			p.Transform(dst, x)
+		})
+		if allocs > 0 {
+			t.Errorf("n=%d: %v allocations per transform", n, allocs)
+		}
+	}
+}
+
+func TestSpectrumMatchesLegacy(t *testing.T) {
+	const n = 2048
+	rng := rand.New(rand.NewSource(2))
+	iSamples := make([]int16, n)
+	qSamples := make([]int16, n)
+	for i := range iSamples {
+		phase := 2 * math.Pi * 0.1 * float64(i)
+		iSamples[i] = int16(1500*math.Cos(phase) + rng.NormFloat64()*4)
+		qSamples[i] = int16(1500*math.Sin(phase) + rng.NormFloat64()*4)
+	}
+
+	want := legacySpectrum(iSamples, qSamples, n)
+	got := make([]float64, n)
+	planSpectrum(got, make([]complex128, n), iSamples, qSamples)
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-6 {
+			t.Fatalf("bin %d: got %.9f dBm, legacy %.9f dBm", i, got[i], want[i])
+		}
+	}
+}
+
+func benchmarkSizes() []int {
+	return []int{1024, 4096, 16384, 65536}
+}
+
+func BenchmarkLegacyFFT(b *testing.B) {
+	for _, n := range benchmarkSizes() {
+		x := randomInput(n, 1)
+		b.Run(sizeName(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				legacyFFT(x)
+			}
+		})
+	}
+}
+
+func BenchmarkPlanInPlace(b *testing.B) {
+	for _, n := range append(benchmarkSizes(), 3000, 12000) {
+		x := randomInput(n, 1)
+		p := PlanFor(n)
+		b.Run(sizeName(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p.InPlace(x)
+			}
+		})
+	}
+}
+
+func BenchmarkLegacySpectrum(b *testing.B) {
+	for _, n := range benchmarkSizes() {
+		iSamples, qSamples := make([]int16, n), make([]int16, n)
+		b.Run(sizeName(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				legacySpectrum(iSamples, qSamples, n)
+			}
+		})
+	}
+}
+
+func BenchmarkPlanSpectrum(b *testing.B) {
+	for _, n := range benchmarkSizes() {
+		iSamples, qSamples := make([]int16, n), make([]int16, n)
+		result, buf := make([]float64, n), make([]complex128, n)
+		b.Run(sizeName(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				planSpectrum(result, buf, iSamples, qSamples)
+			}
+		})
+	}
+}
+
+func sizeName(n int) string {
+	return "n=" + strconv.Itoa(n)
+}
+
+func TestWindowFigures(t *testing.T) {
+	// Published ENBW (bins) and coherent gain for large n
+	cases := []struct {
+		kind WindowKind
+		enbw float64
+		cg   float64
+	}{
+		{Rectangular, 1.0, 1.0},
+		{Hann, 1.50, 0.50},
+		{Hamming, 1.36, 0.54},
+		{Blackman, 1.73, 0.42},
+		{BlackmanHarris, 2.00, 0.36},
+		{FlatTop, 3.77, 0.22},
+	}
+	for _, c := range cases {
+		w, err := GetWindow(c.kind, 65536)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(w.ENBW-c.enbw) > 0.01 || math.Abs(w.CoherentGain-c.cg) > 0.01 {
+			t.Errorf("%s: ENBW %.3f bins, CG %.3f; want %.2f, %.2f", c.kind, w.ENBW, w.CoherentGain, c.enbw, c.cg)
+		}
+	}
+
+	// Kaiser beta 0 is rectangular; larger beta widens the main lobe
+	k0, _ := GetWindowSpec(WindowSpec{Kind: Kaiser, Param: 0}, 1024)
+	k9, _ := GetWindowSpec(WindowSpec{Kind: Kaiser, Param: 9}, 1024)
+	if math.Abs(k0.ENBW-1) > 1e-9 || k9.ENBW <= 1.5 {
+		t.Errorf("kaiser ENBW: beta 0 = %.3f, beta 9 = %.3f", k0.ENBW, k9.ENBW)
+	}
+
+	if spec, err := ParseWindow("Hanning", 0); err != nil || spec.Kind != Hann {
+		t.Errorf("ParseWindow(Hanning) = %v, %v", spec, err)
+	}
+	if _, err := ParseWindow("triangle", 0); err == nil {
+		t.Error("ParseWindow accepted an unknown window")
+	}
+}
+
+// TestWindowCacheBounded requests many Kaiser betas and checks that the
+// cache keeps only the most recently used windows
+func TestWindowCacheBounded(t *testing.T) {
+	first, err := GetWindowSpec(WindowSpec{Kind: Kaiser, Param: 1}, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < 10*maxCachedWindows; k++ {
+		if _, err := GetWindowSpec(WindowSpec{Kind: Kaiser, Param: 2 + float64(k)/100}, 64); err != nil {
+			t.Fatal(err)
+		}
+	}
+	windowsMu.Lock()
+	n, order := len(windows), len(windowOrder)
+	windowsMu.Unlock()
+	if n != maxCachedWindows || order != maxCachedWindows {
+		t.Errorf("%d cached windows (%d ordered), want %d", n, order, maxCachedWindows)
+	}
+	again, err := GetWindowSpec(WindowSpec{Kind: Kaiser, Param: 1}, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == first || again.Sum != first.Sum {
+		t.Error("evicted window was not rebuilt with the same coefficients")
+	}
+}
@@ -0,0 +1,230 @@
+package fft
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+// WindowKind names a window function
+type WindowKind string
+
+const (
+	Rectangular    WindowKind = "rectangular"
+	Hann           WindowKind = "hann"
+	Hamming        WindowKind = "hamming"
+	Blackman       WindowKind = "blackman"
+	BlackmanHarris WindowKind = "blackman-harris" // 4-term, -92 dB sidelobes
+	FlatTop        WindowKind = "flattop"         // 5-term, for amplitude accuracy
+	Kaiser         WindowKind = "kaiser"          // Param is beta
+	Gaussian       WindowKind = "gaussian"        // Param is sigma relative to the half-width
+)
+
+// Default parameters for the parameterized windows
+const (
+	DefaultKaiserBeta    = 8.6
+	DefaultGaussianSigma = 0.4
+)
+
+// windowAliases accepts the names the web UI has historically used
+var windowAliases = map[string]WindowKind{
+	"hanning":        Hann,
+	"blackmanharris": BlackmanHarris,
+	"flat-top":       FlatTop,
+	"rect":           Rectangular,
+	"none":           Rectangular,
+}
+
+// WindowSpec selects a window and its parameter (Kaiser beta, Gaussian sigma)
+type WindowSpec struct {
+	Kind  WindowKind `json:"kind"`
+	Param float64    `json:"param,omitempty"`
+}
+
+// ParseWindow resolves a window name (case-insensitive, aliases allowed) and
+// fills in the default parameter where one is needed
+func ParseWindow(name string, param float64) (WindowSpec, error) {
+	kind := WindowKind(strings.ToLower(strings.TrimSpace(name)))
+	if alias, ok := windowAliases[string(kind)]; ok {
+		kind = alias
+	}
+	if kind == "" {
+		kind = Blackman
+	}
+
+	spec := WindowSpec{Kind: kind}
+	switch kind {
+	case Rectangular, Hann, Hamming, Blackman, BlackmanHarris, FlatTop:
+	case Kaiser:
+		spec.Param = param
+		if spec.Param == 0 {
+			spec.Param = DefaultKaiserBeta
+		}
+		if spec.Param < 0 {
+			return spec, fmt.Errorf("kaiser beta must be positive")
+		}
+	case Gaussian:
+		spec.Param = param
+		if spec.Param == 0 {
+			spec.Param = DefaultGaussianSigma
+		}
+		if spec.Param < 0 {
+			return spec, fmt.Errorf("gaussian sigma must be positive")
+		}
+	default:
+		return spec, fmt.Errorf("unknown window %q", name)
+	}
+	return spec, nil
+}
+
+// WindowKinds lists the supported windows
+func WindowKinds() []WindowKind {
+	return []WindowKind{Rectangular, Hann, Hamming, Blackman, BlackmanHarris, FlatTop, Kaiser, Gaussian}
+}
+
+// Window is a cached set of window coefficients for one size
+type Window struct {
+	Spec   WindowSpec
+	Coeffs []float64
+	Sum    float64 // Sum of coefficients, for tone amplitude normalization
+	SumSq  float64 // Sum of squared coefficients, for noise power normalization
+
+	// CoherentGain is the mean coefficient: a tone's amplitude is scaled by it
+	CoherentGain float64
+	// ENBW is the equivalent noise bandwidth in bins. RBW in Hz is
+	// ENBW * sampleRate / n.
+	ENBW float64
+}
+
+type windowKey struct {
+	spec WindowSpec
+	n    int
+}
+
+// maxCachedWindows bounds the window cache. Kaiser and Gaussian parameters
+// are free floats and sizes go up to 2^20 (8 MB per window), so the least
+// recently used windows are dropped beyond it.
+const maxCachedWindows = 16
+
+var (
+	windowsMu   sync.Mutex
+	windows     = make(map[windowKey]*Window)
+	windowOrder []windowKey // Least recently used first
+)
+
+// touchWindow marks key as the most recently used, evicting the least
+// recently used windows beyond maxCachedWindows. windowsMu must be held.
+func touchWindow(key windowKey) {
+	for i, k := range windowOrder {
+		if k == key {
+			windowOrder = append(windowOrder[:i], windowOrder[i+1:]...)
+			break
+		}
+	}
+	windowOrder = append(windowOrder, key)
+	for len(windowOrder) > maxCachedWindows {
+		delete(windows, windowOrder[0])
+		windowOrder = windowOrder[1:]
+	}
+}
+
+// GetWindow returns the cached window of the given kind and size with the
+// default parameter. The returned coefficients are shared and must not be
+// modified.
+func GetWindow(kind WindowKind, n int) (*Window, error) {
+	spec, err := ParseWindow(string(kind), 0)
+	if err != nil {
+		return nil, err
+	}
+	return GetWindowSpec(spec, n)
+}
+
+// GetWindowSpec returns the cached window for spec and size n. Only the
+// most recently used windows stay cached.
+func GetWindowSpec(spec WindowSpec, n int) (*Window, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("window size must be positive")
+	}
+	if spec.Kind == Gaussian && spec.Param <= 0 {
+		return nil, fmt.Errorf("gaussian sigma must be positive")
+	}
+
+	windowsMu.Lock()
+	defer windowsMu.Unlock()
+
+	key := windowKey{spec, n}
+	if w, ok := windows[key]; ok {
+		touchWindow(key)
+		return w, nil
+	}
+
+	coeffs := make([]float64, n)
+	if n == 1 {
+		coeffs[0] = 1
+	} else {
+		// Symmetric windows over n-1 intervals, matching the original Blackman
+		m := float64(n - 1)
+		for i := range coeffs {
+			x := float64(i) / m
+			switch spec.Kind {
+			case Rectangular:
+				coeffs[i] = 1
+			case Hann:
+				coeffs[i] = cosineSum(x, 0.5, 0.5)
+			case Hamming:
+				coeffs[i] = cosineSum(x, 0.54, 0.46)
+			case Blackman:
+				coeffs[i] = cosineSum(x, 0.42, 0.5, 0.08)
+			case BlackmanHarris:
+				coeffs[i] = cosineSum(x, 0.35875, 0.48829, 0.14128, 0.01168)
+			case FlatTop:
+				coeffs[i] = cosineSum(x, 0.21557895, 0.41663158, 0.277263158, 0.083578947, 0.006947368)
+			case Kaiser:
+				r := 2*x - 1
+				coeffs[i] = besselI0(spec.Param*math.Sqrt(1-r*r)) / besselI0(spec.Param)
+			case Gaussian:
+				r := (2*x - 1) / spec.Param
+				coeffs[i] = math.Exp(-0.5 * r * r)
+			default:
+				return nil, fmt.Errorf("unknown window %q", spec.Kind)
+			}
+		}
+	}
+
+	w := &Window{Spec: spec, Coeffs: coeffs}
+	for _, c := range coeffs {
+		w.Sum += c
+		w.SumSq += c * c
+	}
+	w.CoherentGain = w.Sum / float64(n)
+	w.ENBW = float64(n) * w.SumSq / (w.Sum * w.Sum)
+	windows[key] = w
+	touchWindow(key)
+	return w, nil
+}
+
+// cosineSum evaluates a0 - a1*cos(2*pi*x) + a2*cos(4*pi*x) - ... for x in [0, 1]
+func cosineSum(x float64, a ...float64) float64 {
+	v := 0.0
+	sign := 1.0
+	for k, ak := range a {
+		v += sign * ak * math.Cos(2*math.Pi*float64(k)*x)
+		sign = -sign
+	}
+	return v
+}
+
+// besselI0 is the zeroth-order modified Bessel function of the first kind
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	half := x / 2
+	for k := 1; k < 100; k++ {
+		term *= (half / float64(k)) * (half / float64(k))
+		sum += term
+		if term < sum*1e-16 {
+			break
+		}
+	}
+	return sum
+}
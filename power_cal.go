@@ -0,0 +1,617 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// powerCalibrationFile holds the power calibration tables of a unit
+const powerCalibrationFile = "power_calibration.json"
+
+// powerCalCSVHeader is the column order of CSV imports and exports
+var powerCalCSVHeader = []string{"channel", "filter", "attenuation_db", "freq_mhz", "full_scale_dbm"}
+
+// powerCalFilters are the filter names a table can be for; "" is any filter
+var powerCalFilters = map[string]bool{"": true, "500mhz": true, "1ghz": true, "2ghz": true, "bypass": true}
+
+// PowerCalPoint is the input power of a full-scale tone at one frequency
+type PowerCalPoint struct {
+	FreqMHz      float64 `json:"freq_mhz"`       // RF frequency
+	FullScaleDBm float64 `json:"full_scale_dbm"` // Input power that reads 0 dBFS
+}
+
+// PowerCalTable is one channel's calibration with one filter and attenuation
+type PowerCalTable struct {
+	Channel       int             `json:"channel"`        // Receiver channel (1-8); 0 covers channels without their own tables
+	Filter        string          `json:"filter"`         // 500mhz, 1ghz, 2ghz or bypass; "" covers filters without their own tables
+	AttenuationDB int             `json:"attenuation_db"` // 0-31
+	Points        []PowerCalPoint `json:"points"`         // Linear in frequency, held beyond the ends
+}
+
+// at interpolates the table at an RF frequency
+func (t *PowerCalTable) at(freqMHz float64) float64 {
+	p := t.Points
+	k := sort.Search(len(p), func(k int) bool { return p[k].FreqMHz >= freqMHz })
+	switch {
+	case k == 0:
+		return p[0].FullScaleDBm
+	case k == len(p):
+		return p[len(p)-1].FullScaleDBm
+	}
+	frac := (freqMHz - p[k-1].FreqMHz) / (p[k].FreqMHz - p[k-1].FreqMHz)
+	return p[k-1].FullScaleDBm + frac*(p[k].FullScaleDBm-p[k-1].FullScaleDBm)
+}
+
+// PowerCalibration is the stored set of power calibration tables of a unit.
+// Levels in dBFS read as dBm by adding the full-scale power, which the
+// tables give by channel, filter, attenuation and frequency; without a
+// matching table it is the nominal fullScaleDBm.
+type PowerCalibration struct {
+	Unit   string          `json:"unit"`
+	Name   string          `json:"name"` // Referenced in capture metadata
+	Time   time.Time       `json:"time"`
+	Source string          `json:"source,omitempty"`
+	Tables []PowerCalTable `json:"tables"`
+}
+
+// Validate normalizes and checks the tables and fills in the name and time
+func (c *PowerCalibration) Validate() error {
+	if len(c.Tables) == 0 {
+		return fmt.Errorf("no calibration tables")
+	}
+	seen := make(map[string]bool)
+	for k := range c.Tables {
+		t := &c.Tables[k]
+		t.Filter = strings.ToLower(t.Filter)
+		if t.Channel < 0 || t.Channel > 8 {
+			return fmt.Errorf("table %d: channel must be a receiver channel (1-8) or 0 for all", k)
+		}
+		if !powerCalFilters[t.Filter] {
+			return fmt.Errorf("table %d: unknown filter %q (want 500mhz, 1ghz, 2ghz, bypass or empty)", k, t.Filter)
+		}
+		if t.AttenuationDB < 0 || t.AttenuationDB > 31 {
+			return fmt.Errorf("table %d: attenuation_db must be between 0 and 31", k)
+		}
+		key := fmt.Sprintf("%d/%s/%d", t.Channel, t.Filter, t.AttenuationDB)
+		if seen[key] {
+			return fmt.Errorf("table %d: duplicate table for channel %d, filter %q, %d dB", k, t.Channel, t.Filter, t.AttenuationDB)
+		}
+		seen[key] = true
+		if len(t.Points) == 0 {
+			return fmt.Errorf("table %d: no points", k)
+		}
+		sort.Slice(t.Points, func(i, j int) bool { return t.Points[i].FreqMHz < t.Points[j].FreqMHz })
+		for i, p := range t.Points {
+			if math.IsNaN(p.FreqMHz) || math.IsInf(p.FreqMHz, 0) || math.IsNaN(p.FullScaleDBm) || math.IsInf(p.FullScaleDBm, 0) {
+				return fmt.Errorf("table %d: points must be finite", k)
+			}
+			if i > 0 && p.FreqMHz == t.Points[i-1].FreqMHz {
+				return fmt.Errorf("table %d: two points at %g MHz", k, p.FreqMHz)
+			}
+		}
+	}
+	sort.Slice(c.Tables, func(i, j int) bool {
+		a, b := c.Tables[i], c.Tables[j]
+		if a.Channel != b.Channel {
+			return a.Channel < b.Channel
+		}
+		if a.Filter != b.Filter {
+			return a.Filter < b.Filter
+		}
+		return a.AttenuationDB < b.AttenuationDB
+	})
+	if c.Time.IsZero() {
+		c.Time = time.Now()
+	}
+	if c.Name == "" {
+		c.Name = c.Time.Format("20060102-150405")
+	}
+	c.Unit = unitName
+	return nil
+}
+
+// digest identifies the tables, so metadata can tell sets with the same
+// name apart
+func (c *PowerCalibration) digest() string {
+	data, _ := json.Marshal(c.Tables)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// powerCalMatch is the tables that apply to one channel, filter and
+// attenuation: the nearest table at or below the attenuation and the nearest
+// at or above, interpolated linearly in dB. Beyond the measured attenuations
+// the nearest table is shifted by the difference, as for an ideal attenuator.
+type powerCalMatch struct {
+	lo, hi *PowerCalTable
+	atten  int
+}
+
+// match finds the tables for a channel (1-8), preferring the channel's own
+// tables to the all-channel ones and the filter's to the any-filter ones
+func (c *PowerCalibration) match(ch int, filter string, atten int) (powerCalMatch, bool) {
+	for _, wantCh := range []int{ch, 0} {
+		for _, wantFilter := range []string{filter, ""} {
+			m := powerCalMatch{atten: atten}
+			for k := range c.Tables {
+				t := &c.Tables[k]
+				if t.Channel != wantCh || t.Filter != wantFilter {
+					continue
+				}
+				// Tables are sorted by attenuation
+				if t.AttenuationDB <= atten {
+					m.lo = t
+				}
+				if t.AttenuationDB >= atten && m.hi == nil {
+					m.hi = t
+				}
+			}
+			if m.lo != nil || m.hi != nil {
+				return m, true
+			}
+		}
+	}
+	return powerCalMatch{}, false
+}
+
+// at returns the full-scale input power at an RF frequency
+func (m powerCalMatch) at(freqMHz float64) float64 {
+	switch {
+	case m.hi == nil:
+		return m.lo.at(freqMHz) + float64(m.atten-m.lo.AttenuationDB)
+	case m.lo == nil:
+		return m.hi.at(freqMHz) - float64(m.hi.AttenuationDB-m.atten)
+	case m.lo == m.hi:
+		return m.lo.at(freqMHz)
+	}
+	frac := float64(m.atten-m.lo.AttenuationDB) / float64(m.hi.AttenuationDB-m.lo.AttenuationDB)
+	return m.lo.at(freqMHz) + frac*(m.hi.at(freqMHz)-m.lo.at(freqMHz))
+}
+
+// points returns the corners of the interpolated curve; it is linear
+// between them and held beyond the ends
+func (m powerCalMatch) points() []PowerCalPoint {
+	var freqs []float64
+	for _, t := range []*PowerCalTable{m.lo, m.hi} {
+		if t != nil {
+			for _, p := range t.Points {
+				freqs = append(freqs, p.FreqMHz)
+			}
+		}
+	}
+	sort.Float64s(freqs)
+	var out []PowerCalPoint
+	for _, f := range freqs {
+		if len(out) == 0 || out[len(out)-1].FreqMHz != f {
+			out = append(out, PowerCalPoint{FreqMHz: f, FullScaleDBm: m.at(f)})
+		}
+	}
+	return out
+}
+
+// powerCurve is the full-scale input power across one channel's band: the
+// calibration of its receiver channel at the RF frequency of its DC. A nil
+// curve is the nominal fullScaleDBm everywhere.
+type powerCurve struct {
+	match powerCalMatch
+	rfMHz float64 // RF frequency of the channel's DC
+
+	mu    sync.Mutex
+	gains map[powerGainKey][]float64
+}
+
+type powerGainKey struct {
+	n    int
+	rate float64
+}
+
+// fullScaleDBm returns the input power of a full-scale tone at an offset
+// from the channel's DC
+func (p *powerCurve) fullScaleDBm(offsetHz float64) float64 {
+	if p == nil {
+		return fullScaleDBm
+	}
+	return p.match.at(p.rfMHz + offsetHz/1e6)
+}
+
+// binGains returns each bin's power relative to the nominal scaling for a
+// DC-centered spectrum of n bins at rate, or nil for a nil curve
+func (p *powerCurve) binGains(n int, rate float64) []float64 {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := powerGainKey{n, rate}
+	if g, ok := p.gains[key]; ok {
+		return g
+	}
+	g := make([]float64, n)
+	for k := range g {
+		g[k] = math.Pow(10, (p.fullScaleDBm(float64(k-n/2)*rate/float64(n))-fullScaleDBm)/10)
+	}
+	if p.gains == nil || len(p.gains) >= 8 {
+		p.gains = make(map[powerGainKey][]float64)
+	}
+	p.gains[key] = g
+	return g
+}
+
+// powerCalibrations caches this unit's stored tables, loaded on first use,
+// and the curves resolved from them
+var powerCalibrations struct {
+	mu     sync.Mutex
+	loaded bool
+	cal    *PowerCalibration
+	curves map[powerCurveKey]*powerCurve
+}
+
+type powerCurveKey struct {
+	channel, atten int
+	filter         string
+	rfMHz          float64
+}
+
+// loadPowerCalibration returns the unit's tables, or nil; the caller holds
+// powerCalibrations.mu
+func loadPowerCalibration() *PowerCalibration {
+	if !powerCalibrations.loaded {
+		powerCalibrations.loaded = true
+		if data, err := os.ReadFile(unitCalibrationPath(powerCalibrationFile)); err == nil {
+			var cal PowerCalibration
+			if json.Unmarshal(data, &cal) == nil && cal.Validate() == nil {
+				powerCalibrations.cal = &cal
+			}
+		}
+	}
+	return powerCalibrations.cal
+}
+
+// currentPowerCalibration returns the unit's tables, or nil
+func currentPowerCalibration() *PowerCalibration {
+	powerCalibrations.mu.Lock()
+	defer powerCalibrations.mu.Unlock()
+	return loadPowerCalibration()
+}
+
+// savePowerCalibration stores the unit's tables, replacing them, or removes
+// them when cal is nil
+func savePowerCalibration(cal *PowerCalibration) error {
+	powerCalibrations.mu.Lock()
+	defer powerCalibrations.mu.Unlock()
+	path := unitCalibrationPath(powerCalibrationFile)
+	if cal == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		data, _ := json.MarshalIndent(cal, "", "  ")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	powerCalibrations.loaded, powerCalibrations.cal, powerCalibrations.curves = true, cal, nil
+	return nil
+}
+
+// powerCalContext is the receiver configuration calibration is looked up
+// in. An unknown filter only matches any-filter tables.
+type powerCalContext struct {
+	ddcMHz float64
+	filter string
+	atten  int
+}
+
+// configPowerCalContext describes a hardware configuration; nil is DDC
+// frequency 0, an unknown filter and no attenuation
+func configPowerCalContext(cfg *HardwareConfig) powerCalContext {
+	var x powerCalContext
+	if cfg == nil {
+		return x
+	}
+	if cfg.DDC0FreqMHz != nil {
+		x.ddcMHz = float64(*cfg.DDC0FreqMHz)
+	}
+	if cfg.Filter != nil && *cfg.Filter != "unknown" {
+		x.filter = *cfg.Filter
+	}
+	if cfg.Attenuation != nil {
+		x.atten = *cfg.Attenuation
+	}
+	return x
+}
+
+// livePowerCalContext describes the live data: the replay file's
+// configuration while replaying, otherwise the hardware's
+func livePowerCalContext() powerCalContext {
+	serverState.mu.RLock()
+	replayConfig := serverState.ReplayConfig
+	replaying := serverState.ReplayMode && len(serverState.ReplayData) > 0
+	ddcMHz := serverState.DDCFreqMHz
+	hwAvailable := serverState.HardwareAvailable
+	serverState.mu.RUnlock()
+	if replaying {
+		return configPowerCalContext(replayConfig)
+	}
+	var x powerCalContext
+	if hwAvailable && hwController != nil {
+		x = configPowerCalContext(hwController.GetConfig())
+	}
+	x.ddcMHz = ddcMHz
+	return x
+}
+
+// recordingPowerCalContext describes the configuration a recording was made in
+func recordingPowerCalContext(meta *CaptureMetadata) powerCalContext {
+	return configPowerCalContext(meta.Config)
+}
+
+// curve returns the curve of a receiver channel (1-8) whose DC is offsetHz
+// from the DDC frequency, or nil when no table covers it
+func (x powerCalContext) curve(ch int, offsetHz float64) *powerCurve {
+	powerCalibrations.mu.Lock()
+	defer powerCalibrations.mu.Unlock()
+	cal := loadPowerCalibration()
+	if cal == nil {
+		return nil
+	}
+	key := powerCurveKey{channel: ch, atten: x.atten, filter: x.filter, rfMHz: x.ddcMHz + offsetHz/1e6}
+	if p, ok := powerCalibrations.curves[key]; ok {
+		return p
+	}
+	var p *powerCurve
+	if m, ok := cal.match(ch, x.filter, x.atten); ok {
+		p = &powerCurve{match: m, rfMHz: key.rfMHz}
+	}
+	if powerCalibrations.curves == nil || len(powerCalibrations.curves) >= 1024 {
+		powerCalibrations.curves = make(map[powerCurveKey]*powerCurve)
+	}
+	powerCalibrations.curves[key] = p
+	return p
+}
+
+// channelCurve returns the curve of a user-facing channel: receivers use
+// their tables, sub-channels those of their receiver channel at their
+// center. Beams, and sub-channels of beams, use the nominal scaling.
+func (x powerCalContext) channelCurve(ch int, chz *ChannelizerInfo) *powerCurve {
+	if ch >= 1 && ch <= 8 {
+		return x.curve(ch, 0)
+	}
+	if isSubChannel(ch) && chz != nil && chz.Channel <= 8 {
+		for _, sub := range chz.SubChannels {
+			if sub.Channel == ch {
+				return x.curve(chz.Channel, sub.CenterHz)
+			}
+		}
+	}
+	return nil
+}
+
+// PowerCalRef records in capture metadata the power calibration for the
+// capture's configuration
+type PowerCalRef struct {
+	Unit          string    `json:"unit"`
+	Name          string    `json:"name"`
+	Time          time.Time `json:"time"`
+	Digest        string    `json:"digest"` // First 16 hex digits of the tables' SHA-256
+	Filter        string    `json:"filter,omitempty"`
+	AttenuationDB int       `json:"attenuation_db"`
+	Channels      []int     `json:"channels"` // Receiver channels with a table; the others are nominal
+}
+
+// powerCalRef describes the calibration of the channels in a configuration,
+// or nil when the unit has none
+func powerCalRef(x powerCalContext, channels []int) *PowerCalRef {
+	cal := currentPowerCalibration()
+	if cal == nil {
+		return nil
+	}
+	ref := &PowerCalRef{Unit: cal.Unit, Name: cal.Name, Time: cal.Time, Digest: cal.digest(), Filter: x.filter, AttenuationDB: x.atten, Channels: []int{}}
+	for _, ch := range channels {
+		if _, ok := cal.match(ch, x.filter, x.atten); ok && ch >= 1 && ch <= 8 {
+			ref.Channels = append(ref.Channels, ch)
+		}
+	}
+	return ref
+}
+
+// readPowerCalCSV parses one point per row in powerCalCSVHeader order
+func readPowerCalCSV(r io.Reader) (*PowerCalibration, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	cal := &PowerCalibration{}
+	tables := make(map[string]int)
+	for n, row := range rows {
+		if n == 0 && len(row) > 0 && strings.TrimSpace(row[0]) == powerCalCSVHeader[0] {
+			continue
+		}
+		if len(row) != len(powerCalCSVHeader) {
+			return nil, fmt.Errorf("row %d: want %d columns (%s)", n+1, len(powerCalCSVHeader), strings.Join(powerCalCSVHeader, ","))
+		}
+		var t PowerCalTable
+		var p PowerCalPoint
+		var errs [4]error
+		t.Channel, errs[0] = strconv.Atoi(strings.TrimSpace(row[0]))
+		t.Filter = strings.ToLower(strings.TrimSpace(row[1]))
+		t.AttenuationDB, errs[1] = strconv.Atoi(strings.TrimSpace(row[2]))
+		p.FreqMHz, errs[2] = strconv.ParseFloat(strings.TrimSpace(row[3]), 64)
+		p.FullScaleDBm, errs[3] = strconv.ParseFloat(strings.TrimSpace(row[4]), 64)
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %v", n+1, err)
+			}
+		}
+		key := fmt.Sprintf("%d/%s/%d", t.Channel, t.Filter, t.AttenuationDB)
+		k, ok := tables[key]
+		if !ok {
+			k = len(cal.Tables)
+			tables[key] = k
+			cal.Tables = append(cal.Tables, t)
+		}
+		cal.Tables[k].Points = append(cal.Tables[k].Points, p)
+	}
+	return cal, nil
+}
+
+// writePowerCalCSV writes one point per row with a header
+func writePowerCalCSV(w io.Writer, cal *PowerCalibration) error {
+	cw := csv.NewWriter(w)
+	cw.Write(powerCalCSVHeader)
+	for _, t := range cal.Tables {
+		for _, p := range t.Points {
+			cw.Write([]string{
+				strconv.Itoa(t.Channel),
+				t.Filter,
+				strconv.Itoa(t.AttenuationDB),
+				strconv.FormatFloat(p.FreqMHz, 'g', -1, 64),
+				strconv.FormatFloat(p.FullScaleDBm, 'g', -1, 64),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// handlePowerCalibration exports (GET with format=json or csv), imports
+// (POST, JSON or CSV with format=csv or a text/csv body) or removes
+// (DELETE) the unit's power calibration. A plain GET describes the tables
+// and the curves applied to live data.
+func handlePowerCalibration(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	switch r.Method {
+	case http.MethodPost:
+		var cal *PowerCalibration
+		var err error
+		if format == "csv" || strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			cal, err = readPowerCalCSV(r.Body)
+		} else {
+			cal = &PowerCalibration{}
+			err = json.NewDecoder(r.Body).Decode(cal)
+		}
+		if err != nil {
+			http.Error(w, "Invalid calibration: "+err.Error(), 400)
+			return
+		}
+		if name := r.URL.Query().Get("name"); name != "" {
+			cal.Name = name
+		}
+		if source := r.URL.Query().Get("source"); source != "" {
+			cal.Source = source
+		}
+		if err := cal.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := savePowerCalibration(cal); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		go broadcastJSON(powerCalibrationMessage())
+	case http.MethodDelete:
+		if err := savePowerCalibration(nil); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		go broadcastJSON(powerCalibrationMessage())
+	case http.MethodGet:
+		if format == "" {
+			break
+		}
+		cal := currentPowerCalibration()
+		if cal == nil {
+			http.Error(w, "No power calibration stored for unit "+unitName, 404)
+			return
+		}
+		switch format {
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "power_calibration_"+unitName+".json"))
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(cal)
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "power_calibration_"+unitName+".csv"))
+			writePowerCalCSV(w, cal)
+		default:
+			http.Error(w, "format must be json or csv", 400)
+		}
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(powerCalibrationMessage())
+}
+
+// LivePowerCurve is the calibration applied to one live channel: the
+// full-scale input power at offsets from its DC, linear between the points
+type LivePowerCurve struct {
+	Channel int                `json:"channel"`
+	Points  []LivePowerCurvePt `json:"points"`
+}
+
+// LivePowerCurvePt is one corner of a live curve
+type LivePowerCurvePt struct {
+	OffsetHz     float64 `json:"offset_hz"`
+	FullScaleDBm float64 `json:"full_scale_dbm"`
+}
+
+// powerCalibrationMessage describes the stored tables and the curves of the
+// live channels, so the browser's own FFT can apply them
+func powerCalibrationMessage() map[string]interface{} {
+	x := livePowerCalContext()
+	var chz *ChannelizerInfo
+	if c := currentChannelizer(); c != nil {
+		chz = c.info()
+	}
+	curves := []LivePowerCurve{}
+	for ch := 1; ch <= maxChannel; ch++ {
+		p := x.channelCurve(ch, chz)
+		if p == nil {
+			continue
+		}
+		lc := LivePowerCurve{Channel: ch}
+		for _, pt := range p.match.points() {
+			lc.Points = append(lc.Points, LivePowerCurvePt{OffsetHz: (pt.FreqMHz - p.rfMHz) * 1e6, FullScaleDBm: pt.FullScaleDBm})
+		}
+		curves = append(curves, lc)
+	}
+	msg := map[string]interface{}{
+		"type":                   "power_calibration",
+		"nominal_full_scale_dbm": fullScaleDBm,
+		"filter":                 x.filter,
+		"attenuation_db":         x.atten,
+		"ddc_mhz":                x.ddcMHz,
+		"curves":                 curves,
+	}
+	if cal := currentPowerCalibration(); cal != nil {
+		msg["calibration"] = map[string]interface{}{
+			"unit":   cal.Unit,
+			"name":   cal.Name,
+			"time":   cal.Time,
+			"source": cal.Source,
+			"digest": cal.digest(),
+			"tables": len(cal.Tables),
+		}
+	}
+	return msg
+}
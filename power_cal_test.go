@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// TestPowerCalibration checks table selection, interpolation in frequency
+// and attenuation, the CSV round trip and calibrated spectra
+func TestPowerCalibration(t *testing.T) {
+	cal := &PowerCalibration{Tables: []PowerCalTable{
+		{Channel: 0, Points: []PowerCalPoint{{FreqMHz: 100, FullScaleDBm: 5}, {FreqMHz: 300, FullScaleDBm: 7}}},
+		{Channel: 2, Filter: "1GHz", AttenuationDB: 10, Points: []PowerCalPoint{{FreqMHz: 200, FullScaleDBm: 20}}},
+		{Channel: 2, Filter: "1ghz", AttenuationDB: 0, Points: []PowerCalPoint{{FreqMHz: 200, FullScaleDBm: 8}}},
+	}}
+	if err := cal.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	at := func(ch int, filter string, atten int, freqMHz float64) float64 {
+		m, ok := cal.match(ch, filter, atten)
+		if !ok {
+			t.Fatalf("no table for channel %d, filter %q, %d dB", ch, filter, atten)
+		}
+		return m.at(freqMHz)
+	}
+	for _, c := range []struct {
+		ch     int
+		filter string
+		atten  int
+		freq   float64
+		want   float64
+	}{
+		{1, "1ghz", 0, 200, 6},  // All-channel table, interpolated
+		{1, "", 0, 50, 5},       // Held below the first point
+		{1, "", 3, 400, 10},     // Held above the last, shifted by the attenuation
+		{2, "1ghz", 0, 200, 8},  // Channel's own table
+		{2, "1ghz", 5, 200, 14}, // Between measured attenuations
+		{2, "1ghz", 15, 200, 25},
+		{2, "2ghz", 0, 200, 6}, // Other filter falls back to all channels
+	} {
+		if got := at(c.ch, c.filter, c.atten, c.freq); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("channel %d %q %d dB at %g MHz: %g dBm, want %g", c.ch, c.filter, c.atten, c.freq, got, c.want)
+		}
+	}
+	dup := &PowerCalibration{Tables: []PowerCalTable{cal.Tables[0], cal.Tables[0]}}
+	if dup.Validate() == nil {
+		t.Error("duplicate tables accepted")
+	}
+
+	var buf bytes.Buffer
+	if err := writePowerCalCSV(&buf, cal); err != nil {
+		t.Fatal(err)
+	}
+	back, err := readPowerCalCSV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := back.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back.Tables, cal.Tables) {
+		t.Errorf("CSV round trip changed the tables:\n%v\n%v", back.Tables, cal.Tables)
+	}
+
+	// A tone 100 bins above DC at -20 dBFS reads its calibrated power
+	const n = 1024
+	binHz := float64(captureSampleRate) / n
+	i, q := make([]int16, n), make([]int16, n)
+	for k := range i {
+		ph := 2 * math.Pi * 100 * float64(k) / n
+		i[k] = int16(math.Round(fullScaleAmplitude * 0.1 * math.Cos(ph)))
+		q[k] = int16(math.Round(fullScaleAmplitude * 0.1 * math.Sin(ph)))
+	}
+	m, _ := cal.match(1, "", 0)
+	opts := defaultSpectrumOptions(n)
+	opts.Cal = &powerCurve{match: m, rfMHz: 200}
+	trace, err := computeSpectrum(i, q, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := m.at(200+100*binHz/1e6) - 20
+	if got := trace[n/2+100]; math.Abs(got-want) > 0.05 {
+		t.Errorf("calibrated tone %.2f dBm, want %.2f", got, want)
+	}
+}
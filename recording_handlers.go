@@ -2,10 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -19,6 +19,8 @@ type RecordStartRequest struct {
 	Value    string          `json:"value"` // Input string
 	Filename string          `json:"filename"`
 	Config   *HardwareConfig `json:"config"`
+	Hop      *HopPlan        `json:"hop"`      // Optional tuning schedule
+	Channels []int           `json:"channels"` // User-facing channels; empty = the channels selected for streaming
 }
 
 func parseSize(value string) (int, error) {
@@ -87,42 +89,86 @@ func handleRecordStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Hop != nil {
+		if err := req.Hop.Validate(captureSampleRate); err != nil {
+			http.Error(w, "Invalid hop plan: "+err.Error(), 400)
+			return
+		}
+	}
+
 	serverState.mu.RLock()
 	if !serverState.HardwareAvailable {
 		serverState.mu.RUnlock()
 		http.Error(w, "Hardware unavailable", http.StatusServiceUnavailable)
 		return
 	}
-	serverState.mu.RUnlock()
 
-	// Apply hardware configuration if provided
-	if req.Config != nil && hwController != nil {
-		if err := hwController.ApplyConfig(req.Config); err != nil {
-			log.Printf("Error applying hardware config: %v", err)
+	// Use the requested or currently viewed channels; the selection is
+	// captured now so that later GUI changes don't affect jobs already
+	// waiting in the queue
+	beams := serverState.Beams
+	channelizer := serverState.Channelizer
+	available := func(idx int) bool {
+		if isSubChannel(idx) {
+			return channelizer.Enabled && idx < subChannelBase+channelizer.SubChannels
 		}
-		
-		// Update server state center frequency if DDC0 changes
-		if req.Config.DDC0FreqMHz != nil {
-			serverState.mu.Lock()
-			serverState.DDCFreqMHz = float64(*req.Config.DDC0FreqMHz)
-			serverState.mu.Unlock()
+		return idx >= 1 && idx <= 8+len(beams)
+	}
+	channelMap := make(map[int]bool)
+	for _, ch := range req.Channels {
+		if !available(ch) {
+			serverState.mu.RUnlock()
+			http.Error(w, fmt.Sprintf("Channel %d is not available", ch), 400)
+			return
+		}
+		channelMap[ch-1] = true
+	}
+	for _, chName := range serverState.Channels {
+		if len(req.Channels) == 0 && len(chName) >= 2 {
+			// Parse channel index from name like "I1" or "Q1"
+			// Channels are named I1, Q1, ..., I8, Q8, then I9, Q9... for
+			// beams and I17, Q17... for sub-channels
+			if idx, err := strconv.Atoi(chName[1:]); err == nil && available(idx) {
+				channelMap[idx-1] = true
+			}
 		}
 	}
+	serverState.mu.RUnlock()
 
-	serverState.mu.Lock()
-	// Do NOT defer unlock here because we want to unlock before starting goroutine (though logically fine, better explicitly manage if we accessed complex state)
-	// But defer is fine for this short block.
-	
-	if serverState.Recording {
-		serverState.mu.Unlock()
-		http.Error(w, "Already recording", 409)
-		return
+	var recChannels []int
+	if len(channelMap) > 0 {
+		recChannels = make([]int, 0, len(channelMap))
+		for chIdx := range channelMap {
+			recChannels = append(recChannels, chIdx)
+		}
+		sort.Ints(recChannels)
+	} else {
+		// Fallback to all channels if nothing selected
+		recChannels = []int{0, 1, 2, 3, 4, 5, 6, 7}
 	}
 
-	// Create data directory if not exists
-	dataDir := "data"
-	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
-		os.Mkdir(dataDir, 0755)
+	// Convert internal indices to user-facing channels (1-8, beams 9-16,
+	// sub-channels 17-80). Sub-channels run at a lower rate, so they are
+	// recorded on their own.
+	activeChannels := make([]int, len(recChannels))
+	subChannels := 0
+	for i, ch := range recChannels {
+		activeChannels[i] = ch + 1
+		if isSubChannel(ch + 1) {
+			subChannels++
+		}
+	}
+	var jobChannelizer *ChannelizerConfig
+	if subChannels > 0 {
+		if subChannels < len(activeChannels) {
+			http.Error(w, "Sub-channels can't be recorded together with full-rate channels", 400)
+			return
+		}
+		if req.Hop != nil {
+			http.Error(w, "Hop plans can't be used with sub-channel recordings", 400)
+			return
+		}
+		jobChannelizer = &channelizer
 	}
 
 	// Determine filename
@@ -134,97 +180,44 @@ func handleRecordStart(w http.ResponseWriter, r *http.Request) {
 		}
 		// Sanitize to prevent path traversal
 		filename = filepath.Base(filename)
+		if recordingQueue.FilenameInUse(filename) {
+			http.Error(w, "A queued recording already uses "+filename, 409)
+			return
+		}
 	} else {
 		// Generate filename: capture_YYYYMMDD_HHMMSS.bin
-		filename = fmt.Sprintf("capture_%s.bin", time.Now().Format("20060102_150405"))
-	}
-
-	fullPath := filepath.Join(dataDir, filename)
-
-	f, err := os.Create(fullPath)
-	if err != nil {
-		serverState.mu.Unlock()
-		http.Error(w, "Failed to create file: "+err.Error(), 500)
-		return
-	}
-
-	// Use currently viewed channels if not explicitly set in the request
-	// (Always override RecordingChannels with GUI selection for consistency)
-	serverState.RecordingChannels = nil
-	
-	// Convert serverState.Channels (e.g. ["I1", "Q1", "I3"]) to indices
-	channelMap := make(map[int]bool)
-	for _, chName := range serverState.Channels {
-		if len(chName) >= 2 {
-			// Parse channel index from name like "I1" or "Q1"
-			// Channels are named I1, Q1, I2, Q2, ..., I8, Q8
-			if idx, err := strconv.Atoi(chName[1:]); err == nil {
-				channelMap[idx-1] = true
-			}
+		base := fmt.Sprintf("capture_%s", time.Now().Format("20060102_150405"))
+		filename = base + ".bin"
+		for n := 2; recordingQueue.FilenameInUse(filename); n++ {
+			filename = fmt.Sprintf("%s_%d.bin", base, n)
 		}
 	}
 
-	if len(channelMap) > 0 {
-		serverState.RecordingChannels = make([]int, 0, len(channelMap))
-		for chIdx := range channelMap {
-			serverState.RecordingChannels = append(serverState.RecordingChannels, chIdx)
-		}
-		sort.Ints(serverState.RecordingChannels)
-	} else {
-		// Fallback to all channels if nothing selected
-		serverState.RecordingChannels = []int{0, 1, 2, 3, 4, 5, 6, 7}
+	job := &RecordingJob{
+		Filename:    filename,
+		Total:       req.Samples,
+		Channels:    activeChannels,
+		Config:      req.Config,
+		Hop:         req.Hop,
+		recChannels: recChannels,
+		beams:       beams,
+		channelizer: jobChannelizer,
 	}
+	position := recordingQueue.Enqueue(job)
 
-	serverState.Recording = true
-	serverState.RecordingFile = filename
-	serverState.RecordingSamples = req.Samples
-	serverState.RecordingCurrent = 0
-	serverState.RecordingFileHandle = f
-	serverState.mu.Unlock()
+	log.Printf("[RECORD] Queued job %s: %s (%d samples, position %d)", job.ID, filename, req.Samples, position)
 
-	// Save Metadata
-	metaFilename := strings.TrimSuffix(filename, ".bin") + ".json"
-	metaPath := filepath.Join(dataDir, metaFilename)
-
-	var currentConfig *HardwareConfig
-	if hwController != nil {
-		currentConfig = hwController.GetConfig()
-	}
-
-	serverState.mu.RLock()
-	// Convert internal 0-7 indices to user-facing 1-8
-	activeChannels := make([]int, len(serverState.RecordingChannels))
-	for i, ch := range serverState.RecordingChannels {
-		activeChannels[i] = ch + 1
-	}
-	serverState.mu.RUnlock()
-
-	metadata := CaptureMetadata{
-		Timestamp:  time.Now().Format(time.RFC3339),
-		SampleRate: 244400000,
-		Channels:   activeChannels,
-		Config:     currentConfig,
-	}
-	
-	if metaBytes, err := json.MarshalIndent(metadata, "", "  "); err == nil {
-		os.WriteFile(metaPath, metaBytes, 0644)
+	if position > 0 {
+		if j, ok := recordingQueue.Get(job.ID); ok {
+			go broadcastRecordingStatus(&j)
+		}
 	}
 
-	// Broadcast start
-	go broadcastJSON(map[string]interface{}{
-		"type":     "recording_status",
-		"recording": true,
-		"filename": filename,
-		"total":    req.Samples,
-		"current":  0,
-	})
-
-	// Start the recording loop in background
-	go performRecording()
-
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":  true,
+		"job_id":   job.ID,
 		"filename": filename,
+		"position": position,
 	})
 }
 
@@ -238,56 +231,163 @@ func cleanupRecording(errorMsg string) {
 	}
 	serverState.Recording = false
 
+	jobID := serverState.RecordingJobID
+	recordingQueue.Complete(jobID, errorMsg)
+
 	msg := map[string]interface{}{
 		"type":      "recording_status",
 		"recording": false,
 		"finished":  true,
+		"job_id":    jobID,
+		"state":     JobDone,
+		"filename":  serverState.RecordingFile,
+		"queued":    recordingQueue.Pending(),
 	}
 	if errorMsg != "" {
 		msg["error"] = errorMsg
 		msg["finished"] = false
+		msg["state"] = JobFailed
 	}
 	go broadcastJSON(msg)
 }
 
+// handleRecordStop cancels the running job; queued jobs continue afterwards
 func handleRecordStop(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
 
-	serverState.mu.Lock()
-	defer serverState.mu.Unlock()
+	serverState.mu.RLock()
+	recording := serverState.Recording
+	jobID := serverState.RecordingJobID
+	serverState.mu.RUnlock()
 
-	if !serverState.Recording {
+	if !recording {
 		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "message": "Not recording"})
 		return
 	}
 
-	// Close file
-	if serverState.RecordingFileHandle != nil {
-		serverState.RecordingFileHandle.Close()
-		serverState.RecordingFileHandle = nil
+	if _, err := recordingQueue.Cancel(jobID); err != nil {
+		// The job already finished between the check and the cancel
+		stopActiveRecording(jobID)
 	}
-	serverState.Recording = false
 
-	// Broadcast stop
-	go broadcastJSON(map[string]interface{}{
-		"type":     "recording_status",
-		"recording": false,
-	})
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "job_id": jobID})
+}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+func handleRecordCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var req struct {
+		JobID string `json:"job_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+
+	job, err := recordingQueue.Cancel(req.JobID)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	log.Printf("[RECORD] Cancelled job %s", job.ID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job":     job,
+	})
 }
 
 func handleRecordStatus(w http.ResponseWriter, r *http.Request) {
+	if id := r.URL.Query().Get("job_id"); id != "" {
+		job, ok := recordingQueue.Get(id)
+		if !ok {
+			http.Error(w, "Job not found", 404)
+			return
+		}
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+
+	jobs := recordingQueue.Snapshot()
+
 	serverState.mu.RLock()
 	defer serverState.mu.RUnlock()
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"recording": serverState.Recording,
+		"job_id":    serverState.RecordingJobID,
 		"filename":  serverState.RecordingFile,
 		"total":     serverState.RecordingSamples,
 		"current":   serverState.RecordingCurrent,
+		"queued":    recordingQueue.Pending(),
+		"jobs":      jobs,
 	})
-}
\ No newline at end of file
+}
+
+// handleExport converts a recording in the data folder to another sample format
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var req struct {
+		Filename string `json:"filename"`
+		Output   string `json:"output"` // Optional output name
+		ExportOptions
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+
+	req.Format = strings.ToLower(req.Format)
+	if _, ok := formatExtensions[req.Format]; !ok {
+		http.Error(w, "Unsupported format: "+req.Format, 400)
+		return
+	}
+
+	// Sanitize filenames to prevent path traversal; the output always
+	// carries the format's extension
+	inName := filepath.Base(req.Filename)
+	outName := strings.TrimSuffix(inName, ".bin") + "_" + req.Format
+	if req.Output != "" {
+		outName = filepath.Base(req.Output)
+	}
+	outName = exportPath(outName, req.Format)
+
+	meta, err := convertRecording(filepath.Join(dataFolder, inName), filepath.Join(dataFolder, outName), req.ExportOptions)
+	if errors.Is(err, errExportConflict) {
+		http.Error(w, "Export failed: "+err.Error(), 409)
+		return
+	} else if err != nil {
+		http.Error(w, "Export failed: "+err.Error(), 400)
+		return
+	}
+
+	log.Printf("[EXPORT] %s -> %s (%s, %d samples)", inName, outName, req.Format, meta.Samples)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"filename": outName,
+		"metadata": meta,
+	})
+}
+
+// handleExportDownload serves an exported file from the data folder
+func handleExportDownload(w http.ResponseWriter, r *http.Request) {
+	name := filepath.Base(r.URL.Query().Get("filename"))
+	if name == "." || name == "/" {
+		http.Error(w, "Missing filename", 400)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(w, r, filepath.Join(dataFolder, name))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// HopStep is one entry in a recording's tuning schedule. Fields left nil keep
+// the previous setting.
+type HopStep struct {
+	DDCFreqMHz    *float64 `json:"ddc_freq_mhz,omitempty"`
+	AttenuationDB *int     `json:"attenuation_db,omitempty"`
+}
+
+// HopPlan makes one recording step the DDC and/or attenuation on a fixed dwell
+type HopPlan struct {
+	Steps              []HopStep `json:"steps"`
+	DwellMS            float64   `json:"dwell_ms"`            // Dwell per step in milliseconds
+	DwellSamples       int64     `json:"dwell_samples"`       // Dwell per step in samples (overrides dwell_ms)
+	SettleSamples      int64     `json:"settle_samples"`      // Samples flagged as transition after each retune
+	ExcludeTransitions bool      `json:"exclude_transitions"` // Drop transition samples from the file
+}
+
+// HopSegment tags a sample range of the recording with the active hardware config
+type HopSegment struct {
+	Step          int     `json:"step"`
+	DDCFreqMHz    float64 `json:"ddc_freq_mhz"`
+	AttenuationDB int     `json:"attenuation_db"`
+	StartSample   int64   `json:"start_sample"` // First settled sample (inclusive)
+	EndSample     int64   `json:"end_sample"`   // Exclusive
+
+	// Transition samples before StartSample, captured while retuning/settling
+	TransitionStart int64 `json:"transition_start"`
+	TransitionEnd   int64 `json:"transition_end"`
+
+	AppliedAt time.Time `json:"applied_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Validate checks the plan and fills in the dwell in samples
+func (p *HopPlan) Validate(sampleRate float64) error {
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("hop plan has no steps")
+	}
+	if p.DwellSamples <= 0 {
+		p.DwellSamples = int64(p.DwellMS / 1000 * sampleRate)
+	}
+	if p.DwellSamples <= 0 {
+		return fmt.Errorf("hop plan needs dwell_ms or dwell_samples")
+	}
+	if p.SettleSamples < 0 || p.SettleSamples >= p.DwellSamples {
+		return fmt.Errorf("settle_samples must be between 0 and the dwell (%d samples)", p.DwellSamples)
+	}
+	for i, s := range p.Steps {
+		if s.DDCFreqMHz == nil && s.AttenuationDB == nil {
+			return fmt.Errorf("step %d changes nothing", i)
+		}
+		if s.AttenuationDB != nil && (*s.AttenuationDB < 0 || *s.AttenuationDB > 31) {
+			return fmt.Errorf("step %d: attenuation must be between 0 and 31 dB", i)
+		}
+	}
+	return nil
+}
+
+// hopper applies a HopPlan from inside a recording loop and builds the timeline
+type hopper struct {
+	plan     *HopPlan
+	step     int
+	segments []HopSegment
+}
+
+// newHopper applies the first step before capture starts. Returns nil if plan is nil.
+func newHopper(plan *HopPlan) *hopper {
+	if plan == nil {
+		return nil
+	}
+	h := &hopper{plan: plan}
+	seg := h.apply(0)
+	seg.TransitionStart, seg.TransitionEnd, seg.StartSample = 0, 0, 0
+	h.segments = append(h.segments, seg)
+	return h
+}
+
+// Advance retunes once the current step's dwell has elapsed. position returns
+// the current stream position in samples; it is sampled before and after the
+// hardware update so the transition covers the whole retune.
+func (h *hopper) Advance(position func() int64) {
+	if h == nil {
+		return
+	}
+	cur := &h.segments[len(h.segments)-1]
+	pos := position()
+	if pos < cur.StartSample+h.plan.DwellSamples {
+		return
+	}
+
+	h.step = (h.step + 1) % len(h.plan.Steps)
+	cur.EndSample = pos
+
+	seg := h.apply(h.step)
+	seg.TransitionStart = pos
+	seg.TransitionEnd = position() + h.plan.SettleSamples
+	seg.StartSample = seg.TransitionEnd
+	h.segments = append(h.segments, seg)
+}
+
+// Finish closes the timeline at the final sample count
+func (h *hopper) Finish(total int64) []HopSegment {
+	if h == nil {
+		return nil
+	}
+	last := &h.segments[len(h.segments)-1]
+	last.EndSample = total
+	for i := range h.segments {
+		s := &h.segments[i]
+		// Clamp ranges that ran past the end of a short or stopped recording
+		if s.TransitionEnd > total {
+			s.TransitionEnd = total
+		}
+		if s.StartSample > total {
+			s.StartSample = total
+		}
+		if s.EndSample < s.StartSample {
+			s.EndSample = s.StartSample
+		}
+	}
+	return h.segments
+}
+
+// apply programs the hardware for step i and returns its segment header
+func (h *hopper) apply(i int) HopSegment {
+	step := h.plan.Steps[i]
+	seg := HopSegment{Step: i, AppliedAt: time.Now()}
+
+	// Carry over settings the step doesn't change
+	if len(h.segments) > 0 {
+		prev := h.segments[len(h.segments)-1]
+		seg.DDCFreqMHz = prev.DDCFreqMHz
+		seg.AttenuationDB = prev.AttenuationDB
+	} else {
+		serverState.mu.RLock()
+		seg.DDCFreqMHz = serverState.DDCFreqMHz
+		serverState.mu.RUnlock()
+		if hwController != nil {
+			seg.AttenuationDB, _ = hwController.GetParameter(ATTENUATION_BVAL)
+		}
+	}
+
+	if hwController == nil {
+		seg.Error = "hardware controller unavailable"
+		return seg
+	}
+
+	if step.DDCFreqMHz != nil {
+		actual, err := setDDCFrequency(0, *step.DDCFreqMHz)
+		if err != nil {
+			log.Printf("[HOP] Step %d: failed to set DDC frequency: %v", i, err)
+			seg.Error = err.Error()
+		} else {
+			seg.DDCFreqMHz = actual
+			serverState.mu.Lock()
+			serverState.DDCFreqMHz = actual
+			serverState.mu.Unlock()
+			go broadcastJSON(map[string]interface{}{
+				"type":      "ddc_freq_update",
+				"ddc_index": 0,
+				"freq_mhz":  int(actual),
+			})
+		}
+	}
+
+	if step.AttenuationDB != nil {
+		if err := hwController.UpdateParameter(ATTENUATION_BVAL, *step.AttenuationDB); err != nil {
+			log.Printf("[HOP] Step %d: failed to set attenuation: %v", i, err)
+			seg.Error = err.Error()
+		} else {
+			seg.AttenuationDB = *step.AttenuationDB
+			go broadcastJSON(map[string]interface{}{
+				"type":           "attenuation_update",
+				"attenuation_db": *step.AttenuationDB,
+			})
+		}
+	}
+
+	return seg
+}
+
+// dropTransitions removes transition samples from frame data and returns the
+// compacted data with the timeline remapped to output sample indices
+func dropTransitions(data []byte, frameSize int, segments []HopSegment) ([]byte, []HopSegment) {
+	out := data[:0]
+	remapped := make([]HopSegment, len(segments))
+	var written int64
+	for i, s := range segments {
+		remapped[i] = s
+		remapped[i].TransitionStart = written
+		remapped[i].TransitionEnd = written
+		remapped[i].StartSample = written
+
+		start, end := s.StartSample*int64(frameSize), s.EndSample*int64(frameSize)
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if start < end {
+			// In-place compaction is safe since out never overtakes the read position
+			out = append(out, data[start:end]...)
+			written += (end - start) / int64(frameSize)
+		}
+		remapped[i].EndSample = written
+	}
+	return out, remapped
+}
+
+// remapTimeline moves a timeline from capture samples to the samples
+// written after alignment and channelization. Written sample k stands for
+// capture sample shift + k*decim, so each boundary moves to the first
+// written sample at or after it, within 0 to total.
+func remapTimeline(segments []HopSegment, shift float64, decim int, total int64) []HopSegment {
+	at := func(s int64) int64 {
+		k := int64(math.Ceil((float64(s) - shift) / float64(decim)))
+		return max(0, min(k, total))
+	}
+	remapped := make([]HopSegment, len(segments))
+	for i, s := range segments {
+		remapped[i] = s
+		remapped[i].TransitionStart = at(s.TransitionStart)
+		remapped[i].TransitionEnd = at(s.TransitionEnd)
+		remapped[i].StartSample = at(s.StartSample)
+		remapped[i].EndSample = at(s.EndSample)
+	}
+	return remapped
+}
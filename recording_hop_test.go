@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// TestHopTimelineRemap checks that hop boundaries point at the same capture
+// samples after alignment drops its lead and after the channelizer
+// decimates
+func TestHopTimelineRemap(t *testing.T) {
+	timeline := []HopSegment{
+		{Step: 0, TransitionStart: 0, TransitionEnd: 0, StartSample: 0, EndSample: 1000},
+		{Step: 1, TransitionStart: 1000, TransitionEnd: 1100, StartSample: 1100, EndSample: 3000},
+	}
+
+	// Each sample holds its capture index; the reference slot is copied
+	// without interpolation
+	const frames = 5000
+	data := make([]byte, 0, frames*8)
+	for s := 0; s < frames; s++ {
+		for slot := 0; slot < 2; slot++ {
+			data = binary.LittleEndian.AppendUint16(data, uint16(s))
+			data = binary.LittleEndian.AppendUint16(data, 0)
+		}
+	}
+	a := newChannelAligner([]float64{0, 2.5})
+	aligned := a.alignFrames(data)
+	total := int64(len(aligned) / 8)
+	got := remapTimeline(timeline, a.referenceLead(), 1, total)
+	for k, seg := range timeline {
+		for _, b := range [][2]int64{{seg.TransitionEnd, got[k].TransitionEnd}, {seg.StartSample, got[k].StartSample}, {seg.EndSample, got[k].EndSample}} {
+			// Capture samples before the lead are not written
+			want := max(b[0], int64(a.referenceLead()))
+			if v := int64(binary.LittleEndian.Uint16(aligned[b[1]*8:])); v != want {
+				t.Errorf("segment %d: written sample %d holds capture sample %d, want %d", k, b[1], v, want)
+			}
+		}
+	}
+	if got[0].StartSample != 0 {
+		t.Errorf("first segment starts at %d, want 0", got[0].StartSample)
+	}
+
+	// A step at a boundary reaches half amplitude just before the remapped
+	// sub-channel sample
+	c, err := newPolyphaseChannelizer(ChannelizerConfig{SubChannels: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const step, amp = 1000, 1000
+	i, q := make([]int16, frames), make([]int16, frames)
+	for s := step; s < frames; s++ {
+		i[s] = amp
+	}
+	subI, _ := c.channelize(i, q, []int{c.m / 2})
+	sub := remapTimeline([]HopSegment{{StartSample: step, EndSample: frames}}, c.delay(), c.m, int64(len(subI[0])))
+	k := sub[0].StartSample
+	if before, at := subI[0][k-1], subI[0][k]; before > amp/2+1 || at <= amp/2+1 {
+		t.Errorf("sub-channel samples around %d: %d, %d, want the step to pass half amplitude between them", k, before, at)
+	}
+	if sub[0].EndSample != int64(len(subI[0])) {
+		t.Errorf("end %d, want %d", sub[0].EndSample, len(subI[0]))
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RecordingJobState is the lifecycle state of a queued recording
+type RecordingJobState string
+
+const (
+	JobQueued    RecordingJobState = "queued"
+	JobRunning   RecordingJobState = "running"
+	JobDone      RecordingJobState = "done"
+	JobFailed    RecordingJobState = "failed"
+	JobCancelled RecordingJobState = "cancelled"
+)
+
+// errJobCancelled reports a job cancelled before its recording started
+var errJobCancelled = errors.New("cancelled before start")
+
+// maxFinishedJobs bounds how many completed jobs are kept for status queries
+const maxFinishedJobs = 50
+
+// RecordingJob is a single recording request in the queue
+type RecordingJob struct {
+	ID         string            `json:"id"`
+	State      RecordingJobState `json:"state"`
+	Filename   string            `json:"filename"`
+	Total      int               `json:"total"`    // Samples requested
+	Current    int               `json:"current"`  // Samples recorded so far
+	Progress   float64           `json:"progress"` // 0.0 to 1.0
+	Channels   []int             `json:"channels"` // User-facing channel numbers (1-8, beams 9-16, sub-channels 17-80)
+	Config     *HardwareConfig   `json:"config,omitempty"`
+	Hop        *HopPlan          `json:"hop,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+
+	recChannels []int              // Internal channel indices (0-7, beams 8-15, sub-channels 16-79)
+	beams       []Beam             // Beam definitions when the job was queued
+	channelizer *ChannelizerConfig // Channelizer when the job was queued, for sub-channel jobs
+}
+
+func (j *RecordingJob) finished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled
+}
+
+// RecordingQueue runs recording jobs one at a time in submission order
+type RecordingQueue struct {
+	mu      sync.Mutex
+	jobs    []*RecordingJob
+	nextID  int
+	running bool // Worker goroutine active
+}
+
+var recordingQueue = &RecordingQueue{nextID: 1}
+
+// Enqueue adds a job and starts the worker if it is idle
+func (q *RecordingQueue) Enqueue(job *RecordingJob) (position int) {
+	q.mu.Lock()
+	job.ID = fmt.Sprintf("rec-%d", q.nextID)
+	q.nextID++
+	job.State = JobQueued
+	job.CreatedAt = time.Now()
+	q.jobs = append(q.jobs, job)
+
+	for _, j := range q.jobs {
+		if j.State == JobQueued || j.State == JobRunning {
+			position++
+		}
+	}
+
+	shouldStart := !q.running
+	if shouldStart {
+		q.running = true
+	}
+	q.mu.Unlock()
+
+	if shouldStart {
+		go q.run()
+	}
+	return position - 1
+}
+
+// Cancel removes a queued job or stops the running one
+func (q *RecordingQueue) Cancel(id string) (*RecordingJob, error) {
+	q.mu.Lock()
+	var job *RecordingJob
+	for _, j := range q.jobs {
+		if j.ID == id {
+			job = j
+			break
+		}
+	}
+	if job == nil {
+		q.mu.Unlock()
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+	if job.finished() {
+		q.mu.Unlock()
+		return nil, fmt.Errorf("job %s already %s", id, job.State)
+	}
+
+	wasRunning := job.State == JobRunning
+	now := time.Now()
+	job.State = JobCancelled
+	job.FinishedAt = &now
+	snapshot := *job
+	q.mu.Unlock()
+
+	if wasRunning {
+		// startRecordingJob rechecks the state before it hands the file over,
+		// so a job that hasn't started yet never records
+		stopActiveRecording(id)
+	} else {
+		// Queued jobs never created their file
+		go broadcastRecordingStatus(&snapshot)
+	}
+	return &snapshot, nil
+}
+
+// Complete records the outcome of the job that was running
+func (q *RecordingQueue) Complete(id string, errorMsg string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, j := range q.jobs {
+		if j.ID != id || j.finished() {
+			continue
+		}
+		now := time.Now()
+		j.FinishedAt = &now
+		if errorMsg != "" {
+			j.State = JobFailed
+			j.Error = errorMsg
+		} else {
+			j.State = JobDone
+		}
+		return
+	}
+}
+
+// isRunning reports whether id is still the running job
+func (q *RecordingQueue) isRunning(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, j := range q.jobs {
+		if j.ID == id {
+			return j.State == JobRunning
+		}
+	}
+	return false
+}
+
+// Snapshot returns copies of all jobs with live progress filled in
+func (q *RecordingQueue) Snapshot() []RecordingJob {
+	serverState.mu.RLock()
+	activeID := serverState.RecordingJobID
+	activeCurrent := serverState.RecordingCurrent
+	serverState.mu.RUnlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]RecordingJob, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		if j.ID == activeID && j.State == JobRunning {
+			j.Current = activeCurrent
+		}
+		if j.Total > 0 {
+			j.Progress = float64(j.Current) / float64(j.Total)
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs
+}
+
+// Get returns a copy of a single job
+func (q *RecordingQueue) Get(id string) (RecordingJob, bool) {
+	for _, j := range q.Snapshot() {
+		if j.ID == id {
+			return j, true
+		}
+	}
+	return RecordingJob{}, false
+}
+
+// Pending returns the number of jobs waiting to run
+func (q *RecordingQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, j := range q.jobs {
+		if j.State == JobQueued {
+			n++
+		}
+	}
+	return n
+}
+
+// FilenameInUse reports whether an unfinished job already targets filename
+func (q *RecordingQueue) FilenameInUse(filename string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, j := range q.jobs {
+		if !j.finished() && j.Filename == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// next marks the oldest queued job as running, or stops the worker if none remain
+func (q *RecordingQueue) next() *RecordingJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, j := range q.jobs {
+		if j.State == JobQueued {
+			now := time.Now()
+			j.State = JobRunning
+			j.StartedAt = &now
+			return j
+		}
+	}
+	q.running = false
+	q.prune()
+	return nil
+}
+
+// prune drops the oldest finished jobs beyond maxFinishedJobs
+func (q *RecordingQueue) prune() {
+	finished := 0
+	for _, j := range q.jobs {
+		if j.finished() {
+			finished++
+		}
+	}
+	if finished <= maxFinishedJobs {
+		return
+	}
+
+	kept := q.jobs[:0]
+	for _, j := range q.jobs {
+		if j.finished() && finished > maxFinishedJobs {
+			finished--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	q.jobs = kept
+}
+
+// run executes queued jobs until the queue is empty
+func (q *RecordingQueue) run() {
+	for {
+		job := q.next()
+		if job == nil {
+			return
+		}
+
+		if err := startRecordingJob(job); errors.Is(err, errJobCancelled) {
+			log.Printf("[RECORD] Job %s cancelled before start", job.ID)
+			continue
+		} else if err != nil {
+			log.Printf("[RECORD] Job %s failed to start: %v", job.ID, err)
+			q.Complete(job.ID, err.Error())
+			if j, ok := q.Get(job.ID); ok {
+				broadcastRecordingStatus(&j)
+			}
+			continue
+		}
+
+		// performRecording blocks until the capture is written, stopped or failed
+		performRecording()
+
+		// A stop without an explicit outcome (e.g. /api/record/stop) still finishes the job
+		q.Complete(job.ID, "")
+
+		serverState.mu.Lock()
+		if serverState.RecordingJobID == job.ID {
+			serverState.RecordingJobID = ""
+		}
+		serverState.mu.Unlock()
+	}
+}
+
+// startRecordingJob applies the job's hardware config, creates its file and
+// hands it to the recording loop through serverState
+func startRecordingJob(job *RecordingJob) error {
+	serverState.mu.RLock()
+	hwAvailable := serverState.HardwareAvailable
+	serverState.mu.RUnlock()
+	if !hwAvailable {
+		return fmt.Errorf("hardware unavailable")
+	}
+
+	// Apply hardware configuration if provided
+	if job.Config != nil && hwController != nil {
+		if err := hwController.ApplyConfig(job.Config); err != nil {
+			log.Printf("Error applying hardware config: %v", err)
+		}
+
+		// Update server state center frequency if DDC0 changes
+		if job.Config.DDC0FreqMHz != nil {
+			serverState.mu.Lock()
+			serverState.DDCFreqMHz = float64(*job.Config.DDC0FreqMHz)
+			serverState.mu.Unlock()
+		}
+	}
+
+	if err := ensureDataFolder(); err != nil {
+		return fmt.Errorf("failed to create data folder: %w", err)
+	}
+
+	// Steered beams use the frequency the job tunes to
+	var beamWeights [][8]complex128
+	var recordedBeams []BeamChannel
+	last := job.recChannels[len(job.recChannels)-1]
+	if last >= 8 && !isSubChannel(last+1) || job.channelizer != nil && job.channelizer.Channel >= beamChannelBase {
+		serverState.mu.RLock()
+		g, ddcHz := serverState.Array, serverState.DDCFreqMHz*1e6
+		serverState.mu.RUnlock()
+		var err error
+		if beamWeights, err = resolveBeams(job.beams, g, ddcHz); err != nil {
+			return err
+		}
+		for _, bc := range beamChannels(job.beams, beamWeights) {
+			for _, idx := range job.recChannels {
+				if idx == bc.Channel-1 {
+					recordedBeams = append(recordedBeams, bc)
+				}
+			}
+		}
+	}
+
+	// Sub-channel jobs record only the split source channel
+	var chz *recordingChannelizer
+	if job.channelizer != nil {
+		var err error
+		if chz, err = newRecordingChannelizer(*job.channelizer, job.Channels, beamWeights); err != nil {
+			return err
+		}
+	}
+
+	// Correction coefficients for the configuration the job tuned to
+	iqCal := currentIQCorrection()
+	dc := recordingDCTracker()
+	aligner, delays := currentAligner()
+
+	fullPath := filepath.Join(dataFolder, job.Filename)
+	f, err := os.Create(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	serverState.mu.Lock()
+	if !recordingQueue.isRunning(job.ID) {
+		// Cancelled while the hardware was being configured
+		serverState.mu.Unlock()
+		f.Close()
+		os.Remove(fullPath)
+		if j, ok := recordingQueue.Get(job.ID); ok {
+			go broadcastRecordingStatus(&j)
+		}
+		return errJobCancelled
+	}
+	serverState.Recording = true
+	serverState.RecordingJobID = job.ID
+	serverState.RecordingFile = job.Filename
+	serverState.RecordingSamples = job.Total
+	serverState.RecordingCurrent = 0
+	serverState.RecordingChannels = job.recChannels
+	serverState.RecordingBeams = beamWeights
+	serverState.RecordingIQ = iqCal
+	serverState.RecordingDC = dc
+	serverState.RecordingAligner = aligner
+	serverState.RecordingChannelizer = chz
+	serverState.RecordingHop = job.Hop
+	serverState.RecordingFileHandle = f
+	serverState.mu.Unlock()
+
+	// Save Metadata (completed by processAndWrite once the capture is done)
+	metadata := newCaptureMetadata(job.Channels)
+	metadata.HopPlan = job.Hop
+	metadata.Beams = recordedBeams
+	metadata.IQCorrection = iqCal
+	if chz != nil {
+		metadata.Channelizer = chz.info()
+		metadata.SampleRate = int(chz.c.sampleRate())
+	}
+	if aligner != nil {
+		var channels []int
+		var leads []float64
+		for _, ch := range job.Channels {
+			if ch >= 1 && ch <= 8 {
+				channels = append(channels, ch)
+				leads = append(leads, aligner.lead[ch-1])
+			}
+		}
+		metadata.Alignment = alignmentInfo(delays, channels, leads, aligner.margin)
+	}
+	metadata.DCRemoval = &DCRemovalInfo{}
+	if dc != nil {
+		metadata.DCRemoval = &DCRemovalInfo{Applied: true, TimeConstantS: dc.tau, InitialOffsets: dc.report()}
+	}
+	if err := writeCaptureMetadata(fullPath, metadata); err != nil {
+		log.Printf("Failed to save metadata: %v", err)
+	}
+
+	log.Printf("[RECORD] Job %s started: %s (%d samples)", job.ID, job.Filename, job.Total)
+
+	if j, ok := recordingQueue.Get(job.ID); ok {
+		go broadcastRecordingStatus(&j)
+	}
+	return nil
+}
+
+// stopActiveRecording closes the running recording's file so the loop exits.
+// A non-empty jobID only stops that job, not one the worker started since
+func stopActiveRecording(jobID string) {
+	serverState.mu.Lock()
+	defer serverState.mu.Unlock()
+
+	if !serverState.Recording || jobID != "" && serverState.RecordingJobID != jobID {
+		return
+	}
+	if serverState.RecordingFileHandle != nil {
+		serverState.RecordingFileHandle.Close()
+		serverState.RecordingFileHandle = nil
+	}
+	serverState.Recording = false
+
+	go broadcastJSON(map[string]interface{}{
+		"type":      "recording_status",
+		"recording": false,
+		"job_id":    serverState.RecordingJobID,
+		"state":     JobCancelled,
+		"started":   true,
+		"queued":    recordingQueue.Pending(),
+	})
+}
+
+// broadcastRecordingStatus sends a job-aware recording_status message
+func broadcastRecordingStatus(job *RecordingJob) {
+	msg := map[string]interface{}{
+		"type":      "recording_status",
+		"recording": job.State == JobRunning,
+		"job_id":    job.ID,
+		"state":     job.State,
+		"filename":  job.Filename,
+		"total":     job.Total,
+		"current":   job.Current,
+		"started":   job.StartedAt != nil,
+		"queued":    recordingQueue.Pending(),
+	}
+	if job.Error != "" {
+		msg["error"] = job.Error
+	}
+	broadcastJSON(msg)
+}
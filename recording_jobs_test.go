@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestRecordingQueue drives the queue state machine without the worker:
+// running is preset so Enqueue doesn't start it, and next stands in for it
+func TestRecordingQueue(t *testing.T) {
+	states := func(q *RecordingQueue) string {
+		s := ""
+		for _, j := range q.jobs {
+			s += fmt.Sprintf("%s:%s ", j.ID, j.State)
+		}
+		return s
+	}
+	cases := []struct {
+		name string
+		run  func(t *testing.T, q *RecordingQueue)
+		want string
+	}{
+		{
+			name: "positions in submission order",
+			run: func(t *testing.T, q *RecordingQueue) {
+				for k := range 3 {
+					if pos := q.Enqueue(&RecordingJob{Filename: fmt.Sprintf("f%d", k)}); pos != k {
+						t.Errorf("job %d at position %d", k, pos)
+					}
+				}
+				if j := q.next(); j == nil || j.ID != "rec-1" {
+					t.Fatalf("next %+v, want rec-1", j)
+				}
+				if pos := q.Enqueue(&RecordingJob{}); pos != 3 {
+					t.Errorf("position %d behind a running job and two queued, want 3", pos)
+				}
+				if q.Pending() != 3 {
+					t.Errorf("%d pending, want 3", q.Pending())
+				}
+			},
+			want: "rec-1:running rec-2:queued rec-3:queued rec-4:queued ",
+		},
+		{
+			name: "cancel queued job is skipped",
+			run: func(t *testing.T, q *RecordingQueue) {
+				q.Enqueue(&RecordingJob{})
+				q.Enqueue(&RecordingJob{})
+				if _, err := q.Cancel("rec-1"); err != nil {
+					t.Fatal(err)
+				}
+				if j := q.next(); j == nil || j.ID != "rec-2" {
+					t.Fatalf("next %+v, want rec-2", j)
+				}
+			},
+			want: "rec-1:cancelled rec-2:running ",
+		},
+		{
+			name: "cancel running job survives completion",
+			run: func(t *testing.T, q *RecordingQueue) {
+				q.Enqueue(&RecordingJob{})
+				q.next()
+				if _, err := q.Cancel("rec-1"); err != nil {
+					t.Fatal(err)
+				}
+				if q.isRunning("rec-1") {
+					t.Error("cancelled job still running")
+				}
+				q.Complete("rec-1", "")
+				if _, err := q.Cancel("rec-1"); err == nil {
+					t.Error("second cancel succeeded")
+				}
+			},
+			want: "rec-1:cancelled ",
+		},
+		{
+			name: "complete and fail",
+			run: func(t *testing.T, q *RecordingQueue) {
+				q.Enqueue(&RecordingJob{})
+				q.Enqueue(&RecordingJob{})
+				q.Complete(q.next().ID, "")
+				q.Complete(q.next().ID, "disk full")
+				if j, _ := q.Get("rec-2"); j.Error != "disk full" || j.FinishedAt == nil {
+					t.Errorf("failed job %+v", j)
+				}
+				if q.next() != nil || q.running {
+					t.Error("worker kept running on an empty queue")
+				}
+			},
+			want: "rec-1:done rec-2:failed ",
+		},
+		{
+			name: "unknown job",
+			run: func(t *testing.T, q *RecordingQueue) {
+				if _, err := q.Cancel("rec-9"); err == nil {
+					t.Error("cancelled a job that doesn't exist")
+				}
+			},
+			want: "",
+		},
+		{
+			name: "filename reserved until finished",
+			run: func(t *testing.T, q *RecordingQueue) {
+				q.Enqueue(&RecordingJob{Filename: "a.bin"})
+				if !q.FilenameInUse("a.bin") || q.FilenameInUse("b.bin") {
+					t.Error("queued filename not reserved")
+				}
+				q.Complete(q.next().ID, "")
+				if q.FilenameInUse("a.bin") {
+					t.Error("finished filename still reserved")
+				}
+			},
+			want: "rec-1:done ",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := &RecordingQueue{nextID: 1, running: true}
+			c.run(t, q)
+			if got := states(q); got != c.want {
+				t.Errorf("jobs %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+// TestRecordingQueuePrune keeps the newest finished jobs and every unfinished one
+func TestRecordingQueuePrune(t *testing.T) {
+	q := &RecordingQueue{nextID: 1, running: true}
+	q.Enqueue(&RecordingJob{})
+	q.next()
+	for range maxFinishedJobs + 5 {
+		q.Enqueue(&RecordingJob{})
+	}
+	for q.Pending() > 0 {
+		q.Complete(q.next().ID, "")
+	}
+	q.Enqueue(&RecordingJob{})
+	q.running = true
+	q.prune()
+
+	if len(q.jobs) != maxFinishedJobs+2 {
+		t.Fatalf("%d jobs kept, want %d", len(q.jobs), maxFinishedJobs+2)
+	}
+	if j := q.jobs[0]; j.ID != "rec-1" || j.State != JobRunning {
+		t.Errorf("running job %s:%s pruned", j.ID, j.State)
+	}
+	if j := q.jobs[1]; j.ID != "rec-7" {
+		t.Errorf("oldest kept job %s, want rec-7", j.ID)
+	}
+	if j := q.jobs[len(q.jobs)-1]; j.State != JobQueued {
+		t.Errorf("queued job %s:%s pruned", j.ID, j.State)
+	}
+}
+
+// TestStopActiveRecording only stops the job it was asked to
+func TestStopActiveRecording(t *testing.T) {
+	serverState.mu.Lock()
+	serverState.Recording = true
+	serverState.RecordingJobID = "rec-2"
+	serverState.mu.Unlock()
+	defer func() {
+		serverState.mu.Lock()
+		serverState.Recording = false
+		serverState.RecordingJobID = ""
+		serverState.mu.Unlock()
+	}()
+
+	stopActiveRecording("rec-1")
+	if !serverState.Recording {
+		t.Fatal("stopping a finished job stopped its successor")
+	}
+	stopActiveRecording("rec-2")
+	if serverState.Recording {
+		t.Error("running job not stopped")
+	}
+}
@@ -3,7 +3,9 @@
 package main
 
 import (
+	"encoding/binary"
 	"log"
+	"path/filepath"
 	"time"
 
 	"github.com/dma/pkg/shm_ring"
@@ -27,6 +29,8 @@ func performShmRecording() {
 	shmName := serverState.SHMName
 	samplesTotal := serverState.RecordingSamples
 	recChannels := serverState.RecordingChannels
+	jobID := serverState.RecordingJobID
+	hopPlan := serverState.RecordingHop
 	serverState.mu.RUnlock()
 
 	log.Printf("Opening SHM ring %s for recording...", shmName)
@@ -58,8 +62,17 @@ func performShmRecording() {
 	ringData := ring.Data()
 	ringTotal := ring.Total()
 
+	// Apply the first hop step before capture so it starts settled
+	hop := newHopper(hopPlan)
+
 	// Start reading from the current Head
 	currentPos := ring.GetHead()
+	cursor := ringCursor{last: currentPos, total: ringTotal}
+
+	// Stream position in samples since capture start, based on the producer's head
+	streamPosition := func() int64 {
+		return int64(cursor.update(ring.GetHead()) / inputBlockSize)
+	}
 
 	for samplesRecorded < samplesTotal {
 		serverState.mu.RLock()
@@ -70,6 +83,7 @@ func performShmRecording() {
 		serverState.mu.RUnlock()
 
 		head := ring.GetHead()
+		cursor.update(head)
 
 		// Calculate how many bytes are available to read
 		var available uint64
@@ -119,9 +133,12 @@ func performShmRecording() {
 		serverState.RecordingCurrent = samplesRecorded
 		serverState.mu.Unlock()
 
+		hop.Advance(streamPosition)
+
 		if samplesRecorded-lastBroadcast > 100000 {
 			go broadcastJSON(map[string]interface{}{
 				"type":    "recording_progress",
+				"job_id":  jobID,
 				"current": samplesRecorded,
 				"total":   samplesTotal,
 			})
@@ -129,7 +146,24 @@ func performShmRecording() {
 		}
 	}
 
-	processAndWrite(captureData, samplesRecorded, recChannels, captureStart)
+	processAndWrite(captureData, samplesRecorded, recChannels, captureStart, hop)
+}
+
+// ringCursor counts the bytes the producer has written since capture start
+// across any number of ring wraps. It must see the head at least once per
+// ring period, which the recording loop does on every iteration.
+type ringCursor struct {
+	last    uint64 // Head at the previous update
+	total   uint64 // Ring size
+	written uint64
+}
+
+// update accounts for the producer's progress up to head and returns the
+// bytes written since the cursor was created
+func (c *ringCursor) update(head uint64) uint64 {
+	c.written += (head + c.total - c.last) % c.total
+	c.last = head
+	return c.written
 }
 
 func performXdmRecording() {
@@ -141,6 +175,8 @@ func performXdmRecording() {
 	devicePath := serverState.DevicePath
 	samplesTotal := serverState.RecordingSamples
 	recChannels := serverState.RecordingChannels
+	jobID := serverState.RecordingJobID
+	hopPlan := serverState.RecordingHop
 	serverState.mu.RUnlock()
 
 	if devicePath == "" {
@@ -178,6 +214,9 @@ func performXdmRecording() {
 
 	log.Printf("Capturing %d samples (%d MB) from XDMA into RAM...", samplesTotal, totalBytes/(1024*1024))
 
+	// Apply the first hop step before capture so it starts settled
+	hop := newHopper(hopPlan)
+
 	samplesRecorded := 0
 	lastBroadcast := 0
 	captureStart := time.Now()
@@ -186,6 +225,10 @@ func performXdmRecording() {
 	lastLogTime := time.Now()
 	var bytesReadSinceLastLog int64
 
+	// Without a producer head, the stream position is what we have read so far;
+	// data still buffered in the driver is covered by the hop plan's settle_samples
+	streamPosition := func() int64 { return int64(samplesRecorded) }
+
 	// PHASE 1: Fast capture into RAM (all channels, no filtering)
 	for samplesRecorded < samplesTotal {
 		// Check if stopped externally
@@ -235,10 +278,13 @@ func performXdmRecording() {
 		serverState.RecordingCurrent = samplesRecorded
 		serverState.mu.Unlock()
 
+		hop.Advance(streamPosition)
+
 		// Broadcast progress every 100k samples
 		if samplesRecorded-lastBroadcast > 100000 {
 			go broadcastJSON(map[string]interface{}{
 				"type":    "recording_progress",
+				"job_id":  jobID,
 				"current": samplesRecorded,
 				"total":   samplesTotal,
 			})
@@ -252,10 +298,10 @@ func performXdmRecording() {
 		samplesRecorded = samplesTotal
 	}
 
-	processAndWrite(captureData, samplesRecorded, recChannels, captureStart)
+	processAndWrite(captureData, samplesRecorded, recChannels, captureStart, hop)
 }
 
-func processAndWrite(captureData []byte, samplesRecorded int, recChannels []int, captureStart time.Time) {
+func processAndWrite(captureData []byte, samplesRecorded int, recChannels []int, captureStart time.Time, hop *hopper) {
 	const numChannels = 8
 	const bytesPerSample = 4
 	const inputBlockSize = numChannels * bytesPerSample
@@ -270,11 +316,44 @@ func processAndWrite(captureData []byte, samplesRecorded int, recChannels []int,
 		return
 	}
 	f := serverState.RecordingFileHandle
+	filename := serverState.RecordingFile
+	recBeams := serverState.RecordingBeams
+	iqCal := serverState.RecordingIQ
+	dc := serverState.RecordingDC
+	aligner := serverState.RecordingAligner
+	chz := serverState.RecordingChannelizer
 	serverState.mu.RUnlock()
 
-	// Determine active channels for filtering
+	capturedBytes := len(captureData)
+
+	// Close the hop timeline and optionally cut out the retune transitions
+	timeline := hop.Finish(int64(samplesRecorded))
+	if hop != nil && hop.plan.ExcludeTransitions {
+		captureData, timeline = dropTransitions(captureData, inputBlockSize, timeline)
+		samplesRecorded = len(captureData) / inputBlockSize
+		log.Printf("Excluded hop transitions, %d samples remain", samplesRecorded)
+	}
+
+	// ADC statistics of the raw codes
+	adc := adcFrameStats(captureData, []int{1, 2, 3, 4, 5, 6, 7, 8}, currentADCConfig())
+
+	// Alignment, DC removal and IQ correction are applied before beams are
+	// formed from the receiver channels
+	if aligner != nil {
+		captureData = aligner.alignFrames(captureData)
+		samplesRecorded = len(captureData) / inputBlockSize
+	}
+	if dc != nil {
+		removeDCFrames(captureData, dc)
+	}
+	if iqCal != nil {
+		correctIQFrames(captureData, iqCal)
+	}
+
+	// Determine active channels for filtering; beams (8-15) are formed after them
 	activeMask := [numChannels]bool{}
 	activeCount := 0
+	var beamWeights [][8]complex128
 
 	for _, idx := range recChannels {
 		if idx >= 0 && idx < numChannels {
@@ -282,18 +361,22 @@ func processAndWrite(captureData []byte, samplesRecorded int, recChannels []int,
 				activeMask[idx] = true
 				activeCount++
 			}
+		} else if k := idx - numChannels; k >= 0 && k < len(recBeams) {
+			beamWeights = append(beamWeights, recBeams[k])
 		}
 	}
 
 	// If no channels specified, default to all (safety)
-	if activeCount == 0 {
+	if activeCount == 0 && len(beamWeights) == 0 {
 		for i := 0; i < numChannels; i++ {
 			activeMask[i] = true
 		}
 		activeCount = numChannels
 	}
 
-	log.Printf("Filtering to %d channels and writing to file...", activeCount)
+	if chz == nil {
+		log.Printf("Filtering to %d channels and %d beams and writing to file...", activeCount, len(beamWeights))
+	}
 
 	// Pre-calculate offsets to copy
 	type copyOp struct {
@@ -308,10 +391,21 @@ func processAndWrite(captureData []byte, samplesRecorded int, recChannels []int,
 			dstOff += bytesPerSample
 		}
 	}
-	outputBlockSize := activeCount * bytesPerSample
+	outputBlockSize := (activeCount + len(beamWeights)) * bytesPerSample
 
-	// If all channels are active, just write directly
-	if activeCount == numChannels {
+	// Sub-channel recordings hold only the channelizer outputs; otherwise,
+	// if all channels are active, just write directly
+	if chz != nil {
+		writeStart := time.Now()
+		subData := chz.frames(captureData)
+		samplesRecorded = len(subData) / (len(chz.subs) * bytesPerSample)
+		if _, err := f.Write(subData); err != nil {
+			log.Printf("Recording write error: %v", err)
+			cleanupRecording(err.Error())
+			return
+		}
+		log.Printf("Channelized to %d sub-channels and wrote in %v", len(chz.subs), time.Since(writeStart))
+	} else if activeCount == numChannels && len(beamWeights) == 0 {
 		writeStart := time.Now()
 		if _, err := f.Write(captureData); err != nil {
 			log.Printf("Recording write error: %v", err)
@@ -339,6 +433,19 @@ func processAndWrite(captureData []byte, samplesRecorded int, recChannels []int,
 				filteredData[wIdx+3] = captureData[src+3]
 				wIdx += 4
 			}
+			for _, w := range beamWeights {
+				var v complex128
+				for ch := 0; ch < numChannels; ch++ {
+					if w[ch] != 0 {
+						src := baseSrc + ch*bytesPerSample
+						x := complex(float64(int16(binary.LittleEndian.Uint16(captureData[src:]))), float64(int16(binary.LittleEndian.Uint16(captureData[src+2:]))))
+						v += w[ch] * x
+					}
+				}
+				binary.LittleEndian.PutUint16(filteredData[wIdx:], uint16(clampInt16(real(v))))
+				binary.LittleEndian.PutUint16(filteredData[wIdx+2:], uint16(clampInt16(imag(v))))
+				wIdx += 4
+			}
 		}
 
 		// Write filtered data to file
@@ -352,6 +459,28 @@ func processAndWrite(captureData []byte, samplesRecorded int, recChannels []int,
 		log.Printf("Filter and write complete in %v", writeDuration)
 	}
 
+	// Alignment drops the lead samples and the channelizer decimates, so the
+	// timeline moves to the written samples
+	if len(timeline) > 0 {
+		shift, decim := 0.0, 1
+		if aligner != nil {
+			shift = aligner.referenceLead()
+		}
+		if chz != nil {
+			shift, decim = shift+chz.c.delay(), chz.c.m
+		}
+		timeline = remapTimeline(timeline, shift, decim, int64(samplesRecorded))
+	}
+
+	err := updateCaptureMetadata(filepath.Join(dataFolder, filename), func(m *CaptureMetadata) {
+		m.finishCapture(int64(samplesRecorded), captureDuration, capturedBytes)
+		m.HopTimeline = timeline
+		m.ADC = adc
+	})
+	if err != nil {
+		log.Printf("Failed to update metadata: %v", err)
+	}
+
 	log.Printf("Recording finished. Total samples: %d", samplesRecorded)
 	cleanupRecording("")
 }
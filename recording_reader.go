@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// recordingReader reads selected channels of a raw cs16 recording in chunks,
+// so analysis of long recordings never loads the whole file
+type recordingReader struct {
+	f           *os.File
+	meta        *CaptureMetadata
+	channels    []int          // Requested user-facing channels (1-16)
+	slots       []int          // Slot of each requested channel within a frame; -1 for formed beams
+	beams       [][]complex128 // Weight per slot for each requested channel formed as a beam
+	frameSize   int64
+	totalFrames int64
+	position    int64
+
+	buf []byte
+	// I and Q hold the samples from the last Read, one slice per requested channel
+	I [][]int16
+	Q [][]int16
+}
+
+// openRecording opens a recording for reading the given user-facing channels
+// (1-16); empty means every channel in the file. Beam channels that were not
+// recorded are formed from the recorded receiver channels using the active
+// beams, steered at the recording's DDC frequency.
+func openRecording(path string, channels []int) (*recordingReader, error) {
+	// Without metadata, assume a legacy full 8-channel capture
+	meta, err := loadCaptureMetadata(path)
+	if err != nil {
+		meta = &CaptureMetadata{SampleRate: captureSampleRate, Channels: []int{1, 2, 3, 4, 5, 6, 7, 8}}
+	}
+	if meta.Format != "" && meta.Format != FormatCS16 {
+		return nil, fmt.Errorf("recording is %s; only raw cs16 recordings can be analyzed", meta.Format)
+	}
+	srcChannels := meta.Channels
+	if len(srcChannels) == 0 {
+		srcChannels = []int{1, 2, 3, 4, 5, 6, 7, 8}
+	}
+	if len(channels) == 0 {
+		channels = srcChannels
+	}
+
+	r := &recordingReader{meta: meta, channels: channels, frameSize: int64(len(srcChannels) * 4)}
+	for _, ch := range channels {
+		slot := -1
+		for i, srcCh := range srcChannels {
+			if srcCh == ch {
+				slot = i
+			}
+		}
+		var weights []complex128
+		if slot < 0 {
+			if weights, err = recordingBeamWeights(meta, srcChannels, ch); err != nil {
+				return nil, err
+			}
+		}
+		r.slots = append(r.slots, slot)
+		r.beams = append(r.beams, weights)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.f = f
+	r.totalFrames = info.Size() / r.frameSize
+	r.I = make([][]int16, len(channels))
+	r.Q = make([][]int16, len(channels))
+	return r, nil
+}
+
+// Close closes the underlying file
+func (r *recordingReader) Close() error {
+	return r.f.Close()
+}
+
+// powerCurve returns the power calibration of a user-facing channel in the
+// configuration the recording was made in
+func (r *recordingReader) powerCurve(ch int) *powerCurve {
+	return recordingPowerCalContext(r.meta).channelCurve(ch, r.meta.Channelizer)
+}
+
+// Frames returns the number of complete frames (samples per channel) in the file
+func (r *recordingReader) Frames() int64 {
+	return r.totalFrames
+}
+
+// SeekFrame moves to the given frame
+func (r *recordingReader) SeekFrame(frame int64) error {
+	if frame < 0 || frame > r.totalFrames {
+		return fmt.Errorf("sample %d outside recording (0-%d)", frame, r.totalFrames)
+	}
+	if _, err := r.f.Seek(frame*r.frameSize, io.SeekStart); err != nil {
+		return err
+	}
+	r.position = frame
+	return nil
+}
+
+// Read reads up to n frames into I and Q and returns the number read.
+// Returns io.EOF once no frames remain.
+func (r *recordingReader) Read(n int) (int, error) {
+	if remaining := r.totalFrames - r.position; int64(n) > remaining {
+		n = int(remaining)
+	}
+	if n <= 0 {
+		return 0, io.EOF
+	}
+
+	size := int64(n) * r.frameSize
+	if int64(cap(r.buf)) < size {
+		r.buf = make([]byte, size)
+	}
+	chunk := r.buf[:size]
+	if _, err := io.ReadFull(r.f, chunk); err != nil {
+		return 0, fmt.Errorf("read failed: %w", err)
+	}
+	r.position += int64(n)
+
+	for k, slot := range r.slots {
+		if cap(r.I[k]) < n {
+			r.I[k] = make([]int16, n)
+			r.Q[k] = make([]int16, n)
+		}
+		r.I[k], r.Q[k] = r.I[k][:n], r.Q[k][:n]
+		if slot < 0 {
+			r.formBeam(k, chunk, n)
+			continue
+		}
+		for f := 0; f < n; f++ {
+			off := int64(f)*r.frameSize + int64(slot*4)
+			r.I[k][f] = int16(binary.LittleEndian.Uint16(chunk[off:]))
+			r.Q[k][f] = int16(binary.LittleEndian.Uint16(chunk[off+2:]))
+		}
+	}
+	return n, nil
+}
+
+// formBeam fills requested channel k from the weighted receiver slots
+func (r *recordingReader) formBeam(k int, chunk []byte, n int) {
+	for f := 0; f < n; f++ {
+		var v complex128
+		for slot, w := range r.beams[k] {
+			if w != 0 {
+				off := int64(f)*r.frameSize + int64(slot*4)
+				x := complex(float64(int16(binary.LittleEndian.Uint16(chunk[off:]))), float64(int16(binary.LittleEndian.Uint16(chunk[off+2:]))))
+				v += w * x
+			}
+		}
+		r.I[k][f], r.Q[k][f] = clampInt16(real(v)), clampInt16(imag(v))
+	}
+}
+
+// recordingBeamWeights maps an active beam's weights onto a recording's frame
+// slots, for a beam channel the recording doesn't contain
+func recordingBeamWeights(meta *CaptureMetadata, srcChannels []int, ch int) ([]complex128, error) {
+	k := ch - beamChannelBase
+	serverState.mu.RLock()
+	beams, g, ddcHz := serverState.Beams, serverState.Array, serverState.DDCFreqMHz*1e6
+	serverState.mu.RUnlock()
+	if k < 0 || k >= len(beams) {
+		return nil, fmt.Errorf("channel %d is not in the recording", ch)
+	}
+	if meta.Config != nil && meta.Config.DDC0FreqMHz != nil {
+		ddcHz = float64(*meta.Config.DDC0FreqMHz) * 1e6
+	}
+	w, err := beams[k].weights(g, ddcHz)
+	if err != nil {
+		return nil, fmt.Errorf("beam channel %d: %v", ch, err)
+	}
+
+	slotWeights := make([]complex128, len(srcChannels))
+	for idx, wc := range w {
+		if wc == 0 {
+			continue
+		}
+		found := false
+		for slot, srcCh := range srcChannels {
+			if srcCh == idx+1 {
+				slotWeights[slot] = wc
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("beam channel %d needs channel %d, which is not in the recording", ch, idx+1)
+		}
+	}
+	return slotWeights, nil
+}
@@ -8,7 +8,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dma/pkg/dma"
@@ -29,6 +31,13 @@ type Client struct {
 	conn     *websocket.Conn
 	send     chan interface{}
 	channels []string
+	mode     string          // Stream mode requested by this client
+	spectrum *clientSpectrum // Server-side spectrum state (spectrum mode)
+	spectrogram *clientSpectrogram // Spectrogram subscription, if any
+	measure  *clientMeasure  // Live measurement subscription, if any
+	coherence *clientCoherence // Live inter-channel coherence subscription, if any
+	doa      *clientDOA      // Live direction-of-arrival subscription, if any
+	audio    bool            // Receives demodulated audio frames
 	mu       sync.Mutex
 }
 
@@ -66,6 +75,7 @@ func runShmProducerLoop() {
 	serverState.mu.RLock()
 	devicePath := serverState.DevicePath
 	shmName := serverState.SHMName
+	engines := serverState.DMAEngines
 	serverState.mu.RUnlock()
 
 	log.Printf("Starting Integrated SHM Producer: %s -> %s", devicePath, shmName)
@@ -81,6 +91,11 @@ func runShmProducerLoop() {
 	}
 	defer ring.Close()
 
+	if len(engines) > 0 && !dma.IsDefaultLayout(engines) {
+		runShmEngineProducer(ring, engines)
+		return
+	}
+
 	fd, err := unix.Open(devicePath, unix.O_RDONLY, 0)
 	if err != nil {
 		log.Printf("Failed to open XDMA: %v", err)
@@ -167,6 +182,230 @@ func runShmProducerLoop() {
 	}
 }
 
+// maxEngineReadErrors stops an engine after this many consecutive failed reads
+const maxEngineReadErrors = 50
+
+// engineReadTimeout stops an engine whose block read blocks for longer, so
+// one stalled engine can't hold up the others
+const engineReadTimeout = 5 * time.Second
+
+// ShmEngineState reports one C2H engine of the SHM producer
+type ShmEngineState struct {
+	DevicePath string  `json:"device_path"`
+	Channels   []int   `json:"channels"` // Channel indices (0-7) in on-wire order
+	Running    bool    `json:"running"`
+	BytesRead  int64   `json:"bytes_read"`
+	Throughput float64 `json:"throughput_mbps"` // MB/s over the last rate interval
+	Errors     int     `json:"errors"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+// shmEngines holds the engine states of the running multi-engine producer
+var shmEngines struct {
+	mu     sync.Mutex
+	states []ShmEngineState
+}
+
+// shmEngineStates returns a copy of the per-engine producer states
+func shmEngineStates() []ShmEngineState {
+	shmEngines.mu.Lock()
+	defer shmEngines.mu.Unlock()
+	return append([]ShmEngineState(nil), shmEngines.states...)
+}
+
+// runShmEngineProducer reads several C2H engines concurrently and merges
+// their channels into standard 8-channel frames in the SHM ring. An engine
+// that keeps failing is stopped and its channels are zero-filled; the
+// producer exits once no engine is left.
+func runShmEngineProducer(ring *shm_ring.ShmRing, engines []dma.EngineConfig) {
+	const blockFrames = 128 * 1024 // Frames per engine read (4MB of merged data)
+
+	type engineReader struct {
+		cfg     dma.EngineConfig
+		fd      int
+		full    chan []byte // Closed when the engine stops
+		free    chan []byte
+		bytes   int64 // Updated atomically by the reader goroutine
+		stopped bool  // Owned by the merge loop
+	}
+
+	readers := make([]*engineReader, len(engines))
+	for i, e := range engines {
+		fd, err := unix.Open(e.DevicePath, unix.O_RDONLY, 0)
+		if err != nil {
+			log.Printf("Failed to open XDMA engine %s: %v", e.DevicePath, err)
+			for _, r := range readers[:i] {
+				unix.Close(r.fd)
+			}
+			return
+		}
+		r := &engineReader{cfg: e, fd: fd, full: make(chan []byte, 2), free: make(chan []byte, 2)}
+		for b := 0; b < 2; b++ {
+			r.free <- make([]byte, blockFrames*e.FrameSize())
+		}
+		readers[i] = r
+	}
+	// Closing free ends the reader goroutines once their current read
+	// returns; closing the descriptors ends reads that are still blocked
+	defer func() {
+		for _, r := range readers {
+			close(r.free)
+			unix.Close(r.fd)
+		}
+	}()
+
+	shmEngines.mu.Lock()
+	shmEngines.states = make([]ShmEngineState, len(engines))
+	for i, e := range engines {
+		shmEngines.states[i] = ShmEngineState{DevicePath: e.DevicePath, Channels: e.Channels, Running: true}
+	}
+	shmEngines.mu.Unlock()
+	defer func() {
+		shmEngines.mu.Lock()
+		for i := range shmEngines.states {
+			shmEngines.states[i].Running = false
+			shmEngines.states[i].Throughput = 0
+		}
+		shmEngines.mu.Unlock()
+	}()
+
+	// One goroutine per engine keeps each DMA queue busy independently
+	for i, r := range readers {
+		go func(i int, r *engineReader) {
+			defer close(r.full)
+			failures := 0
+			for buf := range r.free {
+				total := 0
+				for total < len(buf) {
+					n, err := unix.Read(r.fd, buf[total:])
+					if err != nil {
+						if err == unix.EINTR {
+							continue
+						}
+						failures++
+						shmEngines.mu.Lock()
+						shmEngines.states[i].Errors++
+						shmEngines.states[i].LastError = err.Error()
+						if failures >= maxEngineReadErrors {
+							shmEngines.states[i].Running = false
+						}
+						shmEngines.mu.Unlock()
+						if failures >= maxEngineReadErrors {
+							log.Printf("SHM Producer stopping %s after %d consecutive read errors: %v", r.cfg.DevicePath, failures, err)
+							return
+						}
+						log.Printf("SHM Producer read error on %s: %v", r.cfg.DevicePath, err)
+						time.Sleep(100 * time.Millisecond)
+						continue
+					}
+					failures = 0
+					if n == 0 {
+						time.Sleep(1 * time.Millisecond)
+						continue
+					}
+					total += n
+				}
+				atomic.AddInt64(&r.bytes, int64(total))
+				r.full <- buf
+			}
+		}(i, r)
+	}
+
+	log.Printf("SHM Producer merging %d C2H engines", len(readers))
+
+	ringData := ring.Data()
+	ringTotal := ring.Total()
+	srcs := make([][]byte, len(readers))
+	lastBytes := make([]int64, len(readers))
+	lastLogTime := time.Now()
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			duration := now.Sub(lastLogTime).Seconds()
+			var total float64
+			parts := make([]string, len(readers))
+			shmEngines.mu.Lock()
+			for i, r := range readers {
+				b := atomic.LoadInt64(&r.bytes)
+				rate := float64(b-lastBytes[i]) / duration / (1024 * 1024 * 1024)
+				parts[i] = fmt.Sprintf("%s %.2f GB/s", r.cfg.DevicePath, rate)
+				if r.stopped {
+					parts[i] = r.cfg.DevicePath + " stopped"
+				}
+				total += rate
+				lastBytes[i] = b
+				shmEngines.states[i].BytesRead = b
+				shmEngines.states[i].Throughput = rate * 1024
+			}
+			shmEngines.mu.Unlock()
+			log.Printf("SHM Rate: %.2f GB/s [%s], Offset: %d", total, strings.Join(parts, ", "), ring.GetHead())
+			lastLogTime = now
+		default:
+		}
+
+		// Interleave zero-fills the channels of stopped engines
+		var active []dma.EngineConfig
+		for i, r := range readers {
+			if r.stopped {
+				continue
+			}
+			var buf []byte
+			ok := false
+			select {
+			case buf, ok = <-r.full:
+			case <-time.After(engineReadTimeout):
+				log.Printf("SHM Producer stopping %s: no data for %v", r.cfg.DevicePath, engineReadTimeout)
+				shmEngines.mu.Lock()
+				shmEngines.states[i].Running = false
+				shmEngines.states[i].LastError = fmt.Sprintf("read timed out after %v", engineReadTimeout)
+				shmEngines.mu.Unlock()
+			}
+			if !ok {
+				r.stopped = true
+				continue
+			}
+			srcs[i] = buf
+			active = append(active, r.cfg)
+		}
+		if len(active) == 0 {
+			log.Printf("SHM Producer: all %d C2H engines stopped", len(readers))
+			return
+		}
+
+		// Merge block by block, splitting at the end of the ring
+		frames := 0
+		chunk := make([][]byte, 0, len(srcs))
+		for frames < blockFrames {
+			head := ring.GetHead()
+			spaceFrames := int((ringTotal - head) / dma.BytesPerFrame)
+			n := blockFrames - frames
+			if n > spaceFrames {
+				n = spaceFrames
+			}
+			chunk = chunk[:0]
+			for i, r := range readers {
+				if !r.stopped {
+					fs := r.cfg.FrameSize()
+					chunk = append(chunk, srcs[i][frames*fs:(frames+n)*fs])
+				}
+			}
+			written := dma.Interleave(ringData[head:head+uint64(n*dma.BytesPerFrame)], chunk, active)
+			ring.AdvanceHead(uint64(written * dma.BytesPerFrame))
+			frames += written
+		}
+
+		for i, r := range readers {
+			if !r.stopped {
+				r.free <- srcs[i]
+			}
+		}
+	}
+}
+
 func runServer(port int, devicePath string, targetSize int) {
 	commandDevice := "/dev/xdma0_user"
 
@@ -176,10 +415,14 @@ func runServer(port int, devicePath string, targetSize int) {
 	// Define config for 100MB read check
 	var mask [8]bool
 	mask[0] = true // Enable channel 1
+	serverState.mu.RLock()
+	engines := serverState.DMAEngines
+	serverState.mu.RUnlock()
 	chkCfg := dma.CaptureConfig{
 		DevicePath:  devicePath,
 		TargetSize:  100 * 1024 * 1024, // 100MB
 		ChannelMask: mask,
+		Engines:     engines,
 	}
 
 	done := make(chan error, 1)
@@ -286,6 +529,38 @@ func runServer(port int, devicePath string, targetSize int) {
 	http.HandleFunc("/api/record/start", handleRecordStart)
 	http.HandleFunc("/api/record/stop", handleRecordStop)
 	http.HandleFunc("/api/record/status", handleRecordStatus)
+	http.HandleFunc("/api/record/cancel", handleRecordCancel)
+	http.HandleFunc("/api/export", handleExport)
+	http.HandleFunc("/api/export/download", handleExportDownload)
+	http.HandleFunc("/api/spectrum/windows", handleSpectrumWindows)
+	http.HandleFunc("/api/spectrogram/png", handleSpectrogramPNG)
+	http.HandleFunc("/api/spectrogram/rows", handleSpectrogramRows)
+	http.HandleFunc("/api/measure", handleMeasure)
+	http.HandleFunc("/api/dynamic", handleDynamics)
+	http.HandleFunc("/api/iq/estimate", handleIQEstimate)
+	http.HandleFunc("/api/iq/correction", handleIQCorrection)
+	http.HandleFunc("/api/dc", handleDC)
+	http.HandleFunc("/api/delay/estimate", handleDelayEstimate)
+	http.HandleFunc("/api/delay/alignment", handleAlignment)
+	http.HandleFunc("/api/coherence", handleCoherence)
+	http.HandleFunc("/api/array", handleArray)
+	http.HandleFunc("/api/doa", handleDOA)
+	http.HandleFunc("/api/beams", handleBeams)
+	http.HandleFunc("/api/beams/sets", handleBeamSets)
+	http.HandleFunc("/api/beams/save", handleBeamSave)
+	http.HandleFunc("/api/beams/load", handleBeamLoad)
+	http.HandleFunc("/api/channelizer", handleChannelizer)
+	http.HandleFunc("/api/detector", handleDetector)
+	http.HandleFunc("/api/emitters", handleEmitters)
+	http.HandleFunc("/api/pdw", handlePDW)
+	http.HandleFunc("/api/pdw/log", handlePDWLog)
+	http.HandleFunc("/api/pdw/recording", handlePDWRecording)
+	http.HandleFunc("/api/modulation", handleModulation)
+	http.HandleFunc("/api/modulation/measure", handleModulationMeasure)
+	http.HandleFunc("/api/demod", handleDemod)
+	http.HandleFunc("/api/adc", handleADC)
+	http.HandleFunc("/api/stats", handleStats)
+	http.HandleFunc("/api/power/calibration", handlePowerCalibration)
 
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		conn, err := upgrader.Upgrade(w, r, nil)
@@ -304,6 +579,7 @@ func runServer(port int, devicePath string, targetSize int) {
 
 		if shouldStart { 
 			go runGlobalStreamLoop(devicePath) 
+			startStats()
 
 			if hwAvailable {
 				serverState.mu.RLock()
@@ -317,6 +593,7 @@ func runServer(port int, devicePath string, targetSize int) {
 
 		go client.writePump()
 		defer func() {
+			stopClientSpectrogram(client)
 			wsClientsMu.Lock()
 			delete(wsClients, client)
 			wsClientsMu.Unlock()
@@ -333,8 +610,76 @@ func runServer(port int, devicePath string, targetSize int) {
 				FFTSize  int      `json:"fft_size"`
 				Type     string   `json:"type"`
 				Enabled  *bool    `json:"enabled"`
+				Spectrum *SpectrumSettings `json:"spectrum"`
+				Spectrogram *SpectrogramOptions `json:"spectrogram"`
+				Measure  *MeasureOptions   `json:"measure"`
+				Coherence *CoherenceOptions `json:"coherence"`
+				DOA      *DOAOptions       `json:"doa"`
 			}
 			if err := json.Unmarshal(msg, &config); err == nil {
+				client.mu.Lock()
+				if config.Mode != "" { client.mode = config.Mode }
+				if config.Spectrum != nil {
+					if err := config.Spectrum.Validate(); err != nil {
+						client.mu.Unlock()
+						select {
+						case client.send <- map[string]string{"type": "spectrum_error", "error": err.Error()}:
+						default:
+						}
+						continue
+					}
+					client.spectrum = newClientSpectrum(*config.Spectrum)
+				}
+				if config.Type == "spectrum_reset" && client.spectrum != nil {
+					client.spectrum.Reset()
+				}
+				if config.Type == "audio" && config.Enabled != nil {
+					client.audio = *config.Enabled
+				}
+				client.mu.Unlock()
+
+				if config.Type == "spectrogram" {
+					if config.Spectrogram == nil {
+						stopClientSpectrogram(client)
+					} else if err := startClientSpectrogram(client, *config.Spectrogram); err != nil {
+						select {
+						case client.send <- map[string]string{"type": "spectrogram_error", "error": err.Error()}:
+						default:
+						}
+					}
+					continue
+				}
+
+				if config.Type == "measure" {
+					if err := startClientMeasure(client, config.Measure); err != nil {
+						select {
+						case client.send <- map[string]string{"type": "measure_error", "error": err.Error()}:
+						default:
+						}
+					}
+					continue
+				}
+
+				if config.Type == "doa" {
+					if err := startClientDOA(client, config.DOA); err != nil {
+						select {
+						case client.send <- map[string]string{"type": "doa_error", "error": err.Error()}:
+						default:
+						}
+					}
+					continue
+				}
+
+				if config.Type == "coherence" {
+					if err := startClientCoherence(client, config.Coherence); err != nil {
+						select {
+						case client.send <- map[string]string{"type": "coherence_error", "error": err.Error()}:
+						default:
+						}
+					}
+					continue
+				}
+
 				if len(config.Channels) > 0 {
 					client.mu.Lock()
 					client.channels = config.Channels
@@ -349,7 +694,7 @@ func runServer(port int, devicePath string, targetSize int) {
 				}
 				if config.Mode != "" { serverState.StreamMode = config.Mode }
 				if config.FPS > 0 { serverState.StreamFPS = config.FPS }
-				if config.FFTSize > 0 { serverState.FFTSize = config.FFTSize }
+				if config.FFTSize > 0 && checkFFTSize(config.FFTSize) == nil { serverState.FFTSize = config.FFTSize }
 				serverState.mu.Unlock()
 			}
 		}
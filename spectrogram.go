@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"path/filepath"
+)
+
+// spectrogramRowMarker starts a compact spectrogram row on the WebSocket
+const spectrogramRowMarker = 0xF1
+
+// Spectrogram size limits: every row holds FFTSize bins, and a PNG keeps
+// up to spectrogramMaxValues bins in memory before rendering
+const (
+	maxSpectrogramFFTSize = 1 << 16
+	maxSpectrogramRows    = 8192
+	spectrogramMaxValues  = 1 << 24
+)
+
+// SpectrogramOptions configures a spectrogram from live data or a recording
+type SpectrogramOptions struct {
+	Channel     int     `json:"channel"`      // User-facing channel (1-8, beams 9-16, sub-channels 17-80)
+	FFTSize     int     `json:"fft_size"`     // Default 1024, at most 65536
+	Overlap     float64 `json:"overlap"`      // Fraction of each FFT shared with the next, 0-0.95
+	TimeResMS   float64 `json:"time_res_ms"`  // Time per row; FFTs within a row are power-averaged. 0 = one FFT per row
+	Window      string  `json:"window"`       // See fft.ParseWindow, default blackman
+	WindowParam float64 `json:"window_param"` // Kaiser beta or Gaussian sigma
+	MinDB       float64 `json:"min_db"`       // Bottom of the color/quantization scale, default -120
+	MaxDB       float64 `json:"max_db"`       // Top of the color/quantization scale, default 0
+
+	// Recording source; empty Filename means live data
+	Filename    string `json:"filename"`
+	StartSample int64  `json:"start_sample"`
+	Samples     int64  `json:"samples"` // 0 = to end of file
+}
+
+// Validate checks the options, fills in defaults and returns the spectrum options
+func (o *SpectrogramOptions) Validate() (SpectrumOptions, error) {
+	if o.Channel < 1 || o.Channel > maxChannel {
+		return SpectrumOptions{}, fmt.Errorf("channel must be between 1 and %d", maxChannel)
+	}
+	if o.FFTSize == 0 {
+		o.FFTSize = 1024
+	}
+	if o.FFTSize > maxSpectrogramFFTSize {
+		return SpectrumOptions{}, fmt.Errorf("fft_size must be at most %d", maxSpectrogramFFTSize)
+	}
+	if o.Overlap < 0 || o.Overlap > 0.95 {
+		return SpectrumOptions{}, fmt.Errorf("overlap must be between 0 and 0.95")
+	}
+	if o.TimeResMS < 0 {
+		return SpectrumOptions{}, fmt.Errorf("time_res_ms must not be negative")
+	}
+	if o.MinDB == 0 && o.MaxDB == 0 {
+		o.MinDB, o.MaxDB = -120, 0
+	}
+	if o.MaxDB <= o.MinDB {
+		return SpectrumOptions{}, fmt.Errorf("max_db must be above min_db")
+	}
+	if o.Filename != "" {
+		o.Filename = filepath.Base(o.Filename)
+	}
+	return parseSpectrumOptions(o.FFTSize, o.Window, o.WindowParam, ScalingTone)
+}
+
+// hop returns the number of samples between FFT starts
+func (o *SpectrogramOptions) hop() int {
+	hop := int(float64(o.FFTSize) * (1 - o.Overlap))
+	if hop < 1 {
+		hop = 1
+	}
+	return hop
+}
+
+// fftsPerRow returns how many FFTs are averaged into each row
+func (o *SpectrogramOptions) fftsPerRow() int {
+	n := int(math.Round(o.TimeResMS / 1000 * captureSampleRate / float64(o.hop())))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// spectrogramBuilder turns a sample stream into power-averaged rows
+type spectrogramBuilder struct {
+	opts   SpectrumOptions
+	hop    int
+	perRow int
+
+	tailI, tailQ []int16 // Samples not yet consumed by an FFT
+	tailStart    int64   // Stream position of tailI[0]
+	power        []float64
+	acc          []float64
+	count        int
+	rowStart     int64
+
+	// emit receives each finished row in dBm and its first sample; an
+	// error stops the builder
+	emit func(row []float64, startSample int64) error
+}
+
+func newSpectrogramBuilder(o *SpectrogramOptions, opts SpectrumOptions, emit func([]float64, int64) error) *spectrogramBuilder {
+	return &spectrogramBuilder{
+		opts:   opts,
+		hop:    o.hop(),
+		perRow: o.fftsPerRow(),
+		power:  make([]float64, opts.FFTSize),
+		acc:    make([]float64, opts.FFTSize),
+		emit:   emit,
+	}
+}
+
+// Write adds contiguous samples starting at stream position start. A start
+// that doesn't follow the previous write drops any partial FFT.
+func (b *spectrogramBuilder) Write(iSamples, qSamples []int16, start int64) error {
+	if len(b.tailI) == 0 || b.tailStart+int64(len(b.tailI)) != start {
+		// Discontinuity: drop the partial FFT and start over at start
+		b.tailI, b.tailQ = b.tailI[:0], b.tailQ[:0]
+		b.tailStart = start
+	}
+	b.tailI = append(b.tailI, iSamples...)
+	b.tailQ = append(b.tailQ, qSamples...)
+
+	n := b.opts.FFTSize
+	used := 0
+	for len(b.tailI)-used >= n {
+		if b.count == 0 {
+			b.rowStart = b.tailStart + int64(used)
+		}
+		computePowerSpectrumInto(b.power, b.tailI[used:used+n], b.tailQ[used:used+n], b.opts)
+		for k, p := range b.power {
+			b.acc[k] += p
+		}
+		b.count++
+		used += b.hop
+		if b.count == b.perRow {
+			if err := b.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if used > len(b.tailI) {
+		used = len(b.tailI)
+	}
+	b.tailI = append(b.tailI[:0], b.tailI[used:]...)
+	b.tailQ = append(b.tailQ[:0], b.tailQ[used:]...)
+	b.tailStart += int64(used)
+	return nil
+}
+
+// Flush emits the partially averaged row, if any
+func (b *spectrogramBuilder) Flush() error {
+	if b.count == 0 {
+		return nil
+	}
+	row := make([]float64, len(b.acc))
+	for k, p := range b.acc {
+		row[k] = powerToDBm(p / float64(b.count))
+		b.acc[k] = 0
+	}
+	b.count = 0
+	return b.emit(row, b.rowStart)
+}
+
+// encodeSpectrogramRow packs a row as one byte per bin between minDB and maxDB.
+//
+// Layout: marker 0xF1, channel index (0-79), uint32 bins, float64 time in
+// seconds, float32 min dB, float32 max dB, then one uint8 per bin (little endian).
+func encodeSpectrogramRow(ch int, row []float64, timeSec, minDB, maxDB float64) []byte {
+	buf := make([]byte, 0, 22+len(row))
+	buf = append(buf, spectrogramRowMarker, byte(ch))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(row)))
+	buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(timeSec))
+	buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(minDB)))
+	buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(maxDB)))
+	for _, v := range row {
+		buf = append(buf, quantizeDB(v, minDB, maxDB))
+	}
+	return buf
+}
+
+// quantizeDB maps v in [minDB, maxDB] to 0-255
+func quantizeDB(v, minDB, maxDB float64) byte {
+	x := (v - minDB) / (maxDB - minDB) * 255
+	if x < 0 {
+		return 0
+	}
+	if x > 255 {
+		return 255
+	}
+	return byte(x + 0.5)
+}
+
+// recordingSpectrogram streams a recording through the builder. With
+// maxRows > 0 and more rows than that, rows are reduced: sparse reads one
+// row's worth of samples at evenly spaced positions (fast thumbnails),
+// otherwise every row is computed and neighbouring rows are power-averaged.
+// maxRows is limited to maxSpectrogramRows.
+func recordingSpectrogram(o *SpectrogramOptions, maxRows int, sparse bool, emit func(row []float64, startSample int64) error) error {
+	opts, err := o.Validate()
+	if err != nil {
+		return err
+	}
+	if maxRows < 0 || maxRows > maxSpectrogramRows {
+		return fmt.Errorf("max rows must be between 0 and %d", maxSpectrogramRows)
+	}
+	if o.Filename == "" {
+		return fmt.Errorf("filename is required")
+	}
+
+	r, err := openRecording(filepath.Join(dataFolder, o.Filename), []int{o.Channel})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	opts.Cal = r.powerCurve(o.Channel)
+
+	start, end := o.StartSample, r.Frames()
+	if start < 0 || start >= end {
+		return fmt.Errorf("start sample %d outside recording (0-%d)", start, end-1)
+	}
+	if o.Samples > 0 && start+o.Samples < end {
+		end = start + o.Samples
+	}
+
+	// Samples spanned by one row
+	rowSpan := int64(o.FFTSize + (o.fftsPerRow()-1)*o.hop())
+	rowStep := int64(o.fftsPerRow() * o.hop())
+	totalRows := int64(0)
+	if end-start >= rowSpan {
+		totalRows = (end-start-rowSpan)/rowStep + 1
+	}
+	if totalRows == 0 {
+		return fmt.Errorf("recording range is shorter than one row (%d samples)", rowSpan)
+	}
+
+	if maxRows > 0 && totalRows > int64(maxRows) && sparse {
+		b := newSpectrogramBuilder(o, opts, emit)
+		spacing := int64(maxRows - 1)
+		if spacing < 1 {
+			spacing = 1
+		}
+		for k := 0; k < maxRows; k++ {
+			pos := start + int64(k)*(end-start-rowSpan)/spacing
+			if err := r.SeekFrame(pos); err != nil {
+				return err
+			}
+			// Long rows are read in chunks like the full pass below
+			for read := int64(0); read < rowSpan; {
+				n, err := r.Read(int(min(rowSpan-read, spectrogramChunkFrames)))
+				if err != nil {
+					return err
+				}
+				if err := b.Write(r.I[0][:n], r.Q[0][:n], pos+read); err != nil {
+					return err
+				}
+				read += int64(n)
+			}
+			if err := b.Flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	out := emit
+	var merge *rowMerger
+	if maxRows > 0 && totalRows > int64(maxRows) {
+		merge = &rowMerger{totalRows: totalRows, outRows: int64(maxRows), emit: emit}
+		out = merge.add
+	}
+
+	b := newSpectrogramBuilder(o, opts, out)
+	if err := r.SeekFrame(start); err != nil {
+		return err
+	}
+	for pos := start; pos < end; {
+		want := int64(spectrogramChunkFrames)
+		if want > end-pos {
+			want = end - pos
+		}
+		n, err := r.Read(int(want))
+		if err != nil {
+			return err
+		}
+		if err := b.Write(r.I[0][:n], r.Q[0][:n], pos); err != nil {
+			return err
+		}
+		pos += int64(n)
+	}
+	if merge != nil {
+		return merge.flush()
+	}
+	return nil
+}
+
+// spectrogramChunkFrames is the read size for recording spectrograms
+const spectrogramChunkFrames = 256 * 1024
+
+// rowMerger power-averages consecutive rows down to outRows rows
+type rowMerger struct {
+	totalRows, outRows int64
+	index              int64
+	bucket             int64
+	acc                []float64
+	count              int
+	start              int64
+	emit               func([]float64, int64) error
+}
+
+func (m *rowMerger) add(row []float64, startSample int64) error {
+	bucket := m.index * m.outRows / m.totalRows
+	m.index++
+	if m.count > 0 && bucket != m.bucket {
+		if err := m.flush(); err != nil {
+			return err
+		}
+	}
+	if m.acc == nil {
+		m.acc = make([]float64, len(row))
+	}
+	if m.count == 0 {
+		m.start = startSample
+		m.bucket = bucket
+	}
+	for k, v := range row {
+		m.acc[k] += math.Pow(10, v/10)
+	}
+	m.count++
+	return nil
+}
+
+func (m *rowMerger) flush() error {
+	if m.count == 0 {
+		return nil
+	}
+	row := make([]float64, len(m.acc))
+	for k, p := range m.acc {
+		row[k] = powerToDBm(p / float64(m.count))
+		m.acc[k] = 0
+	}
+	m.count = 0
+	return m.emit(row, m.start)
+}
+
+// renderSpectrogramPNG draws rows (time downwards, frequency left to right
+// with DC centered) scaled to width x height. Frequency bins sharing a pixel
+// keep their maximum so narrow signals stay visible.
+func renderSpectrogramPNG(w io.Writer, rows [][]float64, width, height int, minDB, maxDB float64) error {
+	if len(rows) == 0 {
+		return fmt.Errorf("no rows to render")
+	}
+	bins := len(rows[0])
+	if width <= 0 {
+		width = bins
+	}
+	if height <= 0 {
+		height = len(rows)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := rows[y*len(rows)/height]
+		for x := 0; x < width; x++ {
+			lo := x * bins / width
+			hi := (x + 1) * bins / width
+			if hi <= lo {
+				hi = lo + 1
+			}
+			v := row[lo]
+			for k := lo + 1; k < hi; k++ {
+				if row[k] > v {
+					v = row[k]
+				}
+			}
+			img.Set(x, y, spectrogramColor(quantizeDB(v, minDB, maxDB)))
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// spectrogramColor maps a 0-255 level onto a dark-blue to yellow colormap
+func spectrogramColor(level byte) color.RGBA {
+	stops := [...]color.RGBA{
+		{0, 0, 4, 255},
+		{40, 11, 84, 255},
+		{101, 21, 110, 255},
+		{159, 42, 99, 255},
+		{212, 72, 66, 255},
+		{245, 125, 21, 255},
+		{250, 193, 39, 255},
+		{252, 255, 164, 255},
+	}
+	pos := float64(level) / 255 * float64(len(stops)-1)
+	i := int(pos)
+	if i >= len(stops)-1 {
+		return stops[len(stops)-1]
+	}
+	f := pos - float64(i)
+	a, b := stops[i], stops[i+1]
+	mix := func(x, y uint8) uint8 { return uint8(float64(x) + (float64(y)-float64(x))*f) }
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 255}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// spectrogramOptionsFromQuery reads SpectrogramOptions from URL parameters
+// named like their JSON fields
+func spectrogramOptionsFromQuery(q url.Values) (SpectrogramOptions, error) {
+	o := SpectrogramOptions{
+		Filename: q.Get("filename"),
+		Window:   q.Get("window"),
+	}
+	ints := map[string]*int{"channel": &o.Channel, "fft_size": &o.FFTSize}
+	for name, dst := range ints {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return o, fmt.Errorf("invalid %s", name)
+			}
+			*dst = n
+		}
+	}
+	int64s := map[string]*int64{"start_sample": &o.StartSample, "samples": &o.Samples}
+	for name, dst := range int64s {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return o, fmt.Errorf("invalid %s", name)
+			}
+			*dst = n
+		}
+	}
+	floats := map[string]*float64{
+		"overlap": &o.Overlap, "time_res_ms": &o.TimeResMS, "window_param": &o.WindowParam,
+		"min_db": &o.MinDB, "max_db": &o.MaxDB,
+	}
+	for name, dst := range floats {
+		if v := q.Get(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return o, fmt.Errorf("invalid %s", name)
+			}
+			*dst = f
+		}
+	}
+	if o.Channel == 0 {
+		o.Channel = 1
+	}
+	return o, nil
+}
+
+// handleSpectrogramPNG renders a recording's spectrogram as a PNG image.
+// Takes the SpectrogramOptions fields plus width and height in pixels.
+// thumbnail=1 defaults to 256x128 and samples the recording sparsely, so it
+// stays fast on long recordings.
+func handleSpectrogramPNG(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	o, err := spectrogramOptionsFromQuery(q)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	thumbnail := q.Get("thumbnail") == "1" || q.Get("thumbnail") == "true"
+	width, height := 0, 0
+	if thumbnail {
+		width, height = 256, 128
+	}
+	if v := q.Get("width"); v != "" {
+		width, _ = strconv.Atoi(v)
+	}
+	if v := q.Get("height"); v != "" {
+		height, _ = strconv.Atoi(v)
+	}
+	if width < 0 || width > 8192 || height < 0 || height > 8192 {
+		http.Error(w, "width and height must be at most 8192", 400)
+		return
+	}
+
+	if _, err := o.Validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Never hold more rows than the image has lines, nor more bins than
+	// spectrogramMaxValues; the renderer repeats rows to fill the height
+	maxRows := height
+	if maxRows == 0 {
+		maxRows = 1024
+	}
+	maxRows = max(1, min(maxRows, spectrogramMaxValues/o.FFTSize))
+
+	var rows [][]float64
+	err = recordingSpectrogram(&o, maxRows, thumbnail, func(row []float64, _ int64) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Spectrogram failed: "+err.Error(), 400)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := renderSpectrogramPNG(&buf, rows, width, height, o.MinDB, o.MaxDB); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// handleSpectrogramRows streams a recording's spectrogram as compact binary
+// rows (the WebSocket row format, back to back). max_rows limits the output
+// by power-averaging neighbouring rows.
+func handleSpectrogramRows(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	o, err := spectrogramOptionsFromQuery(q)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	maxRows, _ := strconv.Atoi(q.Get("max_rows"))
+
+	// Validate up front so errors can still be reported with a status code
+	if _, err := o.Validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	bw := bufio.NewWriterSize(w, 256*1024)
+	started := false
+	err = recordingSpectrogram(&o, maxRows, false, func(row []float64, startSample int64) error {
+		started = true
+		t := float64(startSample) / captureSampleRate
+		_, err := bw.Write(encodeSpectrogramRow(o.Channel-1, row, t, o.MinDB, o.MaxDB))
+		return err
+	})
+	if err != nil && !started {
+		http.Error(w, "Spectrogram failed: "+err.Error(), 400)
+		return
+	}
+	bw.Flush()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// clientSpectrogram is a client's spectrogram subscription. Live rows are
+// built from the stream frames of the selected channel; since frames are
+// snapshots rather than contiguous data, a live row averages every FFT
+// received within time_res_ms of wall-clock time (one row per frame if 0).
+type clientSpectrogram struct {
+	opts     SpectrogramOptions
+	builder  *spectrogramBuilder
+	started  time.Time
+	rowStart time.Time
+	position int64    // Fake stream position; each frame is a discontinuity
+	rows     [][]byte // Encoded rows waiting to be sent
+	stop     chan struct{}
+}
+
+// startClientSpectrogram replaces any spectrogram subscription on the client.
+// With a filename, rows are computed from the recording in the background.
+func startClientSpectrogram(client *Client, o SpectrogramOptions) error {
+	opts, err := o.Validate()
+	if err != nil {
+		return err
+	}
+
+	cs := &clientSpectrogram{opts: o, started: time.Now(), stop: make(chan struct{})}
+	cs.rowStart = cs.started
+	cs.builder = newSpectrogramBuilder(&cs.opts, opts, func(row []float64, _ int64) error {
+		t := time.Since(cs.started).Seconds()
+		cs.rows = append(cs.rows, encodeSpectrogramRow(cs.opts.Channel-1, row, t, cs.opts.MinDB, cs.opts.MaxDB))
+		return nil
+	})
+	// Live rows are flushed by time, not by FFT count
+	cs.builder.perRow = int(^uint(0) >> 1)
+
+	client.mu.Lock()
+	if client.spectrogram != nil {
+		close(client.spectrogram.stop)
+	}
+	client.spectrogram = cs
+	client.mu.Unlock()
+
+	if o.Filename != "" {
+		go streamRecordingSpectrogram(client, cs)
+	}
+	return nil
+}
+
+// stopClientSpectrogram ends the client's spectrogram subscription, if any
+func stopClientSpectrogram(client *Client) {
+	client.mu.Lock()
+	if client.spectrogram != nil {
+		close(client.spectrogram.stop)
+		client.spectrogram = nil
+	}
+	client.mu.Unlock()
+}
+
+// feed adds one live stream frame and returns any rows that are due.
+// Caller holds the client lock.
+func (cs *clientSpectrogram) feed(iSamples, qSamples []int16) [][]byte {
+	cs.position += int64(len(iSamples)) + 1
+	cs.builder.Write(iSamples, qSamples, cs.position)
+	if time.Since(cs.rowStart) >= time.Duration(cs.opts.TimeResMS*float64(time.Millisecond)) {
+		cs.builder.Flush()
+		cs.rowStart = time.Now()
+	}
+	rows := cs.rows
+	cs.rows = nil
+	return rows
+}
+
+// streamRecordingSpectrogram sends a recording's spectrogram rows to one
+// client, waiting for the client to keep up rather than dropping rows
+func streamRecordingSpectrogram(client *Client, cs *clientSpectrogram) {
+	o := cs.opts
+	rows := 0
+	err := recordingSpectrogram(&o, 0, false, func(row []float64, startSample int64) error {
+		t := float64(startSample) / captureSampleRate
+		if !sendToClient(client, encodeSpectrogramRow(o.Channel-1, row, t, o.MinDB, o.MaxDB), cs.stop) {
+			return fmt.Errorf("client went away")
+		}
+		rows++
+		return nil
+	})
+
+	msg := map[string]interface{}{
+		"type":     "spectrogram_done",
+		"filename": o.Filename,
+		"channel":  o.Channel,
+		"rows":     rows,
+	}
+	if err != nil {
+		log.Printf("[SPECTROGRAM] %s: %v", o.Filename, err)
+		msg["error"] = err.Error()
+	}
+	sendToClient(client, msg, cs.stop)
+}
+
+// sendToClient queues msg for one client, waiting while its send buffer is
+// full. Returns false if the client disconnected or stop was closed.
+func sendToClient(client *Client, msg interface{}, stop <-chan struct{}) bool {
+	for {
+		wsClientsMu.RLock()
+		if !wsClients[client] {
+			wsClientsMu.RUnlock()
+			return false
+		}
+		select {
+		case client.send <- msg:
+			wsClientsMu.RUnlock()
+			return true
+		default:
+		}
+		wsClientsMu.RUnlock()
+
+		select {
+		case <-stop:
+			return false
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/dma/pkg/fft"
+)
+
+// Spectrum averaging types
+const (
+	AverageOff         = "off"         // Pass each frame through
+	AverageRMS         = "rms"         // Mean of linear power
+	AverageLinear      = "linear"      // Mean of voltage magnitude
+	AverageLog         = "log"         // Mean of dBm values
+	AverageExponential = "exponential" // Exponential smoothing of linear power
+)
+
+// Spectrum trace IDs in the binary frame
+const (
+	TraceAverage = 0 // Averaged (or live) trace
+	TraceMaxHold = 1
+	TraceMinHold = 2
+)
+
+// spectrumFrameMarker starts a spectrum frame; raw frames start with a
+// channel header byte (0-159, channel index * 2 + 1 for Q)
+const spectrumFrameMarker = 0xF0
+
+// spectrumTraceStep is the dB resolution of trace values in spectrum frames
+const spectrumTraceStep = 0.01
+
+// Display points per trace: traces longer than this are peak-detected down
+// to it, like a swept analyzer's display detector
+const (
+	defaultSpectrumPoints = 1024
+	minSpectrumPoints     = 16
+	maxSpectrumPoints     = 1 << 16
+)
+
+// SpectrumSettings configures a client's server-side spectrum. Averages over
+// Count frames build up to Count and then continue as a running average
+// with weight 1/Count, like a swept analyzer's repeat averaging.
+type SpectrumSettings struct {
+	Averaging string  `json:"averaging"` // off, rms, linear, log or exponential
+	Count     int     `json:"count"`     // Frames to average (rms, linear, log)
+	Alpha     float64 `json:"alpha"`     // Smoothing factor 0-1 (exponential)
+	MaxHold   bool    `json:"max_hold"`
+	MinHold   bool    `json:"min_hold"`
+	Points    int     `json:"points"` // Display points per trace, default 1024
+
+	Window      string  `json:"window"`       // See fft.ParseWindow, default blackman
+	WindowParam float64 `json:"window_param"` // Kaiser beta or Gaussian sigma
+	Scaling     string  `json:"scaling"`      // tone (dBm) or density (dBm/Hz)
+}
+
+// Validate checks the settings and fills in defaults
+func (s *SpectrumSettings) Validate() error {
+	switch s.Averaging {
+	case "":
+		s.Averaging = AverageOff
+	case AverageOff, AverageRMS, AverageLinear, AverageLog:
+	case AverageExponential:
+		if s.Alpha <= 0 || s.Alpha > 1 {
+			return fmt.Errorf("alpha must be between 0 and 1")
+		}
+	default:
+		return fmt.Errorf("unknown averaging %q", s.Averaging)
+	}
+	if s.Count <= 0 {
+		s.Count = 10
+	}
+	if s.Points == 0 {
+		s.Points = defaultSpectrumPoints
+	}
+	if s.Points < minSpectrumPoints || s.Points > maxSpectrumPoints {
+		return fmt.Errorf("points must be between %d and %d", minSpectrumPoints, maxSpectrumPoints)
+	}
+	opts, err := parseSpectrumOptions(2, s.Window, s.WindowParam, s.Scaling)
+	if err != nil {
+		return err
+	}
+	s.Window, s.WindowParam, s.Scaling = string(opts.Window.Kind), opts.Window.Param, opts.Scaling
+	return nil
+}
+
+// options returns the spectrum options for these settings at fftSize.
+// Settings must have been validated.
+func (s *SpectrumSettings) options(fftSize int) SpectrumOptions {
+	return SpectrumOptions{
+		FFTSize: fftSize,
+		Window:  fft.WindowSpec{Kind: fft.WindowKind(s.Window), Param: s.WindowParam},
+		Scaling: s.Scaling,
+	}
+}
+
+// channelSpectrum holds the averaging and hold state for one channel
+type channelSpectrum struct {
+	frames int
+	avg    []float64 // In the averaging domain (power, voltage or dB)
+	max    []float64 // dBm
+	min    []float64 // dBm
+	out    []float64 // Averaged trace in dBm
+}
+
+// clientSpectrum is a client's spectrum settings and per-channel state
+type clientSpectrum struct {
+	settings SpectrumSettings
+	fftSize  int
+	channels map[int]*channelSpectrum
+}
+
+func newClientSpectrum(settings SpectrumSettings) *clientSpectrum {
+	return &clientSpectrum{settings: settings, channels: make(map[int]*channelSpectrum)}
+}
+
+// Reset clears all averages and holds
+func (cs *clientSpectrum) Reset() {
+	cs.channels = make(map[int]*channelSpectrum)
+}
+
+// update folds a new dBm trace into channel ch and returns its state
+func (cs *clientSpectrum) update(ch int, dBm []float64) *channelSpectrum {
+	if len(dBm) != cs.fftSize {
+		cs.fftSize = len(dBm)
+		cs.Reset()
+	}
+	st, ok := cs.channels[ch]
+	if !ok {
+		n := len(dBm)
+		st = &channelSpectrum{
+			avg: make([]float64, n),
+			max: make([]float64, n),
+			min: make([]float64, n),
+			out: make([]float64, n),
+		}
+		cs.channels[ch] = st
+	}
+	st.frames++
+	s := cs.settings
+
+	// Holds track the live trace
+	for i, v := range dBm {
+		if st.frames == 1 || v > st.max[i] {
+			st.max[i] = v
+		}
+		if st.frames == 1 || v < st.min[i] {
+			st.min[i] = v
+		}
+	}
+
+	weight := 1.0
+	switch s.Averaging {
+	case AverageExponential:
+		if st.frames > 1 {
+			weight = s.Alpha
+		}
+	case AverageRMS, AverageLinear, AverageLog:
+		k := st.frames
+		if k > s.Count {
+			k = s.Count
+		}
+		weight = 1 / float64(k)
+	}
+
+	for i, v := range dBm {
+		var x float64
+		switch s.Averaging {
+		case AverageRMS, AverageExponential:
+			x = math.Pow(10, v/10)
+		case AverageLinear:
+			x = math.Pow(10, v/20)
+		default:
+			x = v
+		}
+		st.avg[i] += (x - st.avg[i]) * weight
+
+		switch s.Averaging {
+		case AverageRMS, AverageExponential:
+			st.out[i] = 10 * math.Log10(st.avg[i])
+		case AverageLinear:
+			st.out[i] = 20 * math.Log10(st.avg[i])
+		default:
+			st.out[i] = st.avg[i]
+		}
+	}
+	return st
+}
+
+// detectTrace reduces a trace to points values. Display point k covers the
+// bins from ceil(k*n/points) up to the next point's first bin and takes
+// their largest value, or their smallest for a negative peak. Traces that
+// are not longer than points are returned as they are.
+func detectTrace(dBm []float64, points int, negative bool) []float64 {
+	n := len(dBm)
+	if n <= points {
+		return dBm
+	}
+	out := make([]float64, points)
+	for k := range out {
+		lo, hi := (k*n+points-1)/points, ((k+1)*n+points-1)/points
+		v := dBm[lo]
+		for _, x := range dBm[lo+1 : hi] {
+			if negative && x < v || !negative && x > v {
+				v = x
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// appendSpectrumTrace encodes one trace block: channel, trace ID, dBm values
+// as int16 in spectrumTraceStep units, clamped to ±327.67 dB
+func appendSpectrumTrace(buf []byte, ch, trace int, dBm []float64) []byte {
+	buf = append(buf, byte(ch), byte(trace))
+	for _, v := range dBm {
+		q := math.Round(v / spectrumTraceStep)
+		if !(q >= -math.MaxInt16) { // Also -Inf and NaN
+			q = -math.MaxInt16
+		}
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(int16(min(q, math.MaxInt16))))
+	}
+	return buf
+}
+
+// buildSpectrumFrame updates a client's spectra with this frame's traces and
+// encodes the result. traces maps channel index to live dBm trace.
+//
+// Frame layout: marker 0xF0, uint32 FFT size, uint32 points per trace, then
+// per channel and trace: channel byte, trace byte, int16 values in 0.01 dB
+// (little endian). Averaging and holds run at full resolution; the average
+// and max-hold traces are then peak-detected and the min-hold trace
+// negative-peak-detected to the display points.
+func (cs *clientSpectrum) buildSpectrumFrame(channels []int, traces map[int][]float64) []byte {
+	var buf []byte
+	for _, ch := range channels {
+		dBm, ok := traces[ch]
+		if !ok {
+			continue
+		}
+		points := min(len(dBm), cs.settings.Points)
+		if buf == nil {
+			buf = append(buf, spectrumFrameMarker)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(dBm)))
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(points))
+		}
+		st := cs.update(ch, dBm)
+		buf = appendSpectrumTrace(buf, ch, TraceAverage, detectTrace(st.out, points, false))
+		if cs.settings.MaxHold {
+			buf = appendSpectrumTrace(buf, ch, TraceMaxHold, detectTrace(st.max, points, false))
+		}
+		if cs.settings.MinHold {
+			buf = appendSpectrumTrace(buf, ch, TraceMinHold, detectTrace(st.min, points, true))
+		}
+	}
+	return buf
+}
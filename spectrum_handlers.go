@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/dma/pkg/fft"
+)
+
+// handleSpectrumWindows reports coherent gain, ENBW and RBW for the window
+// library at an FFT size. ?window= selects one window (with ?param=),
+// otherwise all windows are listed. ?fft_size= defaults to the stream's size.
+func handleSpectrumWindows(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	serverState.mu.RLock()
+	fftSize := serverState.FFTSize
+	serverState.mu.RUnlock()
+	if v := q.Get("fft_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid fft_size", 400)
+			return
+		}
+		fftSize = n
+	}
+
+	param := 0.0
+	if v := q.Get("param"); v != "" {
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "Invalid param", 400)
+			return
+		}
+		param = p
+	}
+
+	names := []string{q.Get("window")}
+	if names[0] == "" {
+		names = names[:0]
+		for _, kind := range fft.WindowKinds() {
+			names = append(names, string(kind))
+		}
+	}
+
+	var infos []*WindowInfo
+	for _, name := range names {
+		opts, err := parseSpectrumOptions(fftSize, name, param, "")
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		info, err := windowInfo(opts)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		infos = append(infos, info)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sample_rate": captureSampleRate,
+		"windows":     infos,
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// TestSpectrumFrameSize checks that traces are peak-detected to the display
+// points, holds included, and that a narrow peak survives
+func TestSpectrumFrameSize(t *testing.T) {
+	const n, points = 65536, 1000
+	s := SpectrumSettings{MaxHold: true, MinHold: true, Points: points}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cs := newClientSpectrum(s)
+	trace := make([]float64, n)
+	for k := range trace {
+		trace[k] = -100
+	}
+	trace[40000], trace[40001] = -20, -120
+	frame := cs.buildSpectrumFrame([]int{0, 3}, map[int][]float64{0: trace, 3: trace})
+
+	// Header, then 2 channels of 3 traces
+	if want := 9 + 2*3*(2+2*points); len(frame) != want {
+		t.Fatalf("frame is %d bytes, want %d (raw I/Q would be %d)", len(frame), want, 2*n*4)
+	}
+	if size, got := binary.LittleEndian.Uint32(frame[1:]), binary.LittleEndian.Uint32(frame[5:]); size != n || got != points {
+		t.Errorf("header FFT size %d, points %d", size, got)
+	}
+	value := func(trace, point int) float64 {
+		p := 9 + trace*(2+2*points) + 2 + 2*point
+		return float64(int16(binary.LittleEndian.Uint16(frame[p:]))) * spectrumTraceStep
+	}
+	k := 40000 * points / n
+	for trace, want := range []float64{-20, -20, -120} {
+		if got := value(trace, k); got != want {
+			t.Errorf("trace %d point %d: %.2f dBm, want %.2f", trace, k, got, want)
+		}
+		if got := value(trace, k+2); got != -100 {
+			t.Errorf("trace %d point %d: %.2f dBm, want -100", trace, k+2, got)
+		}
+	}
+
+	// Traces shorter than the points are sent as they are
+	short := cs.buildSpectrumFrame([]int{0}, map[int][]float64{0: trace[:512]})
+	if want := 9 + 3*(2+2*512); len(short) != want {
+		t.Errorf("short frame is %d bytes, want %d", len(short), want)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"os"
 	"sync"
+
+	"github.com/dma/pkg/dma"
 )
 
 // Server state
@@ -23,7 +25,7 @@ type ServerState struct {
 	SweepParams  *SweepParams
 
 	// Stream config from client
-	StreamMode       string   // "raw", "fft", "both"
+	StreamMode       string   // "raw", "fft", "both", "spectrum"
 	StreamFPS        int      // frames per second
 	FFTSize          int      // 1024, 2048, 4096, 8192
 	FFTTypes         []string // "complex", "i", "q"
@@ -36,31 +38,48 @@ type ServerState struct {
 	ReplayName        string
 	ReplayOffset      int
 	ReplayChannels    []int // Channel indices present in the replay file (0-7)
+	ReplayConfig      *HardwareConfig // Hardware configuration the replay file was captured with, if known
 	ForceReplayUpdate bool
 
 	// Recording
 		Recording          bool
+		RecordingJobID     string // ID of the queued job currently being recorded
 		RecordingFile      string
 		RecordingSamples   int // Total samples to record
 		RecordingCurrent   int // Samples recorded so far
 		RecordingChannels  []int // Channel indices active during this recording (0-7)
+		RecordingHop       *HopPlan // Tuning schedule for the active recording, if any
+		RecordingBeams     [][8]complex128 // Weights of beam channels (indices 8-15), by beam
+		RecordingIQ        *IQCalibration  // IQ correction applied to this recording, if any
+		RecordingDC        *dcTracker      // DC removal for this recording, seeded from the live offsets; nil = off
+		RecordingAligner   *channelAligner // Channel alignment for this recording (8 slots); nil = off
+		RecordingChannelizer *recordingChannelizer // Splits the source into the recorded sub-channels; nil = not a sub-channel recording
 		RecordingFileHandle *os.File
 
 			// System
 			DevicePath        string
+			DMAEngines        []dma.EngineConfig // Parallel C2H engines; empty = DevicePath only
 			UseSHM            bool
 			SHMName           string
 			HardwareAvailable bool
+			Array             *ArrayGeometry // Element positions for DOA; nil until loaded
+			Beams             []Beam         // Virtual beam channels 9-16
+			BeamSetName       string         // Name of the loaded or saved weight set
+			IQCorrection      bool           // Apply the stored IQ imbalance correction
+			DCRemoval         bool           // Remove tracked DC offsets from live data
+			DCRemoveRecordings bool          // Also remove them from recordings
+			Alignment         bool           // Correct the stored inter-channel delays
+			Channelizer       ChannelizerConfig // Sub-channels 17-80 of one channel, when enabled
+			Detector          DetectorConfig    // Live CFAR detection into the emitter log
+			PDW               PDWConfig         // Live pulse extraction into the PDW log
+			Modulation        ModQualityConfig  // Live modulation quality and constellation
+			Demod             DemodConfig       // Audio demodulator of one receiver channel
+			ADC               ADCConfig         // ADC code statistics, clipping alarm and automatic attenuation
+			Stats             StatsConfig       // Live time-domain statistics of every channel
 		}
-	// CaptureMetadata represents the metadata saved alongside a capture
-	type CaptureMetadata struct {
-		Timestamp   string          `json:"timestamp"`
-		SampleRate  int             `json:"sample_rate"` // Always 244400000
-		Channels    []int           `json:"channels"`    // Active channel indices in this capture (0-7)
-		Config      *HardwareConfig `json:"config"`
-	}		
-		type SweepParams struct {
-			StartMHz float64 `json:"start_mhz"`
+
+type SweepParams struct {
+	StartMHz float64 `json:"start_mhz"`
 	StopMHz  float64 `json:"stop_mhz"`
 	StepMHz  float64 `json:"step_mhz"`
 	DwellMS  float64 `json:"dwell_ms"`
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StatsConfig sets the window of the live time-domain statistics
+type StatsConfig struct {
+	IntervalS float64 `json:"interval_s"` // Window and report interval, default 1
+}
+
+// Validate fills in the default and checks the range
+func (c *StatsConfig) Validate() error {
+	if c.IntervalS == 0 {
+		c.IntervalS = 1
+	}
+	if c.IntervalS < 0.1 || c.IntervalS > 60 {
+		return fmt.Errorf("interval_s must be between 0.1 and 60")
+	}
+	return nil
+}
+
+// statsFullScale is the dBFS reference of the statistics: a full-scale tone
+// of the 12-bit ADC. The spectra keep their own calibrated reference.
+const statsFullScale = adcFullScale
+
+// ChannelStats summarizes one channel's samples over a window. Levels are
+// relative to statsFullScale.
+type ChannelStats struct {
+	Channel  int     `json:"channel"` // 1-8, beams 9-16, sub-channels 17-80
+	Samples  int64   `json:"samples"`
+	RMSDBFS  float64 `json:"rms_dbfs"`  // Mean |I + jQ|²
+	PeakDBFS float64 `json:"peak_dbfs"` // Largest |I + jQ|²
+	Peak     float64 `json:"peak"`      // Largest |I + jQ| in codes
+	MeanI    float64 `json:"mean_i"`
+	MeanQ    float64 `json:"mean_q"`
+	VarI     float64 `json:"var_i"` // Sample variance in codes²
+	VarQ     float64 `json:"var_q"`
+}
+
+// statsSums are exact running sums of one channel
+type statsSums struct {
+	n, sumI, sumQ, sumI2, sumQ2, peak2 int64
+}
+
+// statsAccumulator collects the sums of every channel of the stream frames
+type statsAccumulator struct {
+	sums [maxChannel]statsSums
+}
+
+// add folds one block of a channel (0-79)
+func (a *statsAccumulator) add(ch int, i, q []int16) {
+	s := &a.sums[ch]
+	var sumI, sumQ, sumI2, sumQ2 int64
+	peak2 := s.peak2
+	for k := range i {
+		vi, vq := int64(i[k]), int64(q[k])
+		sumI += vi
+		sumQ += vq
+		sumI2 += vi * vi
+		sumQ2 += vq * vq
+		if m := vi*vi + vq*vq; m > peak2 {
+			peak2 = m
+		}
+	}
+	s.n += int64(len(i))
+	s.sumI, s.sumQ, s.sumI2, s.sumQ2, s.peak2 = s.sumI+sumI, s.sumQ+sumQ, s.sumI2+sumI2, s.sumQ2+sumQ2, peak2
+}
+
+// report summarizes the channels seen so far, rounded for a compact message
+func (a *statsAccumulator) report() []ChannelStats {
+	round := func(v float64) float64 { return math.Round(v*1000) / 1000 }
+	dbfs := func(power float64) float64 {
+		return round(10 * math.Log10(math.Max(power, 1e-3)/(statsFullScale*statsFullScale)))
+	}
+	out := []ChannelStats{}
+	for ch, s := range a.sums {
+		if s.n == 0 {
+			continue
+		}
+		n := float64(s.n)
+		st := ChannelStats{
+			Channel:  ch + 1,
+			Samples:  s.n,
+			RMSDBFS:  dbfs(float64(s.sumI2+s.sumQ2) / n),
+			PeakDBFS: dbfs(float64(s.peak2)),
+			Peak:     round(math.Sqrt(float64(s.peak2))),
+			MeanI:    round(float64(s.sumI) / n),
+			MeanQ:    round(float64(s.sumQ) / n),
+		}
+		if s.n > 1 {
+			st.VarI = round((float64(s.sumI2) - float64(s.sumI)*float64(s.sumI)/n) / (n - 1))
+			st.VarQ = round((float64(s.sumQ2) - float64(s.sumQ)*float64(s.sumQ)/n) / (n - 1))
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// Stats sources: the SHM ring read contiguously, the replay buffer stepped
+// through by the stream, or, without either, the stream frames themselves
+const (
+	statsSourceSHM    = "shm"
+	statsSourceReplay = "replay"
+	statsSourceFrames = "frames"
+)
+
+const (
+	statsTick      = 20 * time.Millisecond
+	statsMaxFrames = 1 << 20 // Per tick; the producer's frames beyond this are skipped
+	statsRetry     = time.Second
+)
+
+// statsReader reads contiguous blocks of the 8 receiver channels
+type statsReader interface {
+	frames(n int) ([][]int16, [][]int16, int) // Also returns the frames skipped to catch up
+	close()
+}
+
+// liveStats accumulates one window of the current source and keeps the
+// last window's report. Coverage is the share of the source's frames that
+// went into the window.
+var liveStats = struct {
+	mu       sync.Mutex
+	running  bool // runStats is started
+	ring     bool // runStats is reading the SHM ring
+	source   string
+	acc      statsAccumulator
+	start    time.Time
+	read     int64
+	skipped  int64
+	last     []ChannelStats
+	end      time.Time
+	coverage float64
+	lastSrc  string
+}{}
+
+// feedStats folds every channel of a stream frame into the current window.
+// Live stream frames are display snippets, so they are skipped while the
+// SHM ring is read instead.
+func feedStats(channelI, channelQ [][]int16) {
+	serverState.mu.RLock()
+	replay := serverState.ReplayMode
+	serverState.mu.RUnlock()
+
+	source := statsSourceFrames
+	if replay {
+		source = statsSourceReplay
+	}
+	liveStats.mu.Lock()
+	ring := liveStats.ring
+	liveStats.mu.Unlock()
+	if ring && !replay || len(channelI) == 0 {
+		return
+	}
+	foldStats(source, channelI, channelQ, len(channelI[0]), 0)
+}
+
+// foldStats adds a block of read frames from source to the current window,
+// starting a new window when the source changes, and reports the window
+// once it is complete
+func foldStats(source string, channelI, channelQ [][]int16, read, skipped int) {
+	serverState.mu.RLock()
+	cfg := serverState.Stats
+	serverState.mu.RUnlock()
+	cfg.Validate()
+
+	liveStats.mu.Lock()
+	now := time.Now()
+	if liveStats.start.IsZero() || liveStats.source != source {
+		liveStats.acc, liveStats.start, liveStats.source = statsAccumulator{}, now, source
+		liveStats.read, liveStats.skipped = 0, 0
+	}
+	for ch := 0; ch < maxChannel && ch < len(channelI); ch++ {
+		liveStats.acc.add(ch, channelI[ch], channelQ[ch])
+	}
+	liveStats.read += int64(read)
+	liveStats.skipped += int64(skipped)
+	elapsed := now.Sub(liveStats.start).Seconds()
+	if elapsed < cfg.IntervalS {
+		liveStats.mu.Unlock()
+		return
+	}
+	coverage := 1.0
+	switch source {
+	case statsSourceSHM:
+		if total := liveStats.read + liveStats.skipped; total > 0 {
+			coverage = float64(liveStats.read) / float64(total)
+		}
+	case statsSourceFrames:
+		coverage = math.Min(float64(liveStats.read)/(elapsed*captureSampleRate), 1)
+	}
+	liveStats.last, liveStats.end = liveStats.acc.report(), now
+	liveStats.coverage, liveStats.lastSrc = math.Round(coverage*1e4)/1e4, source
+	liveStats.acc, liveStats.start = statsAccumulator{}, now
+	liveStats.read, liveStats.skipped = 0, 0
+	liveStats.mu.Unlock()
+
+	go broadcastJSON(statsMessage(0))
+}
+
+// startStats starts the SHM statistics reader along with the stream loop
+func startStats() {
+	liveStats.mu.Lock()
+	defer liveStats.mu.Unlock()
+	if !liveStats.running {
+		liveStats.running = true
+		go runStats()
+	}
+}
+
+// runStats reads every frame the SHM producer writes while the stream loop
+// runs and folds it into the statistics after the same corrections as the
+// stream. When processing is slower than the producer, the frames it skips
+// lower the reported coverage. Without live SHM data it idles, and the
+// stream frames are used instead.
+func runStats() {
+	var src statsReader
+	var srcName string
+	var lastTry time.Time
+	defer func() {
+		if src != nil {
+			src.close()
+		}
+		liveStats.mu.Lock()
+		liveStats.running, liveStats.ring = false, false
+		liveStats.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(statsTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		wsClientsMu.RLock()
+		running := streamLoopRunning
+		wsClientsMu.RUnlock()
+		if !running {
+			return
+		}
+		serverState.mu.RLock()
+		live := serverState.UseSHM && serverState.HardwareAvailable && !serverState.ReplayMode
+		shmName := serverState.SHMName
+		serverState.mu.RUnlock()
+
+		if src != nil && (!live || shmName != srcName) {
+			src.close()
+			src = nil
+		}
+		if live && src == nil && time.Since(lastTry) >= statsRetry {
+			lastTry = time.Now()
+			var err error
+			if src, err = openRingStatsReader(shmName); err != nil {
+				log.Printf("[STATS] %v", err)
+			}
+			srcName = shmName
+		}
+		liveStats.mu.Lock()
+		liveStats.ring = src != nil
+		liveStats.mu.Unlock()
+		if src == nil {
+			continue
+		}
+
+		channelI, channelQ, skipped := src.frames(statsMaxFrames)
+		read := len(channelI[0])
+		if read == 0 && skipped == 0 {
+			continue
+		}
+		if read > 0 {
+			channelI, channelQ = statsChannels(channelI, channelQ)
+		}
+		foldStats(statsSourceSHM, channelI, channelQ, read, skipped)
+	}
+}
+
+// statsChannels applies the stream's corrections to a block of the 8
+// receiver channels and forms its beams and sub-channels, as
+// broadcastStreamFrame does, without updating the live DC offsets
+func statsChannels(channelI, channelQ [][]int16) ([][]int16, [][]int16) {
+	if a, _ := currentAligner(); a != nil && len(channelI) == len(a.base) && a.output(len(channelI[0])) > 0 {
+		channelI, channelQ = a.alignChannels(channelI, channelQ)
+	}
+	channelI, channelQ = removeLiveDC(channelI, channelQ)
+	channelQ = applyIQCorrection(channelI, channelQ, currentIQCorrection())
+	_, beamWeights := currentBeams()
+	channelI, channelQ = appendBeamChannels(channelI, channelQ, beamWeights)
+	if c := currentChannelizer(); c != nil && c.outputs(len(channelI[0])) > 0 {
+		channelI, channelQ = appendSubChannels(channelI, channelQ, c)
+	}
+	return channelI, channelQ
+}
+
+// handleStats gets the last window's statistics, optionally of one channel,
+// or sets the window
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var cfg StatsConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		serverState.mu.Lock()
+		serverState.Stats = cfg
+		serverState.mu.Unlock()
+	}
+	channel := 0
+	if v := r.URL.Query().Get("channel"); v != "" {
+		var err error
+		if channel, err = strconv.Atoi(v); err != nil || channel < 1 || channel > maxChannel {
+			http.Error(w, fmt.Sprintf("channel must be between 1 and %d", maxChannel), 400)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(statsMessage(channel))
+}
+
+// statsMessage reports the last window, of one channel or all when channel
+// is 0
+func statsMessage(channel int) map[string]interface{} {
+	serverState.mu.RLock()
+	cfg := serverState.Stats
+	serverState.mu.RUnlock()
+	cfg.Validate()
+
+	liveStats.mu.Lock()
+	stats, end, source, coverage := liveStats.last, liveStats.end, liveStats.lastSrc, liveStats.coverage
+	liveStats.mu.Unlock()
+	out := []ChannelStats{}
+	for _, st := range stats {
+		if channel == 0 || st.Channel == channel {
+			out = append(out, st)
+		}
+	}
+	msg := map[string]interface{}{"type": "stats", "interval_s": cfg.IntervalS, "channels": out}
+	if !end.IsZero() {
+		msg["time"] = end.Format(time.RFC3339Nano)
+		msg["source"] = source
+		msg["coverage"] = coverage
+	}
+	return msg
+}
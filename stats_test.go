@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// TestChannelStats folds a tone with a DC offset into the statistics in two
+// blocks and checks the moments against their closed forms
+func TestChannelStats(t *testing.T) {
+	const n, amp, dcI, dcQ = 4000, 1000.0, 30, -20
+	i, q := make([]int16, n), make([]int16, n)
+	for s := range i {
+		phase := 2 * math.Pi * 50 * float64(s) / n
+		i[s] = int16(math.Round(dcI + amp*math.Cos(phase)))
+		q[s] = int16(math.Round(dcQ + amp*math.Sin(phase)))
+	}
+	var a statsAccumulator
+	a.add(4, i[:n/4], q[:n/4])
+	a.add(4, i[n/4:], q[n/4:])
+	stats := a.report()
+	if len(stats) != 1 || stats[0].Channel != 5 || stats[0].Samples != n {
+		t.Fatalf("%+v", stats)
+	}
+	st := stats[0]
+	if math.Abs(st.MeanI-dcI) > 0.01 || math.Abs(st.MeanQ-dcQ) > 0.01 {
+		t.Errorf("mean %.3f, %.3f, want %d, %d", st.MeanI, st.MeanQ, dcI, dcQ)
+	}
+	// A tone's variance per component is amp²/2
+	if want := amp * amp / 2; math.Abs(st.VarI/want-1) > 0.001 || math.Abs(st.VarQ/want-1) > 0.001 {
+		t.Errorf("variance %.1f, %.1f, want %.1f", st.VarI, st.VarQ, want)
+	}
+	power := amp*amp + dcI*dcI + dcQ*dcQ
+	if want := 10 * math.Log10(power/(statsFullScale*statsFullScale)); math.Abs(st.RMSDBFS-want) > 0.01 {
+		t.Errorf("RMS %.3f dBFS, want %.3f", st.RMSDBFS, want)
+	}
+	if want := amp + math.Hypot(dcI, dcQ); math.Abs(st.Peak-want) > 1 {
+		t.Errorf("peak %.1f, want %.1f", st.Peak, want)
+	}
+	if math.Abs(st.PeakDBFS-20*math.Log10(st.Peak/statsFullScale)) > 0.01 {
+		t.Errorf("peak %.3f dBFS for %.1f codes", st.PeakDBFS, st.Peak)
+	}
+}
+
+// TestStatsCoverage checks that a change of source starts a new window and
+// that frames skipped by the SHM reader lower the coverage
+func TestStatsCoverage(t *testing.T) {
+	serverState.mu.Lock()
+	serverState.Stats = StatsConfig{IntervalS: 0.1}
+	serverState.mu.Unlock()
+	block := func(v int16) ([][]int16, [][]int16) {
+		i, q := make([]int16, 100), make([]int16, 100)
+		for s := range i {
+			i[s], q[s] = v, -v
+		}
+		return [][]int16{i}, [][]int16{q}
+	}
+
+	i, q := block(500)
+	foldStats(statsSourceFrames, i, q, 100, 0)
+	i, q = block(100)
+	foldStats(statsSourceSHM, i, q, 100, 300)
+	time.Sleep(110 * time.Millisecond)
+	foldStats(statsSourceSHM, i, q, 100, 0)
+
+	msg := statsMessage(1)
+	stats := msg["channels"].([]ChannelStats)
+	if msg["source"] != statsSourceSHM || msg["coverage"] != 0.4 {
+		t.Errorf("source %v, coverage %v, want shm, 0.4", msg["source"], msg["coverage"])
+	}
+	if len(stats) != 1 || stats[0].Samples != 200 || stats[0].MeanI != 100 {
+		t.Errorf("%+v, want 200 samples of the SHM window only", stats)
+	}
+}
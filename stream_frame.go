@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// liveFrame is one stream frame kept for measurements that poll live data.
+// The stream loops allocate new slices for every frame, so they are shared
+// rather than copied and must not be modified.
+type liveFrame struct {
+	seq     uint64
+	I, Q    [][]int16 // Per channel index: receivers (0-7), beams (8-15), sub-channels
+	fftSize int
+	subRate float64          // Sample rate of the sub-channels; 0 = no channelizer
+	chz     *ChannelizerInfo // Sub-channels of the frame; nil = no channelizer
+	cal     powerCalContext  // Receiver configuration the frame was captured in
+	end     time.Time        // Capture time of the frame's last sample
+}
+
+var (
+	latestFrame   liveFrame
+	latestFrameMu sync.Mutex
+)
+
+// nextLiveFrame waits for a stream frame newer than seq
+func nextLiveFrame(seq uint64, timeout time.Duration) (liveFrame, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		latestFrameMu.Lock()
+		frame := latestFrame
+		latestFrameMu.Unlock()
+		if frame.seq > seq {
+			return frame, nil
+		}
+		if time.Now().After(deadline) {
+			return liveFrame{}, fmt.Errorf("no live data; streaming must be enabled in the web UI")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// channel returns a user-facing channel's samples (1-8, 9-16 for beams,
+// 17-80 for sub-channels)
+func (f liveFrame) channel(ch int) ([]int16, []int16, error) {
+	if ch < 1 || ch > len(f.I) || len(f.I[ch-1]) == 0 {
+		return nil, nil, fmt.Errorf("channel %d has no live data", ch)
+	}
+	return f.I[ch-1], f.Q[ch-1], nil
+}
+
+// sampleRate returns a user-facing channel's sample rate
+func (f liveFrame) sampleRate(ch int) float64 {
+	if isSubChannel(ch) && f.subRate > 0 {
+		return f.subRate
+	}
+	return captureSampleRate
+}
+
+// powerCurve returns the power calibration of a user-facing channel
+func (f liveFrame) powerCurve(ch int) *powerCurve {
+	return f.cal.channelCurve(ch, f.chz)
+}
+
+// channelsRate returns the sample rate shared by the channels; sub-channels
+// can't be combined with full-rate channels
+func (f liveFrame) channelsRate(channels []int) (float64, error) {
+	rate := 0.0
+	for _, ch := range channels {
+		r := f.sampleRate(ch)
+		if rate != 0 && r != rate {
+			return 0, fmt.Errorf("sub-channels can't be combined with full-rate channels")
+		}
+		rate = r
+	}
+	return rate, nil
+}
+
+// forEachLiveFrame calls fn with each of the next n stream frames
+func forEachLiveFrame(n int, fn func(frame liveFrame) error) error {
+	var seq uint64
+	for i := 0; i < n; i++ {
+		frame, err := nextLiveFrame(seq, 2*time.Second)
+		if err != nil {
+			return err
+		}
+		seq = frame.seq
+		if err := fn(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientChannels returns the channel indices a client has selected that are
+// below count (8 receivers plus any beams)
+func clientChannels(names []string, count int) []int {
+	seen := make(map[int]bool)
+	var channels []int
+	for _, chName := range names {
+		if len(chName) >= 2 {
+			chIdx, err := strconv.Atoi(chName[1:])
+			chIdx--
+			if err == nil && chIdx >= 0 && chIdx < count && !seen[chIdx] {
+				seen[chIdx] = true
+				channels = append(channels, chIdx)
+			}
+		}
+	}
+	sort.Ints(channels)
+	return channels
+}
+
+// replayClock times replay frames by their position in the replay data, so
+// that frames are spaced by the samples they cover rather than by the
+// display rate. It restarts when another file is replayed.
+type replayClock struct {
+	name    string
+	epoch   time.Time
+	samples int64
+}
+
+// next steps over n samples and returns the time of the last one
+func (c *replayClock) next(name string, n int) time.Time {
+	if c.epoch.IsZero() || name != c.name {
+		c.name, c.epoch, c.samples = name, time.Now(), 0
+	}
+	c.samples += int64(n)
+	return c.epoch.Add(time.Duration(float64(c.samples) / captureSampleRate * float64(time.Second)))
+}
+
+// broadcastStreamFrame sends one frame of channel data to every client.
+// Clients in spectrum mode get their averaged dBm traces; all others get the
+// raw I/Q samples and do their own FFT. Channel alignment, DC removal and IQ
+// correction are applied and beam channels and sub-channels are formed here,
+// so every consumer sees them; beams follow the 8 receiver channels, and
+// sub-channels start at index 16. The ADC statistics take the codes before
+// any of this. With the channelizer on, the stream reads enough samples for
+// samplesNeeded sub-channel samples. end is the capture time of the last
+// sample read.
+func broadcastStreamFrame(channelI, channelQ [][]int16, samplesNeeded, fftSize int, end time.Time) {
+	feedADC(channelI, channelQ)
+
+	// The stream reads alignmentMargin extra samples so aligned frames keep
+	// their length
+	if a, _ := currentAligner(); a != nil && len(channelI) == len(a.base) && a.output(len(channelI[0])) >= fftSize {
+		channelI, channelQ = a.alignChannels(channelI, channelQ)
+		samplesNeeded = len(channelI[0])
+	}
+	channelI, channelQ = trackLiveDC(channelI, channelQ)
+	channelQ = applyIQCorrection(channelI, channelQ, currentIQCorrection())
+	_, beamWeights := currentBeams()
+	channelI, channelQ = appendBeamChannels(channelI, channelQ, beamWeights)
+	var subRate float64
+	var chz *ChannelizerInfo
+	if c := currentChannelizer(); c != nil && c.outputs(samplesNeeded) > 0 {
+		channelI, channelQ = appendSubChannels(channelI, channelQ, c)
+		samplesNeeded = c.outputs(samplesNeeded)
+		subRate = c.sampleRate()
+		chz = c.info()
+	}
+	feedStats(channelI, channelQ)
+	numChannels := len(channelI)
+	frame := liveFrame{I: channelI, Q: channelQ, fftSize: fftSize, subRate: subRate, chz: chz, cal: livePowerCalContext(), end: end}
+
+	if samplesNeeded >= fftSize {
+		latestFrameMu.Lock()
+		frame.seq = latestFrame.seq + 1
+		latestFrame = frame
+		latestFrameMu.Unlock()
+		feedDetector(frame)
+		feedPDW(frame)
+		feedModulation(frame)
+	}
+
+	type spectrumClient struct {
+		client   *Client
+		channels []int
+		opts     SpectrumOptions
+	}
+
+	// Determine active channels (Union of all clients' requests)
+	activeChannels := make(map[int]bool)
+	spectrumChannels := make(map[SpectrumOptions]map[int]bool)
+	var rawClients []*Client
+	var spectrumClients []spectrumClient
+	var spectrogramClients []*Client
+	var measureClients []*Client
+	var coherenceClients []*Client
+	var doaClients []*Client
+	wsClientsMu.RLock()
+	for client := range wsClients {
+		client.mu.Lock()
+		if client.measure != nil {
+			measureClients = append(measureClients, client)
+		}
+		if client.coherence != nil {
+			coherenceClients = append(coherenceClients, client)
+		}
+		if client.doa != nil {
+			doaClients = append(doaClients, client)
+		}
+		if client.spectrogram != nil && client.spectrogram.opts.Filename == "" {
+			spectrogramClients = append(spectrogramClients, client)
+		}
+		channels := clientChannels(client.channels, numChannels)
+		if client.mode == "spectrum" {
+			if client.spectrum == nil {
+				settings := SpectrumSettings{}
+				settings.Validate()
+				client.spectrum = newClientSpectrum(settings)
+			}
+			opts := client.spectrum.settings.options(fftSize)
+			spectrumClients = append(spectrumClients, spectrumClient{client, channels, opts})
+			if spectrumChannels[opts] == nil {
+				spectrumChannels[opts] = make(map[int]bool)
+			}
+			for _, ch := range channels {
+				spectrumChannels[opts][ch] = true
+			}
+		} else {
+			rawClients = append(rawClients, client)
+			for _, ch := range channels {
+				activeChannels[ch] = true
+			}
+		}
+		client.mu.Unlock()
+	}
+	wsClientsMu.RUnlock()
+
+	// Send raw time-domain data (Client will do FFT if needed)
+	// We send whatever we read (samplesNeeded), which is based on FFTSize
+	var outBuf []byte
+	for ch := 0; ch < numChannels; ch++ {
+		if !activeChannels[ch] || len(channelI[ch]) == 0 {
+			continue
+		}
+		// I component (header 0-7 for I0-I7)
+		outBuf = append(outBuf, byte(ch*2))
+		for s := 0; s < samplesNeeded && s < len(channelI[ch]); s++ {
+			outBuf = binary.LittleEndian.AppendUint16(outBuf, uint16(channelI[ch][s]))
+		}
+
+		// Q component (header 1, 3, 5... for Q0-Q7)
+		outBuf = append(outBuf, byte(ch*2+1))
+		for s := 0; s < samplesNeeded && s < len(channelQ[ch]); s++ {
+			outBuf = binary.LittleEndian.AppendUint16(outBuf, uint16(channelQ[ch][s]))
+		}
+	}
+
+	// Compute each requested spectrum once per window/scaling, then average per client
+	traces := make(map[SpectrumOptions]map[int][]float64)
+	if samplesNeeded >= fftSize {
+		for opts, channels := range spectrumChannels {
+			traces[opts] = make(map[int][]float64)
+			for ch := range channels {
+				chOpts := opts
+				chOpts.SampleRate = frame.sampleRate(ch + 1)
+				chOpts.Cal = frame.powerCurve(ch + 1)
+				if trace, err := computeSpectrum(channelI[ch], channelQ[ch], chOpts); err == nil {
+					traces[opts][ch] = trace
+				}
+			}
+		}
+	}
+
+	spectrumFrames := make(map[*Client][]byte)
+	for _, sc := range spectrumClients {
+		sc.client.mu.Lock()
+		spectrumFrames[sc.client] = sc.client.spectrum.buildSpectrumFrame(sc.channels, traces[sc.opts])
+		sc.client.mu.Unlock()
+	}
+
+	// Live spectrogram rows
+	spectrogramRows := make(map[*Client][][]byte)
+	for _, client := range spectrogramClients {
+		client.mu.Lock()
+		if sg := client.spectrogram; sg != nil {
+			if ch := sg.opts.Channel - 1; ch < numChannels {
+				n := samplesNeeded
+				if n > len(channelI[ch]) {
+					n = len(channelI[ch])
+				}
+				sg.builder.opts.Cal = frame.powerCurve(ch + 1)
+				spectrogramRows[client] = sg.feed(channelI[ch][:n], channelQ[ch][:n])
+			}
+		}
+		client.mu.Unlock()
+	}
+
+	// Live measurements, sharing density spectra between clients with the same window
+	measurements := make(map[*Client]map[string]interface{})
+	coherenceResults := make(map[*Client]map[string]interface{})
+	doaResults := make(map[*Client]map[string]interface{})
+	if samplesNeeded >= fftSize {
+		densities := make(map[SpectrumOptions]map[int][]float64)
+		for _, client := range measureClients {
+			client.mu.Lock()
+			cm := client.measure
+			if cm == nil {
+				client.mu.Unlock()
+				continue
+			}
+			opts, err := cm.spectrumOptions(fftSize)
+			if err != nil {
+				client.mu.Unlock()
+				continue
+			}
+			channels := clientChannels(client.channels, numChannels)
+			if len(cm.opts.Channels) > 0 {
+				channels = channels[:0]
+				for _, ch := range cm.opts.Channels {
+					if ch <= numChannels {
+						channels = append(channels, ch-1)
+					}
+				}
+			}
+			var users []int
+			for _, ch := range channels {
+				users = append(users, ch+1)
+			}
+			rate, err := frame.channelsRate(users)
+			if err != nil {
+				measurements[client] = map[string]interface{}{"type": "measure_error", "error": err.Error()}
+				client.mu.Unlock()
+				continue
+			}
+			opts.SampleRate = rate
+			if densities[opts] == nil {
+				densities[opts] = make(map[int][]float64)
+			}
+			spectra := make(map[int][]float64)
+			for _, ch := range channels {
+				p, ok := densities[opts][ch]
+				if !ok {
+					p = make([]float64, fftSize)
+					chOpts := opts
+					chOpts.Cal = frame.powerCurve(ch + 1)
+					if computePowerSpectrumInto(p, channelI[ch], channelQ[ch], chOpts) != nil {
+						continue
+					}
+					densities[opts][ch] = p
+				}
+				spectra[ch] = p
+			}
+			if len(spectra) > 0 {
+				measurements[client] = cm.update(spectra, opts)
+			}
+			client.mu.Unlock()
+		}
+	}
+
+	// Live inter-channel coherence and DOA
+	if samplesNeeded >= fftSize {
+		for _, client := range coherenceClients {
+			client.mu.Lock()
+			if cc := client.coherence; cc != nil {
+				available := cc.opts.Channels
+				if len(available) == 0 {
+					for _, ch := range clientChannels(client.channels, numChannels) {
+						available = append(available, ch+1)
+					}
+				}
+				msg, err := cc.update(frame, available)
+				if err != nil {
+					client.coherence = nil
+					coherenceResults[client] = map[string]interface{}{"type": "coherence_error", "error": err.Error()}
+				} else if msg != nil {
+					coherenceResults[client] = msg
+				}
+			}
+			client.mu.Unlock()
+		}
+		for _, client := range doaClients {
+			client.mu.Lock()
+			if cd := client.doa; cd != nil {
+				msg, err := cd.update(frame)
+				if err != nil {
+					client.doa = nil
+					doaResults[client] = map[string]interface{}{"type": "doa_error", "error": err.Error()}
+				} else if msg != nil {
+					doaResults[client] = msg
+				}
+			}
+			client.mu.Unlock()
+		}
+	}
+
+	// Broadcast the frame
+	wsClientsMu.RLock()
+	defer wsClientsMu.RUnlock()
+	send := func(client *Client, msg []byte) {
+		if len(msg) == 0 || !wsClients[client] {
+			return
+		}
+		select {
+		case client.send <- msg:
+		default:
+			// If channel is full, drop the frame to avoid blocking loop
+		}
+	}
+	for _, client := range rawClients {
+		send(client, outBuf)
+	}
+	for client, frame := range spectrumFrames {
+		send(client, frame)
+	}
+	for _, results := range []map[*Client]map[string]interface{}{measurements, coherenceResults, doaResults} {
+		for client, msg := range results {
+			if wsClients[client] {
+				select {
+				case client.send <- msg:
+				default:
+				}
+			}
+		}
+	}
+	for client, rows := range spectrogramRows {
+		for _, row := range rows {
+			send(client, row)
+		}
+	}
+}
@@ -30,6 +30,7 @@ func runGlobalStreamLoop(devicePath string) {
 	const sampleSize = 1024  // samples for time domain display
 
 	frameCounter := 0
+	var replayTime replayClock
 	
 	// Reusable buffer for device read
 	var buf []byte
@@ -68,7 +69,6 @@ func runGlobalStreamLoop(devicePath string) {
 		serverState.mu.RLock()
 		fps := serverState.StreamFPS
 		fftSize := serverState.FFTSize
-		mode := serverState.StreamMode
 		replayMode := serverState.ReplayMode
 		replayData := serverState.ReplayData
 		streamingEnabled := serverState.StreamingEnabled
@@ -107,6 +107,7 @@ func runGlobalStreamLoop(devicePath string) {
 		if samplesNeeded < sampleSize {
 			samplesNeeded = sampleSize
 		}
+		samplesNeeded = channelizerInput(samplesNeeded) + alignmentMargin()
 
 		// Parse into channel data
 		// Data format: for each sample, 8 channels * (I16 + Q16) = 32 bytes
@@ -117,6 +118,7 @@ func runGlobalStreamLoop(devicePath string) {
 			channelQ[ch] = make([]int16, samplesNeeded)
 		}
 
+		var end time.Time // Capture time of the last sample
 		if (replayMode || forceReplayUpdate) && len(replayData) > 0 {
 			// Close device if it was open
 			if deviceOpen {
@@ -190,6 +192,7 @@ func runGlobalStreamLoop(devicePath string) {
 				}
 			}
 			serverState.ReplayOffset = offset
+			end = replayTime.next(serverState.ReplayName, samplesNeeded)
 			serverState.mu.Unlock()
 			
 		} else if hwAvailable {
@@ -210,8 +213,10 @@ func runGlobalStreamLoop(devicePath string) {
 					}
 				}
 
-				// Get current head and back up samplesNeeded
+				// Get current head and back up samplesNeeded; the sample
+				// before the head was written just now
 				head := ring.GetHead()
+				end = time.Now()
 				totalRingBytes := ring.Total()
 				ringData := ring.Data()
 
@@ -311,6 +316,7 @@ func runGlobalStreamLoop(devicePath string) {
 				if totalRead < bytesNeeded {
 					continue // Incomplete frame
 				}
+				end = time.Now()
 
 				bytesProcessed += int64(totalRead)
 				
@@ -331,65 +337,7 @@ func runGlobalStreamLoop(devicePath string) {
 		}
 
 
-		// Build output binary message
-		var outBuf []byte
-
-		// Determine active channels (Union of all clients' requests)
-		activeChannels := make(map[int]bool)
-		wsClientsMu.RLock()
-		for client := range wsClients {
-			client.mu.Lock()
-			for _, chName := range client.channels {
-				if len(chName) >= 2 {
-					chIdx := int(chName[1] - '1')
-					if chIdx >= 0 && chIdx < numChannels {
-						activeChannels[chIdx] = true
-					}
-				}
-			}
-			client.mu.Unlock()
-		}
-		wsClientsMu.RUnlock()
-
-		// Send raw time-domain data (Client will do FFT if needed)
-		// We send whatever we read (samplesNeeded), which is based on FFTSize
-		if mode == "raw" || mode == "fft" || mode == "both" {
-			for ch := 0; ch < numChannels; ch++ {
-				if !activeChannels[ch] {
-					continue
-				}
-				// I component (header 0-7 for I0-I7)
-				iHeader := byte(ch * 2)
-				outBuf = append(outBuf, iHeader)
-				for s := 0; s < samplesNeeded && s < len(channelI[ch]); s++ {
-					b := make([]byte, 2)
-					binary.LittleEndian.PutUint16(b, uint16(channelI[ch][s]))
-					outBuf = append(outBuf, b...)
-				}
-
-				// Q component (header 1, 3, 5... for Q0-Q7)
-				qHeader := byte(ch*2 + 1)
-				outBuf = append(outBuf, qHeader)
-				for s := 0; s < samplesNeeded && s < len(channelQ[ch]); s++ {
-					b := make([]byte, 2)
-					binary.LittleEndian.PutUint16(b, uint16(channelQ[ch][s]))
-					outBuf = append(outBuf, b...)
-				}
-			}
-		}
-
-		// Broadcast the frame
-		if len(outBuf) > 0 {
-			wsClientsMu.RLock()
-			for client := range wsClients {
-				select {
-				case client.send <- outBuf:
-				default:
-					// If channel is full, drop the frame to avoid blocking loop
-				}
-			}
-			wsClientsMu.RUnlock()
-		}
+		broadcastStreamFrame(channelI, channelQ, samplesNeeded, fftSize, end)
 
 		time.Sleep(frameInterval)
 	}